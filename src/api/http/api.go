@@ -96,6 +96,8 @@ func (self *HttpServer) Serve(listener net.Listener) {
 
 	// Write points to the given database
 	self.registerEndpoint(p, "post", "/db/:db/series", self.writePoints)
+	// Rewrite columns of existing points
+	self.registerEndpoint(p, "post", "/db/:db/series/update", self.updatePoints)
 	self.registerEndpoint(p, "del", "/db/:db/series/:series", self.dropSeries)
 	self.registerEndpoint(p, "get", "/db", self.listDatabases)
 	self.registerEndpoint(p, "post", "/db", self.createDatabase)
@@ -132,9 +134,24 @@ func (self *HttpServer) Serve(listener net.Listener) {
 
 	// cluster config endpoints
 	self.registerEndpoint(p, "get", "/cluster/servers", self.listServers)
+	self.registerEndpoint(p, "post", "/cluster/servers/:id/replace", self.replaceServer)
+	self.registerEndpoint(p, "post", "/cluster/servers/:id/decommission", self.decommissionServer)
+	self.registerEndpoint(p, "get", "/cluster/anti_entropy", self.antiEntropyStatus)
+	self.registerEndpoint(p, "post", "/cluster/anti_entropy", self.repairShards)
+	self.registerEndpoint(p, "get", "/cluster/compaction", self.compactionStatus)
+	self.registerEndpoint(p, "post", "/cluster/compaction", self.compactShards)
+	self.registerEndpoint(p, "get", "/cluster/hinted_handoff", self.hintedHandoffStats)
+	self.registerEndpoint(p, "del", "/cluster/hinted_handoff/:id", self.purgeHintedHandoff)
+	self.registerEndpoint(p, "get", "/cluster/wal", self.walReplayStats)
+	self.registerEndpoint(p, "get", "/cluster/back_pressure", self.backPressureStats)
 	self.registerEndpoint(p, "post", "/cluster/shards", self.createShard)
 	self.registerEndpoint(p, "get", "/cluster/shards", self.getShards)
+	self.registerEndpoint(p, "get", "/cluster/shards/stats", self.getShardStats)
 	self.registerEndpoint(p, "del", "/cluster/shards/:id", self.dropShard)
+	self.registerEndpoint(p, "get", "/cluster/shards/:id/backup", self.backupShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/restore", self.restoreShard)
+	self.registerEndpoint(p, "get", "/cluster/metadata", self.exportMetadata)
+	self.registerEndpoint(p, "post", "/cluster/metadata", self.importMetadata)
 
 	if listener == nil {
 		self.startSsl(p)
@@ -305,11 +322,22 @@ func errorToStatusCode(err error) int {
 		return libhttp.StatusUnauthorized // HTTP 401
 	case AuthorizationError:
 		return libhttp.StatusForbidden // HTTP 403
+	case *cluster.PartialWriteError:
+		return libhttp.StatusInternalServerError // HTTP 500
+	case *cluster.OverloadedError:
+		return libhttp.StatusServiceUnavailable // HTTP 503
 	default:
 		return libhttp.StatusBadRequest // HTTP 400
 	}
 }
 
+// tells the client when to retry writes that were rejected by the back-pressure
+func setRetryAfter(w libhttp.ResponseWriter, err error) {
+	if overloaded, ok := err.(*cluster.OverloadedError); ok {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(overloaded.RetryAfter.Seconds())))
+	}
+}
+
 func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request) {
 	db := r.URL.Query().Get(":db")
 	precision, err := TimePrecisionFromString(r.URL.Query().Get("time_precision"))
@@ -318,6 +346,16 @@ func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request
 		w.Write([]byte(err.Error()))
 		return
 	}
+	consistency, err := cluster.ParseWriteConsistency(r.URL.Query().Get("consistency"))
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	requestId := r.Header.Get("X-Request-Id")
+	if requestId == "" {
+		requestId = r.URL.Query().Get("request_id")
+	}
 
 	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
 		series, err := ioutil.ReadAll(r.Body)
@@ -331,6 +369,7 @@ func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request
 		}
 
 		// convert the wire format to the internal representation of the time series
+		dataStoreSeries := make([]*protocol.Series, 0, len(serializedSeries))
 		for _, s := range serializedSeries {
 			if len(s.Points) == 0 {
 				continue
@@ -340,14 +379,88 @@ func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request
 			if err != nil {
 				return libhttp.StatusBadRequest, err.Error()
 			}
+			dataStoreSeries = append(dataStoreSeries, series)
+		}
+
+		// retries of a write with the same request id overwrite the points
+		// instead of duplicating them
+		if requestId != "" {
+			if err := coordinator.AssignIdempotentSequenceNumbers(requestId, dataStoreSeries); err != nil {
+				return libhttp.StatusBadRequest, err.Error()
+			}
+		}
+
+		if len(dataStoreSeries) == 0 {
+			return libhttp.StatusOK, nil
+		}
+		// the back-pressure is checked once for all the series, an overloaded
+		// server doesn't reject the write after logging some of them
+		if err := self.coordinator.WriteSeriesDataWithConsistency(user, db, dataStoreSeries, consistency); err != nil {
+			setRetryAfter(w, err)
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+type updatePointsResponse struct {
+	Updated  int `json:"updated"`
+	Inserted int `json:"inserted"`
+}
+
+// Takes the same series as writePoints. The columns of the existing points with the
+// same timestamps (and sequence numbers, if they're given) get the values of the
+// points, the other columns are left alone. The where parameter restricts the update
+// to the points that match it, with upsert=true the points that didn't match any
+// point get written with the given consistency.
+func (self *HttpServer) updatePoints(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+	precision, err := TimePrecisionFromString(r.URL.Query().Get("time_precision"))
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	consistency, err := cluster.ParseWriteConsistency(r.URL.Query().Get("consistency"))
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	where := r.URL.Query().Get("where")
+	upsert := r.URL.Query().Get("upsert") == "true"
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		serializedSeries := []*SerializedSeries{}
+		err = json.Unmarshal(body, &serializedSeries)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		response := &updatePointsResponse{}
+		for _, s := range serializedSeries {
+			if len(s.Points) == 0 {
+				continue
+			}
 
-			err = self.coordinator.WriteSeriesData(user, db, series)
+			series, err := ConvertToDataStoreSeries(s, precision)
+			if err != nil {
+				return libhttp.StatusBadRequest, err.Error()
+			}
 
+			updated, inserted, err := self.coordinator.UpdateSeriesData(user, db, series, where, upsert, consistency)
 			if err != nil {
+				setRetryAfter(w, err)
 				return errorToStatusCode(err), err.Error()
 			}
+			response.Updated += updated
+			response.Inserted += inserted
 		}
-		return libhttp.StatusOK, nil
+		return libhttp.StatusOK, response
 	})
 }
 
@@ -489,18 +602,36 @@ func getUsernameAndPassword(r *libhttp.Request) (string, string, error) {
 }
 
 func (self *HttpServer) tryAsClusterAdmin(w libhttp.ResponseWriter, r *libhttp.Request, yield func(User) (int, interface{})) {
+	user, ok := self.authenticateClusterAdmin(w, r)
+	if !ok {
+		return
+	}
+	statusCode, contentType, body := yieldUser(user, yield)
+	if statusCode == libhttp.StatusUnauthorized {
+		w.Header().Add("WWW-Authenticate", "Basic realm=\"influxdb\"")
+	}
+	w.Header().Add("content-type", contentType)
+	w.WriteHeader(statusCode)
+	if len(body) > 0 {
+		w.Write(body)
+	}
+}
+
+// Returns the cluster admin the request authenticates as. Writes the error
+// response and returns false if it doesn't.
+func (self *HttpServer) authenticateClusterAdmin(w libhttp.ResponseWriter, r *libhttp.Request) (User, bool) {
 	username, password, err := getUsernameAndPassword(r)
 	if err != nil {
 		w.WriteHeader(libhttp.StatusBadRequest)
 		w.Write([]byte(err.Error()))
-		return
+		return nil, false
 	}
 
 	if username == "" {
 		w.Header().Add("WWW-Authenticate", "Basic realm=\"influxdb\"")
 		w.WriteHeader(libhttp.StatusUnauthorized)
 		w.Write([]byte("Invalid username/password"))
-		return
+		return nil, false
 	}
 
 	user, err := self.userManager.AuthenticateClusterAdmin(username, password)
@@ -508,17 +639,9 @@ func (self *HttpServer) tryAsClusterAdmin(w libhttp.ResponseWriter, r *libhttp.R
 		w.Header().Add("WWW-Authenticate", "Basic realm=\"influxdb\"")
 		w.WriteHeader(libhttp.StatusUnauthorized)
 		w.Write([]byte(err.Error()))
-		return
-	}
-	statusCode, contentType, body := yieldUser(user, yield)
-	if statusCode == libhttp.StatusUnauthorized {
-		w.Header().Add("WWW-Authenticate", "Basic realm=\"influxdb\"")
-	}
-	w.Header().Add("content-type", contentType)
-	w.WriteHeader(statusCode)
-	if len(body) > 0 {
-		w.Write(body)
+		return nil, false
 	}
+	return user, true
 }
 
 type NewUser struct {
@@ -898,12 +1021,162 @@ func (self *HttpServer) listServers(w libhttp.ResponseWriter, r *libhttp.Request
 		servers := self.clusterConfig.Servers()
 		serverMaps := make([]map[string]interface{}, len(servers), len(servers))
 		for i, s := range servers {
-			serverMaps[i] = map[string]interface{}{"id": s.Id, "protobufConnectString": s.ProtobufConnectionString}
+			serverMaps[i] = map[string]interface{}{"id": s.Id, "protobufConnectString": s.ProtobufConnectionString, "state": s.State}
 		}
 		return libhttp.StatusOK, serverMaps
 	})
 }
 
+type replacementServerInfo struct {
+	ReplacementId uint32 `json:"replacementId"`
+}
+
+// Replaces a dead server with a server that has joined the cluster, but isn't
+// holding any shards yet. The shards of the dead server get reassigned to the
+// replacement, which then backfills them from the surviving replicas.
+func (self *HttpServer) replaceServer(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		replacementInfo := &replacementServerInfo{}
+		err = json.Unmarshal(body, &replacementInfo)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		oldServerId := uint32(id)
+		oldServer := self.clusterConfig.GetServerById(&oldServerId)
+		if oldServer == nil {
+			return libhttp.StatusNotFound, fmt.Sprintf("Server %d doesn't exist", oldServerId)
+		}
+		replacement := self.clusterConfig.GetServerById(&replacementInfo.ReplacementId)
+		if replacement == nil {
+			return libhttp.StatusBadRequest, fmt.Sprintf("Replacement server %d doesn't exist", replacementInfo.ReplacementId)
+		}
+		err = self.raftServer.ReplaceServer(oldServer, replacement)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+// Starts moving the shards off a server so it can be taken out of the cluster
+// without losing any copies. The server stops getting new shards right away and is
+// removed from the cluster once all of its shards live on other servers.
+func (self *HttpServer) decommissionServer(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		serverId := uint32(id)
+		server := self.clusterConfig.GetServerById(&serverId)
+		if server == nil {
+			return libhttp.StatusNotFound, fmt.Sprintf("Server %d doesn't exist", serverId)
+		}
+
+		err = self.raftServer.DecommissionServer(server)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+// Starts an anti entropy repair of the shard copies on this server. The copies on
+// the other servers get repaired when they run their own repair.
+func (self *HttpServer) repairShards(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		if err := self.clusterConfig.RepairShards(); err != nil {
+			return libhttp.StatusConflict, err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+func (self *HttpServer) antiEntropyStatus(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		return libhttp.StatusOK, self.clusterConfig.AntiEntropyStatus()
+	})
+}
+
+// Compacts the local copies of the shards, only the one given by shard_id if it's
+// set and only the points of database if it's set.
+func (self *HttpServer) compactShards(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		shardIds := []uint32{}
+		if shardId := r.URL.Query().Get("shard_id"); shardId != "" {
+			id, err := strconv.ParseUint(shardId, 10, 32)
+			if err != nil {
+				return libhttp.StatusBadRequest, err.Error()
+			}
+			shard := self.clusterConfig.GetShardById(uint32(id))
+			if shard == nil {
+				return libhttp.StatusNotFound, fmt.Sprintf("Shard %d doesn't exist", id)
+			}
+			if !shard.IsLocal {
+				return libhttp.StatusBadRequest, fmt.Sprintf("Shard %d isn't stored on this server, servers %v have a copy", id, shard.ServerIds())
+			}
+			shardIds = append(shardIds, uint32(id))
+		}
+		database := r.URL.Query().Get("database")
+		if database != "" && !self.clusterConfig.DatabaseExists(database) {
+			return libhttp.StatusNotFound, fmt.Sprintf("Database %s doesn't exist", database)
+		}
+		if err := self.clusterConfig.CompactShards(shardIds, database); err != nil {
+			return libhttp.StatusConflict, err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+func (self *HttpServer) compactionStatus(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		return libhttp.StatusOK, self.clusterConfig.CompactionStatus()
+	})
+}
+
+func (self *HttpServer) walReplayStats(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		return libhttp.StatusOK, self.clusterConfig.WalReplayStats()
+	})
+}
+
+func (self *HttpServer) backPressureStats(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		return libhttp.StatusOK, self.clusterConfig.BackPressureStats()
+	})
+}
+
+func (self *HttpServer) hintedHandoffStats(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		return libhttp.StatusOK, self.clusterConfig.HintedHandoffStats()
+	})
+}
+
+// Drops the writes queued for a server. They're lost for that server unless they get
+// repaired by anti entropy.
+func (self *HttpServer) purgeHintedHandoff(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		err = self.clusterConfig.PurgeHintedHandoff(uint32(id))
+		if err != nil {
+			return libhttp.StatusNotFound, err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
 type newShardInfo struct {
 	StartTime int64               `json:"startTime"`
 	EndTime   int64               `json:"endTime"`
@@ -958,6 +1231,15 @@ func (self *HttpServer) getShards(w libhttp.ResponseWriter, r *libhttp.Request)
 	})
 }
 
+// Returns the stats of the shards of every server, only the ones of this server if
+// local is true
+func (self *HttpServer) getShardStats(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		localOnly := r.URL.Query().Get("local") == "true"
+		return libhttp.StatusOK, self.clusterConfig.ShardStats(localOnly)
+	})
+}
+
 func (self *HttpServer) dropShard(w libhttp.ResponseWriter, r *libhttp.Request) {
 	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
 		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
@@ -985,6 +1267,89 @@ func (self *HttpServer) dropShard(w libhttp.ResponseWriter, r *libhttp.Request)
 	})
 }
 
+// Streams a consistent snapshot of the copy of the shard on this server. The
+// archive is written straight to the response, so this doesn't go through
+// tryAsClusterAdmin.
+func (self *HttpServer) backupShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	if _, ok := self.authenticateClusterAdmin(w, r); !ok {
+		return
+	}
+
+	id, err := strconv.ParseUint(r.URL.Query().Get(":id"), 10, 32)
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	shard := self.clusterConfig.GetShardById(uint32(id))
+	if shard == nil {
+		w.WriteHeader(libhttp.StatusNotFound)
+		fmt.Fprintf(w, "Shard %d doesn't exist", id)
+		return
+	}
+	if !shard.IsLocal {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		fmt.Fprintf(w, "Shard %d isn't stored on this server, servers %v have a copy", id, shard.ServerIds())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=shard_%d.backup", id))
+	w.WriteHeader(libhttp.StatusOK)
+	if err := self.clusterConfig.BackupShard(uint32(id), w); err != nil {
+		// too late to change the status, restoring the cut off backup will fail
+		log.Error("Cannot back up shard %d: %s", id, err)
+	}
+}
+
+// Loads a backup into the shard on the server given by server_id, this server by
+// default, and registers the copy with the cluster
+func (self *HttpServer) restoreShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseUint(r.URL.Query().Get(":id"), 10, 32)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		serverId := uint64(self.clusterConfig.LocalServerId)
+		if param := r.URL.Query().Get("server_id"); param != "" {
+			serverId, err = strconv.ParseUint(param, 10, 32)
+			if err != nil {
+				return libhttp.StatusBadRequest, err.Error()
+			}
+		}
+		err = self.raftServer.RestoreShard(uint32(id), uint32(serverId), r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+func (self *HttpServer) exportMetadata(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		return libhttp.StatusOK, self.clusterConfig.ExportMetadata()
+	})
+}
+
+// Recreates the databases, users and continuous queries of metadata exported
+// from another cluster
+func (self *HttpServer) importMetadata(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		metadata := &cluster.ClusterMetadata{}
+		if err := json.NewDecoder(r.Body).Decode(metadata); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if err := metadata.Validate(); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		result, err := self.raftServer.ImportMetadata(metadata)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, result
+	})
+}
+
 func (self *HttpServer) convertShardsToMap(shards []*cluster.ShardData) []interface{} {
 	result := make([]interface{}, 0)
 	for _, shard := range shards {
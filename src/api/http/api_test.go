@@ -99,6 +99,11 @@ type MockCoordinator struct {
 	db                string
 	droppedDb         string
 	returnedError     error
+	overloadedError   error
+	writes            int
+	consistency       cluster.WriteConsistency
+	where             string
+	upsert            bool
 }
 
 func (self *MockCoordinator) WriteSeriesData(_ User, db string, series *protocol.Series) error {
@@ -106,6 +111,38 @@ func (self *MockCoordinator) WriteSeriesData(_ User, db string, series *protocol
 	return nil
 }
 
+func (self *MockCoordinator) WriteSeriesDataWithConsistency(_ User, db string, series []*protocol.Series, consistency cluster.WriteConsistency) error {
+	self.writes++
+	if self.overloadedError != nil {
+		return self.overloadedError
+	}
+	if self.returnedError != nil {
+		return self.returnedError
+	}
+	self.series = append(self.series, series...)
+	self.consistency = consistency
+	return nil
+}
+
+func (self *MockCoordinator) UpdateSeriesData(_ User, db string, series *protocol.Series, where string, upsert bool, consistency cluster.WriteConsistency) (int, int, error) {
+	if self.returnedError != nil {
+		return 0, 0, self.returnedError
+	}
+	// the inserted points are held back like writes
+	if upsert && self.overloadedError != nil {
+		return 0, 0, self.overloadedError
+	}
+	self.series = append(self.series, series)
+	self.where = where
+	self.upsert = upsert
+	self.consistency = consistency
+	// pretend the first point existed and the others got inserted
+	if upsert {
+		return 1, len(series.Points) - 1, nil
+	}
+	return 1, 0, nil
+}
+
 func (self *MockCoordinator) DeleteSeriesData(_ User, db string, query *parser.DeleteQuery, localOnly bool) error {
 	self.deleteQueries = append(self.deleteQueries, query)
 	return nil
@@ -198,6 +235,7 @@ func (self *ApiSuite) TearDownSuite(c *C) {
 func (self *ApiSuite) SetUpTest(c *C) {
 	self.coordinator.series = nil
 	self.coordinator.returnedError = nil
+	self.coordinator.overloadedError = nil
 	self.manager.ops = nil
 }
 
@@ -338,6 +376,134 @@ func (self *ApiSuite) TestWritingToSeriesWithUnderscore(c *C) {
 	}
 }
 
+func (self *ApiSuite) TestWriteDataWithConsistency(c *C) {
+	data := `[{"points": [[1382131686, "1"]], "name": "foo", "columns": ["time", "column_one"]}]`
+
+	addr := self.formatUrl("/db/foo/series?time_precision=s&consistency=quorum&u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.series, HasLen, 1)
+	c.Assert(self.coordinator.consistency, Equals, cluster.WriteConsistencyQuorum)
+
+	addr = self.formatUrl("/db/foo/series?time_precision=s&consistency=most&u=dbuser&p=password")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	c.Assert(self.coordinator.series, HasLen, 1)
+}
+
+func (self *ApiSuite) TestWriteDataWithRequestId(c *C) {
+	data := `[
+    {"points": [[1382131686, "1"], [1382131686, "2"]], "name": "foo", "columns": ["time", "column_one"]},
+    {"points": [[1382131686, "3", 42]], "name": "bar", "columns": ["time", "column_one", "sequence_number"]}
+  ]`
+
+	write := func(requestId string) []*protocol.Point {
+		self.coordinator.series = nil
+		addr := self.formatUrl("/db/foo/series?time_precision=s&u=dbuser&p=password")
+		req, err := libhttp.NewRequest("POST", addr, bytes.NewBufferString(data))
+		c.Assert(err, IsNil)
+		req.Header.Set("X-Request-Id", requestId)
+		resp, err := libhttp.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+		c.Assert(self.coordinator.series, HasLen, 2)
+		return append(self.coordinator.series[0].Points, self.coordinator.series[1].Points...)
+	}
+
+	points := write("some-id")
+	c.Assert(points[0].GetSequenceNumber()%coordinator.HOST_ID_OFFSET, Equals, uint64(0))
+	c.Assert(points[0].GetSequenceNumber() < coordinator.MAX_IDEMPOTENT_SEQUENCE_NUMBER, Equals, true)
+	c.Assert(points[0].GetSequenceNumber(), Not(Equals), points[1].GetSequenceNumber())
+	// the sequence numbers sent by the client are kept
+	c.Assert(points[2].GetSequenceNumber(), Equals, uint64(42))
+
+	// a retry gets the same sequence numbers, another request id different ones
+	retried := write("some-id")
+	c.Assert(retried[0].GetSequenceNumber(), Equals, points[0].GetSequenceNumber())
+	c.Assert(retried[1].GetSequenceNumber(), Equals, points[1].GetSequenceNumber())
+	other := write("another-id")
+	c.Assert(other[0].GetSequenceNumber(), Not(Equals), points[0].GetSequenceNumber())
+
+	// points without a time would get a new one on every retry
+	self.coordinator.series = nil
+	data = `[{"points": [["1"]], "name": "foo", "columns": ["column_one"]}]`
+	addr := self.formatUrl("/db/foo/series?request_id=some-id&u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	c.Assert(self.coordinator.series, HasLen, 0)
+}
+
+func (self *ApiSuite) TestWriteDataWhenOverloaded(c *C) {
+	self.coordinator.overloadedError = &cluster.OverloadedError{Reason: "the local write buffer has 9 of 10 writes buffered", RetryAfter: 2 * time.Second}
+	data := `[
+    {"points": [[1382131686, "1"]], "name": "foo", "columns": ["time", "column_one"]},
+    {"points": [[1382131686, "2"]], "name": "bar", "columns": ["time", "column_one"]}
+  ]`
+
+	addr := self.formatUrl("/db/foo/series?time_precision=s&u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusServiceUnavailable)
+	c.Assert(resp.Header.Get("Retry-After"), Equals, "2")
+	c.Assert(self.coordinator.series, HasLen, 0)
+
+	// all the series of the request are written together, so the back-pressure
+	// is checked once before any of them gets written
+	self.coordinator.overloadedError = nil
+	self.coordinator.writes = 0
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.series, HasLen, 2)
+	c.Assert(self.coordinator.writes, Equals, 1)
+}
+
+func (self *ApiSuite) TestUpdatePoints(c *C) {
+	data := `[{"points": [[1382131686, "1"], [1382131687, "2"]], "name": "foo", "columns": ["time", "column_one"]}]`
+
+	where := url.QueryEscape("column_two = 'a'")
+	addr := self.formatUrl("/db/foo/series/update?time_precision=s&where=%s&upsert=true&consistency=quorum&u=dbuser&p=password", where)
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	response := map[string]int{}
+	c.Assert(json.Unmarshal(body, &response), IsNil)
+	c.Assert(response["updated"], Equals, 1)
+	c.Assert(response["inserted"], Equals, 1)
+
+	c.Assert(self.coordinator.where, Equals, "column_two = 'a'")
+	c.Assert(self.coordinator.upsert, Equals, true)
+	c.Assert(self.coordinator.consistency, Equals, cluster.WriteConsistencyQuorum)
+	c.Assert(self.coordinator.series, HasLen, 1)
+	series := self.coordinator.series[0]
+	c.Assert(series.GetName(), Equals, "foo")
+	c.Assert(series.Fields, DeepEquals, []string{"column_one"})
+	c.Assert(series.Points, HasLen, 2)
+	c.Assert(series.Points[0].GetTimestamp(), Equals, int64(1382131686000000))
+	c.Assert(series.Points[0].SequenceNumber, IsNil)
+
+	// upserts are held back like writes while the server is overloaded
+	self.coordinator.series = nil
+	self.coordinator.overloadedError = &cluster.OverloadedError{Reason: "the local write buffer has 9 of 10 writes buffered", RetryAfter: 2 * time.Second}
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusServiceUnavailable)
+	c.Assert(resp.Header.Get("Retry-After"), Equals, "2")
+	c.Assert(self.coordinator.series, HasLen, 0)
+
+	addr = self.formatUrl("/db/foo/series/update?time_precision=s&consistency=most&u=dbuser&p=password")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	c.Assert(self.coordinator.series, HasLen, 0)
+}
+
 func (self *ApiSuite) TestQueryWithInvalidPrecision(c *C) {
 	query := "select * from foo where column_one == 'some_value';"
 	query = url.QueryEscape(query)
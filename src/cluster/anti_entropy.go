@@ -0,0 +1,447 @@
+package cluster
+
+import (
+	"common"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"parser"
+	p "protocol"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+const (
+	// ranges that end less than this long ago are skipped, writes to them may
+	// still be sitting in the write buffers
+	ANTI_ENTROPY_SETTLE_TIME = time.Minute
+)
+
+var seriesChecksumsRequest = p.Request_SERIES_CHECKSUMS
+
+// The anti entropy repair makes the copies of a shard converge when the WAL can't replay the
+// writes a server missed, e.g. because the log files rotated away or a disk was replaced. Every
+// shard is split into time ranges and the checksums of the series in each range are compared
+// between the local copy and the other copies. The points of the series that differ get pulled
+// into the local copy. Every server runs the repair for its own copies, so the copies end up with
+// the union of the points. Points are never removed, so the series that had points deleted or
+// updated are skipped in the range until all the copies got the query, otherwise a copy that
+// missed it would bring the old points back. The ranges are kept in raft, see RecordRewrite.
+type AntiEntropy struct {
+	clusterConfig  *ClusterConfiguration
+	rangesPerShard int
+	bufferSize     int
+	running        bool
+	status         *AntiEntropyStatus
+	statusLock     sync.Mutex
+}
+
+type AntiEntropyStatus struct {
+	Running          bool      `json:"running"`
+	StartedAt        time.Time `json:"startedAt"`
+	FinishedAt       time.Time `json:"finishedAt"`
+	ShardsToCheck    int       `json:"shardsToCheck"`
+	ShardsChecked    int       `json:"shardsChecked"`
+	CurrentShard     uint32    `json:"currentShard"`
+	RangesCompared   int       `json:"rangesCompared"`
+	SeriesRepaired   int       `json:"seriesRepaired"`
+	PointsRepaired   int       `json:"pointsRepaired"`
+	Errors           int       `json:"errors"`
+	LastErrorMessage string    `json:"lastErrorMessage,omitempty"`
+}
+
+func NewAntiEntropy(clusterConfig *ClusterConfiguration, rangesPerShard, bufferSize int) *AntiEntropy {
+	if rangesPerShard < 1 {
+		rangesPerShard = 1
+	}
+	return &AntiEntropy{
+		clusterConfig:  clusterConfig,
+		rangesPerShard: rangesPerShard,
+		bufferSize:     bufferSize,
+		status:         &AntiEntropyStatus{},
+	}
+}
+
+// Runs a repair every interval until the process exits.
+func (self *AntiEntropy) RepairPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := self.Repair(); err != nil {
+			log.Warn("Anti entropy: %s", err)
+		}
+	}
+}
+
+// Compares and repairs all the local shard copies. Returns an error if a repair is
+// already running, or if not all the ranges could be compared with all the other
+// copies.
+func (self *AntiEntropy) Repair() error {
+	self.statusLock.Lock()
+	if self.running {
+		self.statusLock.Unlock()
+		return errors.New("A repair is already running")
+	}
+	self.running = true
+	self.status = &AntiEntropyStatus{Running: true, StartedAt: time.Now()}
+	self.statusLock.Unlock()
+
+	defer func() {
+		self.statusLock.Lock()
+		defer self.statusLock.Unlock()
+		self.running = false
+		self.status.Running = false
+		self.status.FinishedAt = time.Now()
+	}()
+
+	user, err := self.clusterConfig.clusterAdminForInternalQueries()
+	if err != nil {
+		return err
+	}
+	databases := self.clusterConfig.databaseNames()
+
+	shards := make([]*ShardData, 0)
+	for _, shard := range self.clusterConfig.GetAllShards() {
+		if servers, store := shard.copies(); store != nil && len(servers) > 0 {
+			shards = append(shards, shard)
+		}
+	}
+	self.updateStatus(func(status *AntiEntropyStatus) {
+		status.ShardsToCheck = len(shards)
+	})
+
+	log.Info("Anti entropy: checking %d shards", len(shards))
+	for _, shard := range shards {
+		self.updateStatus(func(status *AntiEntropyStatus) {
+			status.CurrentShard = shard.Id()
+		})
+		for _, database := range databases {
+			self.repairShard(shard, database, user)
+		}
+		self.updateStatus(func(status *AntiEntropyStatus) {
+			status.ShardsChecked += 1
+		})
+	}
+	log.Info("Anti entropy: finished checking %d shards", len(shards))
+
+	status := self.Status()
+	if status.Errors > 0 {
+		return fmt.Errorf("%d errors while repairing the shards, the last one: %s", status.Errors, status.LastErrorMessage)
+	}
+	return nil
+}
+
+// Returns a copy of the progress of the running repair, or of the last one.
+func (self *AntiEntropy) Status() AntiEntropyStatus {
+	self.statusLock.Lock()
+	defer self.statusLock.Unlock()
+	return *self.status
+}
+
+func (self *AntiEntropy) updateStatus(update func(status *AntiEntropyStatus)) {
+	self.statusLock.Lock()
+	defer self.statusLock.Unlock()
+	update(self.status)
+}
+
+func (self *AntiEntropy) recordError(err error) {
+	self.updateStatus(func(status *AntiEntropyStatus) {
+		status.Errors += 1
+		status.LastErrorMessage = err.Error()
+	})
+}
+
+func (self *AntiEntropy) repairShard(shard *ShardData, database string, user common.User) {
+	rangeSize := (shard.endMicro - shard.startMicro) / int64(self.rangesPerShard)
+	if rangeSize < 1 {
+		rangeSize = shard.endMicro - shard.startMicro
+	}
+	settled := common.TimeToMicroseconds(time.Now().Add(-ANTI_ENTROPY_SETTLE_TIME))
+
+	for start := shard.startMicro; start < shard.endMicro; start += rangeSize {
+		end := start + rangeSize
+		if end > shard.endMicro {
+			end = shard.endMicro
+		}
+		if end > settled {
+			return
+		}
+		local, err := shard.LocalSeriesChecksums(database, start, end, user)
+		if err != nil {
+			log.Error("Anti entropy: cannot compute checksums of shard %d: %s", shard.Id(), err)
+			self.recordError(err)
+			return
+		}
+
+		servers, _ := shard.copies()
+		for _, server := range servers {
+			if !server.IsUp() {
+				err := fmt.Errorf("server %d is down", server.Id)
+				log.Warn("Anti entropy: cannot compare shard %d with server %d: %s", shard.Id(), server.Id, err)
+				self.recordError(err)
+				continue
+			}
+			remote, err := shard.RemoteSeriesChecksums(server, database, start, end, user, self.bufferSize)
+			if err != nil {
+				log.Error("Anti entropy: cannot get checksums of shard %d from server %d: %s", shard.Id(), server.Id, err)
+				self.recordError(err)
+				continue
+			}
+
+			for _, name := range differingSeries(local, remote) {
+				if self.clusterConfig.IsSeriesRewritten(database, name, start, end) {
+					log.Debug("Anti entropy: skipping series %s in range %d to %d of shard %d, points of it got deleted or updated", name, start, end, shard.Id())
+					continue
+				}
+				points, err := shard.RepairSeries(server, database, name, start, end, user, self.bufferSize)
+				if err != nil {
+					log.Error("Anti entropy: cannot repair series %s in shard %d from server %d: %s", name, shard.Id(), server.Id, err)
+					self.recordError(err)
+					continue
+				}
+				log.Info("Anti entropy: repaired series %s in shard %d from server %d, copied %d points", name, shard.Id(), server.Id, points)
+				self.updateStatus(func(status *AntiEntropyStatus) {
+					status.SeriesRepaired += 1
+					status.PointsRepaired += points
+				})
+			}
+		}
+		self.updateStatus(func(status *AntiEntropyStatus) {
+			status.RangesCompared += 1
+		})
+	}
+}
+
+// A time range in microseconds that points of a series got deleted from or updated
+// in. Series is a regex if IsRegex is set, like the one of a delete query's from
+// clause.
+type RewrittenRange struct {
+	Series     string
+	IsRegex    bool
+	StartMicro int64
+	EndMicro   int64
+	// how many of the queries that recorded the range didn't reach all the copies
+	// of the shards yet
+	Pending int
+}
+
+func (self *RewrittenRange) sameRange(other *RewrittenRange) bool {
+	return self.Series == other.Series && self.IsRegex == other.IsRegex &&
+		self.StartMicro == other.StartMicro && self.EndMicro == other.EndMicro
+}
+
+func (self *RewrittenRange) matches(series string, startMicro, endMicro int64) bool {
+	if self.StartMicro >= endMicro || self.EndMicro < startMicro {
+		return false
+	}
+	if !self.IsRegex {
+		return self.Series == series
+	}
+	regex, err := regexp.Compile(self.Series)
+	if err != nil {
+		// shouldn't happen, the regex came from a query that got parsed. Better
+		// to skip a series too many than to bring deleted points back.
+		return true
+	}
+	return regex.MatchString(series)
+}
+
+// Called before a delete, drop series or update query runs, the anti entropy repair
+// doesn't touch the series in the range until ForgetRewrite is called for it.
+func (self *ClusterConfiguration) RecordRewrite(database string, rewritten *RewrittenRange) {
+	self.rewrittenRangesLock.Lock()
+	defer self.rewrittenRangesLock.Unlock()
+	for _, r := range self.rewrittenRanges[database] {
+		if r.sameRange(rewritten) {
+			r.Pending++
+			return
+		}
+	}
+	recorded := *rewritten
+	recorded.Pending = 1
+	self.rewrittenRanges[database] = append(self.rewrittenRanges[database], &recorded)
+}
+
+// Called once the query that recorded the range reached all the copies of the
+// shards, none of them has the old points anymore. A query that failed on some
+// copies leaves the range in place until it's run again successfully.
+func (self *ClusterConfiguration) ForgetRewrite(database string, rewritten *RewrittenRange) {
+	self.rewrittenRangesLock.Lock()
+	defer self.rewrittenRangesLock.Unlock()
+	ranges := self.rewrittenRanges[database]
+	for i, r := range ranges {
+		if !r.sameRange(rewritten) {
+			continue
+		}
+		r.Pending--
+		if r.Pending <= 0 {
+			self.rewrittenRanges[database] = append(ranges[:i], ranges[i+1:]...)
+		}
+		break
+	}
+	if len(self.rewrittenRanges[database]) == 0 {
+		delete(self.rewrittenRanges, database)
+	}
+}
+
+// Returns true if points of the series got deleted from or updated in the given
+// range and not all the copies of the shards got the query yet.
+func (self *ClusterConfiguration) IsSeriesRewritten(database, series string, startMicro, endMicro int64) bool {
+	self.rewrittenRangesLock.Lock()
+	defer self.rewrittenRangesLock.Unlock()
+	for _, r := range self.rewrittenRanges[database] {
+		if r.matches(series, startMicro, endMicro) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the names of the series that the remote copy has and the local one
+// doesn't, or that have a different checksum
+func differingSeries(local, remote []*p.SeriesChecksum) []string {
+	localChecksums := make(map[string]uint64, len(local))
+	for _, checksum := range local {
+		localChecksums[checksum.GetName()] = checksum.GetChecksum()
+	}
+
+	names := make([]string, 0)
+	for _, checksum := range remote {
+		if localChecksum, ok := localChecksums[checksum.GetName()]; !ok || localChecksum != checksum.GetChecksum() {
+			names = append(names, checksum.GetName())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Computes the checksums of the series of the database in the given time range of
+// the local copy of the shard.
+func (self *ShardData) LocalSeriesChecksums(database string, startMicro, endMicro int64, user common.User) ([]*p.SeriesChecksum, error) {
+	_, store := self.copies()
+	if store == nil {
+		return nil, fmt.Errorf("Shard %d isn't stored on this server", self.id)
+	}
+
+	queries, err := parser.ParseQuery(self.timeRangeQueryString("/.*/", startMicro, endMicro))
+	if err != nil {
+		return nil, err
+	}
+	querySpec := parser.NewQuerySpec(user, database, queries[0])
+
+	shard, err := store.GetOrCreateShard(self.id)
+	if err != nil {
+		return nil, err
+	}
+	defer store.ReturnShard(self.id)
+
+	processor := newChecksumProcessor()
+	if err := shard.Query(querySpec, processor); err != nil {
+		return nil, err
+	}
+	return processor.Checksums(), nil
+}
+
+// Asks the server for the checksums of the series of the database in the given
+// time range of its copy of the shard.
+func (self *ShardData) RemoteSeriesChecksums(server *ClusterServer, database string, startMicro, endMicro int64, user common.User, bufferSize int) ([]*p.SeriesChecksum, error) {
+	request := self.createInternalRequest(seriesChecksumsRequest, database, "", user)
+	request.StartTime = &startMicro
+	request.EndTime = &endMicro
+
+	responses := make(chan *p.Response, bufferSize)
+	server.MakeRequest(request, responses)
+	checksums := make([]*p.SeriesChecksum, 0)
+	for {
+		response := <-responses
+		switch response.GetType() {
+		case p.Response_SERIES_CHECKSUMS:
+			checksums = append(checksums, response.Checksums...)
+		case p.Response_ACCESS_DENIED:
+			return nil, fmt.Errorf("Access denied: %s", response.GetErrorMessage())
+		case p.Response_END_STREAM:
+			if response.ErrorMessage != nil {
+				return nil, errors.New(response.GetErrorMessage())
+			}
+			return checksums, nil
+		}
+	}
+}
+
+// Copies the points of the series in the given time range from the server's copy of
+// the shard to the local one. Returns the number of points copied.
+func (self *ShardData) RepairSeries(server *ClusterServer, database, series string, startMicro, endMicro int64, user common.User, bufferSize int) (int, error) {
+	queryString := self.timeRangeQueryString(SeriesRegex(series), startMicro, endMicro)
+	request := self.createInternalRequest(queryRequest, database, queryString, user)
+
+	responses := make(chan *p.Response, bufferSize)
+	server.MakeRequest(request, responses)
+	_, store := self.copies()
+	return self.writeResponses(database, responses, store)
+}
+
+// A query processor that computes a checksum of every series it gets yielded. The
+// checksum of a point covers its timestamp, sequence number and the non null values
+// with their column names, so it doesn't depend on the order of the columns. The
+// checksum of a series is the sum of the checksums of its points, so it doesn't
+// depend on how the points get batched either.
+type checksumProcessor struct {
+	checksums map[string]*p.SeriesChecksum
+}
+
+func newChecksumProcessor() *checksumProcessor {
+	return &checksumProcessor{checksums: make(map[string]*p.SeriesChecksum)}
+}
+
+func (self *checksumProcessor) YieldPoint(seriesName *string, columnNames []string, point *p.Point) bool {
+	if point == nil {
+		return true
+	}
+	checksum := self.checksums[*seriesName]
+	if checksum == nil {
+		checksum = &p.SeriesChecksum{Name: p.String(*seriesName), Checksum: new(uint64), PointCount: new(uint64)}
+		self.checksums[*seriesName] = checksum
+	}
+
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d:%d", point.GetTimestamp(), point.GetSequenceNumber())
+	pointChecksum := hash.Sum64()
+	for i, value := range point.Values {
+		if value == nil || value.GetIsNull() || i >= len(columnNames) {
+			continue
+		}
+		hash.Reset()
+		fmt.Fprintf(hash, "%d:%d:%s:%v", point.GetTimestamp(), point.GetSequenceNumber(), columnNames[i], value.GetValue())
+		pointChecksum += hash.Sum64()
+	}
+
+	*checksum.Checksum += pointChecksum
+	*checksum.PointCount += 1
+	return true
+}
+
+func (self *checksumProcessor) YieldSeries(series *p.Series) bool {
+	for _, point := range series.Points {
+		self.YieldPoint(series.Name, series.Fields, point)
+	}
+	return true
+}
+
+func (self *checksumProcessor) Close() {}
+
+func (self *checksumProcessor) SetShardInfo(shardId int, shardLocal bool) {}
+
+func (self *checksumProcessor) GetName() string {
+	return "ChecksumProcessor"
+}
+
+func (self *checksumProcessor) Checksums() []*p.SeriesChecksum {
+	checksums := make([]*p.SeriesChecksum, 0, len(self.checksums))
+	for _, checksum := range self.checksums {
+		checksums = append(checksums, checksum)
+	}
+	return checksums
+}
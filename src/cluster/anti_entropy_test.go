@@ -0,0 +1,69 @@
+package cluster
+
+import (
+	. "launchpad.net/gocheck"
+	p "protocol"
+	"testing"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type AntiEntropySuite struct{}
+
+var _ = Suite(&AntiEntropySuite{})
+
+func newChecksumTestPoint(timestamp int64, sequenceNumber uint64, values ...float64) *p.Point {
+	point := &p.Point{Timestamp: &timestamp, SequenceNumber: &sequenceNumber}
+	for i := range values {
+		point.Values = append(point.Values, &p.FieldValue{DoubleValue: &values[i]})
+	}
+	return point
+}
+
+func checksumOf(c *C, series ...*p.Series) *p.SeriesChecksum {
+	processor := newChecksumProcessor()
+	for _, s := range series {
+		processor.YieldSeries(s)
+	}
+	checksums := processor.Checksums()
+	c.Assert(checksums, HasLen, 1)
+	return checksums[0]
+}
+
+func (self *AntiEntropySuite) TestChecksumDoesntDependOnBatchingOrColumnOrder(c *C) {
+	name := "foo"
+	all := &p.Series{
+		Name:   &name,
+		Fields: []string{"a", "b"},
+		Points: []*p.Point{newChecksumTestPoint(1, 1, 1, 2), newChecksumTestPoint(2, 1, 3, 4)},
+	}
+	firstBatch := &p.Series{Name: &name, Fields: []string{"b", "a"}, Points: []*p.Point{newChecksumTestPoint(2, 1, 4, 3)}}
+	secondBatch := &p.Series{Name: &name, Fields: []string{"a", "b"}, Points: []*p.Point{newChecksumTestPoint(1, 1, 1, 2)}}
+
+	expected := checksumOf(c, all)
+	actual := checksumOf(c, firstBatch, secondBatch)
+	c.Assert(actual.GetChecksum(), Equals, expected.GetChecksum())
+	c.Assert(actual.GetPointCount(), Equals, uint64(2))
+}
+
+func (self *AntiEntropySuite) TestChecksumChangesWithValuesAndSequenceNumbers(c *C) {
+	name := "foo"
+	original := checksumOf(c, &p.Series{Name: &name, Fields: []string{"a"}, Points: []*p.Point{newChecksumTestPoint(1, 1, 1)}})
+	otherValue := checksumOf(c, &p.Series{Name: &name, Fields: []string{"a"}, Points: []*p.Point{newChecksumTestPoint(1, 1, 2)}})
+	otherSequence := checksumOf(c, &p.Series{Name: &name, Fields: []string{"a"}, Points: []*p.Point{newChecksumTestPoint(1, 2, 1)}})
+	c.Assert(otherValue.GetChecksum(), Not(Equals), original.GetChecksum())
+	c.Assert(otherSequence.GetChecksum(), Not(Equals), original.GetChecksum())
+}
+
+func (self *AntiEntropySuite) TestDifferingSeries(c *C) {
+	checksum := func(name string, value uint64) *p.SeriesChecksum {
+		count := uint64(1)
+		return &p.SeriesChecksum{Name: &name, Checksum: &value, PointCount: &count}
+	}
+	local := []*p.SeriesChecksum{checksum("same", 1), checksum("different", 2), checksum("only_local", 3)}
+	remote := []*p.SeriesChecksum{checksum("same", 1), checksum("different", 5), checksum("only_remote", 4)}
+	c.Assert(differingSeries(local, remote), DeepEquals, []string{"different", "only_remote"})
+}
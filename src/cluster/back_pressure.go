@@ -0,0 +1,134 @@
+package cluster
+
+import (
+	"configuration"
+	"fmt"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+const (
+	// how often a blocked write checks if there's room in the buffers again
+	BACK_PRESSURE_CHECK_INTERVAL = 10 * time.Millisecond
+	// how long clients are asked to wait before retrying a rejected write
+	BACK_PRESSURE_RETRY_AFTER = time.Second
+)
+
+// Returned when a write was rejected because a write buffer or the wal queue was
+// over its high water mark. The check happens before anything of the write gets
+// logged, the client should retry the whole write after RetryAfter.
+type OverloadedError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (self *OverloadedError) Error() string {
+	return fmt.Sprintf("The server is overloaded, %s. Retry the write in %s", self.Reason, self.RetryAfter)
+}
+
+type WriteBufferStats struct {
+	Name   string `json:"name"`
+	Length int    `json:"length"`
+	Size   int    `json:"size"`
+	// writes that were dropped because the buffer was full, they're replayed from the wal
+	Shed int64 `json:"shed"`
+	// overrides the high water mark of the back-pressure if it's set
+	HighWaterMark float64 `json:"highWaterMark,omitempty"`
+}
+
+type BackPressureStats struct {
+	Policy        string  `json:"policy"`
+	HighWaterMark float64 `json:"highWaterMark"`
+	// why writes are held back right now, empty if they aren't
+	Overloaded       string              `json:"overloaded,omitempty"`
+	Blocked          int64               `json:"blocked"`
+	BlockedSeconds   float64             `json:"blockedSeconds"`
+	Rejected         int64               `json:"rejected"`
+	LastRejectedAt   time.Time           `json:"lastRejectedAt"`
+	LastRejectReason string              `json:"lastRejectReason,omitempty"`
+	Buffers          []*WriteBufferStats `json:"buffers"`
+}
+
+// Holds writes back while a write buffer or the wal queue is fuller than its high
+// water mark, according to the back-pressure policy. With shed writes are never held
+// back, the buffers drop what doesn't fit and replay it from the wal later.
+type BackPressure struct {
+	policy        string
+	highWaterMark float64
+	timeout       time.Duration
+	buffers       func() []*WriteBufferStats
+	stats         BackPressureStats
+	statsLock     sync.Mutex
+}
+
+func NewBackPressure(policy string, highWaterMark float64, timeout time.Duration, buffers func() []*WriteBufferStats) *BackPressure {
+	return &BackPressure{
+		policy:        policy,
+		highWaterMark: highWaterMark,
+		timeout:       timeout,
+		buffers:       buffers,
+		stats:         BackPressureStats{Policy: policy, HighWaterMark: highWaterMark},
+	}
+}
+
+// Returns why writes should be held back, or an empty string if all the buffers are
+// below the high water mark.
+func (self *BackPressure) overloaded() string {
+	for _, buffer := range self.buffers() {
+		highWaterMark := self.highWaterMark
+		if buffer.HighWaterMark > 0 {
+			highWaterMark = buffer.HighWaterMark
+		}
+		if buffer.Size > 0 && float64(buffer.Length) >= highWaterMark*float64(buffer.Size) {
+			return fmt.Sprintf("%s has %d of %d writes buffered", buffer.Name, buffer.Length, buffer.Size)
+		}
+	}
+	return ""
+}
+
+// Returns once the write can go ahead. With block it waits up to the timeout for
+// the buffers to drain, with reject it doesn't wait. Returns an *OverloadedError if
+// the write shouldn't be logged.
+func (self *BackPressure) Wait() error {
+	if self.policy != configuration.BACK_PRESSURE_BLOCK && self.policy != configuration.BACK_PRESSURE_REJECT {
+		return nil
+	}
+	reason := self.overloaded()
+	if reason == "" {
+		return nil
+	}
+
+	if self.policy == configuration.BACK_PRESSURE_BLOCK {
+		start := time.Now()
+		for reason != "" && time.Now().Sub(start) < self.timeout {
+			time.Sleep(BACK_PRESSURE_CHECK_INTERVAL)
+			reason = self.overloaded()
+		}
+		self.statsLock.Lock()
+		self.stats.Blocked++
+		self.stats.BlockedSeconds += time.Now().Sub(start).Seconds()
+		self.statsLock.Unlock()
+		if reason == "" {
+			return nil
+		}
+	}
+
+	log.Debug("Rejecting write: %s", reason)
+	self.statsLock.Lock()
+	self.stats.Rejected++
+	self.stats.LastRejectedAt = time.Now()
+	self.stats.LastRejectReason = reason
+	self.statsLock.Unlock()
+	return &OverloadedError{Reason: reason, RetryAfter: BACK_PRESSURE_RETRY_AFTER}
+}
+
+func (self *BackPressure) Stats() *BackPressureStats {
+	self.statsLock.Lock()
+	stats := self.stats
+	self.statsLock.Unlock()
+	stats.Overloaded = self.overloaded()
+	stats.Buffers = self.buffers()
+	return &stats
+}
@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"configuration"
+	. "launchpad.net/gocheck"
+	"sync"
+	"time"
+)
+
+type BackPressureSuite struct{}
+
+var _ = Suite(&BackPressureSuite{})
+
+type bufferMock struct {
+	length int
+	lock   sync.Mutex
+}
+
+func (self *bufferMock) setLength(length int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.length = length
+}
+
+func (self *bufferMock) stats() []*WriteBufferStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return []*WriteBufferStats{
+		{Name: "the local write buffer", Length: 1, Size: 10},
+		{Name: "the write buffer of server 2", Length: self.length, Size: 10},
+	}
+}
+
+func (self *BackPressureSuite) TestShedNeverHoldsWritesBack(c *C) {
+	buffer := &bufferMock{length: 10}
+	backPressure := NewBackPressure(configuration.BACK_PRESSURE_SHED, 0.8, time.Second, buffer.stats)
+	c.Assert(backPressure.Wait(), IsNil)
+	stats := backPressure.Stats()
+	c.Assert(stats.Rejected, Equals, int64(0))
+	c.Assert(stats.Overloaded, Equals, "the write buffer of server 2 has 10 of 10 writes buffered")
+}
+
+func (self *BackPressureSuite) TestRejectAboveHighWaterMark(c *C) {
+	buffer := &bufferMock{length: 7}
+	backPressure := NewBackPressure(configuration.BACK_PRESSURE_REJECT, 0.8, time.Second, buffer.stats)
+	c.Assert(backPressure.Wait(), IsNil)
+
+	buffer.setLength(8)
+	err := backPressure.Wait()
+	c.Assert(err, FitsTypeOf, &OverloadedError{})
+	c.Assert(err.(*OverloadedError).RetryAfter, Equals, BACK_PRESSURE_RETRY_AFTER)
+	stats := backPressure.Stats()
+	c.Assert(stats.Rejected, Equals, int64(1))
+	c.Assert(stats.LastRejectReason, Equals, "the write buffer of server 2 has 8 of 10 writes buffered")
+	c.Assert(stats.Buffers, HasLen, 2)
+}
+
+func (self *BackPressureSuite) TestWalQueueHasItsOwnHighWaterMark(c *C) {
+	walQueue := &WriteBufferStats{Name: "the wal queue", Length: 4, Size: 10, HighWaterMark: 0.5}
+	buffers := func() []*WriteBufferStats { return []*WriteBufferStats{walQueue} }
+	backPressure := NewBackPressure(configuration.BACK_PRESSURE_REJECT, 0.8, time.Second, buffers)
+	c.Assert(backPressure.Wait(), IsNil)
+
+	// over the mark of the wal queue, even though it's below the one of the buffers
+	walQueue.Length = 5
+	err := backPressure.Wait()
+	c.Assert(err, FitsTypeOf, &OverloadedError{})
+	c.Assert(err.(*OverloadedError).Reason, Equals, "the wal queue has 5 of 10 writes buffered")
+}
+
+func (self *BackPressureSuite) TestBlockUntilBuffersDrain(c *C) {
+	buffer := &bufferMock{length: 9}
+	backPressure := NewBackPressure(configuration.BACK_PRESSURE_BLOCK, 0.8, time.Second, buffer.stats)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		buffer.setLength(2)
+	}()
+	start := time.Now()
+	c.Assert(backPressure.Wait(), IsNil)
+	c.Assert(time.Now().Sub(start) >= 50*time.Millisecond, Equals, true)
+	stats := backPressure.Stats()
+	c.Assert(stats.Blocked, Equals, int64(1))
+	c.Assert(stats.Rejected, Equals, int64(0))
+
+	// writes that wait longer than the timeout get rejected
+	buffer.setLength(9)
+	backPressure = NewBackPressure(configuration.BACK_PRESSURE_BLOCK, 0.8, 50*time.Millisecond, buffer.stats)
+	c.Assert(backPressure.Wait(), FitsTypeOf, &OverloadedError{})
+	c.Assert(backPressure.Stats().Rejected, Equals, int64(1))
+}
+
+func (self *BackPressureSuite) TestWalQueueIsABackPressureInput(c *C) {
+	config := NewClusterConfiguration(&configuration.Configuration{WalQueueHighWaterMark: 0.5}, &walMock{}, nil, nil)
+	buffers := config.writeBufferStats()
+	walQueue := buffers[len(buffers)-1]
+	c.Assert(walQueue.Name, Equals, "the wal queue")
+	c.Assert(walQueue.Size, Equals, 10)
+	c.Assert(walQueue.HighWaterMark, Equals, 0.5)
+}
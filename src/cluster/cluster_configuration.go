@@ -34,10 +34,19 @@ type QuerySpec interface {
 
 type WAL interface {
 	AssignSequenceNumbersAndLog(request *protocol.Request, shard wal.Shard) (uint32, error)
+	AssignSequenceNumbersAndLogAndSync(request *protocol.Request, shard wal.Shard) (uint32, error)
 	Commit(requestNumber uint32, serverId uint32) error
 	CreateCheckpoint() error
 	RecoverServerFromRequestNumber(requestNumber uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error
+	RecoverServer(serverId, requestNumber uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error
 	RecoverServerFromLastCommit(serverId uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error
+	ServersNeedingResync() []uint32
+	QueueLength() (int, int)
+	MarkResync(serverId uint32) error
+	ClearResync(serverId, requestNumber uint32) error
+	LargestRequestNumber() uint32
+	ForgetServer(serverId uint32) error
+	ReplayStats() *wal.ReplayStats
 }
 
 type ShardCreator interface {
@@ -82,6 +91,23 @@ type ClusterConfiguration struct {
 	shardsById                 map[uint32]*ShardData
 	shardsByIdLock             sync.RWMutex
 	LocalRaftName              string
+	antiEntropy                *AntiEntropy
+	compaction                 *Compaction
+	hintedHandoff              *HintedHandoff
+	localWriteBuffer           *WriteBuffer
+	backPressure               *BackPressure
+	// the shards servers got a new copy of that still has to be backfilled from
+	// the other copies, by server id
+	pendingBackfills     map[uint32][]uint32
+	pendingBackfillsLock sync.Mutex
+	// the servers the copies of the shards of a decommissioned server are being
+	// moved to, by shard id
+	replicaMoves     map[uint32]uint32
+	replicaMovesLock sync.Mutex
+	// the series and time ranges points got deleted from or updated in that didn't
+	// reach all the copies yet, by database, see RecordRewrite
+	rewrittenRanges     map[string][]*RewrittenRange
+	rewrittenRangesLock sync.Mutex
 }
 
 type ContinuousQuery struct {
@@ -99,7 +125,7 @@ func NewClusterConfiguration(
 	wal WAL,
 	shardStore LocalShardStore,
 	connectionCreator func(string) ServerConnection) *ClusterConfiguration {
-	return &ClusterConfiguration{
+	clusterConfig := &ClusterConfiguration{
 		DatabaseReplicationFactors: make(map[string]uint8),
 		clusterAdmins:              make(map[string]*ClusterAdmin),
 		dbUsers:                    make(map[string]map[string]*DbUser),
@@ -115,7 +141,18 @@ func NewClusterConfiguration(
 		shortTermShards:            make([]*ShardData, 0),
 		random:                     rand.New(rand.NewSource(time.Now().UnixNano())),
 		shardsById:                 make(map[uint32]*ShardData, 0),
-	}
+		pendingBackfills:           make(map[uint32][]uint32),
+		replicaMoves:               make(map[uint32]uint32),
+		rewrittenRanges:            make(map[string][]*RewrittenRange),
+	}
+	clusterConfig.antiEntropy = NewAntiEntropy(clusterConfig, config.AntiEntropyRangesPerShard, config.QueryShardBufferSize)
+	clusterConfig.compaction = NewCompaction(shardStore)
+	clusterConfig.backPressure = NewBackPressure(config.BackPressure, config.BackPressureHighWaterMark,
+		config.BackPressureTimeout.Duration, clusterConfig.writeBufferStats)
+	if config.HintedHandoffDir != "" {
+		clusterConfig.hintedHandoff = NewHintedHandoff(config.HintedHandoffDir, int64(config.HintedHandoffMaxSize), config.HintedHandoffMaxAge.Duration, wal)
+	}
+	return clusterConfig
 }
 
 func (self *ClusterConfiguration) SetShardCreator(shardCreator ShardCreator) {
@@ -136,6 +173,108 @@ func (self *ClusterConfiguration) CreateFutureShardsAutomaticallyBeforeTimeComes
 	}()
 }
 
+// called by the server, runs the anti entropy repair of the local shards every
+// anti-entropy-interval if it's set. The servers that missed requests which were
+// dropped from the wal are always resynced.
+func (self *ClusterConfiguration) StartAntiEntropy() {
+	go self.resyncServersPeriodically()
+	interval := self.config.AntiEntropyInterval.Duration
+	if interval <= 0 {
+		log.Info("Anti entropy interval isn't set, shards will only be repaired on request")
+		return
+	}
+	go self.antiEntropy.RepairPeriodically(interval)
+}
+
+// Repairs the local shards and waits until the repair is done. Returns an error if
+// one is already running or if the repair didn't succeed.
+func (self *ClusterConfiguration) RepairShardsAndWait() error {
+	return self.antiEntropy.Repair()
+}
+
+// Starts a repair of the local shards in the background. Returns an error if one is
+// already running.
+func (self *ClusterConfiguration) RepairShards() error {
+	if status := self.antiEntropy.Status(); status.Running {
+		return fmt.Errorf("A repair is already running, it started at %s", status.StartedAt)
+	}
+	go func() {
+		if err := self.antiEntropy.Repair(); err != nil {
+			log.Error("Anti entropy: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (self *ClusterConfiguration) AntiEntropyStatus() AntiEntropyStatus {
+	return self.antiEntropy.Status()
+}
+
+// Returns how far behind every server is in the wal of this server and how the
+// replays to them are going.
+func (self *ClusterConfiguration) WalReplayStats() *wal.ReplayStats {
+	return self.wal.ReplayStats()
+}
+
+// Returns the state of the hinted handoff queue of every server that had writes queued
+// since this server started.
+func (self *ClusterConfiguration) HintedHandoffStats() []*HintedHandoffStats {
+	if self.hintedHandoff == nil {
+		return []*HintedHandoffStats{}
+	}
+	return self.hintedHandoff.Stats()
+}
+
+// Returns the buffers back pressure is based on: the local write buffer, the write
+// buffers of the servers that are up and the wal queue, which has its own high water
+// mark. The writes to servers that are down get replayed or handed off once they're
+// back, they don't hold writes back.
+func (self *ClusterConfiguration) writeBufferStats() []*WriteBufferStats {
+	buffers := []*WriteBufferStats{}
+	if self.localWriteBuffer != nil {
+		buffers = append(buffers, self.localWriteBuffer.stats("the local write buffer"))
+	}
+	self.serversLock.RLock()
+	for _, server := range self.servers {
+		if server.writeBuffer == nil || !server.IsUp() {
+			continue
+		}
+		buffers = append(buffers, server.writeBuffer.stats(fmt.Sprintf("the write buffer of server %d", server.Id)))
+	}
+	self.serversLock.RUnlock()
+	length, size := self.wal.QueueLength()
+	return append(buffers, &WriteBufferStats{Name: "the wal queue", Length: length, Size: size, HighWaterMark: self.config.WalQueueHighWaterMark})
+}
+
+// Called once per write request before any of it gets logged, holds it back or
+// rejects it with an *OverloadedError according to the back-pressure policy.
+func (self *ClusterConfiguration) WaitForWriteCapacity() error {
+	return self.backPressure.Wait()
+}
+
+func (self *ClusterConfiguration) BackPressureStats() *BackPressureStats {
+	return self.backPressure.Stats()
+}
+
+func (self *ClusterConfiguration) PurgeHintedHandoff(serverId uint32) error {
+	if self.hintedHandoff == nil {
+		return errors.New("Hinted handoff isn't enabled")
+	}
+	return self.hintedHandoff.Purge(serverId)
+}
+
+func (self *ClusterConfiguration) newServerWriteBuffer(writerInfo string, server *ClusterServer) *WriteBuffer {
+	var queue *HintedHandoffQueue
+	if self.hintedHandoff != nil {
+		var err error
+		queue, err = self.hintedHandoff.Queue(server.Id)
+		if err != nil {
+			log.Error("Cannot open the hinted handoff queue for server %d, writes will be replayed from the WAL: %s", server.Id, err)
+		}
+	}
+	return NewWriteBuffer(writerInfo, server, self.wal, server.Id, self.config.PerServerWriteBufferSize, queue)
+}
+
 func (self *ClusterConfiguration) automaticallyCreateFutureShard(shards []*ShardData, shardType ShardType) {
 	if len(shards) == 0 {
 		// don't automatically create shards if they haven't created any yet.
@@ -202,8 +341,15 @@ func (self *ClusterConfiguration) AddPotentialServer(server *ClusterServer) {
 	self.serversLock.Lock()
 	defer self.serversLock.Unlock()
 	server.State = Potential
+	// ids have to stay unique after servers are replaced or removed, so use the
+	// next id after the largest one instead of the length of the list.
+	server.Id = 1
+	for _, s := range self.servers {
+		if s.Id >= server.Id {
+			server.Id = s.Id + 1
+		}
+	}
 	self.servers = append(self.servers, server)
-	server.Id = uint32(len(self.servers))
 	log.Info("Added server to cluster config: %d, %s, %s", server.Id, server.RaftConnectionString, server.ProtobufConnectionString)
 	log.Info("Checking whether this is the local server new: %s, local: %s\n", self.config.ProtobufConnectionString(), server.ProtobufConnectionString)
 	if server.RaftName != self.LocalRaftName {
@@ -212,7 +358,7 @@ func (self *ClusterConfiguration) AddPotentialServer(server *ClusterServer) {
 			server.connection = self.connectionCreator(server.ProtobufConnectionString)
 			server.Connect()
 		}
-		server.SetWriteBuffer(NewWriteBuffer(fmt.Sprintf("%d", server.GetId()), server, self.wal, server.Id, self.config.PerServerWriteBufferSize))
+		server.SetWriteBuffer(self.newServerWriteBuffer(fmt.Sprintf("%d", server.GetId()), server))
 		server.StartHeartbeat()
 	} else if !self.addedLocalServer {
 		log.Info("Added the local server")
@@ -222,6 +368,217 @@ func (self *ClusterConfiguration) AddPotentialServer(server *ClusterServer) {
 	}
 }
 
+// Replaces a dead server with a server in the potential state. Every shard that
+// had a copy on the old server gets reassigned to the replacement and the old
+// server is taken out of the cluster. If the replacement is the local server
+// the reassigned shards get backfilled from the surviving replicas.
+func (self *ClusterConfiguration) ReplaceServer(oldServerId, replacementId uint32) error {
+	oldServer := self.GetServerById(&oldServerId)
+	if oldServer == nil {
+		return fmt.Errorf("Server %d doesn't exist", oldServerId)
+	}
+	replacement := self.GetServerById(&replacementId)
+	if replacement == nil {
+		return fmt.Errorf("Server %d doesn't exist", replacementId)
+	}
+	if oldServer == replacement {
+		return fmt.Errorf("Server %d can't replace itself", oldServerId)
+	}
+	if replacement.State != Potential {
+		return fmt.Errorf("Server %d can't replace server %d, it must be in the potential state", replacementId, oldServerId)
+	}
+
+	for _, shard := range self.GetAllShards() {
+		if shard.HasServer(replacementId) {
+			return fmt.Errorf("Server %d can't replace server %d, it already has a copy of shard %d", replacementId, oldServerId, shard.Id())
+		}
+	}
+
+	reassignedShards := make([]*ShardData, 0)
+	self.shardsByIdLock.Lock()
+	for _, shard := range self.GetAllShards() {
+		if !shard.HasServer(oldServerId) {
+			continue
+		}
+		if err := shard.ReplaceServer(oldServerId, replacement, self.shardStore, self.LocalServerId); err != nil {
+			self.shardsByIdLock.Unlock()
+			return err
+		}
+		reassignedShards = append(reassignedShards, shard)
+	}
+	self.shardsByIdLock.Unlock()
+
+	self.removeServer(oldServerId)
+	replacement.State = Running
+
+	log.Info("Replaced server %d with server %d, reassigned %d shards", oldServerId, replacementId, len(reassignedShards))
+
+	// this runs again whenever the raft log is replayed, so the backfill isn't started
+	// here. The replacement picks it up and finishes it with a finish_backfill command.
+	self.pendingBackfillsLock.Lock()
+	for _, shard := range reassignedShards {
+		self.pendingBackfills[replacementId] = append(self.pendingBackfills[replacementId], shard.Id())
+	}
+	self.pendingBackfillsLock.Unlock()
+	return nil
+}
+
+// Returns the ids of the shards the server got a new copy of that still has to
+// be backfilled.
+func (self *ClusterConfiguration) PendingBackfills(serverId uint32) []uint32 {
+	self.pendingBackfillsLock.Lock()
+	defer self.pendingBackfillsLock.Unlock()
+	shardIds := make([]uint32, len(self.pendingBackfills[serverId]))
+	copy(shardIds, self.pendingBackfills[serverId])
+	return shardIds
+}
+
+// Marks the backfill of the shards on the server as done, queries go to its copies
+// of them from now on.
+func (self *ClusterConfiguration) FinishBackfill(serverId uint32, shardIds []uint32) {
+	finished := make(map[uint32]bool, len(shardIds))
+	self.shardsByIdLock.RLock()
+	for _, id := range shardIds {
+		finished[id] = true
+		if shard := self.shardsById[id]; shard != nil {
+			shard.FinishBackfill(serverId)
+		}
+	}
+	self.shardsByIdLock.RUnlock()
+
+	self.pendingBackfillsLock.Lock()
+	defer self.pendingBackfillsLock.Unlock()
+	pending := make([]uint32, 0)
+	for _, id := range self.pendingBackfills[serverId] {
+		if !finished[id] {
+			pending = append(pending, id)
+		}
+	}
+	if len(pending) == 0 {
+		delete(self.pendingBackfills, serverId)
+		return
+	}
+	self.pendingBackfills[serverId] = pending
+}
+
+// Puts a server in the decommissioning state. It won't get any new shards
+// assigned, but keeps its existing ones until they're copied elsewhere.
+func (self *ClusterConfiguration) DecommissionServer(serverId uint32) error {
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		return fmt.Errorf("Server %d doesn't exist", serverId)
+	}
+	if len(self.serversAcceptingShards()) < 2 && server.State != Decommissioning {
+		return fmt.Errorf("Cannot decommission server %d, there are no other servers to take its shards", serverId)
+	}
+	server.State = Decommissioning
+	log.Info("Decommissioning server %d", serverId)
+	return nil
+}
+
+// Returns the server that should get a new copy of the given shard, which is
+// the one with the fewest shards that doesn't have a copy already.
+func (self *ClusterConfiguration) ServerForNewReplica(shard *ShardData) *ClusterServer {
+	shardCounts := make(map[uint32]int)
+	for _, s := range self.GetAllShards() {
+		for _, id := range s.ServerIds() {
+			shardCounts[id] += 1
+		}
+	}
+
+	var target *ClusterServer
+	for _, server := range self.serversAcceptingShards() {
+		if shard.HasServer(server.Id) {
+			continue
+		}
+		if target == nil || shardCounts[server.Id] < shardCounts[target.Id] {
+			target = server
+		}
+	}
+	return target
+}
+
+// Adds another copy of the shard on the given server. Writes start going to the new
+// copy right away, the existing data has to be copied with CopyShardReplica.
+func (self *ClusterConfiguration) AddShardReplica(shardId, serverId uint32) error {
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		return fmt.Errorf("Server %d doesn't exist", serverId)
+	}
+
+	self.shardsByIdLock.Lock()
+	defer self.shardsByIdLock.Unlock()
+	shard := self.shardsById[shardId]
+	if shard == nil {
+		return fmt.Errorf("Shard %d doesn't exist", shardId)
+	}
+	log.Info("Adding a copy of shard %d on server %d", shardId, serverId)
+	return shard.AddServer(server, self.shardStore, self.LocalServerId)
+}
+
+// Adds a copy of the shard on the given server like AddShardReplica and remembers
+// that it's the copy replacing the one of a decommissioned server, until the shard
+// gets dropped from that server.
+func (self *ClusterConfiguration) MoveShardReplica(shardId, serverId uint32) error {
+	if err := self.AddShardReplica(shardId, serverId); err != nil {
+		return err
+	}
+	self.replicaMovesLock.Lock()
+	defer self.replicaMovesLock.Unlock()
+	self.replicaMoves[shardId] = serverId
+	return nil
+}
+
+// Returns the server a copy of the shard is being moved to, if there's a move that
+// didn't finish.
+func (self *ClusterConfiguration) ReplicaMoveTarget(shardId uint32) (uint32, bool) {
+	self.replicaMovesLock.Lock()
+	defer self.replicaMovesLock.Unlock()
+	serverId, ok := self.replicaMoves[shardId]
+	return serverId, ok
+}
+
+// Copies the existing data of a shard to one of its replicas.
+func (self *ClusterConfiguration) CopyShardReplica(shardId, destinationId uint32) error {
+	self.shardsByIdLock.RLock()
+	shard := self.shardsById[shardId]
+	self.shardsByIdLock.RUnlock()
+	if shard == nil {
+		return fmt.Errorf("Shard %d doesn't exist", shardId)
+	}
+
+	var destination Writer = self.shardStore
+	if destinationId != self.LocalServerId {
+		server := self.GetServerById(&destinationId)
+		if server == nil {
+			return fmt.Errorf("Server %d doesn't exist", destinationId)
+		}
+		destination = server
+	}
+
+	user, err := self.clusterAdminForInternalQueries()
+	if err != nil {
+		return err
+	}
+	return shard.CopyData(self.databaseNames(), user, destination, destinationId, self.config.QueryShardBufferSize)
+}
+
+// Takes a server out of the cluster. The server must not have a copy of any shards.
+func (self *ClusterConfiguration) RemoveServer(serverId uint32) error {
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		return fmt.Errorf("Server %d doesn't exist", serverId)
+	}
+	for _, shard := range self.GetAllShards() {
+		if shard.HasServer(serverId) {
+			return fmt.Errorf("Cannot remove server %d, it still has a copy of shard %d", serverId, shard.Id())
+		}
+	}
+	self.removeServer(serverId)
+	log.Info("Removed server %d from the cluster", serverId)
+	return nil
+}
+
 func (self *ClusterConfiguration) GetDatabases() []*Database {
 	self.createDatabaseLock.RLock()
 	defer self.createDatabaseLock.RUnlock()
@@ -233,6 +590,13 @@ func (self *ClusterConfiguration) GetDatabases() []*Database {
 	return dbs
 }
 
+func (self *ClusterConfiguration) DatabaseExists(name string) bool {
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+	_, ok := self.DatabaseReplicationFactors[name]
+	return ok
+}
+
 func (self *ClusterConfiguration) CreateDatabase(name string, replicationFactor uint8) error {
 	self.createDatabaseLock.Lock()
 	defer self.createDatabaseLock.Unlock()
@@ -258,6 +622,10 @@ func (self *ClusterConfiguration) DropDatabase(name string) error {
 	defer self.usersLock.Unlock()
 
 	delete(self.dbUsers, name)
+
+	self.rewrittenRangesLock.Lock()
+	delete(self.rewrittenRanges, name)
+	self.rewrittenRangesLock.Unlock()
 	return nil
 }
 
@@ -424,6 +792,9 @@ type SavedConfiguration struct {
 	ShortTermShards   []*NewShardData
 	LongTermShards    []*NewShardData
 	ContinuousQueries map[string][]*ContinuousQuery
+	PendingBackfills  map[uint32][]uint32
+	ReplicaMoves      map[uint32]uint32
+	RewrittenRanges   map[string][]*RewrittenRange
 }
 
 func (self *ClusterConfiguration) Save() ([]byte, error) {
@@ -434,6 +805,9 @@ func (self *ClusterConfiguration) Save() ([]byte, error) {
 		DbUsers:           self.dbUsers,
 		Servers:           self.servers,
 		ContinuousQueries: self.continuousQueries,
+		PendingBackfills:  self.pendingBackfills,
+		ReplicaMoves:      self.replicaMoves,
+		RewrittenRanges:   self.rewrittenRanges,
 		ShortTermShards:   self.convertShardsToNewShardData(self.shortTermShards),
 		LongTermShards:    self.convertShardsToNewShardData(self.longTermShards),
 	}
@@ -450,7 +824,7 @@ func (self *ClusterConfiguration) Save() ([]byte, error) {
 func (self *ClusterConfiguration) convertShardsToNewShardData(shards []*ShardData) []*NewShardData {
 	newShardData := make([]*NewShardData, len(shards), len(shards))
 	for i, shard := range shards {
-		newShardData[i] = &NewShardData{Id: shard.id, Type: shard.shardType, StartTime: shard.startTime, EndTime: shard.endTime, ServerIds: shard.serverIds, DurationSplit: shard.durationIsSplit}
+		newShardData[i] = &NewShardData{Id: shard.id, Type: shard.shardType, StartTime: shard.startTime, EndTime: shard.endTime, ServerIds: shard.ServerIds(), DurationSplit: shard.durationIsSplit}
 	}
 	return newShardData
 }
@@ -489,6 +863,24 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 	self.DatabaseReplicationFactors = data.Databases
 	self.clusterAdmins = data.Admins
 	self.dbUsers = data.DbUsers
+	self.pendingBackfillsLock.Lock()
+	self.pendingBackfills = data.PendingBackfills
+	if self.pendingBackfills == nil {
+		self.pendingBackfills = make(map[uint32][]uint32)
+	}
+	self.pendingBackfillsLock.Unlock()
+	self.replicaMovesLock.Lock()
+	self.replicaMoves = data.ReplicaMoves
+	if self.replicaMoves == nil {
+		self.replicaMoves = make(map[uint32]uint32)
+	}
+	self.replicaMovesLock.Unlock()
+	self.rewrittenRangesLock.Lock()
+	self.rewrittenRanges = data.RewrittenRanges
+	if self.rewrittenRanges == nil {
+		self.rewrittenRanges = make(map[string][]*RewrittenRange)
+	}
+	self.rewrittenRangesLock.Unlock()
 
 	// copy the protobuf client from the old servers
 	oldServers := map[string]ServerConnection{}
@@ -509,7 +901,7 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 		if server.connection == nil {
 			server.connection = self.connectionCreator(server.ProtobufConnectionString)
 			if server.ProtobufConnectionString != self.config.ProtobufConnectionString() {
-				server.SetWriteBuffer(NewWriteBuffer(fmt.Sprintf("server: %d", server.GetId()), server, self.wal, server.Id, self.config.PerServerWriteBufferSize))
+				server.SetWriteBuffer(self.newServerWriteBuffer(fmt.Sprintf("server: %d", server.GetId()), server))
 				server.Connect()
 				server.StartHeartbeat()
 			}
@@ -530,6 +922,15 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 		shard := s
 		self.shardsById[s.id] = shard
 	}
+	self.pendingBackfillsLock.Lock()
+	for serverId, shardIds := range self.pendingBackfills {
+		for _, id := range shardIds {
+			if shard := self.shardsById[id]; shard != nil {
+				shard.StartBackfill(serverId)
+			}
+		}
+	}
+	self.pendingBackfillsLock.Unlock()
 
 	for db, queries := range data.ContinuousQueries {
 		for _, query := range queries {
@@ -643,9 +1044,10 @@ func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardTyp
 		numberOfShardsToCreateForDuration = self.config.ShortTermShard.Split
 		secondsOfDuration = self.config.ShortTermShard.ParsedDuration().Seconds()
 	}
+	servers := self.serversAcceptingShards()
 	startIndex := 0
 	if self.lastServerToGetShard != nil {
-		for i, server := range self.servers {
+		for i, server := range servers {
 			if server == self.lastServerToGetShard {
 				startIndex = i + 1
 			}
@@ -663,15 +1065,15 @@ func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardTyp
 
 		// if they have the replication factor set higher than the number of servers in the cluster, limit it
 		rf := self.config.ReplicationFactor
-		if rf > len(self.servers) {
-			rf = len(self.servers)
+		if rf > len(servers) {
+			rf = len(servers)
 		}
 
 		for rf = rf; rf > 0; rf-- {
-			if startIndex >= len(self.servers) {
+			if startIndex >= len(servers) {
 				startIndex = 0
 			}
-			server := self.servers[startIndex]
+			server := servers[startIndex]
 			self.lastServerToGetShard = server
 			serverIds = append(serverIds, server.Id)
 			startIndex += 1
@@ -832,45 +1234,64 @@ func (self *ClusterConfiguration) AddShards(shards []*NewShardData) ([]*ShardDat
 
 	durationIsSplit := len(shards) > 1
 	for _, newShard := range shards {
-		id := uint32(len(self.GetAllShards()) + 1)
-		shard := NewShard(id, newShard.StartTime, newShard.EndTime, shardType, durationIsSplit, self.wal)
-		servers := make([]*ClusterServer, 0)
-		for _, serverId := range newShard.ServerIds {
-			if serverId == self.LocalServerId {
-				err := shard.SetLocalStore(self.shardStore, self.LocalServerId)
-				if err != nil {
-					log.Error("AddShards: error setting local store: ", err)
-					return nil, err
-				}
-			} else {
-				servers = append(servers, self.GetServerById(&serverId))
-			}
+		shard, err := self.addShard(self.nextShardId(), newShard, shardType, durationIsSplit)
+		if err != nil {
+			return nil, err
 		}
-		shard.SetServers(servers)
+		createdShards = append(createdShards, shard)
+	}
+	return createdShards, nil
+}
 
-		self.shardsByIdLock.Lock()
-		self.shardsById[shard.id] = shard
-		self.shardsByIdLock.Unlock()
+// Shard ids used to be the number of shards plus one, which can be taken after
+// shards got dropped or restored with their own id
+func (self *ClusterConfiguration) nextShardId() uint32 {
+	self.shardsByIdLock.RLock()
+	defer self.shardsByIdLock.RUnlock()
+	id := uint32(len(self.GetAllShards()) + 1)
+	for self.shardsById[id] != nil {
+		id++
+	}
+	return id
+}
 
-		message := "Adding long term shard"
-		if newShard.Type == LONG_TERM {
-			self.longTermShards = append(self.longTermShards, shard)
-			SortShardsByTimeDescending(self.longTermShards)
+// should be called with the shard lock held
+func (self *ClusterConfiguration) addShard(id uint32, newShard *NewShardData, shardType ShardType, durationIsSplit bool) (*ShardData, error) {
+	shard := NewShard(id, newShard.StartTime, newShard.EndTime, shardType, durationIsSplit, self.wal)
+	servers := make([]*ClusterServer, 0)
+	for _, serverId := range newShard.ServerIds {
+		if serverId == self.LocalServerId {
+			err := shard.SetLocalStore(self.shardStore, self.LocalServerId)
+			if err != nil {
+				log.Error("AddShards: error setting local store: ", err)
+				return nil, err
+			}
 		} else {
-			message = "Adding short term shard"
-			self.shortTermShards = append(self.shortTermShards, shard)
-			SortShardsByTimeDescending(self.shortTermShards)
+			servers = append(servers, self.GetServerById(&serverId))
 		}
+	}
+	shard.SetServers(servers)
 
-		createdShards = append(createdShards, shard)
+	self.shardsByIdLock.Lock()
+	self.shardsById[shard.id] = shard
+	self.shardsByIdLock.Unlock()
 
-		log.Info("%s: %d - start: %s (%d). end: %s (%d). isLocal: %d. servers: %s",
-			message, shard.Id(),
-			shard.StartTime().Format("Mon Jan 2 15:04:05 -0700 MST 2006"), shard.StartTime().Unix(),
-			shard.EndTime().Format("Mon Jan 2 15:04:05 -0700 MST 2006"), shard.EndTime().Unix(),
-			shard.IsLocal, shard.ServerIds())
+	message := "Adding long term shard"
+	if newShard.Type == LONG_TERM {
+		self.longTermShards = append(self.longTermShards, shard)
+		SortShardsByTimeDescending(self.longTermShards)
+	} else {
+		message = "Adding short term shard"
+		self.shortTermShards = append(self.shortTermShards, shard)
+		SortShardsByTimeDescending(self.shortTermShards)
 	}
-	return createdShards, nil
+
+	log.Info("%s: %d - start: %s (%d). end: %s (%d). isLocal: %d. servers: %s",
+		message, shard.Id(),
+		shard.StartTime().Format("Mon Jan 2 15:04:05 -0700 MST 2006"), shard.StartTime().Unix(),
+		shard.EndTime().Format("Mon Jan 2 15:04:05 -0700 MST 2006"), shard.EndTime().Unix(),
+		shard.IsLocal, shard.ServerIds())
+	return shard, nil
 }
 
 func (self *ClusterConfiguration) MarshalNewShardArrayToShards(newShards []*NewShardData) ([]*ShardData, error) {
@@ -896,6 +1317,13 @@ func (self *ClusterConfiguration) MarshalNewShardArrayToShards(newShards []*NewS
 	return shards, nil
 }
 
+// Returns nil if the shard doesn't exist
+func (self *ClusterConfiguration) GetShardById(id uint32) *ShardData {
+	self.shardsByIdLock.RLock()
+	defer self.shardsByIdLock.RUnlock()
+	return self.shardsById[id]
+}
+
 // This function is for the request handler to get the shard to write a
 // request to locally.
 func (self *ClusterConfiguration) GetLocalShardById(id uint32) *ShardData {
@@ -914,6 +1342,10 @@ func (self *ClusterConfiguration) GetLocalShardById(id uint32) *ShardData {
 }
 
 func (self *ClusterConfiguration) DropShard(shardId uint32, serverIds []uint32) error {
+	self.replicaMovesLock.Lock()
+	delete(self.replicaMoves, shardId)
+	self.replicaMovesLock.Unlock()
+
 	// take it out of the memory map so writes and queries stop going to it
 	self.updateOrRemoveShard(shardId, serverIds)
 
@@ -927,7 +1359,8 @@ func (self *ClusterConfiguration) DropShard(shardId uint32, serverIds []uint32)
 }
 
 func (self *ClusterConfiguration) RecoverFromWAL() error {
-	self.shardStore.SetWriteBuffer(NewWriteBuffer("local", self.shardStore, self.wal, self.LocalServerId, self.config.LocalStoreWriteBufferSize))
+	self.localWriteBuffer = NewWriteBuffer("local", self.shardStore, self.wal, self.LocalServerId, self.config.LocalStoreWriteBufferSize, nil)
+	self.shardStore.SetWriteBuffer(self.localWriteBuffer)
 	var waitForAll sync.WaitGroup
 	for _, server := range self.servers {
 		waitForAll.Add(1)
@@ -960,7 +1393,7 @@ func (self *ClusterConfiguration) RecoverFromWAL() error {
 func (self *ClusterConfiguration) recover(serverId uint32, writer Writer) error {
 	shardIds := self.shardIdsForServerId(serverId)
 	log.Debug("replaying wal for server %d and shardIds %#v", serverId, shardIds)
-	return self.wal.RecoverServerFromLastCommit(serverId, shardIds, func(request *protocol.Request, shardId uint32) error {
+	err := self.wal.RecoverServerFromLastCommit(serverId, shardIds, func(request *protocol.Request, shardId uint32) error {
 		if request == nil {
 			log.Error("Error on recover, the wal yielded a nil request")
 			return nil
@@ -974,12 +1407,102 @@ func (self *ClusterConfiguration) recover(serverId uint32, writer Writer) error
 		log.Debug("Finished sending request %d to server %d", request.GetRequestNumber(), serverId)
 		return self.wal.Commit(requestNumber, serverId)
 	})
+	if _, ok := err.(*wal.ResyncNeededError); ok {
+		log.Warn("Not replaying the wal for server %d: %s", serverId, err)
+		return nil
+	}
+	return err
+}
+
+// Copies the data of the shards from their other copies to the local ones. Returns
+// the ids of the shards that were backfilled, the ones that failed can be retried.
+func (self *ClusterConfiguration) BackfillShards(shardIds []uint32) []uint32 {
+	user, err := self.clusterAdminForInternalQueries()
+	if err != nil {
+		log.Error("Cannot backfill shards: %s", err)
+		return nil
+	}
+	databases := self.databaseNames()
+
+	backfilled := make([]uint32, 0, len(shardIds))
+	for _, id := range shardIds {
+		shard := self.GetShardById(id)
+		if shard == nil || !shard.IsLocal {
+			log.Info("Not backfilling shard %d, it isn't stored on this server anymore", id)
+			backfilled = append(backfilled, id)
+			continue
+		}
+		log.Info("Backfilling shard %d from its replicas", id)
+		if err := shard.Backfill(databases, user, self.config.QueryShardBufferSize); err != nil {
+			log.Error("Error while backfilling shard %d: %s", id, err)
+			continue
+		}
+		log.Info("Finished backfilling shard %d", id)
+		backfilled = append(backfilled, id)
+	}
+	return backfilled
+}
+
+func (self *ClusterConfiguration) clusterAdminForInternalQueries() (common.User, error) {
+	admins := self.GetClusterAdmins()
+	if len(admins) == 0 {
+		return nil, errors.New("There are no cluster admins to run the queries as")
+	}
+	return self.GetClusterAdmin(admins[0]), nil
+}
+
+func (self *ClusterConfiguration) databaseNames() []string {
+	databases := make([]string, 0)
+	for _, database := range self.GetDatabases() {
+		databases = append(databases, database.Name)
+	}
+	return databases
+}
+
+func (self *ClusterConfiguration) serversAcceptingShards() []*ClusterServer {
+	servers := make([]*ClusterServer, 0, len(self.servers))
+	for _, server := range self.servers {
+		if server.State != Decommissioning {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// Takes the server out of the cluster, stops its heartbeat and write buffer and
+// tells the wal to stop keeping requests around for it.
+func (self *ClusterConfiguration) removeServer(serverId uint32) {
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	servers := make([]*ClusterServer, 0, len(self.servers))
+	for _, server := range self.servers {
+		if server.Id != serverId {
+			servers = append(servers, server)
+			continue
+		}
+		if self.lastServerToGetShard == server {
+			self.lastServerToGetShard = nil
+		}
+		server.Stop()
+	}
+	self.servers = servers
+
+	if self.wal != nil {
+		if err := self.wal.ForgetServer(serverId); err != nil {
+			log.Error("Cannot remove server %d from the wal: %s", serverId, err)
+		}
+	}
+	if self.hintedHandoff != nil {
+		if err := self.hintedHandoff.Remove(serverId); err != nil {
+			log.Error("Cannot remove the hinted handoff queue of server %d: %s", serverId, err)
+		}
+	}
 }
 
 func (self *ClusterConfiguration) shardIdsForServerId(serverId uint32) []uint32 {
 	shardIds := make([]uint32, 0)
 	for _, shard := range self.GetAllShards() {
-		for _, id := range shard.serverIds {
+		for _, id := range shard.ServerIds() {
 			if id == serverId {
 				sid := id
 				shardIds = append(shardIds, sid)
@@ -1006,28 +1529,16 @@ func (self *ClusterConfiguration) updateOrRemoveShard(shardId uint32, serverIds
 	}
 	if shard == nil {
 		log.Error("Attempted to remove shard %d, which we couldn't find. %d shards currently loaded.", shardId, len(self.GetAllShards()))
+		return
 	}
 
-	if len(shard.serverIds) == len(serverIds) {
+	if len(shard.ServerIds()) == len(serverIds) {
 		self.removeShard(shardId)
 		return
 	}
 	self.shardsByIdLock.Lock()
 	defer self.shardsByIdLock.Unlock()
-	newIds := make([]uint32, 0)
-	for _, oldId := range shard.serverIds {
-		include := true
-		for _, removeId := range serverIds {
-			if oldId == removeId {
-				include = false
-				break
-			}
-		}
-		if include {
-			newIds = append(newIds, oldId)
-		}
-	}
-	shard.serverIds = newIds
+	shard.RemoveServers(serverIds)
 }
 
 func (self *ClusterConfiguration) removeShard(shardId uint32) {
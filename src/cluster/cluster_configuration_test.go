@@ -0,0 +1,94 @@
+package cluster
+
+import (
+	"configuration"
+	. "launchpad.net/gocheck"
+	"math"
+	"time"
+)
+
+type ClusterConfigurationSuite struct{}
+
+var _ = Suite(&ClusterConfigurationSuite{})
+
+func (self *ClusterConfigurationSuite) TestPendingBackfillsSurviveSnapshots(c *C) {
+	config := NewClusterConfiguration(&configuration.Configuration{}, nil, nil, nil)
+	config.pendingBackfills[2] = []uint32{1, 2, 3}
+	config.FinishBackfill(2, []uint32{2})
+	c.Assert(config.PendingBackfills(2), DeepEquals, []uint32{1, 3})
+
+	data, err := config.Save()
+	c.Assert(err, IsNil)
+	recovered := NewClusterConfiguration(&configuration.Configuration{}, nil, nil, nil)
+	c.Assert(recovered.Recovery(data), IsNil)
+	c.Assert(recovered.PendingBackfills(2), DeepEquals, []uint32{1, 3})
+
+	recovered.FinishBackfill(2, []uint32{1, 3})
+	c.Assert(recovered.PendingBackfills(2), HasLen, 0)
+	c.Assert(recovered.pendingBackfills, HasLen, 0)
+}
+
+func (self *ClusterConfigurationSuite) TestReplicaMovesSurviveSnapshots(c *C) {
+	config := NewClusterConfiguration(&configuration.Configuration{}, nil, nil, nil)
+	config.replicaMoves[7] = 3
+
+	data, err := config.Save()
+	c.Assert(err, IsNil)
+	recovered := NewClusterConfiguration(&configuration.Configuration{}, nil, nil, nil)
+	c.Assert(recovered.Recovery(data), IsNil)
+	serverId, ok := recovered.ReplicaMoveTarget(7)
+	c.Assert(ok, Equals, true)
+	c.Assert(serverId, Equals, uint32(3))
+	_, ok = recovered.ReplicaMoveTarget(8)
+	c.Assert(ok, Equals, false)
+}
+
+func (self *ClusterConfigurationSuite) TestRewrittenRanges(c *C) {
+	config := NewClusterConfiguration(&configuration.Configuration{}, nil, nil, nil)
+	config.RecordRewrite("db1", &RewrittenRange{Series: "foo", StartMicro: 10, EndMicro: 20})
+	config.RecordRewrite("db1", &RewrittenRange{Series: "^bar", IsRegex: true, StartMicro: 50, EndMicro: 60})
+
+	c.Assert(config.IsSeriesRewritten("db1", "foo", 0, 10), Equals, true)
+	c.Assert(config.IsSeriesRewritten("db1", "foo", 21, 30), Equals, false)
+	c.Assert(config.IsSeriesRewritten("db1", "bar.baz", 55, 56), Equals, true)
+	c.Assert(config.IsSeriesRewritten("db1", "foo", 55, 56), Equals, false)
+	c.Assert(config.IsSeriesRewritten("db2", "foo", 0, 100), Equals, false)
+
+	data, err := config.Save()
+	c.Assert(err, IsNil)
+	recovered := NewClusterConfiguration(&configuration.Configuration{}, nil, nil, nil)
+	c.Assert(recovered.Recovery(data), IsNil)
+	c.Assert(recovered.IsSeriesRewritten("db1", "foo", 15, 16), Equals, true)
+
+	// the range is kept until all the queries that recorded it reached all the copies
+	recovered.RecordRewrite("db1", &RewrittenRange{Series: "foo", StartMicro: 10, EndMicro: 20})
+	recovered.ForgetRewrite("db1", &RewrittenRange{Series: "foo", StartMicro: 10, EndMicro: 20})
+	c.Assert(recovered.IsSeriesRewritten("db1", "foo", 15, 16), Equals, true)
+	recovered.ForgetRewrite("db1", &RewrittenRange{Series: "foo", StartMicro: 10, EndMicro: 20})
+	c.Assert(recovered.IsSeriesRewritten("db1", "foo", 15, 16), Equals, false)
+}
+
+func (self *ClusterConfigurationSuite) TestDroppedSeriesDontStopTheRepairOfOtherSeries(c *C) {
+	config := NewClusterConfiguration(&configuration.Configuration{}, nil, nil, nil)
+	config.RecordRewrite("db1", &RewrittenRange{Series: "foo", StartMicro: math.MinInt64, EndMicro: math.MaxInt64})
+
+	c.Assert(config.IsSeriesRewritten("db1", "foo", 0, 100), Equals, true)
+	c.Assert(config.IsSeriesRewritten("db1", "bar", 0, 100), Equals, false)
+	c.Assert(config.IsSeriesRewritten("db1", "foo.bar", 0, 100), Equals, false)
+}
+
+func (self *ClusterConfigurationSuite) TestShardsWithoutCopyOnTheServersThatAnswered(c *C) {
+	config := NewClusterConfiguration(&configuration.Configuration{}, nil, nil, nil)
+	config.shortTermShards = []*ShardData{newShardWithServers(false, true)}
+
+	// the series of the shard are in the index of either copy
+	c.Assert(config.shardsWithoutCopyOn(map[uint32]bool{2: true}), HasLen, 0)
+	c.Assert(config.shardsWithoutCopyOn(map[uint32]bool{}), DeepEquals, []uint32{1})
+
+	replacement := NewClusterServer("", "", "", &connectionMock{true}, time.Second)
+	replacement.Id = 3
+	c.Assert(config.shortTermShards[0].ReplaceServer(2, replacement, nil, 0), IsNil)
+	c.Assert(config.shardsWithoutCopyOn(map[uint32]bool{3: true}), DeepEquals, []uint32{1})
+	config.shortTermShards[0].FinishBackfill(3)
+	c.Assert(config.shardsWithoutCopyOn(map[uint32]bool{3: true}), HasLen, 0)
+}
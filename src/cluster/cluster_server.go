@@ -27,6 +27,7 @@ type ClusterServer struct {
 	isUp                     bool
 	writeBuffer              *WriteBuffer
 	heartbeatStarted         bool
+	stopHeartbeat            chan bool
 }
 
 type ServerConnection interface {
@@ -42,6 +43,7 @@ const (
 	DeletingOldData
 	Running
 	Potential
+	Decommissioning
 )
 
 func NewClusterServer(raftName, raftConnectionString, protobufConnectionString string, connection ServerConnection, heartbeatInterval time.Duration) *ClusterServer {
@@ -69,7 +71,21 @@ func (self *ClusterServer) StartHeartbeat() {
 
 	self.heartbeatStarted = true
 	self.isUp = true
-	go self.heartbeat()
+	self.stopHeartbeat = make(chan bool)
+	go self.heartbeat(self.stopHeartbeat)
+}
+
+// Stops the heartbeat and the write buffer, called when the server leaves the
+// cluster. Writes that are still buffered for it are dropped.
+func (self *ClusterServer) Stop() {
+	if self.stopHeartbeat != nil {
+		close(self.stopHeartbeat)
+		self.stopHeartbeat = nil
+	}
+	if self.writeBuffer != nil {
+		self.writeBuffer.Stop()
+	}
+	self.isUp = false
 }
 
 func (self *ClusterServer) SetWriteBuffer(writeBuffer *WriteBuffer) {
@@ -120,6 +136,14 @@ func (self *ClusterServer) BufferWrite(request *protocol.Request) {
 	self.writeBuffer.Write(request)
 }
 
+func (self *ClusterServer) BufferWriteAndNotify(request *protocol.Request, acks chan<- uint32) {
+	self.writeBuffer.WriteAndNotify(request, acks)
+}
+
+func (self *ClusterServer) StopNotifying(requestNumber uint32, acks chan<- uint32) {
+	self.writeBuffer.StopNotifying(requestNumber, acks)
+}
+
 func (self *ClusterServer) IsUp() bool {
 	return self.isUp
 }
@@ -128,7 +152,7 @@ func (self *ClusterServer) IsUp() bool {
 
 var HEARTBEAT_TYPE = protocol.Request_HEARTBEAT
 
-func (self *ClusterServer) heartbeat() {
+func (self *ClusterServer) heartbeat(stop <-chan bool) {
 	defer func() {
 		self.heartbeatStarted = false
 	}()
@@ -141,16 +165,22 @@ func (self *ClusterServer) heartbeat() {
 	for {
 		heartbeatRequest.Id = nil
 		self.MakeRequest(heartbeatRequest, responseChan)
+		wait := self.HeartbeatInterval
 		err := self.getHeartbeatResponse(responseChan)
 		if err != nil {
 			self.handleHeartbeatError(err)
-			continue
+			wait = self.Backoff
+		} else {
+			// otherwise, reset the backoff and mark the server as up
+			self.isUp = true
+			self.Backoff = DEFAULT_BACKOFF
 		}
 
-		// otherwise, reset the backoff and mark the server as up
-		self.isUp = true
-		self.Backoff = DEFAULT_BACKOFF
-		<-time.After(self.HeartbeatInterval)
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
 	}
 }
 
@@ -177,7 +207,6 @@ func (self *ClusterServer) handleHeartbeatError(err error) {
 	if self.Backoff > MAX_BACKOFF {
 		self.Backoff = MAX_BACKOFF
 	}
-	<-time.After(self.Backoff)
 }
 
 // in the coordinator test we don't want to create protobuf servers,
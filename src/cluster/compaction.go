@@ -0,0 +1,126 @@
+package cluster
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// Compacts the local shards on request. Deletes and dropped series compact the key
+// ranges they removed on their own, this reclaims the space when that got cut off,
+// e.g. by a restart. Every server compacts its own copies of the shards.
+type Compaction struct {
+	shardStore LocalShardStore
+	running    bool
+	status     *CompactionStatus
+	statusLock sync.Mutex
+}
+
+type CompactionStatus struct {
+	Running         bool      `json:"running"`
+	StartedAt       time.Time `json:"startedAt"`
+	FinishedAt      time.Time `json:"finishedAt"`
+	Database        string    `json:"database,omitempty"`
+	ShardsToCompact int       `json:"shardsToCompact"`
+	ShardsCompacted int       `json:"shardsCompacted"`
+	CurrentShard    uint32    `json:"currentShard"`
+	// the progress of the current shard, a whole shard counts as one series
+	SeriesToCompact  int    `json:"seriesToCompact"`
+	SeriesCompacted  int    `json:"seriesCompacted"`
+	Errors           int    `json:"errors"`
+	LastErrorMessage string `json:"lastErrorMessage,omitempty"`
+}
+
+func NewCompaction(shardStore LocalShardStore) *Compaction {
+	return &Compaction{
+		shardStore: shardStore,
+		status:     &CompactionStatus{},
+	}
+}
+
+// Starts compacting the shards in the background, only the points of the database
+// get compacted if it isn't empty. Returns an error if a compaction is already
+// running.
+func (self *Compaction) Start(shardIds []uint32, database string) error {
+	self.statusLock.Lock()
+	defer self.statusLock.Unlock()
+	if self.running {
+		return fmt.Errorf("A compaction is already running, it started at %s", self.status.StartedAt)
+	}
+	self.running = true
+	self.status = &CompactionStatus{
+		Running:         true,
+		StartedAt:       time.Now(),
+		Database:        database,
+		ShardsToCompact: len(shardIds),
+	}
+	go self.compact(shardIds, database)
+	return nil
+}
+
+// Returns a copy of the progress of the running compaction, or of the last one.
+func (self *Compaction) Status() CompactionStatus {
+	self.statusLock.Lock()
+	defer self.statusLock.Unlock()
+	return *self.status
+}
+
+func (self *Compaction) compact(shardIds []uint32, database string) {
+	defer self.updateStatus(func(status *CompactionStatus) {
+		self.running = false
+		status.Running = false
+		status.FinishedAt = time.Now()
+	})
+
+	log.Info("Compaction: compacting %d shards", len(shardIds))
+	for _, id := range shardIds {
+		self.updateStatus(func(status *CompactionStatus) {
+			status.CurrentShard = id
+			status.SeriesToCompact = 0
+			status.SeriesCompacted = 0
+		})
+		err := self.shardStore.CompactShard(id, database, func(compacted, total int) {
+			self.updateStatus(func(status *CompactionStatus) {
+				status.SeriesToCompact = total
+				status.SeriesCompacted = compacted
+			})
+		})
+		if err != nil {
+			log.Error("Compaction: cannot compact shard %d: %s", id, err)
+			self.updateStatus(func(status *CompactionStatus) {
+				status.Errors += 1
+				status.LastErrorMessage = err.Error()
+			})
+		}
+		self.updateStatus(func(status *CompactionStatus) {
+			status.ShardsCompacted += 1
+		})
+	}
+	log.Info("Compaction: finished compacting %d shards", len(shardIds))
+}
+
+func (self *Compaction) updateStatus(update func(status *CompactionStatus)) {
+	self.statusLock.Lock()
+	defer self.statusLock.Unlock()
+	update(self.status)
+}
+
+// Starts compacting the local copies of the shards in the background, all of them
+// if shardIds is empty. Only the points of the database get compacted if it isn't
+// empty.
+func (self *ClusterConfiguration) CompactShards(shardIds []uint32, database string) error {
+	if len(shardIds) == 0 {
+		for _, shard := range self.GetAllShards() {
+			if shard.IsLocal {
+				shardIds = append(shardIds, shard.Id())
+			}
+		}
+	}
+	return self.compaction.Start(shardIds, database)
+}
+
+func (self *ClusterConfiguration) CompactionStatus() CompactionStatus {
+	return self.compaction.Status()
+}
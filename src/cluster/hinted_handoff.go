@@ -0,0 +1,603 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"protocol"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+const (
+	HINTED_HANDOFF_MAX_SEGMENT_SIZE = 64 * 1024 * 1024
+	HINTED_HANDOFF_RETRY_INTERVAL   = time.Second
+
+	// every entry starts with the length of the request and the time it was queued
+	hintedHandoffHeaderSize = 4 + 8
+	hintedHandoffSegment    = "segment."
+	hintedHandoffOffsetFile = "offset"
+)
+
+// Keeps a hinted handoff queue on disk for every server writes get buffered for.
+// When a write to a server fails, the write buffer stores the request in the queue
+// of the server and commits it in the WAL, so the log files can rotate away while
+// the server is down. The queue gets delivered once the server is back. Servers
+// that lose queued requests get marked as needing a resync in the WAL.
+type HintedHandoff struct {
+	dir        string
+	maxSize    int64
+	maxAge     time.Duration
+	wal        WAL
+	queues     map[uint32]*HintedHandoffQueue
+	queuesLock sync.Mutex
+}
+
+type HintedHandoffStats struct {
+	ServerId              uint32 `json:"serverId"`
+	Entries               int    `json:"entries"`
+	Bytes                 int64  `json:"bytes"`
+	OldestEntryAgeSeconds int64  `json:"oldestEntryAgeSeconds"`
+	Delivered             int    `json:"delivered"`
+	Dropped               int    `json:"dropped"`
+}
+
+func NewHintedHandoff(dir string, maxSize int64, maxAge time.Duration, wal WAL) *HintedHandoff {
+	return &HintedHandoff{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		wal:     wal,
+		queues:  make(map[uint32]*HintedHandoffQueue),
+	}
+}
+
+// Returns the queue for the server, opening it if it's already on disk.
+func (self *HintedHandoff) Queue(serverId uint32) (*HintedHandoffQueue, error) {
+	self.queuesLock.Lock()
+	defer self.queuesLock.Unlock()
+	if queue, ok := self.queues[serverId]; ok {
+		return queue, nil
+	}
+	queue, err := openHintedHandoffQueue(path.Join(self.dir, strconv.Itoa(int(serverId))), serverId, self.maxSize, self.maxAge, self.wal)
+	if err != nil {
+		return nil, err
+	}
+	self.queues[serverId] = queue
+	return queue, nil
+}
+
+func (self *HintedHandoff) Stats() []*HintedHandoffStats {
+	self.queuesLock.Lock()
+	defer self.queuesLock.Unlock()
+	serverIds := make([]int, 0, len(self.queues))
+	for serverId := range self.queues {
+		serverIds = append(serverIds, int(serverId))
+	}
+	sort.Ints(serverIds)
+
+	stats := make([]*HintedHandoffStats, 0, len(serverIds))
+	for _, serverId := range serverIds {
+		stats = append(stats, self.queues[uint32(serverId)].Stats())
+	}
+	return stats
+}
+
+// Drops everything queued for the server and marks it as needing a resync, so it gets
+// the data from the other copies of its shards.
+func (self *HintedHandoff) Purge(serverId uint32) error {
+	self.queuesLock.Lock()
+	queue := self.queues[serverId]
+	self.queuesLock.Unlock()
+	if queue == nil {
+		return fmt.Errorf("There's no hinted handoff queue for server %d", serverId)
+	}
+	return queue.Purge()
+}
+
+// Called when the server leaves the cluster, deletes its queue from disk.
+func (self *HintedHandoff) Remove(serverId uint32) error {
+	self.queuesLock.Lock()
+	queue := self.queues[serverId]
+	delete(self.queues, serverId)
+	self.queuesLock.Unlock()
+	if queue == nil {
+		return nil
+	}
+	return queue.remove()
+}
+
+// A queue of requests for a single server. The requests are appended to segment files,
+// the oldest segment gets dropped when the queue gets bigger than the max size, or when
+// its last write is older than the max age. The read position is kept in the offset
+// file, so nothing gets delivered twice after a restart, unless the server crashed
+// right after a delivery, which is fine since writes are idempotent. Appended entries
+// are fsynced, the write buffer commits them in the WAL right away.
+type HintedHandoffQueue struct {
+	serverId     uint32
+	dir          string
+	maxSize      int64
+	maxAge       time.Duration
+	wal          WAL
+	segmentSize  int64
+	segments     []*hintedHandoffQueueSegment
+	file         *os.File
+	readOffset   int64
+	headConsumed int
+	next         *hintedHandoffPosition
+	delivered    int
+	dropped      int
+	ready        chan bool
+	lock         sync.Mutex
+}
+
+type hintedHandoffQueueSegment struct {
+	number    int
+	size      int64
+	entries   int
+	lastWrite time.Time
+}
+
+type hintedHandoffPosition struct {
+	segment int
+	offset  int64
+	size    int64
+}
+
+func openHintedHandoffQueue(dir string, serverId uint32, maxSize int64, maxAge time.Duration, wal WAL) (*HintedHandoffQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segmentSize := int64(HINTED_HANDOFF_MAX_SEGMENT_SIZE)
+	if maxSize > 0 && maxSize/10 < segmentSize {
+		segmentSize = maxSize/10 + 1
+	}
+	self := &HintedHandoffQueue{
+		serverId:    serverId,
+		dir:         dir,
+		maxSize:     maxSize,
+		maxAge:      maxAge,
+		wal:         wal,
+		segmentSize: segmentSize,
+		segments:    make([]*hintedHandoffQueueSegment, 0),
+		ready:       make(chan bool, 1),
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), hintedHandoffSegment) {
+			continue
+		}
+		number, err := strconv.Atoi(strings.TrimPrefix(info.Name(), hintedHandoffSegment))
+		if err != nil {
+			log.Warn("Hinted handoff: ignoring %s in %s", info.Name(), dir)
+			continue
+		}
+		segment := &hintedHandoffQueueSegment{number: number, lastWrite: info.ModTime()}
+		segment.entries, segment.size, err = self.scanSegment(number, info.Size())
+		if err != nil {
+			return nil, err
+		}
+		if segment.size < info.Size() {
+			log.Warn("Hinted handoff: truncating the incomplete entry at the end of %s", self.segmentPath(number))
+			if err := os.Truncate(self.segmentPath(number), segment.size); err != nil {
+				return nil, err
+			}
+		}
+		self.segments = append(self.segments, segment)
+	}
+	sort.Sort(hintedHandoffSegments(self.segments))
+
+	if err := self.readOffsetFile(); err != nil {
+		return nil, err
+	}
+
+	nextNumber := 1
+	if len(self.segments) > 0 {
+		nextNumber = self.segments[len(self.segments)-1].number
+	}
+	if err := self.openSegment(nextNumber); err != nil {
+		return nil, err
+	}
+	if self.entries() > 0 {
+		log.Info("Hinted handoff: %d entries queued for server %d", self.entries(), serverId)
+		self.signalReady()
+	}
+	return self, nil
+}
+
+// Returns a channel that gets a value when new entries got appended.
+func (self *HintedHandoffQueue) Ready() <-chan bool {
+	return self.ready
+}
+
+func (self *HintedHandoffQueue) Append(request *protocol.Request) error {
+	data, err := request.Encode()
+	if err != nil {
+		return err
+	}
+	entry := bytes.NewBuffer(make([]byte, 0, hintedHandoffHeaderSize+len(data)))
+	binary.Write(entry, binary.LittleEndian, uint32(len(data)))
+	binary.Write(entry, binary.LittleEndian, time.Now().UnixNano())
+	entry.Write(data)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.expire()
+	for self.maxSize > 0 && self.entries() > 0 && self.bytes()+int64(entry.Len()) > self.maxSize {
+		log.Warn("Hinted handoff: queue for server %d is full, dropping its oldest entries", self.serverId)
+		if err := self.dropHead(); err != nil {
+			return err
+		}
+	}
+
+	tail := self.segments[len(self.segments)-1]
+	if tail.size >= self.segmentSize {
+		if err := self.openSegment(tail.number + 1); err != nil {
+			return err
+		}
+		tail = self.segments[len(self.segments)-1]
+	}
+	if _, err := self.file.Write(entry.Bytes()); err != nil {
+		return err
+	}
+	if err := self.file.Sync(); err != nil {
+		return err
+	}
+	tail.size += int64(entry.Len())
+	tail.entries += 1
+	tail.lastWrite = time.Now()
+	self.signalReady()
+	return nil
+}
+
+// Returns the oldest request in the queue without removing it, or nil if the queue is
+// empty. Ack removes it once it got delivered.
+func (self *HintedHandoffQueue) Next() (*protocol.Request, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.expire()
+	for len(self.segments) > 1 && self.readOffset >= self.segments[0].size {
+		if err := self.removeHead(); err != nil {
+			return nil, err
+		}
+	}
+	head := self.segments[0]
+	if self.readOffset >= head.size {
+		return nil, nil
+	}
+
+	data, timestamp, err := self.readEntry(head.number, self.readOffset)
+	if err != nil {
+		return nil, err
+	}
+	self.next = &hintedHandoffPosition{head.number, self.readOffset, int64(hintedHandoffHeaderSize + len(data))}
+	request := &protocol.Request{}
+	if err := request.Decode(data); err != nil {
+		// skip the entry, otherwise the queue would be stuck on it forever
+		log.Error("Hinted handoff: dropping entry queued at %s for server %d, it can't be decoded: %s", time.Unix(0, timestamp), self.serverId, err)
+		self.dropped += 1
+		self.consumeNext()
+		self.markResync()
+		return nil, err
+	}
+	return request, nil
+}
+
+// Removes the request returned by the last call to Next from the queue.
+func (self *HintedHandoffQueue) Ack() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.consumeNext() {
+		self.delivered += 1
+	}
+}
+
+func (self *HintedHandoffQueue) Entries() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.entries()
+}
+
+func (self *HintedHandoffQueue) Stats() *HintedHandoffStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stats := &HintedHandoffStats{
+		ServerId:  self.serverId,
+		Entries:   self.entries(),
+		Bytes:     self.bytes(),
+		Delivered: self.delivered,
+		Dropped:   self.dropped,
+	}
+	if head := self.segments[0]; self.readOffset < head.size {
+		if _, timestamp, err := self.readEntry(head.number, self.readOffset); err == nil {
+			stats.OldestEntryAgeSeconds = int64(time.Now().Sub(time.Unix(0, timestamp)).Seconds())
+		}
+	}
+	return stats
+}
+
+func (self *HintedHandoffQueue) Purge() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	entries := self.entries()
+	log.Warn("Hinted handoff: purging %d entries queued for server %d", entries, self.serverId)
+	self.dropped += entries
+	if err := self.clear(); err != nil {
+		return err
+	}
+	if entries > 0 {
+		self.markResync()
+	}
+	return nil
+}
+
+func (self *HintedHandoffQueue) remove() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.file.Close()
+	self.segments = []*hintedHandoffQueueSegment{&hintedHandoffQueueSegment{number: 1}}
+	self.readOffset = 0
+	self.headConsumed = 0
+	self.next = nil
+	return os.RemoveAll(self.dir)
+}
+
+// private methods, they expect the lock to be held
+
+func (self *HintedHandoffQueue) entries() int {
+	entries := -self.headConsumed
+	for _, segment := range self.segments {
+		entries += segment.entries
+	}
+	return entries
+}
+
+func (self *HintedHandoffQueue) bytes() int64 {
+	size := -self.readOffset
+	for _, segment := range self.segments {
+		size += segment.size
+	}
+	return size
+}
+
+func (self *HintedHandoffQueue) signalReady() {
+	select {
+	case self.ready <- true:
+	default:
+	}
+}
+
+func (self *HintedHandoffQueue) consumeNext() bool {
+	next := self.next
+	self.next = nil
+	// the entry could have been dropped since Next returned it
+	if next == nil || next.segment != self.segments[0].number || next.offset != self.readOffset {
+		return false
+	}
+	self.readOffset += next.size
+	self.headConsumed += 1
+	self.writeOffsetFile()
+	return true
+}
+
+// drops the segments that weren't written to for longer than the max age
+func (self *HintedHandoffQueue) expire() {
+	if self.maxAge <= 0 {
+		return
+	}
+	oldest := time.Now().Add(-self.maxAge)
+	for self.entries() > 0 && self.segments[0].lastWrite.Before(oldest) {
+		log.Warn("Hinted handoff: dropping entries for server %d that are older than %s", self.serverId, self.maxAge)
+		if err := self.dropHead(); err != nil {
+			log.Error("Hinted handoff: cannot drop entries for server %d: %s", self.serverId, err)
+			return
+		}
+	}
+}
+
+func (self *HintedHandoffQueue) dropHead() error {
+	head := self.segments[0]
+	if head.entries > self.headConsumed {
+		self.dropped += head.entries - self.headConsumed
+		self.markResync()
+	}
+	if len(self.segments) > 1 {
+		return self.removeHead()
+	}
+	return self.clear()
+}
+
+// the server won't get the dropped requests from the queue, it has to get them from
+// the other copies of its shards
+func (self *HintedHandoffQueue) markResync() {
+	if self.wal == nil {
+		return
+	}
+	if err := self.wal.MarkResync(self.serverId); err != nil {
+		log.Error("Hinted handoff: cannot mark server %d as needing a resync: %s", self.serverId, err)
+	}
+}
+
+func (self *HintedHandoffQueue) removeHead() error {
+	head := self.segments[0]
+	self.segments = self.segments[1:]
+	self.readOffset = 0
+	self.headConsumed = 0
+	self.writeOffsetFile()
+	return os.Remove(self.segmentPath(head.number))
+}
+
+// removes all the segments and starts a new one
+func (self *HintedHandoffQueue) clear() error {
+	self.file.Close()
+	self.file = nil
+	for _, segment := range self.segments {
+		if err := os.Remove(self.segmentPath(segment.number)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	number := self.segments[len(self.segments)-1].number + 1
+	self.segments = self.segments[:0]
+	self.readOffset = 0
+	self.headConsumed = 0
+	self.next = nil
+	if err := self.openSegment(number); err != nil {
+		return err
+	}
+	self.writeOffsetFile()
+	return nil
+}
+
+// opens the segment for appending, adding it to the segments if it's new
+func (self *HintedHandoffQueue) openSegment(number int) error {
+	if self.file != nil {
+		self.file.Close()
+	}
+	file, err := os.OpenFile(self.segmentPath(number), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	self.file = file
+	if len(self.segments) == 0 || self.segments[len(self.segments)-1].number != number {
+		self.segments = append(self.segments, &hintedHandoffQueueSegment{number: number, lastWrite: time.Now()})
+	}
+	return nil
+}
+
+func (self *HintedHandoffQueue) segmentPath(number int) string {
+	return path.Join(self.dir, fmt.Sprintf("%s%d", hintedHandoffSegment, number))
+}
+
+// returns the number of complete entries in the first limit bytes of the segment and
+// their size
+func (self *HintedHandoffQueue) scanSegment(number int, limit int64) (int, int64, error) {
+	file, err := os.Open(self.segmentPath(number))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	entries := 0
+	offset := int64(0)
+	header := make([]byte, hintedHandoffHeaderSize)
+	for offset+hintedHandoffHeaderSize <= limit {
+		if _, err := file.ReadAt(header, offset); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, 0, err
+		}
+		size := int64(hintedHandoffHeaderSize) + int64(binary.LittleEndian.Uint32(header))
+		if offset+size > limit {
+			break
+		}
+		entries += 1
+		offset += size
+	}
+	return entries, offset, nil
+}
+
+func (self *HintedHandoffQueue) readEntry(number int, offset int64) ([]byte, int64, error) {
+	file, err := os.Open(self.segmentPath(number))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, hintedHandoffHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(header))
+	timestamp := int64(binary.LittleEndian.Uint64(header[4:]))
+	if _, err := file.ReadAt(data, offset+hintedHandoffHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	return data, timestamp, nil
+}
+
+func (self *HintedHandoffQueue) readOffsetFile() error {
+	content, err := ioutil.ReadFile(path.Join(self.dir, hintedHandoffOffsetFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var number int
+	var offset int64
+	if _, err := fmt.Sscanf(string(content), "%d %d", &number, &offset); err != nil {
+		return fmt.Errorf("Invalid hinted handoff offset file in %s: %s", self.dir, err)
+	}
+	// the segments before the one being read have already been delivered
+	for len(self.segments) > 0 && self.segments[0].number < number {
+		if err := os.Remove(self.segmentPath(self.segments[0].number)); err != nil {
+			return err
+		}
+		self.segments = self.segments[1:]
+	}
+	if len(self.segments) == 0 || self.segments[0].number != number {
+		return nil
+	}
+
+	self.headConsumed, self.readOffset, err = self.scanSegment(number, offset)
+	if err != nil {
+		return err
+	}
+	if self.readOffset != offset {
+		log.Warn("Hinted handoff: offset %d in %s isn't at the start of an entry, continuing from %d", offset, self.dir, self.readOffset)
+	}
+	return nil
+}
+
+func (self *HintedHandoffQueue) writeOffsetFile() {
+	if err := self.saveOffset(); err != nil {
+		log.Error("Hinted handoff: cannot save the offset of the queue for server %d: %s", self.serverId, err)
+	}
+}
+
+// writes the offset to a temporary file and renames it, so a crash can't leave a
+// partially written offset file behind
+func (self *HintedHandoffQueue) saveOffset() error {
+	content := fmt.Sprintf("%d %d", self.segments[0].number, self.readOffset)
+	filename := path.Join(self.dir, hintedHandoffOffsetFile)
+	file, err := os.OpenFile(filename+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+type hintedHandoffSegments []*hintedHandoffQueueSegment
+
+func (self hintedHandoffSegments) Len() int           { return len(self) }
+func (self hintedHandoffSegments) Less(i, j int) bool { return self[i].number < self[j].number }
+func (self hintedHandoffSegments) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
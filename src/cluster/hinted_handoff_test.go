@@ -0,0 +1,119 @@
+package cluster
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"protocol"
+	"time"
+)
+
+type HintedHandoffSuite struct {
+	dir string
+}
+
+var _ = Suite(&HintedHandoffSuite{})
+
+func (self *HintedHandoffSuite) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "hinted_handoff")
+	c.Assert(err, IsNil)
+	self.dir = dir
+}
+
+func (self *HintedHandoffSuite) TearDownTest(c *C) {
+	os.RemoveAll(self.dir)
+}
+
+func newHintedHandoffRequest(requestNumber uint32) *protocol.Request {
+	request := newWriteRequest()
+	request.RequestNumber = &requestNumber
+	return request
+}
+
+func (self *HintedHandoffSuite) TestDeliversInOrderAcrossRestarts(c *C) {
+	queue, err := NewHintedHandoff(self.dir, 0, 0, nil).Queue(2)
+	c.Assert(err, IsNil)
+	for i := uint32(1); i <= 3; i++ {
+		c.Assert(queue.Append(newHintedHandoffRequest(i)), IsNil)
+	}
+	c.Assert(queue.Entries(), Equals, 3)
+
+	request, err := queue.Next()
+	c.Assert(err, IsNil)
+	c.Assert(request.GetRequestNumber(), Equals, uint32(1))
+	queue.Ack()
+
+	// a new process should continue where the old one left off
+	queue, err = NewHintedHandoff(self.dir, 0, 0, nil).Queue(2)
+	c.Assert(err, IsNil)
+	c.Assert(queue.Entries(), Equals, 2)
+	for i := uint32(2); i <= 3; i++ {
+		request, err := queue.Next()
+		c.Assert(err, IsNil)
+		c.Assert(request.GetRequestNumber(), Equals, i)
+		queue.Ack()
+	}
+	request, err = queue.Next()
+	c.Assert(err, IsNil)
+	c.Assert(request, IsNil)
+
+	stats := queue.Stats()
+	c.Assert(stats.Entries, Equals, 0)
+	c.Assert(stats.Delivered, Equals, 2)
+}
+
+func (self *HintedHandoffSuite) TestDropsOldestEntriesWhenFull(c *C) {
+	data, err := newHintedHandoffRequest(1).Encode()
+	c.Assert(err, IsNil)
+	entrySize := int64(hintedHandoffHeaderSize + len(data))
+
+	writeLog := &walMock{}
+	queue, err := NewHintedHandoff(self.dir, 3*entrySize, 0, writeLog).Queue(2)
+	c.Assert(err, IsNil)
+	for i := uint32(1); i <= 5; i++ {
+		c.Assert(queue.Append(newHintedHandoffRequest(i)), IsNil)
+	}
+
+	stats := queue.Stats()
+	c.Assert(stats.Bytes <= 3*entrySize, Equals, true)
+	c.Assert(stats.Entries+stats.Dropped, Equals, 5)
+	request, err := queue.Next()
+	c.Assert(err, IsNil)
+	c.Assert(request.GetRequestNumber(), Equals, uint32(stats.Dropped+1))
+	c.Assert(writeLog.resyncs, Not(HasLen), 0)
+	c.Assert(writeLog.resyncs[0], Equals, uint32(2))
+}
+
+func (self *HintedHandoffSuite) TestDropsExpiredEntries(c *C) {
+	writeLog := &walMock{}
+	queue, err := NewHintedHandoff(self.dir, 0, 50*time.Millisecond, writeLog).Queue(2)
+	c.Assert(err, IsNil)
+	c.Assert(queue.Append(newHintedHandoffRequest(1)), IsNil)
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(queue.Append(newHintedHandoffRequest(2)), IsNil)
+
+	request, err := queue.Next()
+	c.Assert(err, IsNil)
+	c.Assert(request.GetRequestNumber(), Equals, uint32(2))
+	c.Assert(queue.Stats().Dropped, Equals, 1)
+	c.Assert(writeLog.resyncs, DeepEquals, []uint32{2})
+}
+
+func (self *HintedHandoffSuite) TestPurge(c *C) {
+	hintedHandoff := NewHintedHandoff(self.dir, 0, 0, nil)
+	c.Assert(hintedHandoff.Purge(2), NotNil)
+
+	queue, err := hintedHandoff.Queue(2)
+	c.Assert(err, IsNil)
+	c.Assert(queue.Append(newHintedHandoffRequest(1)), IsNil)
+	c.Assert(hintedHandoff.Purge(2), IsNil)
+
+	stats := hintedHandoff.Stats()
+	c.Assert(stats, HasLen, 1)
+	c.Assert(stats[0].Entries, Equals, 0)
+	c.Assert(stats[0].Dropped, Equals, 1)
+
+	queue, err = NewHintedHandoff(self.dir, 0, 0, nil).Queue(2)
+	c.Assert(err, IsNil)
+	c.Assert(queue.Entries(), Equals, 0)
+}
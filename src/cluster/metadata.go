@@ -0,0 +1,135 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Bumped when the format of the exported metadata changes in a way older versions
+// can't import
+const METADATA_VERSION = 1
+
+// The cluster metadata as it gets exported. The servers and shards describe the
+// cluster the metadata was exported from, they don't get imported. The data of
+// the shards has to be restored from shard backups.
+type ClusterMetadata struct {
+	Version           int                           `json:"version"`
+	ExportedAt        time.Time                     `json:"exportedAt"`
+	Databases         []*Database                   `json:"databases"`
+	ClusterAdmins     []*ClusterAdmin               `json:"clusterAdmins"`
+	DbUsers           []*DbUser                     `json:"dbUsers"`
+	ContinuousQueries map[string][]*ContinuousQuery `json:"continuousQueries"`
+	Servers           []*ServerMetadata             `json:"servers"`
+	Shards            []*NewShardData               `json:"shards"`
+}
+
+type ServerMetadata struct {
+	Id                       uint32 `json:"id"`
+	RaftName                 string `json:"raftName"`
+	RaftConnectionString     string `json:"raftConnectionString"`
+	ProtobufConnectionString string `json:"protobufConnectionString"`
+}
+
+// What an import changed. Existing databases and continuous queries are left
+// alone, users get overwritten.
+type MetadataImportResult struct {
+	CreatedDatabases         []string `json:"createdDatabases"`
+	SkippedDatabases         []string `json:"skippedDatabases"`
+	SavedClusterAdmins       []string `json:"savedClusterAdmins"`
+	SavedDbUsers             []string `json:"savedDbUsers"`
+	CreatedContinuousQueries int      `json:"createdContinuousQueries"`
+	SkippedContinuousQueries int      `json:"skippedContinuousQueries"`
+}
+
+func (self *ClusterConfiguration) ExportMetadata() *ClusterMetadata {
+	metadata := &ClusterMetadata{
+		Version:           METADATA_VERSION,
+		ExportedAt:        time.Now().UTC(),
+		Databases:         self.GetDatabases(),
+		ClusterAdmins:     []*ClusterAdmin{},
+		DbUsers:           []*DbUser{},
+		ContinuousQueries: map[string][]*ContinuousQuery{},
+		Servers:           []*ServerMetadata{},
+	}
+	sort.Sort(databasesByName(metadata.Databases))
+
+	self.usersLock.RLock()
+	for _, admin := range self.clusterAdmins {
+		metadata.ClusterAdmins = append(metadata.ClusterAdmins, admin)
+	}
+	for _, dbUsers := range self.dbUsers {
+		for _, dbUser := range dbUsers {
+			metadata.DbUsers = append(metadata.DbUsers, dbUser)
+		}
+	}
+	self.usersLock.RUnlock()
+	sort.Sort(clusterAdminsByName(metadata.ClusterAdmins))
+	sort.Sort(dbUsersByName(metadata.DbUsers))
+
+	for _, database := range metadata.Databases {
+		if queries := self.GetContinuousQueries(database.Name); len(queries) > 0 {
+			metadata.ContinuousQueries[database.Name] = queries
+		}
+	}
+
+	for _, server := range self.Servers() {
+		metadata.Servers = append(metadata.Servers, &ServerMetadata{
+			Id:                       server.Id,
+			RaftName:                 server.RaftName,
+			RaftConnectionString:     server.RaftConnectionString,
+			ProtobufConnectionString: server.ProtobufConnectionString,
+		})
+	}
+
+	self.shardLock.Lock()
+	metadata.Shards = append(self.convertShardsToNewShardData(self.shortTermShards), self.convertShardsToNewShardData(self.longTermShards)...)
+	self.shardLock.Unlock()
+	return metadata
+}
+
+// Checks that the metadata can be imported by this version
+func (self *ClusterMetadata) Validate() error {
+	if self.Version < 1 || self.Version > METADATA_VERSION {
+		return fmt.Errorf("Unsupported cluster metadata version %d, the supported versions are 1 to %d", self.Version, METADATA_VERSION)
+	}
+	for _, database := range self.Databases {
+		if database.Name == "" {
+			return fmt.Errorf("Cluster metadata has a database without a name")
+		}
+	}
+	for _, user := range self.ClusterAdmins {
+		if user.Name == "" || user.Hash == "" {
+			return fmt.Errorf("Cluster metadata has a cluster admin without a name or password hash")
+		}
+	}
+	for _, user := range self.DbUsers {
+		if user.Name == "" || user.Hash == "" || user.Db == "" {
+			return fmt.Errorf("Cluster metadata has a database user without a name, database or password hash")
+		}
+	}
+	return nil
+}
+
+type databasesByName []*Database
+
+func (self databasesByName) Len() int           { return len(self) }
+func (self databasesByName) Less(i, j int) bool { return self[i].Name < self[j].Name }
+func (self databasesByName) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+type clusterAdminsByName []*ClusterAdmin
+
+func (self clusterAdminsByName) Len() int           { return len(self) }
+func (self clusterAdminsByName) Less(i, j int) bool { return self[i].Name < self[j].Name }
+func (self clusterAdminsByName) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+type dbUsersByName []*DbUser
+
+func (self dbUsersByName) Len() int { return len(self) }
+func (self dbUsersByName) Less(i, j int) bool {
+	if self[i].Db != self[j].Db {
+		return self[i].Db < self[j].Db
+	}
+	return self[i].Name < self[j].Name
+}
+func (self dbUsersByName) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"configuration"
+	"encoding/json"
+	. "launchpad.net/gocheck"
+)
+
+type MetadataSuite struct{}
+
+var _ = Suite(&MetadataSuite{})
+
+func (self *MetadataSuite) TestExportRoundTrip(c *C) {
+	config := NewClusterConfiguration(&configuration.Configuration{}, nil, nil, nil)
+	c.Assert(config.CreateDatabase("db2", 2), IsNil)
+	c.Assert(config.CreateDatabase("db1", 1), IsNil)
+	config.SaveClusterAdmin(&ClusterAdmin{CommonUser{Name: "root", Hash: "roothash", CacheKey: "root"}})
+	config.SaveDbUser(&DbUser{
+		CommonUser: CommonUser{Name: "paul", Hash: "paulhash", CacheKey: "db1%paul"},
+		Db:         "db1",
+		ReadFrom:   []*Matcher{{true, ".*"}},
+		WriteTo:    []*Matcher{{false, "foo"}},
+		IsAdmin:    true,
+	})
+	c.Assert(config.CreateContinuousQuery("db1", "select * from foo into bar"), IsNil)
+
+	data, err := json.Marshal(config.ExportMetadata())
+	c.Assert(err, IsNil)
+	metadata := &ClusterMetadata{}
+	c.Assert(json.Unmarshal(data, metadata), IsNil)
+	c.Assert(metadata.Validate(), IsNil)
+
+	c.Assert(metadata.Version, Equals, METADATA_VERSION)
+	c.Assert(metadata.Databases, DeepEquals, []*Database{{"db1", 1}, {"db2", 2}})
+	c.Assert(metadata.ClusterAdmins, HasLen, 1)
+	c.Assert(metadata.ClusterAdmins[0].Hash, Equals, "roothash")
+	c.Assert(metadata.DbUsers, HasLen, 1)
+	user := metadata.DbUsers[0]
+	c.Assert(user.Db, Equals, "db1")
+	c.Assert(user.Hash, Equals, "paulhash")
+	c.Assert(user.IsDbAdmin("db1"), Equals, true)
+	c.Assert(user.HasReadAccess("anything"), Equals, true)
+	c.Assert(user.HasWriteAccess("bar"), Equals, false)
+	c.Assert(metadata.ContinuousQueries["db1"], DeepEquals, []*ContinuousQuery{{1, "select * from foo into bar"}})
+}
+
+func (self *MetadataSuite) TestValidate(c *C) {
+	metadata := &ClusterMetadata{Version: METADATA_VERSION + 1}
+	c.Assert(metadata.Validate(), ErrorMatches, "Unsupported cluster metadata version.*")
+
+	metadata = &ClusterMetadata{Version: METADATA_VERSION, DbUsers: []*DbUser{{CommonUser: CommonUser{Name: "paul", Hash: "hash"}}}}
+	c.Assert(metadata.Validate(), ErrorMatches, ".*without a name, database or password hash")
+}
@@ -0,0 +1,82 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	p "protocol"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+const (
+	RESYNC_CHECK_INTERVAL = time.Minute
+	// how long a server gets to repair its shards, requests to other servers time
+	// out after 20 minutes anyway
+	RESYNC_TIMEOUT = 20 * time.Minute
+)
+
+var resyncRequest = p.Request_RESYNC
+
+// The wal drops its oldest log files once it gets bigger or older than the retention
+// allows. The servers that missed requests in them can't be brought up to date by
+// replaying the wal anymore, they're asked to repair their shards with anti entropy
+// instead as soon as they're up. The resync is only cleared once the repair finished
+// without errors, otherwise it's retried. The requests logged after the repair
+// started may have missed it, they're still replayed to the server.
+func (self *ClusterConfiguration) resyncServersPeriodically() {
+	for {
+		self.resyncServers()
+		time.Sleep(RESYNC_CHECK_INTERVAL)
+	}
+}
+
+func (self *ClusterConfiguration) resyncServers() {
+	for _, serverId := range self.wal.ServersNeedingResync() {
+		requestNumber := self.wal.LargestRequestNumber()
+		if err := self.resyncServer(serverId); err != nil {
+			log.Warn("Cannot resync server %d yet: %s", serverId, err)
+			continue
+		}
+		if err := self.wal.ClearResync(serverId, requestNumber); err != nil {
+			log.Error("Cannot clear the resync of server %d: %s", serverId, err)
+		}
+	}
+}
+
+// Runs the anti entropy repair of the shards of the server and waits for it
+func (self *ClusterConfiguration) resyncServer(serverId uint32) error {
+	if serverId == self.LocalServerId {
+		log.Info("Resyncing the local shards")
+		return self.RepairShardsAndWait()
+	}
+
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		log.Info("Server %d needs a resync but isn't in the cluster anymore", serverId)
+		return nil
+	}
+	if !server.IsUp() {
+		return fmt.Errorf("the server is down")
+	}
+
+	log.Info("Asking server %d to resync its shards", serverId)
+	request := &p.Request{Type: &resyncRequest, Database: p.String("")}
+	responses := make(chan *p.Response, 1)
+	server.MakeRequest(request, responses)
+	timeout := time.After(RESYNC_TIMEOUT)
+	for {
+		select {
+		case response := <-responses:
+			if response.GetType() != p.Response_END_STREAM {
+				continue
+			}
+			if response.ErrorMessage != nil {
+				return errors.New(response.GetErrorMessage())
+			}
+			return nil
+		case <-timeout:
+			return fmt.Errorf("the repair didn't finish in %s", RESYNC_TIMEOUT)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	p "protocol"
+	"regexp"
+	"sort"
+	"sync"
+
+	log "code.google.com/p/log4go"
+)
+
+var listSeriesRequest = p.Request_LIST_SERIES
+
+// What the cluster knows about a series, merged from the series indexes of the
+// servers. The times are in microseconds, the point count is an estimate.
+type SeriesInfo struct {
+	Name string `json:"name"`
+	// sorted, the types are in the same order
+	Columns     []string `json:"columns"`
+	ColumnTypes []string `json:"columnTypes"`
+	FirstSeen   int64    `json:"firstSeen"`
+	LastSeen    int64    `json:"lastSeen"`
+	PointCount  uint64   `json:"pointCount"`
+	seen        bool
+}
+
+// Returns the series of the database that match the regex sorted by name, all the
+// series match a nil regex. Every shard only has to be in the series index of one of
+// the servers with a copy of it, an error is returned if none of them answered
+// instead of leaving the series of the shard out.
+func (self *ClusterConfiguration) ListSeries(database string, regex *regexp.Regexp) ([]*SeriesInfo, error) {
+	servers := make([]*ClusterServer, 0)
+	for _, server := range self.Servers() {
+		if server.Id != self.LocalServerId && server.IsUp() {
+			servers = append(servers, server)
+		}
+	}
+
+	results := make(chan []*p.SeriesInfo, len(servers)+1)
+	answered := make(chan uint32, len(servers)+1)
+	var wait sync.WaitGroup
+	for _, server := range servers {
+		wait.Add(1)
+		go func(server *ClusterServer) {
+			defer wait.Done()
+			infos, err := self.remoteSeriesInfo(server, database, regex)
+			if err != nil {
+				log.Error("Cannot list the series of database %s on server %d: %s", database, server.Id, err)
+				return
+			}
+			results <- infos
+			answered <- server.Id
+		}(server)
+	}
+	results <- self.LocalSeriesInfo(database, regex)
+	answered <- self.LocalServerId
+	wait.Wait()
+	close(results)
+	close(answered)
+
+	answeredIds := make(map[uint32]bool)
+	for id := range answered {
+		answeredIds[id] = true
+	}
+	if missing := self.shardsWithoutCopyOn(answeredIds); len(missing) > 0 {
+		return nil, fmt.Errorf("Cannot list the series of database %s, no server with a copy of shards %v answered", database, missing)
+	}
+
+	// every copy of a shard has an entry for its series, they're merged before the
+	// entries of the different shards get added up
+	byShard := make(map[string]map[uint32]*SeriesInfo)
+	for infos := range results {
+		for _, info := range infos {
+			if self.GetShardById(info.GetShardId()) == nil {
+				continue
+			}
+			shards := byShard[info.GetName()]
+			if shards == nil {
+				shards = make(map[uint32]*SeriesInfo)
+				byShard[info.GetName()] = shards
+			}
+			series := shards[info.GetShardId()]
+			if series == nil {
+				series = &SeriesInfo{Name: info.GetName()}
+				shards[info.GetShardId()] = series
+			}
+			series.merge(info.Columns, info.ColumnTypes, info.FirstSeen != nil, info.GetFirstSeen(), info.GetLastSeen())
+			if info.GetPointCount() > series.PointCount {
+				series.PointCount = info.GetPointCount()
+			}
+		}
+	}
+
+	series := make([]*SeriesInfo, 0, len(byShard))
+	for name, shards := range byShard {
+		merged := &SeriesInfo{Name: name, Columns: []string{}, ColumnTypes: []string{}}
+		for _, shard := range shards {
+			merged.merge(shard.Columns, shard.ColumnTypes, shard.seen, shard.FirstSeen, shard.LastSeen)
+			merged.PointCount += shard.PointCount
+		}
+		series = append(series, merged)
+	}
+	sort.Sort(seriesInfoByName(series))
+	return series, nil
+}
+
+// Returns the ids of the shards that don't have a copy on any of the given servers.
+// Copies that are still being backfilled don't count, their index is incomplete.
+func (self *ClusterConfiguration) shardsWithoutCopyOn(serverIds map[uint32]bool) []uint32 {
+	missing := make([]uint32, 0)
+	for _, shard := range self.GetAllShards() {
+		servers, store := shard.queryableCopies()
+		covered := store != nil && serverIds[self.LocalServerId]
+		for _, server := range servers {
+			covered = covered || serverIds[server.Id]
+		}
+		if !covered {
+			missing = append(missing, shard.Id())
+		}
+	}
+	return missing
+}
+
+// Returns the entries of the series index of this server
+func (self *ClusterConfiguration) LocalSeriesInfo(database string, regex *regexp.Regexp) []*p.SeriesInfo {
+	return self.shardStore.ListSeries(database, regex)
+}
+
+func (self *SeriesInfo) merge(columns, columnTypes []string, seen bool, firstSeen, lastSeen int64) {
+	for columnIndex, column := range columns {
+		columnType := ""
+		if columnIndex < len(columnTypes) {
+			columnType = columnTypes[columnIndex]
+		}
+		i := sort.SearchStrings(self.Columns, column)
+		if i < len(self.Columns) && self.Columns[i] == column {
+			self.ColumnTypes[i] = p.MergeColumnTypes(self.ColumnTypes[i], columnType)
+			continue
+		}
+		self.Columns = append(self.Columns, "")
+		copy(self.Columns[i+1:], self.Columns[i:])
+		self.Columns[i] = column
+		self.ColumnTypes = append(self.ColumnTypes, "")
+		copy(self.ColumnTypes[i+1:], self.ColumnTypes[i:])
+		self.ColumnTypes[i] = columnType
+	}
+	if !seen {
+		return
+	}
+	if !self.seen || firstSeen < self.FirstSeen {
+		self.FirstSeen = firstSeen
+	}
+	if !self.seen || lastSeen > self.LastSeen {
+		self.LastSeen = lastSeen
+	}
+	self.seen = true
+}
+
+func (self *ClusterConfiguration) remoteSeriesInfo(server *ClusterServer, database string, regex *regexp.Regexp) ([]*p.SeriesInfo, error) {
+	request := &p.Request{Type: &listSeriesRequest, Database: &database}
+	if regex != nil {
+		request.Query = p.String(regex.String())
+	}
+	responses := make(chan *p.Response, self.config.QueryShardBufferSize)
+	server.MakeRequest(request, responses)
+	infos := make([]*p.SeriesInfo, 0)
+	for {
+		response := <-responses
+		switch response.GetType() {
+		case p.Response_SERIES_INFO:
+			infos = append(infos, response.SeriesInfo...)
+		case p.Response_END_STREAM:
+			if response.ErrorMessage != nil {
+				return nil, errors.New(response.GetErrorMessage())
+			}
+			return infos, nil
+		}
+	}
+}
+
+type seriesInfoByName []*SeriesInfo
+
+func (self seriesInfoByName) Len() int           { return len(self) }
+func (self seriesInfoByName) Less(i, j int) bool { return self[i].Name < self[j].Name }
+func (self seriesInfoByName) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
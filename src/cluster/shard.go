@@ -3,11 +3,15 @@ package cluster
 import (
 	"common"
 	"engine"
+	"errors"
 	"fmt"
+	"io"
 	"parser"
 	p "protocol"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"wal"
 
@@ -23,6 +27,7 @@ type Shard interface {
 	StartTime() time.Time
 	EndTime() time.Time
 	Write(*p.Request) error
+	WriteWithConsistency(request *p.Request, consistency WriteConsistency, timeout time.Duration) error
 	Query(querySpec *parser.QuerySpec, response chan *p.Response)
 	IsMicrosecondInRange(t int64) bool
 }
@@ -74,6 +79,13 @@ type ShardData struct {
 	shardDuration   time.Duration
 	localServerId   uint32
 	IsLocal         bool
+	// the copies that replaced a server and don't have its data yet, they don't
+	// answer queries until FinishBackfill is called for them
+	backfilling map[uint32]bool
+	// guards the copies of the shard: servers, clusterServers, serverIds, store,
+	// IsLocal and backfilling. They're replaced instead of modified, so the slices
+	// can be used after the lock is released.
+	serversLock sync.RWMutex
 }
 
 func NewShard(id uint32, startTime, endTime time.Time, shardType ShardType, durationIsSplit bool, wal WAL) *ShardData {
@@ -85,6 +97,7 @@ func NewShard(id uint32, startTime, endTime time.Time, shardType ShardType, dura
 		startMicro:      common.TimeToMicroseconds(startTime),
 		endMicro:        common.TimeToMicroseconds(endTime),
 		serverIds:       make([]uint32, 0),
+		backfilling:     make(map[uint32]bool),
 		shardType:       shardType,
 		durationIsSplit: durationIsSplit,
 		shardDuration:   endTime.Sub(startTime),
@@ -101,6 +114,7 @@ var (
 	endStreamResponse    = p.Response_END_STREAM
 	accessDeniedResponse = p.Response_ACCESS_DENIED
 	queryRequest         = p.Request_QUERY
+	writeRequest         = p.Request_WRITE
 	dropDatabaseRequest  = p.Request_DROP_DATABASE
 )
 
@@ -115,9 +129,19 @@ type LocalShardStore interface {
 	Write(request *p.Request) error
 	SetWriteBuffer(writeBuffer *WriteBuffer)
 	BufferWrite(request *p.Request)
+	BufferWriteAndNotify(request *p.Request, acks chan<- uint32)
+	StopNotifying(requestNumber uint32, acks chan<- uint32)
 	GetOrCreateShard(id uint32) (LocalShardDb, error)
+	// Shards get opened with the options of their type, short term until it's set
+	SetShardType(id uint32, shardType ShardType)
 	ReturnShard(id uint32)
 	DeleteShard(shardId uint32) error
+	BackupShard(id uint32, info *ShardBackupInfo, w io.Writer) error
+	RestoreShard(id uint32, r io.Reader, validate func(info *ShardBackupInfo) error) error
+	ListSeries(database string, regex *regexp.Regexp) []*p.SeriesInfo
+	CompactShard(id uint32, database string, progress func(compacted, total int)) error
+	DropShardDatabase(id uint32, database string, matches func(series string) bool) (bool, error)
+	ShardStats() []*p.ShardStats
 }
 
 func (self *ShardData) Id() uint32 {
@@ -145,21 +169,38 @@ func (self *ShardData) IsMicrosecondInRange(t int64) bool {
 }
 
 func (self *ShardData) SetServers(servers []*ClusterServer) {
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	self.setServers(servers)
+}
+
+func (self *ShardData) setServers(servers []*ClusterServer) {
 	self.clusterServers = servers
 	self.servers = make([]wal.Server, len(servers), len(servers))
+	serverIds := make([]uint32, 0, len(self.serverIds)+len(servers))
+	serverIds = append(serverIds, self.serverIds...)
 	for i, server := range servers {
-		self.serverIds = append(self.serverIds, server.Id)
+		serverIds = append(serverIds, server.Id)
 		self.servers[i] = server
 	}
+	self.serverIds = serverIds
 	self.sortServerIds()
 }
 
 func (self *ShardData) SetLocalStore(store LocalShardStore, localServerId uint32) error {
-	self.serverIds = append(self.serverIds, localServerId)
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	return self.setLocalStore(store, localServerId)
+}
+
+func (self *ShardData) setLocalStore(store LocalShardStore, localServerId uint32) error {
+	serverIds := make([]uint32, 0, len(self.serverIds)+1)
+	self.serverIds = append(append(serverIds, self.serverIds...), localServerId)
 	self.localServerId = localServerId
 	self.sortServerIds()
 
 	self.store = store
+	self.store.SetShardType(self.id, self.shardType)
 	// make sure we can open up the shard
 	_, err := self.store.GetOrCreateShard(self.id)
 	if err != nil {
@@ -172,29 +213,267 @@ func (self *ShardData) SetLocalStore(store LocalShardStore, localServerId uint32
 }
 
 func (self *ShardData) ServerIds() []uint32 {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
 	return self.serverIds
 }
 
+// Returns the other servers that have a copy of the shard and the local store, nil
+// if there's no local copy.
+func (self *ShardData) copies() ([]*ClusterServer, LocalShardStore) {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	return self.clusterServers, self.store
+}
+
+// Like copies, but leaves out the copies that are still being backfilled, they'd
+// return partial data.
+func (self *ShardData) queryableCopies() ([]*ClusterServer, LocalShardStore) {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	servers := make([]*ClusterServer, 0, len(self.clusterServers))
+	for _, server := range self.clusterServers {
+		if !self.backfilling[server.Id] {
+			servers = append(servers, server)
+		}
+	}
+	if self.IsLocal && !self.backfilling[self.localServerId] {
+		return servers, self.store
+	}
+	return servers, nil
+}
+
+// Keeps queries off the server's copy of the shard until FinishBackfill is called.
+func (self *ShardData) StartBackfill(serverId uint32) {
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	self.backfilling[serverId] = true
+}
+
+// Called once the server that replaced another one copied the data of the shard,
+// queries can go to its copy from now on.
+func (self *ShardData) FinishBackfill(serverId uint32) {
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	delete(self.backfilling, serverId)
+}
+
+func (self *ShardData) HasServer(serverId uint32) bool {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	return self.hasServer(serverId)
+}
+
+func (self *ShardData) hasServer(serverId uint32) bool {
+	for _, id := range self.serverIds {
+		if id == serverId {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds a server to the list of servers that hold a copy of this shard. If the
+// server is the local one the shard gets opened in the local store. It's up to the
+// caller to copy the existing data over.
+func (self *ShardData) AddServer(server *ClusterServer, store LocalShardStore, localServerId uint32) error {
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	return self.addServer(server, store, localServerId)
+}
+
+func (self *ShardData) addServer(server *ClusterServer, store LocalShardStore, localServerId uint32) error {
+	if self.hasServer(server.Id) {
+		return nil
+	}
+	if server.Id == localServerId {
+		return self.setLocalStore(store, localServerId)
+	}
+	servers := make([]*ClusterServer, 0, len(self.clusterServers)+1)
+	self.serverIds = make([]uint32, 0, len(servers)+1)
+	self.setServers(append(append(servers, self.clusterServers...), server))
+	if self.IsLocal {
+		self.serverIds = append(self.serverIds, self.localServerId)
+		self.sortServerIds()
+	}
+	return nil
+}
+
+// Takes the given servers out of the list of servers that hold a copy of this
+// shard, so writes and queries stop going to them.
+func (self *ShardData) RemoveServers(serverIds []uint32) {
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	self.removeServers(serverIds)
+}
+
+func (self *ShardData) removeServers(serverIds []uint32) {
+	isRemoved := func(id uint32) bool {
+		for _, removeId := range serverIds {
+			if id == removeId {
+				return true
+			}
+		}
+		return false
+	}
+
+	servers := make([]*ClusterServer, 0, len(self.clusterServers))
+	for _, server := range self.clusterServers {
+		if !isRemoved(server.Id) {
+			servers = append(servers, server)
+		}
+	}
+
+	for _, id := range serverIds {
+		delete(self.backfilling, id)
+	}
+	isLocal := self.IsLocal && !isRemoved(self.localServerId)
+	self.serverIds = make([]uint32, 0, len(servers)+1)
+	self.setServers(servers)
+	if isLocal {
+		self.serverIds = append(self.serverIds, self.localServerId)
+		self.sortServerIds()
+		return
+	}
+	self.IsLocal = false
+	self.store = nil
+}
+
+// Swaps the old server for the replacement in the list of servers that
+// hold a copy of this shard. If the replacement is the local server the
+// shard gets opened in the local store, it's up to the caller to backfill it.
+// The replacement gets the writes right away, but queries keep going to the
+// other copies until FinishBackfill is called for it.
+func (self *ShardData) ReplaceServer(oldServerId uint32, replacement *ClusterServer, store LocalShardStore, localServerId uint32) error {
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	if !self.hasServer(oldServerId) {
+		return fmt.Errorf("Server %d doesn't have a copy of shard %d", oldServerId, self.id)
+	}
+	if self.hasServer(replacement.Id) {
+		return fmt.Errorf("Server %d already has a copy of shard %d", replacement.Id, self.id)
+	}
+
+	self.removeServers([]uint32{oldServerId})
+	if err := self.addServer(replacement, store, localServerId); err != nil {
+		return err
+	}
+	self.backfilling[replacement.Id] = true
+	return nil
+}
+
+// Copies the data for the given databases into the local store from one of the
+// other servers that has a copy of this shard. The points keep their timestamps
+// and sequence numbers, so backfilling a range that's already there is harmless.
+func (self *ShardData) Backfill(databases []string, user common.User, bufferSize int) error {
+	_, store := self.copies()
+	if store == nil {
+		return fmt.Errorf("Cannot backfill shard %d, it isn't stored on this server", self.id)
+	}
+
+	for _, database := range databases {
+		if err := self.copyDatabaseFromServers(database, user, store, self.localServerId, bufferSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the data for the given databases to the destination server. The data is
+// read from the local store if this server has a copy of the shard, otherwise it's
+// read from one of the other servers that have one.
+func (self *ShardData) CopyData(databases []string, user common.User, destination Writer, destinationId uint32, bufferSize int) error {
+	_, store := self.queryableCopies()
+	for _, database := range databases {
+		var err error
+		if store != nil && self.localServerId != destinationId {
+			err = self.copyDatabaseFromLocalStore(database, user, destination, bufferSize)
+		} else {
+			err = self.copyDatabaseFromServers(database, user, destination, destinationId, bufferSize)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (self *ShardData) Write(request *p.Request) error {
+	return self.WriteWithConsistency(request, WriteConsistencyAny, 0)
+}
+
+// Logs the write and buffers it for every copy of the shard. Unless the consistency is
+// any, it waits until the write is fsynced to the log and enough copies acknowledged
+// it or the timeout expires, in which case a *PartialWriteError is returned.
+func (self *ShardData) WriteWithConsistency(request *p.Request, consistency WriteConsistency, timeout time.Duration) error {
 	request.ShardId = &self.id
-	requestNumber, err := self.wal.AssignSequenceNumbersAndLog(request, self)
+	var requestNumber uint32
+	var err error
+	if consistency == WriteConsistencyAny {
+		requestNumber, err = self.wal.AssignSequenceNumbersAndLog(request, self)
+	} else {
+		requestNumber, err = self.wal.AssignSequenceNumbersAndLogAndSync(request, self)
+	}
 	if err != nil {
 		return err
 	}
 	request.RequestNumber = &requestNumber
-	if self.store != nil {
-		self.store.BufferWrite(request)
+
+	servers, store := self.copies()
+	copies := len(servers)
+	if store != nil {
+		copies += 1
 	}
-	for _, server := range self.clusterServers {
+	requiredAcks := consistency.RequiredAcks(copies)
+	var acks chan uint32
+	if requiredAcks > 0 {
+		acks = make(chan uint32, copies)
+	}
+
+	if store != nil {
+		if acks != nil {
+			store.BufferWriteAndNotify(request, acks)
+		} else {
+			store.BufferWrite(request)
+		}
+	}
+	for _, server := range servers {
 		// we have to create a new reqeust object because the ID gets assigned on each server.
 		requestWithoutId := &p.Request{Type: request.Type, Database: request.Database, Series: request.Series, ShardId: &self.id, RequestNumber: request.RequestNumber}
-		server.BufferWrite(requestWithoutId)
+		if acks != nil {
+			server.BufferWriteAndNotify(requestWithoutId, acks)
+		} else {
+			server.BufferWrite(requestWithoutId)
+		}
+	}
+
+	if requiredAcks == 0 {
+		return nil
+	}
+	// the copies that didn't ack by the time we return may never do
+	defer func() {
+		if store != nil {
+			store.StopNotifying(requestNumber, acks)
+		}
+		for _, server := range servers {
+			server.StopNotifying(requestNumber, acks)
+		}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for received := 0; received < requiredAcks; received++ {
+		select {
+		case <-acks:
+		case <-timer.C:
+			return &PartialWriteError{ShardId: self.id, Consistency: consistency, Acks: received, RequiredAcks: requiredAcks}
+		}
 	}
 	return nil
 }
 
 func (self *ShardData) WriteLocalOnly(request *p.Request) error {
-	self.store.Write(request)
+	_, store := self.copies()
+	store.Write(request)
 	return nil
 }
 
@@ -209,7 +488,8 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 		}
 	}
 
-	if self.IsLocal {
+	servers, store := self.queryableCopies()
+	if store != nil {
 		var processor QueryProcessor
 		var err error
 
@@ -228,7 +508,7 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 					log.Error("Error while creating engine: %s", err)
 					return
 				}
-				processor.SetShardInfo(int(self.Id()), self.IsLocal)
+				processor.SetShardInfo(int(self.Id()), true)
 			} else if query.HasAggregates() {
 				maxPointsToBufferBeforeSending := 1000
 				log.Debug("creating a passthrough engine\n")
@@ -240,13 +520,13 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 			}
 			processor = engine.NewFilteringEngine(query, processor)
 		}
-		shard, err := self.store.GetOrCreateShard(self.id)
+		shard, err := store.GetOrCreateShard(self.id)
 		if err != nil {
 			response <- &p.Response{Type: &endStreamResponse, ErrorMessage: p.String(err.Error())}
 			log.Error("Error while getting shards: %s", err)
 			return
 		}
-		defer self.store.ReturnShard(self.id)
+		defer store.ReturnShard(self.id)
 		err = shard.Query(querySpec, processor)
 		processor.Close()
 		if err != nil {
@@ -256,8 +536,8 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 		return
 	}
 
-	healthyServers := make([]*ClusterServer, 0, len(self.clusterServers))
-	for _, s := range self.clusterServers {
+	healthyServers := make([]*ClusterServer, 0, len(servers))
+	for _, s := range servers {
 		if !s.IsUp() {
 			continue
 		}
@@ -278,9 +558,10 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 }
 
 func (self *ShardData) DropDatabase(database string, sendToServers bool) {
-	if self.IsLocal {
-		if shard, err := self.store.GetOrCreateShard(self.id); err == nil {
-			defer self.store.ReturnShard(self.id)
+	servers, store := self.copies()
+	if store != nil {
+		if shard, err := store.GetOrCreateShard(self.id); err == nil {
+			defer store.ReturnShard(self.id)
 			shard.DropDatabase(database)
 		}
 	}
@@ -289,8 +570,8 @@ func (self *ShardData) DropDatabase(database string, sendToServers bool) {
 		return
 	}
 
-	responses := make([]chan *p.Response, len(self.clusterServers), len(self.clusterServers))
-	for i, server := range self.clusterServers {
+	responses := make([]chan *p.Response, len(servers), len(servers))
+	for i, server := range servers {
 		responseChan := make(chan *p.Response, 1)
 		responses[i] = responseChan
 		request := &p.Request{Type: &dropDatabaseRequest, Database: &database, ShardId: &self.id}
@@ -303,12 +584,13 @@ func (self *ShardData) DropDatabase(database string, sendToServers bool) {
 }
 
 func (self *ShardData) String() string {
+	servers, store := self.copies()
 	serversString := make([]string, 0)
-	for _, s := range self.servers {
+	for _, s := range servers {
 		serversString = append(serversString, fmt.Sprintf("%d", s.GetId()))
 	}
 	local := "false"
-	if self.IsLocal {
+	if store != nil {
 		local = "true"
 	}
 
@@ -351,26 +633,69 @@ func (self *ShardData) LogAndHandleDestructiveQuery(querySpec *parser.QuerySpec,
 	self.HandleDestructiveQuery(querySpec, request, response, false)
 }
 
-func (self *ShardData) deleteDataLocally(querySpec *parser.QuerySpec) (<-chan *p.Response, error) {
+func (self *ShardData) deleteDataLocally(store LocalShardStore, querySpec *parser.QuerySpec) (<-chan *p.Response, error) {
 	localResponses := make(chan *p.Response, 1)
 
+	// deletes that cover the whole shard drop the data of the database instead of
+	// deleting it point by point
+	if matches := self.seriesDeletedEntirely(querySpec); matches != nil {
+		dropped, err := store.DropShardDatabase(self.id, querySpec.Database(), matches)
+		if err != nil {
+			return nil, err
+		}
+		if dropped {
+			localResponses <- &p.Response{Type: &endStreamResponse}
+			return localResponses, nil
+		}
+	}
+
 	// this doesn't really apply at this point since destructive queries don't output anything, but it may later
 	maxPointsFromDestructiveQuery := 1000
 	processor := engine.NewPassthroughEngine(localResponses, maxPointsFromDestructiveQuery)
-	shard, err := self.store.GetOrCreateShard(self.id)
+	shard, err := store.GetOrCreateShard(self.id)
 	if err != nil {
 		return nil, err
 	}
-	defer self.store.ReturnShard(self.id)
+	defer store.ReturnShard(self.id)
 	err = shard.Query(querySpec, processor)
 	processor.Close()
 	return localResponses, err
 }
 
+// Returns a function that tells if a series is one the delete query removes from
+// the shard, nil if the query doesn't delete all the points of the series in the
+// shard.
+func (self *ShardData) seriesDeletedEntirely(querySpec *parser.QuerySpec) func(series string) bool {
+	if !querySpec.IsDeleteFromSeriesQuery() {
+		return nil
+	}
+	query := querySpec.DeleteQuery()
+	if query.GetWhereCondition() != nil || query.GetStartTime().After(self.startTime) || query.GetEndTime().Before(self.endTime) {
+		return nil
+	}
+	fromClause := query.GetFromClause()
+	if fromClause.Type != parser.FromClauseArray {
+		return nil
+	}
+	return func(series string) bool {
+		for _, name := range fromClause.Names {
+			if regex, ok := name.Name.GetCompiledRegex(); ok {
+				if regex.MatchString(series) {
+					return true
+				}
+			} else if name.Name.Name == series {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 func (self *ShardData) forwardRequest(request *p.Request) ([]<-chan *p.Response, []uint32, error) {
 	ids := []uint32{}
 	responses := []<-chan *p.Response{}
-	for _, server := range self.clusterServers {
+	servers, _ := self.copies()
+	for _, server := range servers {
 		responseChan := make(chan *p.Response, 1)
 		// do this so that a new id will get assigned
 		request.Id = nil
@@ -383,15 +708,22 @@ func (self *ShardData) forwardRequest(request *p.Request) ([]<-chan *p.Response,
 }
 
 func (self *ShardData) HandleDestructiveQuery(querySpec *parser.QuerySpec, request *p.Request, response chan *p.Response, runLocalOnly bool) {
-	if !self.IsLocal && runLocalOnly {
+	_, store := self.copies()
+	if store == nil && runLocalOnly {
 		panic("WTF islocal is false and runLocalOnly is true")
 	}
 
 	responseCahnnels := []<-chan *p.Response{}
 	serverIds := []uint32{}
 
-	if self.IsLocal {
-		channel, err := self.deleteDataLocally(querySpec)
+	if store != nil {
+		var channel <-chan *p.Response
+		var err error
+		if request.GetType() == updateRequest {
+			channel, err = self.updateDataLocally(store, querySpec, request.Series)
+		} else {
+			channel, err = self.deleteDataLocally(store, querySpec)
+		}
 		if err != nil {
 			msg := err.Error()
 			response <- &p.Response{Type: &endStreamResponse, ErrorMessage: &msg}
@@ -410,6 +742,9 @@ func (self *ShardData) HandleDestructiveQuery(querySpec *parser.QuerySpec, reque
 	}
 
 	accessDenied := false
+	// the copies that failed, e.g. because they're down, are reported at the end, the
+	// caller can't assume they got the query
+	var errorMessage *string
 	for idx, channel := range responseCahnnels {
 		serverId := serverIds[idx]
 		log.Debug("Waiting for response to %s from %d", request.GetDescription(), serverId)
@@ -417,6 +752,9 @@ func (self *ShardData) HandleDestructiveQuery(querySpec *parser.QuerySpec, reque
 			res := <-channel
 			log.Debug("Received %s response from %d for %s", res.GetType(), serverId, request.GetDescription())
 			if *res.Type == endStreamResponse {
+				if res.ErrorMessage != nil {
+					errorMessage = p.String(fmt.Sprintf("Server %d: %s", serverId, res.GetErrorMessage()))
+				}
 				break
 			}
 
@@ -433,7 +771,7 @@ func (self *ShardData) HandleDestructiveQuery(querySpec *parser.QuerySpec, reque
 	if accessDenied {
 		response <- &p.Response{Type: &accessDeniedResponse}
 	}
-	response <- &p.Response{Type: &endStreamResponse}
+	response <- &p.Response{Type: &endStreamResponse, ErrorMessage: errorMessage}
 }
 
 func (self *ShardData) createRequest(querySpec *parser.QuerySpec) *p.Request {
@@ -453,6 +791,88 @@ func (self *ShardData) createRequest(querySpec *parser.QuerySpec) *p.Request {
 	}
 }
 
+func (self *ShardData) timeRangeQueryString(from string, startMicro, endMicro int64) string {
+	return fmt.Sprintf("select * from %s where time > %du and time < %du", from, startMicro-1, endMicro)
+}
+
+func (self *ShardData) createInternalRequest(requestType p.Request_Type, database, queryString string, user common.User) *p.Request {
+	userName := user.GetName()
+	isDbUser := !user.IsClusterAdmin()
+	return &p.Request{
+		Type:     &requestType,
+		ShardId:  &self.id,
+		Query:    &queryString,
+		UserName: &userName,
+		Database: &database,
+		IsDbUser: &isDbUser,
+	}
+}
+
+func (self *ShardData) copyDatabaseFromLocalStore(database string, user common.User, destination Writer, bufferSize int) error {
+	queries, err := parser.ParseQuery(self.timeRangeQueryString("/.*/", self.startMicro, self.endMicro))
+	if err != nil {
+		return err
+	}
+	querySpec := parser.NewQuerySpec(user, database, queries[0])
+	responses := make(chan *p.Response, bufferSize)
+	go self.Query(querySpec, responses)
+	_, err = self.writeResponses(database, responses, destination)
+	return err
+}
+
+func (self *ShardData) copyDatabaseFromServers(database string, user common.User, destination Writer, excludeServerId uint32, bufferSize int) error {
+	var err error = fmt.Errorf("No servers up to copy shard %d from", self.id)
+	servers, _ := self.queryableCopies()
+	for _, server := range servers {
+		if server.Id == excludeServerId || !server.IsUp() {
+			continue
+		}
+
+		queryString := self.timeRangeQueryString("/.*/", self.startMicro, self.endMicro)
+		request := self.createInternalRequest(queryRequest, database, queryString, user)
+		responses := make(chan *p.Response, bufferSize)
+		server.MakeRequest(request, responses)
+		_, err = self.writeResponses(database, responses, destination)
+		if err == nil {
+			return nil
+		}
+		log.Warn("Couldn't copy shard %d for database %s from server %d: %s", self.id, database, server.Id, err)
+	}
+	return err
+}
+
+// Writes the series in the responses to the destination until the end of the stream
+// and returns the number of points written. The responses are drained even if a
+// write fails so the query doesn't get stuck.
+func (self *ShardData) writeResponses(database string, responses <-chan *p.Response, destination Writer) (int, error) {
+	var err error
+	points := 0
+	for {
+		response := <-responses
+		switch response.GetType() {
+		case p.Response_END_STREAM:
+			if err == nil && response.ErrorMessage != nil {
+				err = errors.New(response.GetErrorMessage())
+			}
+			return points, err
+		case p.Response_ACCESS_DENIED:
+			if err == nil {
+				err = fmt.Errorf("Access denied: %s", response.GetErrorMessage())
+			}
+			return points, err
+		}
+
+		if err != nil || response.Series == nil || len(response.Series.Points) == 0 {
+			continue
+		}
+		write := &p.Request{Type: &writeRequest, Database: &database, Series: response.Series, ShardId: &self.id}
+		err = destination.Write(write)
+		if err == nil {
+			points += len(response.Series.Points)
+		}
+	}
+}
+
 // used to serialize shards when sending around in raft or when snapshotting in the log
 func (self *ShardData) ToNewShardData() *NewShardData {
 	return &NewShardData{
@@ -460,7 +880,7 @@ func (self *ShardData) ToNewShardData() *NewShardData {
 		StartTime: self.startTime,
 		EndTime:   self.endTime,
 		Type:      self.shardType,
-		ServerIds: self.serverIds,
+		ServerIds: self.ServerIds(),
 	}
 }
 
@@ -0,0 +1,82 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// Describes the shard a backup was taken of. It's stored in the backup so the shard
+// can be registered again when it's restored into a cluster that doesn't have it.
+type ShardBackupInfo struct {
+	ShardId       uint32
+	StartTime     time.Time
+	EndTime       time.Time
+	Type          ShardType
+	DurationSplit bool
+	CreatedAt     time.Time
+}
+
+func (self *ShardData) backupInfo() *ShardBackupInfo {
+	return &ShardBackupInfo{
+		ShardId:       self.id,
+		StartTime:     self.startTime,
+		EndTime:       self.endTime,
+		Type:          self.shardType,
+		DurationSplit: self.durationIsSplit,
+		CreatedAt:     time.Now(),
+	}
+}
+
+// Writes a consistent snapshot of the local copy of the shard to w. Writes that
+// come in while the backup is running aren't part of it.
+func (self *ClusterConfiguration) BackupShard(id uint32, w io.Writer) error {
+	shard := self.GetShardById(id)
+	if shard == nil {
+		return fmt.Errorf("Shard %d doesn't exist", id)
+	}
+	if !shard.IsLocal {
+		return fmt.Errorf("Shard %d isn't stored on this server, servers %v have a copy", id, shard.ServerIds())
+	}
+	log.Info("Backing up shard %d", id)
+	return self.shardStore.BackupShard(id, shard.backupInfo(), w)
+}
+
+// Replaces the local copy of the shard with the backup. If the shard exists it has to
+// cover the same time range as the shard the backup was taken of. It's up to the
+// caller to register the copy with the cluster.
+func (self *ClusterConfiguration) RestoreShard(id uint32, r io.Reader) (*ShardBackupInfo, error) {
+	var restored *ShardBackupInfo
+	err := self.shardStore.RestoreShard(id, r, func(info *ShardBackupInfo) error {
+		shard := self.GetShardById(id)
+		if shard != nil && (!shard.startTime.Equal(info.StartTime) || !shard.endTime.Equal(info.EndTime) || shard.shardType != info.Type) {
+			return fmt.Errorf("Cannot restore the backup of shard %d into shard %d, they don't cover the same time range", info.ShardId, id)
+		}
+		restored = info
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Restored shard %d from a backup of shard %d taken at %s", id, restored.ShardId, restored.CreatedAt)
+	return restored, nil
+}
+
+// Adds a shard that got restored from a backup. Unlike AddShards the shard keeps
+// the id it was restored into.
+func (self *ClusterConfiguration) AddRestoredShard(newShard *NewShardData) (*ShardData, error) {
+	self.shardLock.Lock()
+	defer self.shardLock.Unlock()
+
+	if self.GetShardById(newShard.Id) != nil {
+		return nil, fmt.Errorf("Shard %d already exists", newShard.Id)
+	}
+	for _, serverId := range newShard.ServerIds {
+		if self.GetServerById(&serverId) == nil {
+			return nil, fmt.Errorf("Server %d doesn't exist", serverId)
+		}
+	}
+	return self.addShard(newShard.Id, newShard, newShard.Type, newShard.DurationSplit)
+}
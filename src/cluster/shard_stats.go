@@ -0,0 +1,115 @@
+package cluster
+
+import (
+	"errors"
+	p "protocol"
+	"sort"
+	"sync"
+
+	log "code.google.com/p/log4go"
+)
+
+var shardStatsRequest = p.Request_SHARD_STATS
+
+// The state of the copy of a shard on a server. The key count is estimated from the
+// point counts of the series index.
+type ShardStats struct {
+	ShardId  uint32 `json:"shardId"`
+	ServerId uint32 `json:"serverId"`
+	Bytes    int64  `json:"bytes"`
+	// the number of files on every level, missing for shards that aren't open and
+	// engines without levels
+	LevelFiles      []int64 `json:"levelFiles,omitempty"`
+	ApproximateKeys int64   `json:"approximateKeys"`
+	Series          int64   `json:"series"`
+	Open            bool    `json:"open"`
+	RefCount        int64   `json:"refCount"`
+}
+
+// Returns the stats of the shards of all the servers sorted by shard and server id,
+// or only the ones of this server if localOnly is set. The shards of the servers that
+// are down are left out.
+func (self *ClusterConfiguration) ShardStats(localOnly bool) []*ShardStats {
+	servers := make([]*ClusterServer, 0)
+	for _, server := range self.Servers() {
+		if !localOnly && server.Id != self.LocalServerId && server.IsUp() {
+			servers = append(servers, server)
+		}
+	}
+
+	results := make(chan []*p.ShardStats, len(servers)+1)
+	var wait sync.WaitGroup
+	for _, server := range servers {
+		wait.Add(1)
+		go func(server *ClusterServer) {
+			defer wait.Done()
+			stats, err := self.remoteShardStats(server)
+			if err != nil {
+				log.Error("Cannot get the shard stats of server %d: %s", server.Id, err)
+				return
+			}
+			results <- stats
+		}(server)
+	}
+	results <- self.LocalShardStats()
+	wait.Wait()
+	close(results)
+
+	allStats := make([]*ShardStats, 0)
+	for stats := range results {
+		for _, s := range stats {
+			allStats = append(allStats, &ShardStats{
+				ShardId:         s.GetShardId(),
+				ServerId:        s.GetServerId(),
+				Bytes:           s.GetBytes(),
+				LevelFiles:      s.LevelFiles,
+				ApproximateKeys: s.GetApproximateKeys(),
+				Series:          s.GetSeries(),
+				Open:            s.GetOpen(),
+				RefCount:        s.GetRefCount(),
+			})
+		}
+	}
+	sort.Sort(shardStatsById(allStats))
+	return allStats
+}
+
+// Returns the stats of the shards of this server
+func (self *ClusterConfiguration) LocalShardStats() []*p.ShardStats {
+	serverId := self.LocalServerId
+	stats := self.shardStore.ShardStats()
+	for _, s := range stats {
+		s.ServerId = &serverId
+	}
+	return stats
+}
+
+func (self *ClusterConfiguration) remoteShardStats(server *ClusterServer) ([]*p.ShardStats, error) {
+	request := &p.Request{Type: &shardStatsRequest, Database: p.String("")}
+	responses := make(chan *p.Response, self.config.QueryShardBufferSize)
+	server.MakeRequest(request, responses)
+	stats := make([]*p.ShardStats, 0)
+	for {
+		response := <-responses
+		switch response.GetType() {
+		case p.Response_SHARD_STATS:
+			stats = append(stats, response.ShardStats...)
+		case p.Response_END_STREAM:
+			if response.ErrorMessage != nil {
+				return nil, errors.New(response.GetErrorMessage())
+			}
+			return stats, nil
+		}
+	}
+}
+
+type shardStatsById []*ShardStats
+
+func (self shardStatsById) Len() int      { return len(self) }
+func (self shardStatsById) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self shardStatsById) Less(i, j int) bool {
+	if self[i].ShardId != self[j].ShardId {
+		return self[i].ShardId < self[j].ShardId
+	}
+	return self[i].ServerId < self[j].ServerId
+}
@@ -0,0 +1,117 @@
+package cluster
+
+import (
+	"common"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"parser"
+	p "protocol"
+	"time"
+)
+
+type ShardSuite struct{}
+
+var _ = Suite(&ShardSuite{})
+
+func (self *ShardSuite) TestSeriesDeletedEntirely(c *C) {
+	start := time.Unix(3600, 0)
+	end := start.Add(time.Hour)
+	shard := NewShard(1, start, end, SHORT_TERM, false, nil)
+	matches := func(query string) func(string) bool {
+		queries, err := parser.ParseQuery(query)
+		c.Assert(err, IsNil)
+		return shard.seriesDeletedEntirely(parser.NewQuerySpec(nil, "db1", queries[0]))
+	}
+	endMicro := common.TimeToMicroseconds(end)
+
+	deleted := matches(fmt.Sprintf("delete from /^cpu/, mem where time < %du", endMicro))
+	c.Assert(deleted, NotNil)
+	c.Assert(deleted("cpu.idle"), Equals, true)
+	c.Assert(deleted("mem"), Equals, true)
+	c.Assert(deleted("disk"), Equals, false)
+
+	// deletes that leave points in the shard
+	c.Assert(matches(fmt.Sprintf("delete from /.*/ where time < %du", endMicro-1)), IsNil)
+	c.Assert(matches(fmt.Sprintf("delete from /.*/ where time > %du and time < %du", common.TimeToMicroseconds(start)+1, endMicro)), IsNil)
+	c.Assert(matches("select * from foo"), IsNil)
+}
+
+func (self *ShardSuite) TestUpdateFailsIfACopyMissedIt(c *C) {
+	shard := newShardWithServers(false)
+	queries, err := parser.ParseQuery("select * from /^cpu$/ where time > 99u and time < 201u")
+	c.Assert(err, IsNil)
+	user := &ClusterAdmin{CommonUser{Name: "root"}}
+	timestamp := int64(100)
+	values := &p.Series{Name: p.String("cpu"), Fields: []string{"value"}, Points: []*p.Point{{Timestamp: &timestamp}}}
+
+	// the caller keeps the range from the anti entropy repair until all the copies
+	// got the update, otherwise the copy that missed it would bring the old values back
+	response := make(chan *p.Response, 10)
+	shard.Update(parser.NewQuerySpec(user, "db", queries[0]), values, response)
+	end := <-response
+	c.Assert(end.GetType(), Equals, endStreamResponse)
+	c.Assert(end.GetErrorMessage(), Equals, "Server 1: server is down")
+}
+
+func (self *ShardSuite) TestQueriesSkipCopiesThatAreBeingBackfilled(c *C) {
+	shard := newShardWithServers(true, true)
+	replacement := NewClusterServer("", "", "", &connectionMock{true}, time.Second)
+	replacement.Id = 3
+	c.Assert(shard.ReplaceServer(1, replacement, nil, 0), IsNil)
+	c.Assert(shard.ServerIds(), DeepEquals, []uint32{2, 3})
+
+	// writes go to the replacement right away, queries only once it has the data
+	servers, _ := shard.copies()
+	c.Assert(servers, HasLen, 2)
+	servers, _ = shard.queryableCopies()
+	c.Assert(servers, HasLen, 1)
+	c.Assert(servers[0].Id, Equals, uint32(2))
+
+	shard.FinishBackfill(3)
+	servers, _ = shard.queryableCopies()
+	c.Assert(servers, HasLen, 2)
+}
+
+func (self *ShardSuite) TestUpdateProcessor(c *C) {
+	queries, err := parser.ParseQuery("select * from /^cpu$/ where time > 99u and time < 201u and (host = 'a')")
+	c.Assert(err, IsNil)
+
+	point := func(timestamp int64, sequenceNumber uint64, values ...*p.FieldValue) *p.Point {
+		return &p.Point{Timestamp: &timestamp, SequenceNumber: &sequenceNumber, Values: values}
+	}
+	str := func(value string) *p.FieldValue { return &p.FieldValue{StringValue: &value} }
+	integer := func(value int64) *p.FieldValue { return &p.FieldValue{Int64Value: &value} }
+
+	// the point at 100 has no sequence number, all the points at 100 get updated
+	anyPointAt100 := point(100, 0, integer(10))
+	anyPointAt100.SequenceNumber = nil
+	values := &p.Series{
+		Name:   p.String("cpu"),
+		Fields: []string{"value"},
+		Points: []*p.Point{anyPointAt100, point(200, 5, integer(20))},
+	}
+	processor := newUpdateProcessor(queries[0].SelectQuery, values)
+	processor.YieldSeries(&p.Series{
+		Name:   p.String("cpu"),
+		Fields: []string{"host", "value"},
+		Points: []*p.Point{
+			point(200, 5, str("a"), integer(2)),
+			point(200, 4, str("a"), integer(2)),
+			point(150, 3, str("a"), integer(1)),
+			point(100, 2, str("b"), integer(1)),
+			point(100, 1, str("a"), integer(1)),
+		},
+	})
+	c.Assert(processor.err, IsNil)
+	c.Assert(processor.updates, HasLen, 1)
+	updated := processor.updates[0]
+	c.Assert(updated.GetName(), Equals, "cpu")
+	c.Assert(updated.Fields, DeepEquals, []string{"value"})
+	c.Assert(updated.Points, HasLen, 2)
+	c.Assert(updated.Points[0].GetTimestamp(), Equals, int64(200))
+	c.Assert(updated.Points[0].GetSequenceNumber(), Equals, uint64(5))
+	c.Assert(updated.Points[0].Values[0].GetInt64Value(), Equals, int64(20))
+	c.Assert(updated.Points[1].GetTimestamp(), Equals, int64(100))
+	c.Assert(updated.Points[1].GetSequenceNumber(), Equals, uint64(1))
+	c.Assert(updated.Points[1].Values[0].GetInt64Value(), Equals, int64(10))
+}
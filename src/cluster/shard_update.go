@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"engine"
+	"parser"
+	p "protocol"
+	"regexp"
+	"strings"
+)
+
+var updateRequest = p.Request_UPDATE
+
+// Returns a regex that only matches the given series, for queries on series whose
+// names the parser can't take as they are.
+func SeriesRegex(series string) string {
+	return "/^" + strings.Replace(regexp.QuoteMeta(series), "/", "\\/", -1) + "$/"
+}
+
+// Rewrites the columns of values in the points the select query matches, on all the
+// copies of the shard through the destructive query path. A point only gets updated
+// if one of the points of values has its timestamp, and its sequence number if it's
+// set, with the values of that point. The other columns of the point are left alone.
+// The updated points are sent on response, with their timestamp and sequence number
+// but without values.
+func (self *ShardData) Update(querySpec *parser.QuerySpec, values *p.Series, response chan *p.Response) {
+	request := self.createRequest(querySpec)
+	request.Type = &updateRequest
+	request.Series = values
+	self.LogAndHandleDestructiveQuery(querySpec, request, response, false)
+}
+
+func (self *ShardData) updateDataLocally(store LocalShardStore, querySpec *parser.QuerySpec, values *p.Series) (<-chan *p.Response, error) {
+	shard, err := store.GetOrCreateShard(self.id)
+	if err != nil {
+		return nil, err
+	}
+	defer store.ReturnShard(self.id)
+
+	processor := newUpdateProcessor(querySpec.SelectQuery(), values)
+	if err := shard.Query(querySpec, processor); err != nil {
+		return nil, err
+	}
+	if processor.err != nil {
+		return nil, processor.err
+	}
+
+	localResponses := make(chan *p.Response, len(processor.updates)+1)
+	for _, series := range processor.updates {
+		// the points keep their timestamp and sequence number, so the new values
+		// overwrite the old ones of the columns
+		if err := shard.Write(querySpec.Database(), series); err != nil {
+			return nil, err
+		}
+		updated := &p.Series{Name: series.Name, Fields: []string{}, Points: make([]*p.Point, 0, len(series.Points))}
+		for _, point := range series.Points {
+			updated.Points = append(updated.Points, &p.Point{Timestamp: point.Timestamp, SequenceNumber: point.SequenceNumber, Values: []*p.FieldValue{}})
+		}
+		localResponses <- &p.Response{Type: &queryResponse, Series: updated}
+	}
+	localResponses <- &p.Response{Type: &endStreamResponse}
+	return localResponses, nil
+}
+
+// A query processor that collects the new values of the points that get updated
+type updateProcessor struct {
+	query *parser.SelectQuery
+	// the points of the update by timestamp
+	targets map[int64][]*p.Point
+	fields  []string
+	updates []*p.Series
+	err     error
+}
+
+func newUpdateProcessor(query *parser.SelectQuery, values *p.Series) *updateProcessor {
+	targets := map[int64][]*p.Point{}
+	for _, point := range values.Points {
+		targets[point.GetTimestamp()] = append(targets[point.GetTimestamp()], point)
+	}
+	return &updateProcessor{query: query, targets: targets, fields: values.Fields}
+}
+
+func (self *updateProcessor) YieldPoint(seriesName *string, columnNames []string, point *p.Point) bool {
+	return self.YieldSeries(&p.Series{Name: seriesName, Fields: columnNames, Points: []*p.Point{point}})
+}
+
+func (self *updateProcessor) YieldSeries(series *p.Series) bool {
+	series, err := engine.Filter(self.query, series)
+	if err != nil {
+		self.err = err
+		return false
+	}
+
+	updated := &p.Series{Name: series.Name, Fields: self.fields}
+	for _, point := range series.Points {
+		target := self.target(point)
+		if target == nil {
+			continue
+		}
+		updated.Points = append(updated.Points, &p.Point{
+			Timestamp:      point.Timestamp,
+			SequenceNumber: point.SequenceNumber,
+			Values:         target.Values,
+		})
+	}
+	if len(updated.Points) > 0 {
+		self.updates = append(self.updates, updated)
+	}
+	return true
+}
+
+// Returns the point of the update with the timestamp of the given point, and its
+// sequence number if the point of the update has one. nil if there's none.
+func (self *updateProcessor) target(point *p.Point) *p.Point {
+	for _, target := range self.targets[point.GetTimestamp()] {
+		if target.SequenceNumber == nil || target.GetSequenceNumber() == point.GetSequenceNumber() {
+			return target
+		}
+	}
+	return nil
+}
+
+func (self *updateProcessor) Close() {}
+
+func (self *updateProcessor) SetShardInfo(shardId int, shardLocal bool) {}
+
+func (self *updateProcessor) GetName() string {
+	return "UpdateProcessor"
+}
@@ -3,6 +3,8 @@ package cluster
 import (
 	log "code.google.com/p/log4go"
 	"protocol"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,13 +18,22 @@ type WriteBuffer struct {
 	bufferSize    int
 	shardIds      map[uint32]bool
 	writerInfo    string
+	acks          map[uint32][]chan<- uint32
+	acksLock      sync.Mutex
+	hintedHandoff *HintedHandoffQueue
+	// the number of writes dropped because the buffer was full, accessed atomically
+	shed     int64
+	stopped  chan bool
+	stopOnce sync.Once
 }
 
 type Writer interface {
 	Write(request *protocol.Request) error
 }
 
-func NewWriteBuffer(writerInfo string, writer Writer, wal WAL, serverId uint32, bufferSize int) *WriteBuffer {
+// Writes that fail get stored in the hinted handoff queue if there is one, otherwise
+// they're retried until they succeed.
+func NewWriteBuffer(writerInfo string, writer Writer, wal WAL, serverId uint32, bufferSize int, hintedHandoff *HintedHandoffQueue) *WriteBuffer {
 	log.Info("%s: Initializing write buffer with buffer size of %d", writerInfo, bufferSize)
 	buff := &WriteBuffer{
 		writer:        writer,
@@ -33,8 +44,14 @@ func NewWriteBuffer(writerInfo string, writer Writer, wal WAL, serverId uint32,
 		bufferSize:    bufferSize,
 		shardIds:      make(map[uint32]bool),
 		writerInfo:    writerInfo,
+		acks:          make(map[uint32][]chan<- uint32),
+		hintedHandoff: hintedHandoff,
+		stopped:       make(chan bool),
 	}
 	go buff.handleWrites()
+	if hintedHandoff != nil {
+		go buff.deliverHintedHandoff()
+	}
 	return buff
 }
 
@@ -45,6 +62,7 @@ func (self *WriteBuffer) Write(request *protocol.Request) {
 	case self.writes <- request:
 		return
 	default:
+		atomic.AddInt64(&self.shed, 1)
 		select {
 		case self.stoppedWrites <- *request.RequestNumber:
 			return
@@ -54,9 +72,76 @@ func (self *WriteBuffer) Write(request *protocol.Request) {
 	}
 }
 
+// Like Write, but the server id of the buffer gets sent on acks once the writer accepted
+// the request, which can be after a replay from the WAL. The send doesn't block, so acks
+// should have room for every buffer the request gets written to.
+func (self *WriteBuffer) WriteAndNotify(request *protocol.Request, acks chan<- uint32) {
+	self.acksLock.Lock()
+	self.acks[*request.RequestNumber] = append(self.acks[*request.RequestNumber], acks)
+	self.acksLock.Unlock()
+	self.Write(request)
+}
+
+// Stops sending the server id on acks for the request. Called once the writer doesn't
+// wait for the acks anymore, requests that never get written, e.g. because they got
+// dropped from the hinted handoff queue or the server needs a resync, would keep
+// their acks around forever otherwise.
+func (self *WriteBuffer) StopNotifying(requestNumber uint32, acks chan<- uint32) {
+	self.acksLock.Lock()
+	defer self.acksLock.Unlock()
+	remaining := self.acks[requestNumber][:0]
+	for _, ack := range self.acks[requestNumber] {
+		if ack != acks {
+			remaining = append(remaining, ack)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(self.acks, requestNumber)
+		return
+	}
+	self.acks[requestNumber] = remaining
+}
+
+func (self *WriteBuffer) stats(name string) *WriteBufferStats {
+	return &WriteBufferStats{
+		Name:   name,
+		Length: len(self.writes),
+		Size:   self.bufferSize,
+		Shed:   atomic.LoadInt64(&self.shed),
+	}
+}
+
+func (self *WriteBuffer) notify(requestNumber uint32) {
+	self.acksLock.Lock()
+	acks := self.acks[requestNumber]
+	delete(self.acks, requestNumber)
+	self.acksLock.Unlock()
+
+	for _, ack := range acks {
+		select {
+		case ack <- self.serverId:
+		default:
+		}
+	}
+}
+
+// Stops delivering writes, the ones that are still buffered are dropped and nobody
+// gets notified about them anymore.
+func (self *WriteBuffer) Stop() {
+	self.stopOnce.Do(func() {
+		log.Info("%s: Stopping write buffer for server %d", self.writerInfo, self.serverId)
+		close(self.stopped)
+		self.acksLock.Lock()
+		self.acks = make(map[uint32][]chan<- uint32)
+		self.acksLock.Unlock()
+	})
+}
+
 func (self *WriteBuffer) handleWrites() {
 	for {
 		select {
+		case <-self.stopped:
+			return
 		case requestDropped := <-self.stoppedWrites:
 			self.replayAndRecover(requestDropped)
 		case request := <-self.writes:
@@ -66,6 +151,11 @@ func (self *WriteBuffer) handleWrites() {
 }
 
 func (self *WriteBuffer) write(request *protocol.Request) {
+	// keep the writes in order while the queue is being delivered
+	if self.hintedHandoff != nil && self.hintedHandoff.Entries() > 0 && self.handOff(request) {
+		return
+	}
+
 	attempts := 0
 	for {
 		self.shardIds[*request.ShardId] = true
@@ -73,6 +163,11 @@ func (self *WriteBuffer) write(request *protocol.Request) {
 		err := self.writer.Write(request)
 		if err == nil {
 			self.wal.Commit(requestNumber, self.serverId)
+			self.notify(requestNumber)
+			return
+		}
+		if self.hintedHandoff != nil && self.handOff(request) {
+			log.Warn("%s: WriteBuffer: error on write to server %d, queued the write for hinted handoff: %s", self.writerInfo, self.serverId, err)
 			return
 		}
 		if attempts%100 == 0 {
@@ -80,7 +175,59 @@ func (self *WriteBuffer) write(request *protocol.Request) {
 		}
 		attempts += 1
 		// backoff happens in the writer, just sleep for a small fixed amount of time before retrying
-		time.Sleep(time.Millisecond * 100)
+		select {
+		case <-self.stopped:
+			return
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
+// Stores the request in the hinted handoff queue and commits it, the WAL doesn't have
+// to keep it around for the server anymore. Returns false if the request couldn't be
+// queued.
+func (self *WriteBuffer) handOff(request *protocol.Request) bool {
+	requestNumber := *request.RequestNumber
+	// the id gets assigned by the connection the request gets delivered on
+	request.Id = nil
+	if err := self.hintedHandoff.Append(request); err != nil {
+		log.Error("%s: WriteBuffer: cannot queue write for hinted handoff to server %d: %s", self.writerInfo, self.serverId, err)
+		return false
+	}
+	self.wal.Commit(requestNumber, self.serverId)
+	return true
+}
+
+func (self *WriteBuffer) deliverHintedHandoff() {
+	for {
+		select {
+		case <-self.stopped:
+			return
+		default:
+		}
+
+		request, err := self.hintedHandoff.Next()
+		if err != nil {
+			log.Error("%s: WriteBuffer: cannot read the hinted handoff queue of server %d: %s", self.writerInfo, self.serverId, err)
+			time.Sleep(HINTED_HANDOFF_RETRY_INTERVAL)
+			continue
+		}
+		if request == nil {
+			select {
+			case <-self.hintedHandoff.Ready():
+			case <-self.stopped:
+			case <-time.After(HINTED_HANDOFF_RETRY_INTERVAL):
+			}
+			continue
+		}
+
+		if err := self.writer.Write(request); err != nil {
+			log.Debug("%s: WriteBuffer: hinted handoff to server %d failed: %s", self.writerInfo, self.serverId, err)
+			time.Sleep(HINTED_HANDOFF_RETRY_INTERVAL)
+			continue
+		}
+		self.hintedHandoff.Ack()
+		self.notify(request.GetRequestNumber())
 	}
 }
 
@@ -111,7 +258,7 @@ func (self *WriteBuffer) replayAndRecover(missedRequest uint32) {
 		}
 
 		log.Debug("%s: REPLAY: from request %d. Shards: ", self.writerInfo, req.GetRequestNumber(), shardIds)
-		self.wal.RecoverServerFromRequestNumber(*req.RequestNumber, shardIds, func(request *protocol.Request, shardId uint32) error {
+		self.wal.RecoverServer(self.serverId, *req.RequestNumber, shardIds, func(request *protocol.Request, shardId uint32) error {
 			log.Debug("%s: REPLAY: writing request number: %d", self.writerInfo, request.GetRequestNumber())
 			req = request
 			request.ShardId = &shardId
@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"fmt"
+)
+
+// How many copies of a shard have to acknowledge a write before it's reported as
+// successful. Writes are always logged to the WAL first, so even writes that don't
+// get enough acknowledgements will eventually make it to every copy.
+type WriteConsistency int
+
+const (
+	// the write is logged to the WAL, no copy has to acknowledge it
+	WriteConsistencyAny WriteConsistency = iota
+	WriteConsistencyOne
+	WriteConsistencyQuorum
+	WriteConsistencyAll
+)
+
+func ParseWriteConsistency(consistency string) (WriteConsistency, error) {
+	switch consistency {
+	case "", "any":
+		return WriteConsistencyAny, nil
+	case "one":
+		return WriteConsistencyOne, nil
+	case "quorum":
+		return WriteConsistencyQuorum, nil
+	case "all":
+		return WriteConsistencyAll, nil
+	}
+	return WriteConsistencyAny, fmt.Errorf("Unknown consistency %s, it should be one of any, one, quorum or all", consistency)
+}
+
+func (self WriteConsistency) String() string {
+	switch self {
+	case WriteConsistencyOne:
+		return "one"
+	case WriteConsistencyQuorum:
+		return "quorum"
+	case WriteConsistencyAll:
+		return "all"
+	}
+	return "any"
+}
+
+// Returns the number of acknowledgements needed from a shard with the given number
+// of copies.
+func (self WriteConsistency) RequiredAcks(copies int) int {
+	switch self {
+	case WriteConsistencyOne:
+		return 1
+	case WriteConsistencyQuorum:
+		return copies/2 + 1
+	case WriteConsistencyAll:
+		return copies
+	}
+	return 0
+}
+
+// Returned when a write was logged but fewer copies than the consistency asked for
+// acknowledged it before the timeout. The remaining copies get the write once their
+// servers catch up.
+type PartialWriteError struct {
+	ShardId      uint32
+	Consistency  WriteConsistency
+	Acks         int
+	RequiredAcks int
+}
+
+func (self *PartialWriteError) Error() string {
+	return fmt.Sprintf("Partial write to shard %d: %d of the %d acknowledgements required for consistency %s were received",
+		self.ShardId, self.Acks, self.RequiredAcks, self.Consistency)
+}
@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"errors"
+	. "launchpad.net/gocheck"
+	"protocol"
+	"time"
+	"wal"
+)
+
+type WriteConsistencySuite struct{}
+
+var _ = Suite(&WriteConsistencySuite{})
+
+type walMock struct {
+	requestNumber uint32
+	resyncs       []uint32
+}
+
+func (self *walMock) AssignSequenceNumbersAndLog(request *protocol.Request, shard wal.Shard) (uint32, error) {
+	self.requestNumber += 1
+	return self.requestNumber, nil
+}
+
+func (self *walMock) AssignSequenceNumbersAndLogAndSync(request *protocol.Request, shard wal.Shard) (uint32, error) {
+	return self.AssignSequenceNumbersAndLog(request, shard)
+}
+
+func (self *walMock) Commit(requestNumber uint32, serverId uint32) error { return nil }
+
+func (self *walMock) CreateCheckpoint() error { return nil }
+
+func (self *walMock) RecoverServerFromRequestNumber(requestNumber uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error {
+	return nil
+}
+
+func (self *walMock) RecoverServerFromLastCommit(serverId uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error {
+	return nil
+}
+
+func (self *walMock) RecoverServer(serverId, requestNumber uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error {
+	return nil
+}
+
+func (self *walMock) ReplayStats() *wal.ReplayStats { return &wal.ReplayStats{} }
+
+func (self *walMock) ServersNeedingResync() []uint32 { return nil }
+
+func (self *walMock) MarkResync(serverId uint32) error {
+	self.resyncs = append(self.resyncs, serverId)
+	return nil
+}
+
+func (self *walMock) ClearResync(serverId, requestNumber uint32) error { return nil }
+
+func (self *walMock) LargestRequestNumber() uint32 { return self.requestNumber }
+
+func (self *walMock) ForgetServer(serverId uint32) error { return nil }
+
+func (self *walMock) QueueLength() (int, int) { return 0, 10 }
+
+// acknowledges writes if it's up, otherwise fails them
+type connectionMock struct {
+	up bool
+}
+
+func (self *connectionMock) Connect() {}
+
+func (self *connectionMock) MakeRequest(request *protocol.Request, responseStream chan *protocol.Response) error {
+	if !self.up {
+		return errors.New("server is down")
+	}
+	writeOk := protocol.Response_WRITE_OK
+	responseStream <- &protocol.Response{Type: &writeOk, RequestId: request.Id}
+	return nil
+}
+
+func newShardWithServers(up ...bool) *ShardData {
+	writeLog := &walMock{}
+	shard := NewShard(1, time.Now(), time.Now().Add(time.Hour), SHORT_TERM, false, writeLog)
+	servers := make([]*ClusterServer, 0, len(up))
+	for i, isUp := range up {
+		server := NewClusterServer("", "", "", &connectionMock{isUp}, time.Second)
+		server.Id = uint32(i + 1)
+		server.SetWriteBuffer(NewWriteBuffer("test", server, writeLog, server.Id, 10, nil))
+		servers = append(servers, server)
+	}
+	shard.SetServers(servers)
+	return shard
+}
+
+func newWriteRequest() *protocol.Request {
+	name := "foo"
+	database := "db"
+	return &protocol.Request{Type: &writeRequest, Database: &database, Series: &protocol.Series{Name: &name}}
+}
+
+func (self *WriteConsistencySuite) TestRequiredAcks(c *C) {
+	for _, t := range []struct {
+		consistency string
+		copies      int
+		acks        int
+	}{
+		{"", 3, 0},
+		{"any", 3, 0},
+		{"one", 3, 1},
+		{"quorum", 1, 1},
+		{"quorum", 2, 2},
+		{"quorum", 3, 2},
+		{"quorum", 4, 3},
+		{"all", 3, 3},
+	} {
+		consistency, err := ParseWriteConsistency(t.consistency)
+		c.Assert(err, IsNil)
+		c.Assert(consistency.RequiredAcks(t.copies), Equals, t.acks)
+	}
+
+	_, err := ParseWriteConsistency("most")
+	c.Assert(err, NotNil)
+}
+
+func (self *WriteConsistencySuite) TestQuorumWriteSucceedsWithOneServerDown(c *C) {
+	shard := newShardWithServers(true, true, false)
+	err := shard.WriteWithConsistency(newWriteRequest(), WriteConsistencyQuorum, time.Second)
+	c.Assert(err, IsNil)
+}
+
+func (self *WriteConsistencySuite) TestWriteToAllReturnsPartialWriteError(c *C) {
+	shard := newShardWithServers(true, true, false)
+	err := shard.WriteWithConsistency(newWriteRequest(), WriteConsistencyAll, 100*time.Millisecond)
+	c.Assert(err, FitsTypeOf, &PartialWriteError{})
+	partialWrite := err.(*PartialWriteError)
+	c.Assert(partialWrite.Acks, Equals, 2)
+	c.Assert(partialWrite.RequiredAcks, Equals, 3)
+}
+
+func (self *WriteConsistencySuite) TestAcksAreForgottenWhenTheWriteReturns(c *C) {
+	shard := newShardWithServers(true, false)
+	err := shard.WriteWithConsistency(newWriteRequest(), WriteConsistencyAll, 100*time.Millisecond)
+	c.Assert(err, FitsTypeOf, &PartialWriteError{})
+	for _, server := range shard.clusterServers {
+		server.writeBuffer.acksLock.Lock()
+		c.Assert(server.writeBuffer.acks, HasLen, 0)
+		server.writeBuffer.acksLock.Unlock()
+	}
+}
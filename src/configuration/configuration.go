@@ -8,6 +8,7 @@ import (
 	"github.com/BurntSushi/toml"
 	"io/ioutil"
 	"os"
+	"path"
 	"regexp"
 	"strconv"
 	"time"
@@ -18,8 +19,24 @@ type size struct {
 }
 
 const (
+	ONE_KILOBYTE = 1024
 	ONE_MEGABYTE = 1024 * 1024
 	ONE_GIGABYTE = 1024 * ONE_MEGABYTE
+
+	// the wal sync modes, with none the wal is fsynced after flush-after
+	// requests, with batch all the requests appended in the last sync-interval
+	// are fsynced together and with always every request is fsynced
+	WAL_SYNC_NONE   = "none"
+	WAL_SYNC_BATCH  = "batch"
+	WAL_SYNC_ALWAYS = "always"
+
+	// what happens to writes while a write buffer or the wal queue is over its
+	// high water mark, with shed they're logged and the buffers that are full
+	// drop them and replay them from the wal later, with block they wait until
+	// there's room again and with reject they fail right away
+	BACK_PRESSURE_SHED   = "shed"
+	BACK_PRESSURE_BLOCK  = "block"
+	BACK_PRESSURE_REJECT = "reject"
 )
 
 func (d *size) UnmarshalText(text []byte) error {
@@ -30,6 +47,8 @@ func (d *size) UnmarshalText(text []byte) error {
 		return err
 	}
 	switch suffix := text[len(text)-1]; suffix {
+	case 'k':
+		size *= ONE_KILOBYTE
 	case 'm':
 		size *= ONE_MEGABYTE
 	case 'g':
@@ -75,8 +94,11 @@ type RaftConfig struct {
 }
 
 type StorageConfig struct {
-	Dir             string
-	WriteBufferSize int `toml:"write-buffer-size"`
+	Dir                  string
+	Engine               string
+	WriteBufferSize      int    `toml:"write-buffer-size"`
+	PointEncoding        string `toml:"point-encoding"`
+	MigratePointEncoding bool   `toml:"migrate-point-encoding"`
 }
 
 type ClusterConfig struct {
@@ -86,6 +108,13 @@ type ClusterConfig struct {
 	ProtobufHeartbeatInterval duration `toml:"protobuf_heartbeat"`
 	WriteBufferSize           int      `toml"write-buffer-size"`
 	QueryShardBufferSize      int      `toml:"query-shard-buffer-size"`
+	AntiEntropyInterval       duration `toml:"anti-entropy-interval"`
+	AntiEntropyRangesPerShard int      `toml:"anti-entropy-ranges-per-shard"`
+	WriteConsistencyTimeout   duration `toml:"write-consistency-timeout"`
+	BackPressure              string   `toml:"back-pressure"`
+	BackPressureHighWaterMark float64  `toml:"back-pressure-high-water-mark"`
+	BackPressureTimeout       duration `toml:"back-pressure-timeout"`
+	WalQueueHighWaterMark     float64  `toml:"back-pressure-wal-queue-high-water-mark"`
 }
 
 type LoggingConfig struct {
@@ -94,10 +123,59 @@ type LoggingConfig struct {
 }
 
 type LevelDbConfiguration struct {
-	MaxOpenFiles   int  `toml:"max-open-files"`
-	LruCacheSize   size `toml:"lru-cache-size"`
-	MaxOpenShards  int  `toml:"max-open-shards"`
-	PointBatchSize int  `toml:"point-batch-size"`
+	MaxOpenFiles   int                       `toml:"max-open-files"`
+	LruCacheSize   size                      `toml:"lru-cache-size"`
+	MaxOpenShards  int                       `toml:"max-open-shards"`
+	PointBatchSize int                       `toml:"point-batch-size"`
+	ShortTerm      LevelDbShardConfiguration `toml:"short-term"`
+	LongTerm       LevelDbShardConfiguration `toml:"long-term"`
+}
+
+// The LevelDB options of the shards of one shard type
+type LevelDbShardConfiguration struct {
+	BlockSize       size    `toml:"block-size"`
+	WriteBufferSize size    `toml:"write-buffer-size"`
+	Compression     *bool   `toml:"compression"`
+	BloomFilterBits int     `toml:"bloom-filter-bits"`
+	CacheShare      float64 `toml:"cache-share"`
+}
+
+type LevelDbShardOptions struct {
+	BlockSize       int
+	WriteBufferSize int
+	Compression     bool
+	BloomFilterBits int
+	// the shards of the type share a cache of this size
+	CacheSize int
+}
+
+// Fills in the defaults, the cache share is the part of the lru cache size the
+// shards of the type get.
+func (self *LevelDbShardConfiguration) Options(lruCacheSize int) (LevelDbShardOptions, error) {
+	options := LevelDbShardOptions{
+		BlockSize:       self.BlockSize.int,
+		WriteBufferSize: self.WriteBufferSize.int,
+		Compression:     self.Compression == nil || *self.Compression,
+		BloomFilterBits: self.BloomFilterBits,
+	}
+	if options.BlockSize == 0 {
+		options.BlockSize = 64 * ONE_KILOBYTE
+	}
+	if options.WriteBufferSize == 0 {
+		options.WriteBufferSize = 4 * ONE_MEGABYTE
+	}
+	if options.BloomFilterBits == 0 {
+		options.BloomFilterBits = 10
+	}
+	share := self.CacheShare
+	if share == 0 {
+		share = 0.5
+	}
+	if share < 0 || share > 1 {
+		return options, fmt.Errorf("The cache share has to be between 0 and 1, it's %f", share)
+	}
+	options.CacheSize = int(float64(lruCacheSize) * share)
+	return options, nil
 }
 
 type ShardingDefinition struct {
@@ -154,11 +232,23 @@ func (self *ShardConfiguration) SplitRegex() *regexp.Regexp {
 }
 
 type WalConfig struct {
-	Dir                   string `toml:"dir"`
-	FlushAfterRequests    int    `toml:"flush-after"`
-	BookmarkAfterRequests int    `toml:"bookmark-after"`
-	IndexAfterRequests    int    `toml:"index-after"`
-	RequestsPerLogFile    int    `toml:"requests-per-log-file"`
+	Dir                   string   `toml:"dir"`
+	Dirs                  []string `toml:"dirs"`
+	FlushAfterRequests    int      `toml:"flush-after"`
+	BookmarkAfterRequests int      `toml:"bookmark-after"`
+	IndexAfterRequests    int      `toml:"index-after"`
+	RequestsPerLogFile    int      `toml:"requests-per-log-file"`
+	SyncMode              string   `toml:"sync-mode"`
+	SyncInterval          duration `toml:"sync-interval"`
+	Compression           bool     `toml:"compression"`
+	MaxSize               size     `toml:"max-size"`
+	MaxAge                duration `toml:"max-age"`
+}
+
+type HintedHandoffConfig struct {
+	Dir     string   `toml:"dir"`
+	MaxSize size     `toml:"max-size"`
+	MaxAge  duration `toml:"max-age"`
 }
 
 type InputPlugins struct {
@@ -166,18 +256,19 @@ type InputPlugins struct {
 }
 
 type TomlConfiguration struct {
-	Admin        AdminConfig
-	HttpApi      ApiConfig    `toml:"api"`
-	InputPlugins InputPlugins `toml:"input_plugins"`
-	Raft         RaftConfig
-	Storage      StorageConfig
-	Cluster      ClusterConfig
-	Logging      LoggingConfig
-	LevelDb      LevelDbConfiguration
-	Hostname     string
-	BindAddress  string             `toml:"bind-address"`
-	Sharding     ShardingDefinition `toml:"sharding"`
-	WalConfig    WalConfig          `toml:"wal"`
+	Admin         AdminConfig
+	HttpApi       ApiConfig    `toml:"api"`
+	InputPlugins  InputPlugins `toml:"input_plugins"`
+	Raft          RaftConfig
+	Storage       StorageConfig
+	Cluster       ClusterConfig
+	Logging       LoggingConfig
+	LevelDb       LevelDbConfiguration
+	Hostname      string
+	BindAddress   string              `toml:"bind-address"`
+	Sharding      ShardingDefinition  `toml:"sharding"`
+	WalConfig     WalConfig           `toml:"wal"`
+	HintedHandoff HintedHandoffConfig `toml:"hinted-handoff"`
 }
 
 type Configuration struct {
@@ -193,6 +284,9 @@ type Configuration struct {
 	RaftTimeout               duration
 	SeedServers               []string
 	DataDir                   string
+	StorageEngine             string
+	StoragePointEncoding      string
+	StorageMigrateEncoding    bool
 	RaftDir                   string
 	ProtobufPort              int
 	ProtobufTimeout           duration
@@ -205,17 +299,35 @@ type Configuration struct {
 	LevelDbLruCacheSize       int
 	LevelDbMaxOpenShards      int
 	LevelDbPointBatchSize     int
+	LevelDbShortTerm          LevelDbShardOptions
+	LevelDbLongTerm           LevelDbShardOptions
 	ShortTermShard            *ShardConfiguration
 	LongTermShard             *ShardConfiguration
 	ReplicationFactor         int
 	WalDir                    string
+	WalDirs                   []string
 	WalFlushAfterRequests     int
 	WalBookmarkAfterRequests  int
 	WalIndexAfterRequests     int
 	WalRequestsPerLogFile     int
+	WalSyncMode               string
+	WalSyncInterval           time.Duration
+	WalCompression            bool
+	WalMaxSize                int
+	WalMaxAge                 time.Duration
 	LocalStoreWriteBufferSize int
 	PerServerWriteBufferSize  int
 	QueryShardBufferSize      int
+	AntiEntropyInterval       duration
+	AntiEntropyRangesPerShard int
+	WriteConsistencyTimeout   duration
+	BackPressure              string
+	BackPressureHighWaterMark float64
+	BackPressureTimeout       duration
+	WalQueueHighWaterMark     float64
+	HintedHandoffDir          string
+	HintedHandoffMaxSize      int
+	HintedHandoffMaxAge       duration
 }
 
 func LoadConfiguration(fileName string) *Configuration {
@@ -280,6 +392,9 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		ProtobufHeartbeatInterval: tomlConfiguration.Cluster.ProtobufHeartbeatInterval,
 		SeedServers:               tomlConfiguration.Cluster.SeedServers,
 		DataDir:                   tomlConfiguration.Storage.Dir,
+		StorageEngine:             tomlConfiguration.Storage.Engine,
+		StoragePointEncoding:      tomlConfiguration.Storage.PointEncoding,
+		StorageMigrateEncoding:    tomlConfiguration.Storage.MigratePointEncoding,
 		LogFile:                   tomlConfiguration.Logging.File,
 		LogLevel:                  tomlConfiguration.Logging.Level,
 		Hostname:                  tomlConfiguration.Hostname,
@@ -295,9 +410,24 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		WalBookmarkAfterRequests:  tomlConfiguration.WalConfig.BookmarkAfterRequests,
 		WalIndexAfterRequests:     tomlConfiguration.WalConfig.IndexAfterRequests,
 		WalRequestsPerLogFile:     tomlConfiguration.WalConfig.RequestsPerLogFile,
+		WalSyncMode:               tomlConfiguration.WalConfig.SyncMode,
+		WalSyncInterval:           tomlConfiguration.WalConfig.SyncInterval.Duration,
+		WalCompression:            tomlConfiguration.WalConfig.Compression,
+		WalMaxSize:                tomlConfiguration.WalConfig.MaxSize.int,
+		WalMaxAge:                 tomlConfiguration.WalConfig.MaxAge.Duration,
 		LocalStoreWriteBufferSize: tomlConfiguration.Storage.WriteBufferSize,
 		PerServerWriteBufferSize:  tomlConfiguration.Cluster.WriteBufferSize,
 		QueryShardBufferSize:      defaultQueryShardBufferSize,
+		AntiEntropyInterval:       tomlConfiguration.Cluster.AntiEntropyInterval,
+		AntiEntropyRangesPerShard: tomlConfiguration.Cluster.AntiEntropyRangesPerShard,
+		WriteConsistencyTimeout:   tomlConfiguration.Cluster.WriteConsistencyTimeout,
+		BackPressure:              tomlConfiguration.Cluster.BackPressure,
+		BackPressureHighWaterMark: tomlConfiguration.Cluster.BackPressureHighWaterMark,
+		BackPressureTimeout:       tomlConfiguration.Cluster.BackPressureTimeout,
+		WalQueueHighWaterMark:     tomlConfiguration.Cluster.WalQueueHighWaterMark,
+		HintedHandoffDir:          tomlConfiguration.HintedHandoff.Dir,
+		HintedHandoffMaxSize:      tomlConfiguration.HintedHandoff.MaxSize.int,
+		HintedHandoffMaxAge:       tomlConfiguration.HintedHandoff.MaxAge,
 	}
 
 	if config.LocalStoreWriteBufferSize == 0 {
@@ -307,6 +437,81 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		config.PerServerWriteBufferSize = 1000
 	}
 
+	switch config.WalSyncMode {
+	case "":
+		config.WalSyncMode = WAL_SYNC_NONE
+	case WAL_SYNC_NONE, WAL_SYNC_BATCH, WAL_SYNC_ALWAYS:
+	default:
+		return nil, fmt.Errorf("Unknown wal sync-mode %s, it should be one of none, batch or always", config.WalSyncMode)
+	}
+	if config.WalSyncInterval == 0 {
+		config.WalSyncInterval = 10 * time.Millisecond
+	}
+
+	// the log files are spread over dir and dirs, the bookmark stays in dir
+	walDirs := tomlConfiguration.WalConfig.Dirs
+	if config.WalDir == "" && len(walDirs) > 0 {
+		config.WalDir = walDirs[0]
+	}
+	config.WalDirs = []string{config.WalDir}
+	for _, dir := range walDirs {
+		duplicate := false
+		for _, existing := range config.WalDirs {
+			if path.Clean(existing) == path.Clean(dir) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			config.WalDirs = append(config.WalDirs, dir)
+		}
+	}
+
+	if config.AntiEntropyRangesPerShard == 0 {
+		config.AntiEntropyRangesPerShard = 10
+	}
+	if config.WriteConsistencyTimeout.Duration == 0 {
+		config.WriteConsistencyTimeout = duration{10 * time.Second}
+	}
+
+	switch config.BackPressure {
+	case "":
+		config.BackPressure = BACK_PRESSURE_SHED
+	case BACK_PRESSURE_SHED, BACK_PRESSURE_BLOCK, BACK_PRESSURE_REJECT:
+	default:
+		return nil, fmt.Errorf("Unknown back-pressure %s, it should be one of shed, block or reject", config.BackPressure)
+	}
+	if config.BackPressureHighWaterMark == 0 {
+		config.BackPressureHighWaterMark = 0.9
+	}
+	if config.BackPressureHighWaterMark < 0 || config.BackPressureHighWaterMark > 1 {
+		return nil, fmt.Errorf("back-pressure-high-water-mark should be between 0 and 1, not %f", config.BackPressureHighWaterMark)
+	}
+	if config.BackPressureTimeout.Duration == 0 {
+		config.BackPressureTimeout = duration{5 * time.Second}
+	}
+	if config.WalQueueHighWaterMark == 0 {
+		config.WalQueueHighWaterMark = config.BackPressureHighWaterMark
+	}
+	if config.WalQueueHighWaterMark < 0 || config.WalQueueHighWaterMark > 1 {
+		return nil, fmt.Errorf("back-pressure-wal-queue-high-water-mark should be between 0 and 1, not %f", config.WalQueueHighWaterMark)
+	}
+
+	// if it wasn't set, set it to 1 GB
+	if config.HintedHandoffMaxSize == 0 {
+		config.HintedHandoffMaxSize = ONE_GIGABYTE
+	}
+	if config.HintedHandoffMaxAge.Duration == 0 {
+		config.HintedHandoffMaxAge = duration{7 * 24 * time.Hour}
+	}
+
+	if config.StorageEngine == "" {
+		config.StorageEngine = "leveldb"
+	}
+	if config.StoragePointEncoding == "" {
+		config.StoragePointEncoding = "points"
+	}
+
 	// if it wasn't set, set it to 100
 	if config.LevelDbMaxOpenFiles == 0 {
 		config.LevelDbMaxOpenFiles = 100
@@ -322,6 +527,15 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		config.LevelDbPointBatchSize = 100
 	}
 
+	config.LevelDbShortTerm, err = tomlConfiguration.LevelDb.ShortTerm.Options(config.LevelDbLruCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	config.LevelDbLongTerm, err = tomlConfiguration.LevelDb.LongTerm.Options(config.LevelDbLruCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
 
@@ -29,6 +29,21 @@ func (self *LoadConfigurationSuite) TestConfig(c *C) {
 	// file
 	c.Assert(config.LevelDbMaxOpenFiles, Equals, 100)
 
+	c.Assert(config.LevelDbShortTerm, Equals, LevelDbShardOptions{
+		BlockSize:       64 * ONE_KILOBYTE,
+		WriteBufferSize: 4 * ONE_MEGABYTE,
+		Compression:     true,
+		BloomFilterBits: 10,
+		CacheSize:       100 * ONE_MEGABYTE,
+	})
+	c.Assert(config.LevelDbLongTerm, Equals, LevelDbShardOptions{
+		BlockSize:       256 * ONE_KILOBYTE,
+		WriteBufferSize: 4 * ONE_MEGABYTE,
+		Compression:     false,
+		BloomFilterBits: 10,
+		CacheSize:       150 * ONE_MEGABYTE,
+	})
+
 	c.Assert(config.ApiHttpPort, Equals, 0)
 	c.Assert(config.ApiHttpSslPort, Equals, 8087)
 	c.Assert(config.ApiHttpCertPath, Equals, "../cert.pem")
@@ -43,17 +58,36 @@ func (self *LoadConfigurationSuite) TestConfig(c *C) {
 	c.Assert(config.RaftTimeout.Duration, Equals, time.Second)
 
 	c.Assert(config.DataDir, Equals, "/tmp/influxdb/development/db")
+	c.Assert(config.StorageEngine, Equals, "leveldb")
+	c.Assert(config.StoragePointEncoding, Equals, "points")
 
 	c.Assert(config.ProtobufPort, Equals, 8099)
 	c.Assert(config.ProtobufHeartbeatInterval.Duration, Equals, 200*time.Millisecond)
 	c.Assert(config.ProtobufTimeout.Duration, Equals, 2*time.Second)
 	c.Assert(config.SeedServers, DeepEquals, []string{"hosta:8090", "hostb:8090"})
+	c.Assert(config.AntiEntropyInterval.Duration, Equals, time.Duration(0))
+	c.Assert(config.AntiEntropyRangesPerShard, Equals, 10)
+	c.Assert(config.WriteConsistencyTimeout.Duration, Equals, 10*time.Second)
+	c.Assert(config.BackPressure, Equals, BACK_PRESSURE_REJECT)
+	c.Assert(config.BackPressureHighWaterMark, Equals, 0.8)
+	c.Assert(config.BackPressureTimeout.Duration, Equals, 5*time.Second)
+	c.Assert(config.WalQueueHighWaterMark, Equals, 0.5)
 
 	c.Assert(config.WalDir, Equals, "/tmp/influxdb/development/wal")
 	c.Assert(config.WalFlushAfterRequests, Equals, 0)
 	c.Assert(config.WalBookmarkAfterRequests, Equals, 0)
 	c.Assert(config.WalIndexAfterRequests, Equals, 1000)
 	c.Assert(config.WalRequestsPerLogFile, Equals, 10000)
+	c.Assert(config.WalSyncMode, Equals, WAL_SYNC_BATCH)
+	c.Assert(config.WalSyncInterval, Equals, 10*time.Millisecond)
+	c.Assert(config.WalCompression, Equals, true)
+	c.Assert(config.WalMaxSize, Equals, 5*ONE_GIGABYTE)
+	c.Assert(config.WalMaxAge, Equals, 72*time.Hour)
+	c.Assert(config.WalDirs, DeepEquals, []string{"/tmp/influxdb/development/wal", "/tmp/influxdb/development/wal2"})
+
+	c.Assert(config.HintedHandoffDir, Equals, "/tmp/influxdb/development/hh")
+	c.Assert(config.HintedHandoffMaxSize, Equals, ONE_GIGABYTE)
+	c.Assert(config.HintedHandoffMaxAge.Duration, Equals, 168*time.Hour)
 }
 
 func (self *LoadConfigurationSuite) TestSizeParsing(c *C) {
@@ -3,6 +3,7 @@ package coordinator
 import (
 	"cluster"
 	log "code.google.com/p/log4go"
+	"fmt"
 	"github.com/goraft/raft"
 	"time"
 )
@@ -23,6 +24,15 @@ func init() {
 		&SetContinuousQueryTimestampCommand{},
 		&CreateShardsCommand{},
 		&DropShardCommand{},
+		&ReplaceServerCommand{},
+		&FinishBackfillCommand{},
+		&DecommissionServerCommand{},
+		&AddShardReplicaCommand{},
+		&MoveShardReplicaCommand{},
+		&RecordRewriteCommand{},
+		&ForgetRewriteCommand{},
+		&RemoveServerCommand{},
+		&RestoreShardCommand{},
 	} {
 		internalRaftCommands[command.CommandName()] = command
 	}
@@ -268,3 +278,196 @@ func (c *DropShardCommand) Apply(server raft.Server) (interface{}, error) {
 	err := config.DropShard(c.ShardId, c.ServerIds)
 	return nil, err
 }
+
+type ReplaceServerCommand struct {
+	OldServerId         uint32
+	ReplacementServerId uint32
+}
+
+func NewReplaceServerCommand(oldServerId, replacementServerId uint32) *ReplaceServerCommand {
+	return &ReplaceServerCommand{OldServerId: oldServerId, ReplacementServerId: replacementServerId}
+}
+
+func (c *ReplaceServerCommand) CommandName() string {
+	return "replace_server"
+}
+
+func (c *ReplaceServerCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	oldServer := config.GetServerById(&c.OldServerId)
+	if oldServer == nil {
+		return nil, fmt.Errorf("Server %d doesn't exist", c.OldServerId)
+	}
+	if err := config.ReplaceServer(c.OldServerId, c.ReplacementServerId); err != nil {
+		return nil, err
+	}
+	return nil, removeRaftPeer(server, oldServer)
+}
+
+type FinishBackfillCommand struct {
+	ServerId uint32
+	ShardIds []uint32
+}
+
+func NewFinishBackfillCommand(serverId uint32, shardIds []uint32) *FinishBackfillCommand {
+	return &FinishBackfillCommand{ServerId: serverId, ShardIds: shardIds}
+}
+
+func (c *FinishBackfillCommand) CommandName() string {
+	return "finish_backfill"
+}
+
+func (c *FinishBackfillCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	config.FinishBackfill(c.ServerId, c.ShardIds)
+	return nil, nil
+}
+
+type DecommissionServerCommand struct {
+	ServerId uint32
+}
+
+func NewDecommissionServerCommand(serverId uint32) *DecommissionServerCommand {
+	return &DecommissionServerCommand{ServerId: serverId}
+}
+
+func (c *DecommissionServerCommand) CommandName() string {
+	return "decommission_server"
+}
+
+func (c *DecommissionServerCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.DecommissionServer(c.ServerId)
+	return nil, err
+}
+
+type AddShardReplicaCommand struct {
+	ShardId  uint32
+	ServerId uint32
+}
+
+func NewAddShardReplicaCommand(shardId, serverId uint32) *AddShardReplicaCommand {
+	return &AddShardReplicaCommand{ShardId: shardId, ServerId: serverId}
+}
+
+func (c *AddShardReplicaCommand) CommandName() string {
+	return "add_shard_replica"
+}
+
+func (c *AddShardReplicaCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.AddShardReplica(c.ShardId, c.ServerId)
+	return nil, err
+}
+
+type RecordRewriteCommand struct {
+	Database string
+	Range    *cluster.RewrittenRange
+}
+
+func NewRecordRewriteCommand(database string, rewritten *cluster.RewrittenRange) *RecordRewriteCommand {
+	return &RecordRewriteCommand{database, rewritten}
+}
+
+func (c *RecordRewriteCommand) CommandName() string {
+	return "record_rewrite"
+}
+
+func (c *RecordRewriteCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	config.RecordRewrite(c.Database, c.Range)
+	return nil, nil
+}
+
+type ForgetRewriteCommand struct {
+	Database string
+	Range    *cluster.RewrittenRange
+}
+
+func NewForgetRewriteCommand(database string, rewritten *cluster.RewrittenRange) *ForgetRewriteCommand {
+	return &ForgetRewriteCommand{database, rewritten}
+}
+
+func (c *ForgetRewriteCommand) CommandName() string {
+	return "forget_rewrite"
+}
+
+func (c *ForgetRewriteCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	config.ForgetRewrite(c.Database, c.Range)
+	return nil, nil
+}
+
+type MoveShardReplicaCommand struct {
+	ShardId  uint32
+	ServerId uint32
+}
+
+func NewMoveShardReplicaCommand(shardId, serverId uint32) *MoveShardReplicaCommand {
+	return &MoveShardReplicaCommand{ShardId: shardId, ServerId: serverId}
+}
+
+func (c *MoveShardReplicaCommand) CommandName() string {
+	return "move_shard_replica"
+}
+
+func (c *MoveShardReplicaCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.MoveShardReplica(c.ShardId, c.ServerId)
+	return nil, err
+}
+
+type RemoveServerCommand struct {
+	ServerId uint32
+}
+
+func NewRemoveServerCommand(serverId uint32) *RemoveServerCommand {
+	return &RemoveServerCommand{ServerId: serverId}
+}
+
+func (c *RemoveServerCommand) CommandName() string {
+	return "remove_server"
+}
+
+func (c *RemoveServerCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	clusterServer := config.GetServerById(&c.ServerId)
+	if clusterServer == nil {
+		return nil, fmt.Errorf("Server %d doesn't exist", c.ServerId)
+	}
+	if err := config.RemoveServer(c.ServerId); err != nil {
+		return nil, err
+	}
+	return nil, removeRaftPeer(server, clusterServer)
+}
+
+// The removed server just stops being part of the cluster, the other ones drop it
+// from their peers
+func removeRaftPeer(server raft.Server, clusterServer *cluster.ClusterServer) error {
+	if clusterServer.RaftName == server.Name() {
+		log.Info("(raft:%s) This server has been removed from the cluster", server.Name())
+		return nil
+	}
+	if _, ok := server.Peers()[clusterServer.RaftName]; !ok {
+		return nil
+	}
+	return server.RemovePeer(clusterServer.RaftName)
+}
+
+type RestoreShardCommand struct {
+	Shard *cluster.NewShardData
+}
+
+func NewRestoreShardCommand(shard *cluster.NewShardData) *RestoreShardCommand {
+	return &RestoreShardCommand{Shard: shard}
+}
+
+func (c *RestoreShardCommand) CommandName() string {
+	return "restore_shard"
+}
+
+func (c *RestoreShardCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	_, err := config.AddRestoredShard(c.Shard)
+	return nil, err
+}
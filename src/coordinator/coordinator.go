@@ -32,8 +32,6 @@ const (
 	// actual point sequence numbers will have the first part of the number
 	// be a host id. This ensures that sequence numbers are unique across the cluster
 	HOST_ID_OFFSET = uint64(10000)
-
-	SHARDS_TO_QUERY_FOR_LIST_SERIES = 10
 )
 
 var (
@@ -107,7 +105,13 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 
 		if query.IsListQuery() {
 			if query.IsListSeriesQuery() {
-				self.runListSeriesQuery(querySpec, seriesWriter)
+				if err := self.runListSeriesQuery(querySpec, seriesWriter); err != nil {
+					return err
+				}
+			} else if query.IsListColumnsQuery() {
+				if err := self.runListColumnsQuery(querySpec, seriesWriter); err != nil {
+					return err
+				}
 			} else if query.IsListContinuousQueriesQuery() {
 				queries, err := self.ListContinuousQueries(user, database)
 				if err != nil {
@@ -149,49 +153,61 @@ func (self *CoordinatorImpl) runQuery(query *parser.Query, user common.User, dat
 }
 
 func (self *CoordinatorImpl) runListSeriesQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
-	shortTermShards := self.clusterConfiguration.GetShortTermShards()
-	if len(shortTermShards) > SHARDS_TO_QUERY_FOR_LIST_SERIES {
-		shortTermShards = shortTermShards[:SHARDS_TO_QUERY_FOR_LIST_SERIES]
+	listQuery := querySpec.Query().ListQuery
+	series, err := self.clusterConfiguration.ListSeries(querySpec.Database(), listQuery.Regex)
+	if err != nil {
+		return err
 	}
-	longTermShards := self.clusterConfiguration.GetLongTermShards()
-	if len(longTermShards) > SHARDS_TO_QUERY_FOR_LIST_SERIES {
-		longTermShards = longTermShards[:SHARDS_TO_QUERY_FOR_LIST_SERIES]
+	if listQuery.Offset >= len(series) {
+		series = nil
+	} else {
+		series = series[listQuery.Offset:]
 	}
-	seriesYielded := make(map[string]bool)
-
-	responses := make([]chan *protocol.Response, 0)
-	for _, shard := range shortTermShards {
-		responseChan := make(chan *protocol.Response, self.config.QueryShardBufferSize)
-		go shard.Query(querySpec, responseChan)
-		responses = append(responses, responseChan)
+	if listQuery.Limit > 0 && listQuery.Limit < len(series) {
+		series = series[:listQuery.Limit]
 	}
-	for _, shard := range longTermShards {
-		responseChan := make(chan *protocol.Response, self.config.QueryShardBufferSize)
-		go shard.Query(querySpec, responseChan)
-		responses = append(responses, responseChan)
+	for _, info := range series {
+		name := info.Name
+		seriesWriter.Write(&protocol.Series{Name: &name})
 	}
+	seriesWriter.Close()
+	return nil
+}
 
-	var err error
-	for _, responseChan := range responses {
-		for {
-			response := <-responseChan
-			if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
-				if response.ErrorMessage != nil && err != nil {
-					log.Debug("Error when querying shard: %s", err)
-					err = common.NewQueryError(common.InvalidArgument, *response.ErrorMessage)
-				}
-				break
-			}
-			for _, series := range response.MultiSeries {
-				if !seriesYielded[*series.Name] {
-					seriesYielded[*series.Name] = true
-					seriesWriter.Write(series)
-				}
-			}
+// Returns a point with the name and the type of every column of the series. The type
+// is empty if the column only has null values.
+func (self *CoordinatorImpl) runListColumnsQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	name := querySpec.Query().ListQuery.SeriesName
+	if !querySpec.User().HasReadAccess(name) {
+		return common.NewAuthorizationError("User doesn't have read access to %s", name)
+	}
+
+	regex := regexp.MustCompile("^" + regexp.QuoteMeta(name) + "$")
+	points := []*protocol.Point{}
+	timestamp := common.TimeToMicroseconds(time.Now())
+	sequenceNumber := uint64(1)
+	series, err := self.clusterConfiguration.ListSeries(querySpec.Database(), regex)
+	if err != nil {
+		return err
+	}
+	for _, info := range series {
+		for i, column := range info.Columns {
+			column, columnType := column, info.ColumnTypes[i]
+			points = append(points, &protocol.Point{
+				Values: []*protocol.FieldValue{
+					&protocol.FieldValue{StringValue: &column},
+					&protocol.FieldValue{StringValue: &columnType},
+				},
+				Timestamp:      &timestamp,
+				SequenceNumber: &sequenceNumber,
+			})
 		}
 	}
-	seriesWriter.Close()
-	return err
+	return seriesWriter.Write(&protocol.Series{
+		Name:   &name,
+		Fields: []string{"name", "type"},
+		Points: points,
+	})
 }
 
 func (self *CoordinatorImpl) runDeleteQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
@@ -200,8 +216,18 @@ func (self *CoordinatorImpl) runDeleteQuery(querySpec *parser.QuerySpec, seriesW
 	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
 		return common.NewAuthorizationError("Insufficient permission to write to %s", db)
 	}
-	querySpec.RunAgainstAllServersInShard = true
-	return self.runQuerySpec(querySpec, seriesWriter)
+	startMicro := common.TimeToMicroseconds(querySpec.GetStartTime())
+	endMicro := common.TimeToMicroseconds(querySpec.GetEndTime())
+	ranges := []*cluster.RewrittenRange{}
+	for _, name := range querySpec.Query().DeleteQuery.GetFromClause().Names {
+		rewritten := &cluster.RewrittenRange{Series: name.Name.Name, StartMicro: startMicro, EndMicro: endMicro}
+		if regex, ok := name.Name.GetCompiledRegex(); ok {
+			rewritten.Series = regex.String()
+			rewritten.IsRegex = true
+		}
+		ranges = append(ranges, rewritten)
+	}
+	return self.runRewritingQuery(querySpec, seriesWriter, ranges)
 }
 
 func (self *CoordinatorImpl) runDropSeriesQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
@@ -211,8 +237,32 @@ func (self *CoordinatorImpl) runDropSeriesQuery(querySpec *parser.QuerySpec, ser
 	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) && !user.HasWriteAccess(series) {
 		return common.NewAuthorizationError("Insufficient permissions to drop series")
 	}
+	// the series is gone from all the shards
+	ranges := []*cluster.RewrittenRange{{Series: series, StartMicro: math.MinInt64, EndMicro: math.MaxInt64}}
+	return self.runRewritingQuery(querySpec, seriesWriter, ranges)
+}
+
+// Runs the delete on all the copies of the shards. The ranges it deletes from are
+// recorded in raft first, so the anti entropy repair doesn't bring the points back
+// from a copy that didn't get the delete yet. They're forgotten once the delete
+// succeeded on all the copies, if it didn't they're kept until it's run again.
+func (self *CoordinatorImpl) runRewritingQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter, ranges []*cluster.RewrittenRange) error {
+	db := querySpec.Database()
+	for _, rewritten := range ranges {
+		if err := self.raftServer.RecordRewrite(db, rewritten); err != nil {
+			return err
+		}
+	}
 	querySpec.RunAgainstAllServersInShard = true
-	return self.runQuerySpec(querySpec, seriesWriter)
+	if err := self.runQuerySpec(querySpec, seriesWriter); err != nil {
+		return err
+	}
+	for _, rewritten := range ranges {
+		if err := self.raftServer.ForgetRewrite(db, rewritten); err != nil {
+			log.Warn("Cannot forget the range %d to %d of %s in %s: %s", rewritten.StartMicro, rewritten.EndMicro, rewritten.Series, db, err)
+		}
+	}
+	return nil
 }
 
 func (self *CoordinatorImpl) shouldAggregateLocally(shards []*cluster.ShardData, querySpec *parser.QuerySpec) bool {
@@ -358,21 +408,31 @@ func (self *CoordinatorImpl) ForceCompaction(user common.User) error {
 }
 
 func (self *CoordinatorImpl) WriteSeriesData(user common.User, db string, series *protocol.Series) error {
+	return self.WriteSeriesDataWithConsistency(user, db, []*protocol.Series{series}, cluster.WriteConsistencyAny)
+}
+
+func (self *CoordinatorImpl) WriteSeriesDataWithConsistency(user common.User, db string, series []*protocol.Series, consistency cluster.WriteConsistency) error {
 	if !user.HasWriteAccess(db) {
 		return common.NewAuthorizationError("Insufficient permissions to write to %s", db)
 	}
-	if len(series.Points) == 0 {
-		return fmt.Errorf("Can't write series with zero points.")
+	for _, s := range series {
+		if len(s.Points) == 0 {
+			return fmt.Errorf("Can't write series with zero points.")
+		}
 	}
-
-	err := self.CommitSeriesData(db, series)
-	if err != nil {
+	// all the writes go through here, the back-pressure is checked once for all
+	// the series so a write doesn't get rejected after some of them got logged
+	if err := self.clusterConfiguration.WaitForWriteCapacity(); err != nil {
 		return err
 	}
 
-	self.ProcessContinuousQueries(db, series)
-
-	return err
+	for _, s := range series {
+		if err := self.commitSeriesData(db, s, consistency); err != nil {
+			return err
+		}
+		self.ProcessContinuousQueries(db, s)
+	}
+	return nil
 }
 
 func (self *CoordinatorImpl) ProcessContinuousQueries(db string, series *protocol.Series) {
@@ -466,6 +526,10 @@ func (self *CoordinatorImpl) InterpolateValuesAndCommit(db string, series *proto
 }
 
 func (self *CoordinatorImpl) CommitSeriesData(db string, series *protocol.Series) error {
+	return self.commitSeriesData(db, series, cluster.WriteConsistencyAny)
+}
+
+func (self *CoordinatorImpl) commitSeriesData(db string, series *protocol.Series, consistency cluster.WriteConsistency) error {
 	lastPointIndex := 0
 	now := common.CurrentTime()
 	var shardToWrite cluster.Shard
@@ -496,7 +560,7 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, series *protocol.Series
 			} else if shardToWrite.Id() != shard.Id() {
 				newIndex := i
 				newSeries := &protocol.Series{Name: series.Name, Fields: series.Fields, Points: series.Points[lastPointIndex:newIndex]}
-				if err := self.write(db, newSeries, shardToWrite); err != nil {
+				if err := self.write(db, newSeries, shardToWrite, consistency); err != nil {
 					return err
 				}
 				lastPointIndex = newIndex
@@ -513,7 +577,7 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, series *protocol.Series
 			shardToWrite, _ = self.clusterConfiguration.GetShardToWriteToBySeriesAndTime(db, *series.Name, *series.Points[0].Timestamp)
 		}
 
-		err := self.write(db, series, shardToWrite)
+		err := self.write(db, series, shardToWrite, consistency)
 
 		if err != nil {
 			log.Error("COORD error writing: ", err)
@@ -526,9 +590,112 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, series *protocol.Series
 	return nil
 }
 
-func (self *CoordinatorImpl) write(db string, series *protocol.Series, shard cluster.Shard) error {
+func (self *CoordinatorImpl) write(db string, series *protocol.Series, shard cluster.Shard, consistency cluster.WriteConsistency) error {
 	request := &protocol.Request{Type: &write, Database: &db, Series: series}
-	return shard.Write(request)
+	if consistency == cluster.WriteConsistencyAny {
+		return shard.Write(request)
+	}
+	return shard.WriteWithConsistency(request, consistency, self.config.WriteConsistencyTimeout.Duration)
+}
+
+type updatedPoint struct {
+	timestamp      int64
+	sequenceNumber uint64
+}
+
+func (self *CoordinatorImpl) UpdateSeriesData(user common.User, db string, series *protocol.Series, where string, upsert bool, consistency cluster.WriteConsistency) (int, int, error) {
+	if !user.HasWriteAccess(db) {
+		return 0, 0, common.NewAuthorizationError("Insufficient permissions to write to %s", db)
+	}
+	if len(series.Points) == 0 {
+		return 0, 0, fmt.Errorf("Can't update series with zero points.")
+	}
+	start, end := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, point := range series.Points {
+		if point.Timestamp == nil {
+			return 0, 0, fmt.Errorf("The points to update need a time.")
+		}
+		if t := point.GetTimestamp(); t < start {
+			start = t
+		}
+		if t := point.GetTimestamp(); t > end {
+			end = t
+		}
+	}
+
+	// the shards only return the points in the time range, the exact timestamps are
+	// matched when the points get updated
+	queryString := fmt.Sprintf("select * from %s where time > %du and time < %du", cluster.SeriesRegex(series.GetName()), start-1, end+1)
+	if where != "" {
+		queryString += " and (" + where + ")"
+	}
+	queries, err := parser.ParseQuery(queryString)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(queries) != 1 || queries[0].SelectQuery == nil || queries[0].SelectQuery.GetIntoClause() != nil {
+		return 0, 0, fmt.Errorf("Invalid where condition %s", where)
+	}
+	querySpec := parser.NewQuerySpec(user, db, queries[0])
+
+	// the copies that miss the update would bring the old values back in the anti
+	// entropy repair, it skips the range until all of them got the update
+	rewritten := &cluster.RewrittenRange{Series: series.GetName(), StartMicro: start, EndMicro: end}
+	if err := self.raftServer.RecordRewrite(db, rewritten); err != nil {
+		return 0, 0, err
+	}
+
+	// every copy of a shard returns the points it updated
+	updated := map[updatedPoint]bool{}
+	updatedTimestamps := map[int64]bool{}
+	for _, shard := range self.clusterConfiguration.GetShards(querySpec) {
+		responseChan := make(chan *protocol.Response, self.config.QueryShardBufferSize)
+		go shard.Update(querySpec, series, responseChan)
+		for {
+			response := <-responseChan
+			if response.GetType() == accessDeniedResponse && err == nil {
+				err = common.NewAuthorizationError("Insufficient permissions to update %s", series.GetName())
+			}
+			if response.GetType() == endStreamResponse || response.GetType() == accessDeniedResponse {
+				if response.ErrorMessage != nil && err == nil {
+					err = common.NewQueryError(common.InvalidArgument, *response.ErrorMessage)
+				}
+				break
+			}
+			if response.Series == nil {
+				continue
+			}
+			for _, point := range response.Series.Points {
+				updated[updatedPoint{point.GetTimestamp(), point.GetSequenceNumber()}] = true
+				updatedTimestamps[point.GetTimestamp()] = true
+			}
+		}
+	}
+	if err == nil {
+		if err := self.raftServer.ForgetRewrite(db, rewritten); err != nil {
+			log.Warn("Cannot forget the range %d to %d of %s in %s: %s", start, end, series.GetName(), db, err)
+		}
+	}
+	if err != nil || !upsert {
+		return len(updated), 0, err
+	}
+
+	// the points that didn't match any point get written
+	inserted := make([]*protocol.Point, 0)
+	for _, point := range series.Points {
+		if point.SequenceNumber == nil && updatedTimestamps[point.GetTimestamp()] {
+			continue
+		}
+		if point.SequenceNumber != nil && updated[updatedPoint{point.GetTimestamp(), point.GetSequenceNumber()}] {
+			continue
+		}
+		inserted = append(inserted, point)
+	}
+	if len(inserted) == 0 {
+		return len(updated), 0, nil
+	}
+	err = self.WriteSeriesDataWithConsistency(user, db, []*protocol.Series{{Name: series.Name, Fields: series.Fields, Points: inserted}}, consistency)
+	return len(updated), len(inserted), err
 }
 
 func (self *CoordinatorImpl) CreateContinuousQuery(user common.User, db string, query string) error {
@@ -51,6 +51,14 @@ func (self *WALMock) AssignSequenceNumbersAndLog(request *protocol.Request, shar
 	return uint32(1), nil
 }
 
+func (self *WALMock) AssignSequenceNumbersAndLogAndSync(request *protocol.Request, shard wal.Shard) (uint32, error) {
+	return uint32(1), nil
+}
+
+func (self *WALMock) ForgetServer(serverId uint32) error {
+	return nil
+}
+
 func stringToSeries(seriesString string, c *C) *protocol.Series {
 	series := &protocol.Series{}
 	err := json.Unmarshal([]byte(seriesString), &series)
@@ -677,3 +685,40 @@ func (self *CoordinatorSuite) TestCanJoinAClusterWhenNotInitiallyPointedAtLeader
 	time.Sleep(REPLICATION_LAG)
 	assertConfigContains(newServer.port, "db8", true, c)
 }
+
+func (self *CoordinatorSuite) TestCanDecommissionServerWithoutShards(c *C) {
+	servers := startAndVerifyCluster(3, c)
+	defer clean(servers...)
+
+	removedName := servers[2].name
+	removed := servers[0].clusterConfig.GetServerByRaftName(removedName)
+	c.Assert(removed, NotNil)
+	err := servers[0].DecommissionServer(removed)
+	c.Assert(err, IsNil)
+	time.Sleep(REPLICATION_LAG)
+
+	for _, server := range servers[:2] {
+		c.Assert(server.clusterConfig.Servers(), HasLen, 2)
+		c.Assert(server.clusterConfig.GetServerByRaftName(removedName), IsNil)
+		_, isPeer := server.raftServer.Peers()[removedName]
+		c.Assert(isPeer, Equals, false)
+	}
+}
+
+func (self *CoordinatorSuite) TestReplaceServerRemovesItFromTheRaftPeers(c *C) {
+	servers := startAndVerifyCluster(3, c)
+	defer clean(servers...)
+
+	replacedName := servers[2].name
+	replaced := servers[0].clusterConfig.GetServerByRaftName(replacedName)
+	replacement := servers[0].clusterConfig.GetServerByRaftName(servers[1].name)
+	err := servers[0].ReplaceServer(replaced, replacement)
+	c.Assert(err, IsNil)
+	time.Sleep(REPLICATION_LAG)
+
+	for _, server := range servers[:2] {
+		c.Assert(server.clusterConfig.GetServerByRaftName(replacedName), IsNil)
+		_, isPeer := server.raftServer.Peers()[replacedName]
+		c.Assert(isPeer, Equals, false)
+	}
+}
@@ -0,0 +1,49 @@
+package coordinator
+
+import (
+	"fmt"
+	"hash/fnv"
+	"protocol"
+)
+
+// The sequence numbers derived from request ids stay below 2^53, so they survive
+// the float64 JSON uses for numbers when clients read them back or send them.
+const MAX_IDEMPOTENT_SEQUENCE_NUMBER = uint64(1) << 53
+
+type idempotentPointKey struct {
+	series    string
+	timestamp int64
+}
+
+// Gives the points that don't have a sequence number one derived from the request
+// id, the series, the timestamp and how many points of the series with the same
+// timestamp came before it in the request. A retry of the same write gets the same
+// sequence numbers and overwrites its points instead of duplicating them. The
+// numbers are multiples of HOST_ID_OFFSET, so they never collide with the ones the
+// servers assign, which end in the server id. Points without a time would get a
+// different one on every retry, so they return an error without assigning anything.
+func AssignIdempotentSequenceNumbers(requestId string, series []*protocol.Series) error {
+	for _, s := range series {
+		for _, point := range s.Points {
+			if point.Timestamp == nil {
+				return fmt.Errorf("Writes with a request id need a time for every point, %s has points without one", s.GetName())
+			}
+		}
+	}
+
+	occurrences := map[idempotentPointKey]int{}
+	for _, s := range series {
+		for _, point := range s.Points {
+			if point.SequenceNumber != nil {
+				continue
+			}
+			key := idempotentPointKey{s.GetName(), point.GetTimestamp()}
+			occurrences[key]++
+			hash := fnv.New64a()
+			fmt.Fprintf(hash, "%s\x00%s\x00%d\x00%d", requestId, key.series, key.timestamp, occurrences[key])
+			sequenceNumber := hash.Sum64() % (MAX_IDEMPOTENT_SEQUENCE_NUMBER / HOST_ID_OFFSET) * HOST_ID_OFFSET
+			point.SequenceNumber = &sequenceNumber
+		}
+	}
+	return nil
+}
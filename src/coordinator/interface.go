@@ -16,7 +16,22 @@ type Coordinator interface {
 	//      for all the data points that are returned
 	//   4. The end of a time series is signaled by returning a series with no data points
 	//   5. TODO: Aggregation on the nodes
+	//
+	// Returns a *cluster.OverloadedError if the write was held back by the
+	// back-pressure policy, nothing got written then.
 	WriteSeriesData(user common.User, db string, series *protocol.Series) error
+	// Like WriteSeriesData, but writes all the series of a request and waits until
+	// enough copies of the shards acknowledged them. Returns a
+	// *cluster.PartialWriteError if they didn't in time. The back-pressure is
+	// checked once for all the series, before any of them gets written.
+	WriteSeriesDataWithConsistency(user common.User, db string, series []*protocol.Series, consistency cluster.WriteConsistency) error
+	// Rewrites the columns of the series in the existing points with the same
+	// timestamps, and sequence numbers if they're set, on all the copies of their
+	// shards. Only the points that match the where condition get updated if it
+	// isn't empty. With upsert the points that didn't match any point get written
+	// with WriteSeriesDataWithConsistency. Returns how many points were updated
+	// and how many were written.
+	UpdateSeriesData(user common.User, db string, series *protocol.Series, where string, upsert bool, consistency cluster.WriteConsistency) (int, int, error)
 	DropDatabase(user common.User, db string) error
 	CreateDatabase(user common.User, db string, replicationFactor uint8) error
 	ForceCompaction(user common.User) error
@@ -32,6 +47,11 @@ type Coordinator interface {
 type ClusterConsensus interface {
 	CreateDatabase(name string, replicationFactor uint8) error
 	DropDatabase(name string) error
+	// Keeps the anti entropy repair from bringing back the points deleted from, or
+	// the old values of the points updated in, the series in the time range until
+	// ForgetRewrite is called once all the copies of the shards got the query
+	RecordRewrite(database string, rewritten *cluster.RewrittenRange) error
+	ForgetRewrite(database string, rewritten *cluster.RewrittenRange) error
 	CreateContinuousQuery(db string, query string) error
 	DeleteContinuousQuery(db string, id uint32) error
 	SaveClusterAdminUser(u *cluster.ClusterAdmin) error
@@ -11,6 +11,7 @@ import (
 	"net"
 	"parser"
 	"protocol"
+	"regexp"
 )
 
 type ProtobufRequestHandler struct {
@@ -20,8 +21,18 @@ type ProtobufRequestHandler struct {
 }
 
 var (
-	internalError        = protocol.Response_INTERNAL_ERROR
-	accessDeniedResponse = protocol.Response_ACCESS_DENIED
+	internalError           = protocol.Response_INTERNAL_ERROR
+	accessDeniedResponse    = protocol.Response_ACCESS_DENIED
+	seriesChecksumsResponse = protocol.Response_SERIES_CHECKSUMS
+	seriesInfoResponse      = protocol.Response_SERIES_INFO
+	shardStatsResponse      = protocol.Response_SHARD_STATS
+)
+
+// keep the checksum, series info and shard stats responses well below MAX_RESPONSE_SIZE
+const (
+	SERIES_CHECKSUMS_PER_RESPONSE = 1000
+	SERIES_INFO_PER_RESPONSE      = 1000
+	SHARD_STATS_PER_RESPONSE      = 1000
 )
 
 func NewProtobufRequestHandler(coordinator Coordinator, clusterConfig *cluster.ClusterConfiguration) *ProtobufRequestHandler {
@@ -42,8 +53,16 @@ func (self *ProtobufRequestHandler) HandleRequest(request *protocol.Request, con
 	} else if *request.Type == protocol.Request_DROP_DATABASE {
 		go self.handleDropDatabase(request, conn)
 		return nil
-	} else if *request.Type == protocol.Request_QUERY {
+	} else if *request.Type == protocol.Request_QUERY || *request.Type == protocol.Request_UPDATE {
 		go self.handleQuery(request, conn)
+	} else if *request.Type == protocol.Request_SERIES_CHECKSUMS {
+		go self.handleSeriesChecksums(request, conn)
+	} else if *request.Type == protocol.Request_LIST_SERIES {
+		go self.handleListSeries(request, conn)
+	} else if *request.Type == protocol.Request_SHARD_STATS {
+		go self.handleShardStats(request, conn)
+	} else if *request.Type == protocol.Request_RESYNC {
+		go self.handleResync(request, conn)
 	} else if *request.Type == protocol.Request_HEARTBEAT {
 		response := &protocol.Response{RequestId: request.Id, Type: &heartbeatResponse}
 		return self.WriteResponse(conn, response)
@@ -84,7 +103,8 @@ func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn
 	querySpec := parser.NewQuerySpec(user, *request.Database, query)
 
 	responseChan := make(chan *protocol.Response)
-	if querySpec.IsDestructiveQuery() {
+	// updates are select queries that rewrite the points they match
+	if querySpec.IsDestructiveQuery() || request.GetType() == protocol.Request_UPDATE {
 		go shard.HandleDestructiveQuery(querySpec, request, responseChan, true)
 	} else {
 		go shard.Query(querySpec, responseChan)
@@ -99,6 +119,101 @@ func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn
 	}
 }
 
+func (self *ProtobufRequestHandler) handleSeriesChecksums(request *protocol.Request, conn net.Conn) {
+	var user common.User
+	if *request.IsDbUser {
+		user = self.clusterConfig.GetDbUser(*request.Database, *request.UserName)
+	} else {
+		user = self.clusterConfig.GetClusterAdmin(*request.UserName)
+	}
+
+	if user == nil {
+		errorMsg := fmt.Sprintf("Cannot find user %s", *request.UserName)
+		response := &protocol.Response{Type: &accessDeniedResponse, ErrorMessage: &errorMsg, RequestId: request.Id}
+		self.WriteResponse(conn, response)
+		return
+	}
+
+	shard := self.clusterConfig.GetLocalShardById(*request.ShardId)
+	checksums, err := shard.LocalSeriesChecksums(*request.Database, request.GetStartTime(), request.GetEndTime(), user)
+	if err != nil {
+		log.Error("Error computing series checksums of shard %d: %s", *request.ShardId, err)
+		errorMsg := err.Error()
+		response := &protocol.Response{Type: &endStreamResponse, ErrorMessage: &errorMsg, RequestId: request.Id}
+		self.WriteResponse(conn, response)
+		return
+	}
+
+	for len(checksums) > 0 {
+		count := SERIES_CHECKSUMS_PER_RESPONSE
+		if count > len(checksums) {
+			count = len(checksums)
+		}
+		response := &protocol.Response{Type: &seriesChecksumsResponse, Checksums: checksums[:count], RequestId: request.Id}
+		if err := self.WriteResponse(conn, response); err != nil {
+			return
+		}
+		checksums = checksums[count:]
+	}
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	self.WriteResponse(conn, response)
+}
+
+// the query of the request is the regex the series names have to match, if there's one
+func (self *ProtobufRequestHandler) handleListSeries(request *protocol.Request, conn net.Conn) {
+	var regex *regexp.Regexp
+	if request.GetQuery() != "" {
+		var err error
+		if regex, err = regexp.Compile(request.GetQuery()); err != nil {
+			errorMsg := err.Error()
+			response := &protocol.Response{Type: &endStreamResponse, ErrorMessage: &errorMsg, RequestId: request.Id}
+			self.WriteResponse(conn, response)
+			return
+		}
+	}
+	infos := self.clusterConfig.LocalSeriesInfo(*request.Database, regex)
+	for len(infos) > 0 {
+		count := SERIES_INFO_PER_RESPONSE
+		if count > len(infos) {
+			count = len(infos)
+		}
+		response := &protocol.Response{Type: &seriesInfoResponse, SeriesInfo: infos[:count], RequestId: request.Id}
+		if err := self.WriteResponse(conn, response); err != nil {
+			return
+		}
+		infos = infos[count:]
+	}
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	self.WriteResponse(conn, response)
+}
+
+func (self *ProtobufRequestHandler) handleShardStats(request *protocol.Request, conn net.Conn) {
+	stats := self.clusterConfig.LocalShardStats()
+	for len(stats) > 0 {
+		count := SHARD_STATS_PER_RESPONSE
+		if count > len(stats) {
+			count = len(stats)
+		}
+		response := &protocol.Response{Type: &shardStatsResponse, ShardStats: stats[:count], RequestId: request.Id}
+		if err := self.WriteResponse(conn, response); err != nil {
+			return
+		}
+		stats = stats[count:]
+	}
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	self.WriteResponse(conn, response)
+}
+
+// Answers once the repair is done, so the server that asked for it only clears the
+// resync if the repair succeeded.
+func (self *ProtobufRequestHandler) handleResync(request *protocol.Request, conn net.Conn) {
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	if err := self.clusterConfig.RepairShardsAndWait(); err != nil {
+		response.ErrorMessage = protocol.String(err.Error())
+	}
+	self.WriteResponse(conn, response)
+}
+
 func (self *ProtobufRequestHandler) handleDropDatabase(request *protocol.Request, conn net.Conn) {
 	shard := self.clusterConfig.GetLocalShardById(*request.ShardId)
 	shard.DropDatabase(*request.Database, false)
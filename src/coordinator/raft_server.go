@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"github.com/goraft/raft"
 	"github.com/gorilla/mux"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
@@ -20,6 +21,7 @@ import (
 	"parser"
 	"path/filepath"
 	"protocol"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -27,6 +29,10 @@ import (
 
 const (
 	DEFAULT_ROOT_PWD = "root"
+	// how often the shards this server got a new copy of are checked for a backfill
+	BACKFILL_CHECK_INTERVAL = time.Second
+	// how long the leader waits before it retries a decommission that failed
+	DECOMMISSION_RETRY_INTERVAL = 10 * time.Second
 )
 
 // The raftd server is a combination of the Raft server and an HTTP
@@ -47,6 +53,9 @@ type RaftServer struct {
 	config        *configuration.Configuration
 	notLeader     chan bool
 	coordinator   *CoordinatorImpl
+	// the servers the leader is moving the shards of, by id
+	decommissions     map[uint32]bool
+	decommissionsLock sync.Mutex
 }
 
 var registeredCommands bool
@@ -69,6 +78,7 @@ func NewRaftServer(config *configuration.Configuration, clusterConfig *cluster.C
 		notLeader:     make(chan bool, 1),
 		router:        mux.NewRouter(),
 		config:        config,
+		decommissions: make(map[uint32]bool),
 	}
 	// Read existing name or generate a new one.
 	if b, err := ioutil.ReadFile(filepath.Join(s.path, "name")); err == nil {
@@ -188,6 +198,18 @@ func (s *RaftServer) DropDatabase(name string) error {
 	return err
 }
 
+func (s *RaftServer) RecordRewrite(database string, rewritten *cluster.RewrittenRange) error {
+	command := NewRecordRewriteCommand(database, rewritten)
+	_, err := s.doOrProxyCommand(command, "record_rewrite")
+	return err
+}
+
+func (s *RaftServer) ForgetRewrite(database string, rewritten *cluster.RewrittenRange) error {
+	command := NewForgetRewriteCommand(database, rewritten)
+	_, err := s.doOrProxyCommand(command, "forget_rewrite")
+	return err
+}
+
 func (s *RaftServer) SaveDbUser(u *cluster.DbUser) error {
 	command := NewSaveDbUserCommand(u)
 	_, err := s.doOrProxyCommand(command, "save_db_user")
@@ -267,7 +289,45 @@ func (s *RaftServer) MovePotentialServer(server *cluster.ClusterServer, insertIn
 }
 
 func (s *RaftServer) ReplaceServer(oldServer *cluster.ClusterServer, replacement *cluster.ClusterServer) error {
-	return errors.New("not implemented")
+	command := NewReplaceServerCommand(oldServer.Id, replacement.Id)
+	_, err := s.doOrProxyCommand(command, "replace_server")
+	return err
+}
+
+// Backfills the shards that were assigned to this server by a replace_server
+// command. The raft state keeps track of them until the backfill finished, so
+// a backfill that got interrupted by a restart is picked up again.
+func (s *RaftServer) BackfillShardsPeriodically() {
+	for {
+		s.backfillShards()
+		time.Sleep(BACKFILL_CHECK_INTERVAL)
+	}
+}
+
+func (s *RaftServer) backfillShards() {
+	serverId := s.clusterConfig.LocalServerId
+	shardIds := s.clusterConfig.PendingBackfills(serverId)
+	if len(shardIds) == 0 {
+		return
+	}
+	backfilled := s.clusterConfig.BackfillShards(shardIds)
+	if len(backfilled) == 0 {
+		return
+	}
+	command := NewFinishBackfillCommand(serverId, backfilled)
+	if _, err := s.doOrProxyCommand(command, "finish_backfill"); err != nil {
+		log.Error("Cannot mark the backfill of shards %v as finished: %s", backfilled, err)
+	}
+}
+
+// Puts the server in decommissioning mode, so it doesn't get any new shards. The
+// leader moves its shards to the other servers in the background, see
+// resumeDecommissions. Once all the shards have been moved the server is removed
+// from the cluster.
+func (s *RaftServer) DecommissionServer(server *cluster.ClusterServer) error {
+	command := NewDecommissionServerCommand(server.Id)
+	_, err := s.doOrProxyCommand(command, "decommission_server")
+	return err
 }
 
 func (s *RaftServer) AssignCoordinator(coordinator *CoordinatorImpl) error {
@@ -408,6 +468,7 @@ func (s *RaftServer) raftLeaderLoop(loopTimer *time.Ticker) {
 		case <-loopTimer.C:
 			log.Debug("(raft:%s) Executing leader loop.", s.raftServer.Name())
 			s.checkContinuousQueries()
+			s.resumeDecommissions()
 			break
 		case <-s.notLeader:
 			log.Debug("(raft:%s) Exiting leader loop.", s.raftServer.Name())
@@ -493,6 +554,7 @@ func (s *RaftServer) Serve(l net.Listener) error {
 	s.router.HandleFunc("/cluster_config", s.configHandler).Methods("GET")
 	s.router.HandleFunc("/join", s.joinHandler).Methods("POST")
 	s.router.HandleFunc("/process_command/{command_type}", s.processCommandHandler).Methods("POST")
+	s.router.HandleFunc("/restore_shard/{id}", s.restoreShardHandler).Methods("POST")
 
 	log.Info("Raft Server Listening at %s", s.connectionString())
 
@@ -675,8 +737,205 @@ func (self *RaftServer) CreateShards(shards []*cluster.NewShardData) ([]*cluster
 	return self.clusterConfig.MarshalNewShardArrayToShards(newShards)
 }
 
+func (self *RaftServer) AddShardReplica(shardId, serverId uint32) error {
+	command := NewAddShardReplicaCommand(shardId, serverId)
+	_, err := self.doOrProxyCommand(command, "add_shard_replica")
+	return err
+}
+
+// Called by the leader loop. The decommissioning state is kept in raft, so the
+// leader picks up the servers that are being decommissioned, including the ones
+// whose decommission got interrupted by a restart or a new leader.
+func (self *RaftServer) resumeDecommissions() {
+	for _, server := range self.clusterConfig.Servers() {
+		if server.State != cluster.Decommissioning {
+			continue
+		}
+
+		self.decommissionsLock.Lock()
+		running := self.decommissions[server.Id]
+		self.decommissions[server.Id] = true
+		self.decommissionsLock.Unlock()
+		if running {
+			continue
+		}
+
+		go func(server *cluster.ClusterServer) {
+			if err := self.moveShardsAndRemoveServer(server); err != nil {
+				log.Error("Cannot decommission server %d, retrying in %s: %s", server.Id, DECOMMISSION_RETRY_INTERVAL, err)
+				time.Sleep(DECOMMISSION_RETRY_INTERVAL)
+			}
+			self.decommissionsLock.Lock()
+			delete(self.decommissions, server.Id)
+			self.decommissionsLock.Unlock()
+		}(server)
+	}
+}
+
+func (self *RaftServer) moveShardsAndRemoveServer(server *cluster.ClusterServer) error {
+	for _, shard := range self.clusterConfig.GetAllShards() {
+		if !shard.HasServer(server.Id) {
+			continue
+		}
+
+		// a move that didn't finish is continued with the same server, copying the
+		// data again is fine since writes are idempotent
+		targetId, moving := self.clusterConfig.ReplicaMoveTarget(shard.Id())
+		if !moving || !shard.HasServer(targetId) {
+			target := self.clusterConfig.ServerForNewReplica(shard)
+			if target == nil {
+				return fmt.Errorf("there's no server to move shard %d to", shard.Id())
+			}
+			targetId = target.Id
+			command := NewMoveShardReplicaCommand(shard.Id(), targetId)
+			if _, err := self.doOrProxyCommand(command, "move_shard_replica"); err != nil {
+				return fmt.Errorf("error adding shard %d to server %d: %s", shard.Id(), targetId, err)
+			}
+		}
+
+		log.Info("Decommissioning server %d: moving shard %d to server %d", server.Id, shard.Id(), targetId)
+		if err := self.clusterConfig.CopyShardReplica(shard.Id(), targetId); err != nil {
+			return fmt.Errorf("error copying shard %d to server %d: %s", shard.Id(), targetId, err)
+		}
+		if err := self.DropShard(shard.Id(), []uint32{server.Id}); err != nil {
+			return fmt.Errorf("error dropping shard %d: %s", shard.Id(), err)
+		}
+	}
+
+	command := NewRemoveServerCommand(server.Id)
+	if _, err := self.doOrProxyCommand(command, "remove_server"); err != nil {
+		return fmt.Errorf("error removing the server from the cluster: %s", err)
+	}
+	log.Info("Finished decommissioning server %d", server.Id)
+	return nil
+}
+
 func (self *RaftServer) DropShard(id uint32, serverIds []uint32) error {
 	command := NewDropShardCommand(id, serverIds)
 	_, err := self.doOrProxyCommand(command, "drop_shard")
 	return err
 }
+
+// Loads a shard backup into the copy of the shard on the given server, the backup is
+// forwarded to the server if it isn't this one. The server gets added to the shard,
+// or the shard gets created if the cluster doesn't have it.
+func (self *RaftServer) RestoreShard(shardId, serverId uint32, backup io.Reader) error {
+	if serverId != self.clusterConfig.LocalServerId {
+		return self.forwardShardRestore(shardId, serverId, backup)
+	}
+
+	info, err := self.clusterConfig.RestoreShard(shardId, backup)
+	if err != nil {
+		return err
+	}
+	shard := self.clusterConfig.GetShardById(shardId)
+	if shard == nil {
+		command := NewRestoreShardCommand(&cluster.NewShardData{
+			Id:            shardId,
+			StartTime:     info.StartTime,
+			EndTime:       info.EndTime,
+			ServerIds:     []uint32{serverId},
+			Type:          info.Type,
+			DurationSplit: info.DurationSplit,
+		})
+		_, err := self.doOrProxyCommand(command, "restore_shard")
+		return err
+	}
+	if shard.HasServer(serverId) {
+		return nil
+	}
+	return self.AddShardReplica(shardId, serverId)
+}
+
+func (self *RaftServer) forwardShardRestore(shardId, serverId uint32, backup io.Reader) error {
+	server := self.clusterConfig.GetServerById(&serverId)
+	if server == nil {
+		return fmt.Errorf("Server %d doesn't exist", serverId)
+	}
+	url := fmt.Sprintf("%s/restore_shard/%d", server.RaftConnectionString, shardId)
+	resp, err := http.Post(url, "application/octet-stream", backup)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Server %d couldn't restore shard %d: %s", serverId, shardId, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (s *RaftServer) restoreShardHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.RestoreShard(uint32(id), s.clusterConfig.LocalServerId, req.Body); err != nil {
+		log.Error("Cannot restore shard %d: %s", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Recreates the databases, users and continuous queries of exported metadata.
+// Databases and continuous queries that already exist are skipped, so an import
+// can be retried after it failed part way.
+func (self *RaftServer) ImportMetadata(metadata *cluster.ClusterMetadata) (*cluster.MetadataImportResult, error) {
+	if err := metadata.Validate(); err != nil {
+		return nil, err
+	}
+	result := &cluster.MetadataImportResult{
+		CreatedDatabases:   []string{},
+		SkippedDatabases:   []string{},
+		SavedClusterAdmins: []string{},
+		SavedDbUsers:       []string{},
+	}
+
+	for _, database := range metadata.Databases {
+		if self.clusterConfig.DatabaseExists(database.Name) {
+			result.SkippedDatabases = append(result.SkippedDatabases, database.Name)
+			continue
+		}
+		if err := self.CreateDatabase(database.Name, database.ReplicationFactor); err != nil {
+			return result, fmt.Errorf("Cannot create database %s: %s", database.Name, err)
+		}
+		result.CreatedDatabases = append(result.CreatedDatabases, database.Name)
+	}
+
+	for _, user := range metadata.ClusterAdmins {
+		if err := self.SaveClusterAdminUser(user); err != nil {
+			return result, fmt.Errorf("Cannot save cluster admin %s: %s", user.Name, err)
+		}
+		result.SavedClusterAdmins = append(result.SavedClusterAdmins, user.Name)
+	}
+
+	for _, user := range metadata.DbUsers {
+		if !self.clusterConfig.DatabaseExists(user.Db) {
+			return result, fmt.Errorf("Cannot save user %s, database %s doesn't exist", user.Name, user.Db)
+		}
+		if err := self.SaveDbUser(user); err != nil {
+			return result, fmt.Errorf("Cannot save user %s of database %s: %s", user.Name, user.Db, err)
+		}
+		result.SavedDbUsers = append(result.SavedDbUsers, user.Db+"."+user.Name)
+	}
+
+	for db, queries := range metadata.ContinuousQueries {
+		existing := map[string]bool{}
+		for _, query := range self.clusterConfig.GetContinuousQueries(db) {
+			existing[query.Query] = true
+		}
+		for _, query := range queries {
+			if existing[query.Query] {
+				result.SkippedContinuousQueries++
+				continue
+			}
+			if err := self.CreateContinuousQuery(db, query.Query); err != nil {
+				return result, fmt.Errorf("Cannot create continuous query %s of database %s: %s", query.Query, db, err)
+			}
+			result.CreatedContinuousQueries++
+		}
+	}
+
+	log.Info("Imported the cluster metadata exported at %s", metadata.ExportedAt)
+	return result, nil
+}
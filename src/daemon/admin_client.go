@@ -0,0 +1,117 @@
+package main
+
+import (
+	"configuration"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Backups and metadata exports need the state the cluster keeps in raft, so the
+// command line tools go through the api of the server that's running with the config.
+type adminClient struct {
+	baseUrl  string
+	username string
+	password string
+}
+
+func newAdminClient(config *configuration.Configuration, username, password string) *adminClient {
+	host := config.BindAddress
+	if host == "" || host == "0.0.0.0" {
+		host = "localhost"
+	}
+	return &adminClient{
+		baseUrl:  fmt.Sprintf("http://%s:%d", host, config.ApiHttpPort),
+		username: username,
+		password: password,
+	}
+}
+
+func (self *adminClient) do(method, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(self.username, self.password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+func (self *adminClient) backup(shardId int, fileName string) error {
+	return self.download(fmt.Sprintf("%s/cluster/shards/%d/backup", self.baseUrl, shardId), fileName)
+}
+
+func (self *adminClient) exportMetadata(fileName string) error {
+	return self.download(self.baseUrl+"/cluster/metadata", fileName)
+}
+
+func (self *adminClient) download(url, fileName string) error {
+	resp, err := self.do("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// write to a temporary file so a failed download doesn't replace a good one
+	file, err := os.Create(fileName + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), fileName)
+}
+
+func (self *adminClient) restore(shardId, serverId int, fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	url := fmt.Sprintf("%s/cluster/shards/%d/restore", self.baseUrl, shardId)
+	if serverId > 0 {
+		url = fmt.Sprintf("%s?server_id=%d", url, serverId)
+	}
+	resp, err := self.do("POST", url, file)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// prints what the import changed
+func (self *adminClient) importMetadata(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	resp, err := self.do("POST", self.baseUrl+"/cluster/metadata", file)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(os.Stdout, resp.Body)
+	fmt.Println()
+	return err
+}
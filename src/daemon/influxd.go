@@ -57,6 +57,14 @@ func main() {
 	wantsVersion := flag.Bool("v", false, "Get version number")
 	resetRootPassword := flag.Bool("reset-root", false, "Reset root password")
 	pidFile := flag.String("pidfile", "", "the pid file")
+	backupShard := flag.Int("backup-shard", 0, "Back up the shard with the given id from the running server to -backup-file")
+	restoreShard := flag.Int("restore-shard", 0, "Restore -backup-file into the shard with the given id through the running server")
+	restoreServer := flag.Int("restore-server", 0, "The id of the server to restore the shard on, defaults to the running server")
+	backupFile := flag.String("backup-file", "", "The shard backup file")
+	exportMetadata := flag.String("export-metadata", "", "Export the databases, users and continuous queries of the running server's cluster to the file")
+	importMetadata := flag.String("import-metadata", "", "Import the metadata exported with -export-metadata into the running server's cluster")
+	username := flag.String("username", "root", "The cluster admin to run the backup, restore or metadata commands as")
+	password := flag.String("password", "root", "The password of the cluster admin")
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
@@ -66,6 +74,29 @@ func main() {
 		return
 	}
 	config := configuration.LoadConfiguration(*fileName)
+
+	if *backupShard > 0 || *restoreShard > 0 || *exportMetadata != "" || *importMetadata != "" {
+		client := newAdminClient(config, *username, *password)
+		var err error
+		switch {
+		case *exportMetadata != "":
+			err = client.exportMetadata(*exportMetadata)
+		case *importMetadata != "":
+			err = client.importMetadata(*importMetadata)
+		case *backupFile == "":
+			err = fmt.Errorf("-backup-file is required")
+		case *backupShard > 0:
+			err = client.backup(*backupShard, *backupFile)
+		default:
+			err = client.restore(*restoreShard, *restoreServer, *backupFile)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	setupLogging(config.LogLevel, config.LogFile)
 
 	if pidFile != nil && *pidFile != "" {
@@ -0,0 +1,543 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"protocol"
+)
+
+// Shards using the block encoding pack runs of consecutive points of a column into
+// a single entry. The entry is stored under the point key of the last point in the
+// block, so seeking to a point key lands on the block that would contain it. Blocks
+// start with a zero byte, which can't be the first byte of a marshalled FieldValue,
+// so blocks and entries holding a single point can live side by side in a shard.
+//
+// A block is laid out like this:
+//
+//   marker (0x00), version, number of points (uvarint)
+//   timestamp and sequence number of the first point, like in the keys
+//   timestamps as run length encoded delta of deltas
+//   sequence numbers as run length encoded deltas
+//   the value types, run length encoded
+//   int64 values as run length encoded deltas
+//   bool values run length encoded
+//   string values prefixed with their length
+//   double values xor'ed with the previous value (length prefixed bit stream)
+
+const (
+	BLOCK_MARKER          = 0x00
+	BLOCK_VERSION         = 1
+	MAX_POINTS_PER_BLOCK  = 1000
+	BLOCK_HEADER_SIZE     = 2
+	blockValueTypeEmpty   = 0
+	blockValueTypeInt64   = 1
+	blockValueTypeDouble  = 2
+	blockValueTypeBool    = 3
+	blockValueTypeString  = 4
+	blockMaxVarintLength  = binary.MaxVarintLen64
+	blockFirstPointLength = 16
+)
+
+type blockPoint struct {
+	timestamp int64
+	sequence  uint64
+	// a nil value deletes the point when writing
+	value *protocol.FieldValue
+}
+
+// returns -1, 0 or 1 if the point sorts before, at the same place or after other
+func (self *blockPoint) compare(other *blockPoint) int {
+	switch {
+	case self.timestamp < other.timestamp:
+		return -1
+	case self.timestamp > other.timestamp:
+		return 1
+	case self.sequence < other.sequence:
+		return -1
+	case self.sequence > other.sequence:
+		return 1
+	}
+	return 0
+}
+
+func isBlock(value []byte) bool {
+	return len(value) > 0 && value[0] == BLOCK_MARKER
+}
+
+func blockValueType(value *protocol.FieldValue) byte {
+	switch {
+	case value.Int64Value != nil:
+		return blockValueTypeInt64
+	case value.DoubleValue != nil:
+		return blockValueTypeDouble
+	case value.BoolValue != nil:
+		return blockValueTypeBool
+	case value.StringValue != nil:
+		return blockValueTypeString
+	}
+	return blockValueTypeEmpty
+}
+
+func encodeBlock(points []*blockPoint) []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0, BLOCK_HEADER_SIZE+blockFirstPointLength+len(points)*4))
+	buffer.WriteByte(BLOCK_MARKER)
+	buffer.WriteByte(BLOCK_VERSION)
+	writeUvarint(buffer, uint64(len(points)))
+	binary.Write(buffer, binary.BigEndian, convertTimestampToUint(points[0].timestamp))
+	binary.Write(buffer, binary.BigEndian, points[0].sequence)
+
+	// the arithmetic wraps around the same way when decoding
+	timestampDelta := func(i int) int64 {
+		if i == 0 {
+			return 0
+		}
+		return points[i].timestamp - points[i-1].timestamp
+	}
+	writeRuns(buffer, len(points)-1, func(i int) uint64 {
+		return uint64(timestampDelta(i+1) - timestampDelta(i))
+	}, func(v uint64) {
+		writeVarint(buffer, int64(v))
+	})
+	writeRuns(buffer, len(points)-1, func(i int) uint64 {
+		return points[i+1].sequence - points[i].sequence
+	}, func(v uint64) {
+		writeVarint(buffer, int64(v))
+	})
+
+	types := make([]byte, len(points))
+	for i, point := range points {
+		types[i] = blockValueType(point.value)
+	}
+	writeRuns(buffer, len(types), func(i int) uint64 { return uint64(types[i]) }, func(v uint64) {
+		buffer.WriteByte(byte(v))
+	})
+
+	ints := make([]int64, 0)
+	bools := make([]bool, 0)
+	doubles := newBitWriter()
+	xor := &xorEncoder{}
+	for i, point := range points {
+		switch types[i] {
+		case blockValueTypeInt64:
+			ints = append(ints, point.value.GetInt64Value())
+		case blockValueTypeBool:
+			bools = append(bools, point.value.GetBoolValue())
+		case blockValueTypeDouble:
+			xor.encode(doubles, point.value.GetDoubleValue())
+		}
+	}
+
+	if len(ints) > 0 {
+		writeVarint(buffer, ints[0])
+		writeRuns(buffer, len(ints)-1, func(i int) uint64 { return uint64(ints[i+1] - ints[i]) }, func(v uint64) {
+			writeVarint(buffer, int64(v))
+		})
+	}
+
+	writeRuns(buffer, len(bools), func(i int) uint64 {
+		if bools[i] {
+			return 1
+		}
+		return 0
+	}, func(v uint64) {
+		buffer.WriteByte(byte(v))
+	})
+
+	for i, point := range points {
+		if types[i] == blockValueTypeString {
+			value := point.value.GetStringValue()
+			writeUvarint(buffer, uint64(len(value)))
+			buffer.WriteString(value)
+		}
+	}
+
+	writeUvarint(buffer, uint64(len(doubles.bytes)))
+	buffer.Write(doubles.bytes)
+	return buffer.Bytes()
+}
+
+// returns the timestamp and sequence number of the first point in the block without
+// decoding the rest of it
+func blockFirstPoint(block []byte) (int64, uint64, error) {
+	reader := bytes.NewReader(block[BLOCK_HEADER_SIZE:])
+	if _, err := binary.ReadUvarint(reader); err != nil {
+		return 0, 0, err
+	}
+	var timestamp, sequence uint64
+	if err := binary.Read(reader, binary.BigEndian, &timestamp); err != nil {
+		return 0, 0, err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &sequence); err != nil {
+		return 0, 0, err
+	}
+	return convertUintTimestampToInt64(timestamp), sequence, nil
+}
+
+func decodeBlock(block []byte) ([]*blockPoint, error) {
+	if len(block) < BLOCK_HEADER_SIZE || block[0] != BLOCK_MARKER {
+		return nil, fmt.Errorf("Not a block")
+	}
+	if block[1] != BLOCK_VERSION {
+		return nil, fmt.Errorf("Unknown block version %d", block[1])
+	}
+
+	reader := bytes.NewReader(block[BLOCK_HEADER_SIZE:])
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 || count > MAX_POINTS_PER_BLOCK {
+		return nil, fmt.Errorf("Corrupted block with %d points", count)
+	}
+
+	points := make([]*blockPoint, count)
+	var timestamp, sequence uint64
+	if err := binary.Read(reader, binary.BigEndian, &timestamp); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &sequence); err != nil {
+		return nil, err
+	}
+	points[0] = &blockPoint{timestamp: convertUintTimestampToInt64(timestamp), sequence: sequence}
+
+	readVarint := func() (uint64, error) {
+		v, err := binary.ReadVarint(reader)
+		return uint64(v), err
+	}
+	var delta int64
+	i := 1
+	err = readRuns(reader, len(points)-1, readVarint, func(dod uint64) {
+		delta += int64(dod)
+		points[i] = &blockPoint{timestamp: points[i-1].timestamp + delta}
+		i++
+	})
+	if err != nil {
+		return nil, err
+	}
+	i = 1
+	err = readRuns(reader, len(points)-1, readVarint, func(sequenceDelta uint64) {
+		points[i].sequence = points[i-1].sequence + sequenceDelta
+		i++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	types := make([]byte, 0, count)
+	err = readRuns(reader, int(count), func() (uint64, error) {
+		t, err := reader.ReadByte()
+		return uint64(t), err
+	}, func(v uint64) {
+		types = append(types, byte(v))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[byte]int)
+	for _, t := range types {
+		counts[t]++
+	}
+
+	ints := make([]int64, 0, counts[blockValueTypeInt64])
+	if counts[blockValueTypeInt64] > 0 {
+		first, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, first)
+		err = readRuns(reader, counts[blockValueTypeInt64]-1, readVarint, func(delta uint64) {
+			ints = append(ints, ints[len(ints)-1]+int64(delta))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bools := make([]bool, 0, counts[blockValueTypeBool])
+	err = readRuns(reader, counts[blockValueTypeBool], func() (uint64, error) {
+		b, err := reader.ReadByte()
+		return uint64(b), err
+	}, func(v uint64) {
+		bools = append(bools, v == 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	strings := make([]string, 0, counts[blockValueTypeString])
+	for i := 0; i < counts[blockValueTypeString]; i++ {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		if length > uint64(reader.Len()) {
+			return nil, fmt.Errorf("Corrupted block, string of length %d", length)
+		}
+		value := make([]byte, length)
+		reader.Read(value)
+		strings = append(strings, string(value))
+	}
+
+	doublesLength, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if doublesLength > uint64(reader.Len()) {
+		return nil, fmt.Errorf("Corrupted block, doubles of length %d", doublesLength)
+	}
+	doublesBytes := make([]byte, doublesLength)
+	reader.Read(doublesBytes)
+	doubles := &bitReader{bytes: doublesBytes}
+	xor := &xorDecoder{}
+
+	for i, point := range points {
+		value := &protocol.FieldValue{}
+		switch types[i] {
+		case blockValueTypeInt64:
+			value.Int64Value = &ints[0]
+			ints = ints[1:]
+		case blockValueTypeBool:
+			value.BoolValue = &bools[0]
+			bools = bools[1:]
+		case blockValueTypeString:
+			value.StringValue = &strings[0]
+			strings = strings[1:]
+		case blockValueTypeDouble:
+			double, err := xor.decode(doubles)
+			if err != nil {
+				return nil, err
+			}
+			value.DoubleValue = &double
+		case blockValueTypeEmpty:
+		default:
+			return nil, fmt.Errorf("Corrupted block, unknown value type %d", types[i])
+		}
+		point.value = value
+	}
+	return points, nil
+}
+
+func writeUvarint(buffer *bytes.Buffer, v uint64) {
+	b := make([]byte, blockMaxVarintLength)
+	buffer.Write(b[:binary.PutUvarint(b, v)])
+}
+
+func writeVarint(buffer *bytes.Buffer, v int64) {
+	b := make([]byte, blockMaxVarintLength)
+	buffer.Write(b[:binary.PutVarint(b, v)])
+}
+
+// writes runs of equal values as the value followed by the length of the run
+func writeRuns(buffer *bytes.Buffer, count int, value func(i int) uint64, writeValue func(v uint64)) {
+	for i := 0; i < count; {
+		v := value(i)
+		run := 1
+		for i+run < count && value(i+run) == v {
+			run++
+		}
+		writeValue(v)
+		writeUvarint(buffer, uint64(run))
+		i += run
+	}
+}
+
+func readRuns(reader *bytes.Reader, count int, readValue func() (uint64, error), yield func(v uint64)) error {
+	for read := 0; read < count; {
+		v, err := readValue()
+		if err != nil {
+			return err
+		}
+		run, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return err
+		}
+		if run == 0 || run > uint64(count-read) {
+			return fmt.Errorf("Corrupted block, run of length %d", run)
+		}
+		for i := uint64(0); i < run; i++ {
+			yield(v)
+		}
+		read += int(run)
+	}
+	return nil
+}
+
+type bitWriter struct {
+	bytes []byte
+	// the number of bits used in the last byte
+	used uint
+}
+
+func newBitWriter() *bitWriter {
+	return &bitWriter{used: 8}
+}
+
+func (self *bitWriter) writeBit(bit bool) {
+	if self.used == 8 {
+		self.bytes = append(self.bytes, 0)
+		self.used = 0
+	}
+	if bit {
+		self.bytes[len(self.bytes)-1] |= 1 << (7 - self.used)
+	}
+	self.used++
+}
+
+// writes the lowest n bits of v, most significant bit first
+func (self *bitWriter) writeBits(v uint64, n uint) {
+	for i := n; i > 0; i-- {
+		self.writeBit(v&(1<<(i-1)) != 0)
+	}
+}
+
+type bitReader struct {
+	bytes []byte
+	// the number of bits read so far
+	position uint
+}
+
+func (self *bitReader) readBit() (bool, error) {
+	if self.position >= uint(len(self.bytes))*8 {
+		return false, fmt.Errorf("Corrupted block, ran out of bits")
+	}
+	bit := self.bytes[self.position/8]&(1<<(7-self.position%8)) != 0
+	self.position++
+	return bit, nil
+}
+
+func (self *bitReader) readBits(n uint) (uint64, error) {
+	var v uint64
+	for i := uint(0); i < n; i++ {
+		bit, err := self.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+	return v, nil
+}
+
+// Doubles are xor'ed with the previous value. Consecutive values of a metric tend to
+// share the sign, exponent and the first bits of the mantissa, so only the bits in
+// the middle that differ get written.
+type xorEncoder struct {
+	started   bool
+	hasWindow bool
+	previous  uint64
+	leading   uint
+	trailing  uint
+}
+
+func (self *xorEncoder) encode(writer *bitWriter, value float64) {
+	bits := math.Float64bits(value)
+	if !self.started {
+		writer.writeBits(bits, 64)
+		self.started = true
+		self.previous = bits
+		return
+	}
+
+	xor := bits ^ self.previous
+	self.previous = bits
+	if xor == 0 {
+		writer.writeBit(false)
+		return
+	}
+	writer.writeBit(true)
+
+	leading, trailing := leadingZeros(xor), trailingZeros(xor)
+	// the number of leading zeros is written in 5 bits
+	if leading > 31 {
+		leading = 31
+	}
+	if self.hasWindow && leading >= self.leading && trailing >= self.trailing {
+		writer.writeBit(false)
+		writer.writeBits(xor>>self.trailing, 64-self.leading-self.trailing)
+		return
+	}
+
+	writer.writeBit(true)
+	meaningful := 64 - leading - trailing
+	writer.writeBits(uint64(leading), 5)
+	// meaningful is between 1 and 64, 64 is written as 0
+	writer.writeBits(uint64(meaningful&63), 6)
+	writer.writeBits(xor>>trailing, meaningful)
+	self.leading, self.trailing = leading, trailing
+	self.hasWindow = true
+}
+
+type xorDecoder struct {
+	started  bool
+	previous uint64
+	leading  uint
+	trailing uint
+}
+
+func (self *xorDecoder) decode(reader *bitReader) (float64, error) {
+	if !self.started {
+		bits, err := reader.readBits(64)
+		if err != nil {
+			return 0, err
+		}
+		self.started = true
+		self.previous = bits
+		return math.Float64frombits(bits), nil
+	}
+
+	changed, err := reader.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if !changed {
+		return math.Float64frombits(self.previous), nil
+	}
+
+	newWindow, err := reader.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if newWindow {
+		leading, err := reader.readBits(5)
+		if err != nil {
+			return 0, err
+		}
+		meaningful, err := reader.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		if meaningful == 0 {
+			meaningful = 64
+		}
+		if leading+meaningful > 64 {
+			return 0, fmt.Errorf("Corrupted block, invalid xor window")
+		}
+		self.leading, self.trailing = uint(leading), uint(64-leading-meaningful)
+	}
+
+	xor, err := reader.readBits(64 - self.leading - self.trailing)
+	if err != nil {
+		return 0, err
+	}
+	self.previous ^= xor << self.trailing
+	return math.Float64frombits(self.previous), nil
+}
+
+func leadingZeros(v uint64) uint {
+	n := uint(0)
+	for ; n < 64 && v&(1<<(63-n)) == 0; n++ {
+	}
+	return n
+}
+
+func trailingZeros(v uint64) uint {
+	n := uint(0)
+	for ; n < 64 && v&(1<<n) == 0; n++ {
+	}
+	return n
+}
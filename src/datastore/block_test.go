@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	. "launchpad.net/gocheck"
+	"math"
+	"protocol"
+)
+
+type BlockSuite struct{}
+
+var _ = Suite(&BlockSuite{})
+
+func (self *BlockSuite) assertRoundTrip(c *C, points []*blockPoint) []byte {
+	block := encodeBlock(points)
+	c.Assert(isBlock(block), Equals, true)
+
+	decoded, err := decodeBlock(block)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, HasLen, len(points))
+	for i, point := range points {
+		c.Assert(decoded[i].timestamp, Equals, point.timestamp)
+		c.Assert(decoded[i].sequence, Equals, point.sequence)
+		c.Assert(decoded[i].value, DeepEquals, point.value)
+	}
+
+	timestamp, sequence, err := blockFirstPoint(block)
+	c.Assert(err, IsNil)
+	c.Assert(timestamp, Equals, points[0].timestamp)
+	c.Assert(sequence, Equals, points[0].sequence)
+	return block
+}
+
+func (self *BlockSuite) TestRegularDoubles(c *C) {
+	points := make([]*blockPoint, 0, MAX_POINTS_PER_BLOCK)
+	for i := 0; i < MAX_POINTS_PER_BLOCK; i++ {
+		points = append(points, &blockPoint{
+			timestamp: int64(1400000000+i*10) * 1000000,
+			sequence:  uint64(i + 1),
+			value:     &protocol.FieldValue{DoubleValue: proto.Float64(20 + float64(i%7)/2)},
+		})
+	}
+	block := self.assertRoundTrip(c, points)
+
+	// a marshalled FieldValue alone takes 9 bytes for every point
+	c.Assert(len(block) < 9*MAX_POINTS_PER_BLOCK/2, Equals, true)
+}
+
+func (self *BlockSuite) TestMixedValues(c *C) {
+	values := []*protocol.FieldValue{
+		{Int64Value: proto.Int64(math.MinInt64)},
+		{Int64Value: proto.Int64(math.MaxInt64)},
+		{Int64Value: proto.Int64(0)},
+		{DoubleValue: proto.Float64(math.Inf(-1))},
+		{DoubleValue: proto.Float64(1.5)},
+		{DoubleValue: proto.Float64(-0.1)},
+		{BoolValue: proto.Bool(true)},
+		{BoolValue: proto.Bool(true)},
+		{BoolValue: proto.Bool(false)},
+		{StringValue: proto.String("")},
+		{StringValue: proto.String("foo")},
+		{},
+	}
+	points := make([]*blockPoint, 0, len(values))
+	timestamps := []int64{math.MinInt64, -1000000, -1, 0, 0, 0, 1, 1000000, 1000001, 5000000, math.MaxInt64 - 1, math.MaxInt64}
+	for i, value := range values {
+		points = append(points, &blockPoint{timestamp: timestamps[i], sequence: uint64(len(values) - i), value: value})
+	}
+	self.assertRoundTrip(c, points)
+}
+
+func (self *BlockSuite) TestSinglePoint(c *C) {
+	self.assertRoundTrip(c, []*blockPoint{{timestamp: 1, sequence: math.MaxUint64, value: &protocol.FieldValue{StringValue: proto.String("bar")}}})
+}
+
+func (self *BlockSuite) TestCorruptedBlocks(c *C) {
+	block := encodeBlock([]*blockPoint{
+		{timestamp: 1, sequence: 1, value: &protocol.FieldValue{DoubleValue: proto.Float64(1)}},
+		{timestamp: 2, sequence: 1, value: &protocol.FieldValue{DoubleValue: proto.Float64(2)}},
+	})
+	for i := BLOCK_HEADER_SIZE; i < len(block); i++ {
+		_, err := decodeBlock(block[:i])
+		c.Assert(err, NotNil)
+	}
+
+	data, err := proto.Marshal(&protocol.FieldValue{Int64Value: proto.Int64(0)})
+	c.Assert(err, IsNil)
+	c.Assert(isBlock(data), Equals, false)
+}
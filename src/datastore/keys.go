@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"bytes"
+	"common"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// The values of a column are stored under keys made of the 8 byte id of the column, the
+// timestamp and the sequence number of the point. Both are big endian and the timestamp
+// is shifted so negative timestamps sort before positive ones, so iterating over the keys
+// of a column goes through its points in time order.
+
+const (
+	POINT_KEY_SIZE = 24
+)
+
+func convertTimestampToUint(t int64) uint64 {
+	if t < 0 {
+		return uint64(math.MaxInt64 + t + 1)
+	}
+	return uint64(t) + uint64(math.MaxInt64) + uint64(1)
+}
+
+func convertUintTimestampToInt64(t uint64) int64 {
+	if t > uint64(math.MaxInt64) {
+		return int64(t-math.MaxInt64) - int64(1)
+	}
+	return int64(t) - math.MaxInt64 - int64(1)
+}
+
+func byteArrayForTimeInt(t int64) []byte {
+	timeBuffer := bytes.NewBuffer(make([]byte, 0, 8))
+	binary.Write(timeBuffer, binary.BigEndian, convertTimestampToUint(t))
+	return timeBuffer.Bytes()
+}
+
+func byteArrayForTime(t time.Time) []byte {
+	return byteArrayForTimeInt(common.TimeToMicroseconds(t))
+}
+
+func pointKey(columnId []byte, timestamp int64, sequenceNumber uint64) []byte {
+	keyBuffer := bytes.NewBuffer(make([]byte, 0, POINT_KEY_SIZE))
+	keyBuffer.Write(columnId)
+	binary.Write(keyBuffer, binary.BigEndian, convertTimestampToUint(timestamp))
+	binary.Write(keyBuffer, binary.BigEndian, sequenceNumber)
+	return keyBuffer.Bytes()
+}
+
+// returns the first and the last possible key of the column in the time range
+func pointKeyRange(columnId, startTimeBytes, endTimeBytes []byte) ([]byte, []byte) {
+	start := append(append([]byte{}, columnId...), startTimeBytes...)
+	end := append(append(append([]byte{}, columnId...), endTimeBytes...), MAX_SEQUENCE...)
+	return start, end
+}
+
+func timestampFromRaw(rawTime []byte) int64 {
+	return convertUintTimestampToInt64(binary.BigEndian.Uint64(rawTime))
+}
+
+func sequenceNumberFromRaw(rawSequence []byte) uint64 {
+	return binary.BigEndian.Uint64(rawSequence)
+}
+
+// returns true if the point has the correct field id and is
+// in the given time range
+func isPointInRange(fieldId, startTime, endTime, point []byte) bool {
+	id := point[:8]
+	time := point[8:16]
+	return bytes.Equal(id, fieldId) && bytes.Compare(time, startTime) > -1 && bytes.Compare(time, endTime) < 1
+}
+
+func seriesColumnIndexKey(database, series, column string) []byte {
+	return append(append([]byte{}, SERIES_COLUMN_INDEX_PREFIX...), []byte(database+"~"+series+"~"+column)...)
+}
+
+func databaseSeriesIndexKey(database, series string) []byte {
+	return append(append([]byte{}, DATABASE_SERIES_INDEX_PREFIX...), []byte(database+"~"+series)...)
+}
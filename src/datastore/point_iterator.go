@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"bytes"
+	"datastore/storage"
+	"protocol"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Goes through the points of a column one at a time, whether they're stored in blocks
+// or in entries of their own. Entries that don't belong to the column are passed
+// through as they are, so the caller can tell where the column ends by looking at the
+// keys.
+type pointIterator struct {
+	it       storage.Iterator
+	columnId []byte
+	// the decoded points of the current entry, nil if it isn't a block
+	points []*blockPoint
+	index  int
+	err    error
+}
+
+func newPointIterator(it storage.Iterator, columnId []byte) *pointIterator {
+	return &pointIterator{it: it, columnId: columnId}
+}
+
+// Positions the iterator at the first point with a key greater or equal to key
+func (self *pointIterator) Seek(key []byte) {
+	self.it.Seek(key)
+	self.load(false)
+	for self.points != nil && bytes.Compare(self.Key(), key) < 0 {
+		self.index++
+		if self.index == len(self.points) {
+			// can only happen if the key sorts after the key of the block
+			self.it.Next()
+			self.load(false)
+		}
+	}
+}
+
+func (self *pointIterator) Next() {
+	if self.points != nil && self.index+1 < len(self.points) {
+		self.index++
+		return
+	}
+	self.it.Next()
+	self.load(false)
+}
+
+func (self *pointIterator) Prev() {
+	if self.points != nil && self.index > 0 {
+		self.index--
+		return
+	}
+	self.it.Prev()
+	self.load(true)
+}
+
+func (self *pointIterator) Valid() bool {
+	return self.err == nil && self.it.Valid()
+}
+
+func (self *pointIterator) Key() []byte {
+	if self.points == nil {
+		return self.it.Key()
+	}
+	point := self.points[self.index]
+	return pointKey(self.columnId, point.timestamp, point.sequence)
+}
+
+func (self *pointIterator) FieldValue() (*protocol.FieldValue, error) {
+	if self.points != nil {
+		return self.points[self.index].value, nil
+	}
+	value := &protocol.FieldValue{}
+	if err := proto.Unmarshal(self.it.Value(), value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// returns the error that made the iterator invalid, if any
+func (self *pointIterator) Error() error {
+	return self.err
+}
+
+func (self *pointIterator) Close() {
+	self.it.Close()
+}
+
+func (self *pointIterator) load(fromEnd bool) {
+	self.points = nil
+	self.index = 0
+	if self.err != nil || !self.it.Valid() {
+		return
+	}
+	key := self.it.Key()
+	if len(key) != POINT_KEY_SIZE || !bytes.Equal(key[:len(self.columnId)], self.columnId) {
+		return
+	}
+	value := self.it.Value()
+	if !isBlock(value) {
+		return
+	}
+	self.points, self.err = decodeBlock(value)
+	if self.err != nil {
+		self.points = nil
+		return
+	}
+	if fromEnd {
+		self.index = len(self.points) - 1
+	}
+}
@@ -0,0 +1,516 @@
+package datastore
+
+import (
+	"bytes"
+	"datastore/storage"
+	"encoding/binary"
+	"math"
+	"protocol"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	log "code.google.com/p/log4go"
+)
+
+// The series index knows the series of all the shards of the server, with their
+// columns, the first and last time they were written to and an estimate of their
+// point count. It lives in memory and in a store of its own, so listing the series
+// doesn't have to go through every shard.
+//
+// New series and columns are stored before the points get written, so the index
+// never misses a series. The times and point counts are only stored every
+// SERIES_INDEX_FLUSH_INTERVAL, they can be behind after a crash.
+const (
+	SERIES_INDEX_DIR            = "series_index"
+	SERIES_INDEX_FLUSH_INTERVAL = 10 * time.Second
+)
+
+var (
+	// an entry per shard and series, SERIES_INDEX_ENTRY_PREFIX, the shard id, the
+	// database and the series name separated by a zero byte
+	SERIES_INDEX_ENTRY_PREFIX = []byte{'e'}
+	// set once all the series of the shard are in the index
+	SERIES_INDEX_SHARD_PREFIX = []byte{'s'}
+)
+
+type SeriesIndex struct {
+	db   storage.Engine
+	lock sync.RWMutex
+	// database -> series -> shard id -> entry
+	databases     map[string]map[string]map[uint32]*seriesIndexEntry
+	indexedShards map[uint32]bool
+	closed        chan bool
+	closeOnce     sync.Once
+}
+
+type seriesIndexEntry struct {
+	// sorted, the types are in the same order
+	columns     []string
+	columnTypes []string
+	// false if the times aren't known
+	seen       bool
+	firstSeen  int64
+	lastSeen   int64
+	pointCount uint64
+	// the times and point count changed since the entry was stored
+	dirty bool
+}
+
+func NewSeriesIndex(db storage.Engine) (*SeriesIndex, error) {
+	self := &SeriesIndex{
+		db:            db,
+		databases:     make(map[string]map[string]map[uint32]*seriesIndexEntry),
+		indexedShards: make(map[uint32]bool),
+		closed:        make(chan bool),
+	}
+	if err := self.load(); err != nil {
+		return nil, err
+	}
+	go self.flushPeriodically()
+	return self, nil
+}
+
+func (self *SeriesIndex) load() error {
+	it := self.db.Iterator()
+	defer it.Close()
+
+	for it.Seek(SERIES_INDEX_SHARD_PREFIX); it.Valid() && bytes.HasPrefix(it.Key(), SERIES_INDEX_SHARD_PREFIX); it.Next() {
+		self.indexedShards[binary.BigEndian.Uint32(it.Key()[len(SERIES_INDEX_SHARD_PREFIX):])] = true
+	}
+
+	count := 0
+	for it.Seek(SERIES_INDEX_ENTRY_PREFIX); it.Valid() && bytes.HasPrefix(it.Key(), SERIES_INDEX_ENTRY_PREFIX); it.Next() {
+		info := &protocol.SeriesInfo{}
+		if err := proto.Unmarshal(it.Value(), info); err != nil {
+			return err
+		}
+		entry, _ := self.getOrCreateEntry(info.GetShardId(), info.GetDatabase(), info.GetName(), &seriesIndexEntry{})
+		entry.addColumns(info.Columns, info.ColumnTypes)
+		entry.setTimes(info)
+		entry.pointCount = info.GetPointCount()
+		count++
+	}
+	log.Info("DATASTORE: loaded %d series index entries", count)
+	return nil
+}
+
+// should be called with the lock held, the entry is added if there isn't one yet
+func (self *SeriesIndex) getOrCreateEntry(shardId uint32, database, series string, newEntry *seriesIndexEntry) (*seriesIndexEntry, bool) {
+	seriesShards := self.databases[database]
+	if seriesShards == nil {
+		seriesShards = make(map[string]map[uint32]*seriesIndexEntry)
+		self.databases[database] = seriesShards
+	}
+	shards := seriesShards[series]
+	if shards == nil {
+		shards = make(map[uint32]*seriesIndexEntry)
+		seriesShards[series] = shards
+	}
+	if entry := shards[shardId]; entry != nil {
+		return entry, false
+	}
+	shards[shardId] = newEntry
+	return newEntry, true
+}
+
+func seriesIndexEntryKey(shardId uint32, database, series string) []byte {
+	key := make([]byte, 0, len(SERIES_INDEX_ENTRY_PREFIX)+4+len(database)+1+len(series))
+	key = append(key, SERIES_INDEX_ENTRY_PREFIX...)
+	key = append(key, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(key[len(SERIES_INDEX_ENTRY_PREFIX):], shardId)
+	key = append(key, database...)
+	key = append(key, 0)
+	return append(key, series...)
+}
+
+func seriesIndexShardKey(shardId uint32) []byte {
+	key := append([]byte{}, SERIES_INDEX_SHARD_PREFIX...)
+	key = append(key, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(key[len(SERIES_INDEX_SHARD_PREFIX):], shardId)
+	return key
+}
+
+func (self *seriesIndexEntry) write(shardId uint32, database, series string) (storage.Write, error) {
+	data, err := proto.Marshal(self.info(shardId, database, series))
+	if err != nil {
+		return storage.Write{}, err
+	}
+	self.dirty = false
+	return storage.Write{Key: seriesIndexEntryKey(shardId, database, series), Value: data}, nil
+}
+
+func (self *seriesIndexEntry) info(shardId uint32, database, series string) *protocol.SeriesInfo {
+	info := &protocol.SeriesInfo{
+		Name:        proto.String(series),
+		Columns:     self.columns,
+		ColumnTypes: self.columnTypes,
+		PointCount:  proto.Uint64(self.pointCount),
+		ShardId:     proto.Uint32(shardId),
+		Database:    proto.String(database),
+	}
+	if self.seen {
+		info.FirstSeen = proto.Int64(self.firstSeen)
+		info.LastSeen = proto.Int64(self.lastSeen)
+	}
+	return info
+}
+
+func (self *seriesIndexEntry) setTimes(info *protocol.SeriesInfo) {
+	self.seen = info.FirstSeen != nil && info.LastSeen != nil
+	self.firstSeen = info.GetFirstSeen()
+	self.lastSeen = info.GetLastSeen()
+}
+
+// adds the columns that aren't in the entry yet and merges the types of the ones
+// that are, the types can be nil or empty if they aren't known. Returns true if
+// anything changed.
+func (self *seriesIndexEntry) addColumns(columns, columnTypes []string) bool {
+	changed := false
+	for columnIndex, column := range columns {
+		columnType := ""
+		if columnIndex < len(columnTypes) {
+			columnType = columnTypes[columnIndex]
+		}
+		i := sort.SearchStrings(self.columns, column)
+		if i < len(self.columns) && self.columns[i] == column {
+			if merged := protocol.MergeColumnTypes(self.columnTypes[i], columnType); merged != self.columnTypes[i] {
+				self.columnTypes[i] = merged
+				changed = true
+			}
+			continue
+		}
+		self.columns = append(self.columns, "")
+		copy(self.columns[i+1:], self.columns[i:])
+		self.columns[i] = column
+		self.columnTypes = append(self.columnTypes, "")
+		copy(self.columnTypes[i+1:], self.columnTypes[i:])
+		self.columnTypes[i] = columnType
+		changed = true
+	}
+	return changed
+}
+
+func (self *seriesIndexEntry) addPoints(firstSeen, lastSeen int64, count int) {
+	if !self.seen || firstSeen < self.firstSeen {
+		self.firstSeen = firstSeen
+	}
+	if !self.seen || lastSeen > self.lastSeen {
+		self.lastSeen = lastSeen
+	}
+	self.seen = true
+	self.pointCount += uint64(count)
+	self.dirty = true
+}
+
+// returns the types of the columns of the series, the type of a column is empty if
+// all its values are null
+func seriesColumnTypes(series *protocol.Series) []string {
+	types := make([]string, len(series.Fields))
+	for fieldIndex := range series.Fields {
+		for _, point := range series.Points {
+			if fieldIndex >= len(point.Values) {
+				continue
+			}
+			if types[fieldIndex] = point.Values[fieldIndex].GetTypeName(); types[fieldIndex] != "" {
+				break
+			}
+		}
+	}
+	return types
+}
+
+// Called before the points of the series get written to the shard
+func (self *SeriesIndex) Update(shardId uint32, database string, series *protocol.Series) error {
+	firstSeen, lastSeen := *series.Points[0].GetTimestampInMicroseconds(), *series.Points[0].GetTimestampInMicroseconds()
+	for _, point := range series.Points[1:] {
+		timestamp := *point.GetTimestampInMicroseconds()
+		if timestamp < firstSeen {
+			firstSeen = timestamp
+		}
+		if timestamp > lastSeen {
+			lastSeen = timestamp
+		}
+	}
+	columnTypes := seriesColumnTypes(series)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	entry, isNew := self.getOrCreateEntry(shardId, database, series.GetName(), &seriesIndexEntry{})
+	changedColumns := entry.addColumns(series.Fields, columnTypes)
+	entry.addPoints(firstSeen, lastSeen, len(series.Points))
+	if !isNew && !changedColumns {
+		return nil
+	}
+	write, err := entry.write(shardId, database, series.GetName())
+	if err != nil {
+		return err
+	}
+	return self.db.BatchPut([]storage.Write{write})
+}
+
+// Returns true if the series of the shard have been added to the index
+func (self *SeriesIndex) IsShardIndexed(shardId uint32) bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.indexedShards[shardId]
+}
+
+// Adds the series of a shard that was written before the index existed, or
+// restored from a backup
+func (self *SeriesIndex) IndexShard(shardId uint32, infos []*protocol.SeriesInfo) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	writes := make([]storage.Write, 0, len(infos)+1)
+	for _, info := range infos {
+		entry, _ := self.getOrCreateEntry(shardId, info.GetDatabase(), info.GetName(), &seriesIndexEntry{})
+		entry.addColumns(info.Columns, info.ColumnTypes)
+		entry.setTimes(info)
+		entry.pointCount = info.GetPointCount()
+		write, err := entry.write(shardId, info.GetDatabase(), info.GetName())
+		if err != nil {
+			return err
+		}
+		writes = append(writes, write)
+	}
+	writes = append(writes, storage.Write{Key: seriesIndexShardKey(shardId), Value: []byte{}})
+	if err := self.db.BatchPut(writes); err != nil {
+		return err
+	}
+	self.indexedShards[shardId] = true
+	return nil
+}
+
+func (self *SeriesIndex) DropSeries(shardId uint32, database, series string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.removeEntry(shardId, database, series)
+	return self.db.BatchPut([]storage.Write{{Key: seriesIndexEntryKey(shardId, database, series)}})
+}
+
+// Takes the series of the shard out of the index, the shard has to be indexed again
+// if it comes back
+func (self *SeriesIndex) DropShard(shardId uint32) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for database, seriesShards := range self.databases {
+		for series, shards := range seriesShards {
+			if shards[shardId] != nil {
+				self.removeEntry(shardId, database, series)
+			}
+		}
+	}
+	delete(self.indexedShards, shardId)
+
+	// the entries of the next shard come after the bare prefix of its id
+	start := append([]byte{}, SERIES_INDEX_ENTRY_PREFIX...)
+	start = append(start, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(start[len(SERIES_INDEX_ENTRY_PREFIX):], shardId)
+	end := append([]byte{}, SERIES_INDEX_ENTRY_PREFIX...)
+	end = append(end, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(end[len(SERIES_INDEX_ENTRY_PREFIX):], shardId+1)
+	if err := self.db.Del(start, end); err != nil {
+		return err
+	}
+	return self.db.BatchPut([]storage.Write{{Key: seriesIndexShardKey(shardId)}})
+}
+
+// should be called with the lock held
+func (self *SeriesIndex) removeEntry(shardId uint32, database, series string) {
+	seriesShards := self.databases[database]
+	if seriesShards == nil || seriesShards[series] == nil {
+		return
+	}
+	delete(seriesShards[series], shardId)
+	if len(seriesShards[series]) == 0 {
+		delete(seriesShards, series)
+	}
+	if len(seriesShards) == 0 {
+		delete(self.databases, database)
+	}
+}
+
+// Returns an entry for every shard the series of the database that match the regex
+// are in, sorted by series name. All the series match a nil regex.
+func (self *SeriesIndex) ListSeries(database string, regex *regexp.Regexp) []*protocol.SeriesInfo {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	names := self.sortedNames(database, regex)
+	infos := make([]*protocol.SeriesInfo, 0, len(names))
+	for _, name := range names {
+		for shardId, entry := range self.databases[database][name] {
+			infos = append(infos, entry.info(shardId, database, name))
+		}
+	}
+	return infos
+}
+
+// Returns the sorted names of the series of the shard that match the regex
+func (self *SeriesIndex) GetSeriesForShard(shardId uint32, database string, regex *regexp.Regexp) []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	names := make([]string, 0)
+	for _, name := range self.sortedNames(database, regex) {
+		if self.databases[database][name][shardId] != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Returns the number of series and the estimated number of points of every shard
+// in the index
+func (self *SeriesIndex) ShardCounts() (series map[uint32]int64, points map[uint32]int64) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	series = make(map[uint32]int64)
+	points = make(map[uint32]int64)
+	for _, seriesShards := range self.databases {
+		for _, shards := range seriesShards {
+			for shardId, entry := range shards {
+				series[shardId] += 1
+				points[shardId] += int64(entry.pointCount)
+			}
+		}
+	}
+	return series, points
+}
+
+// should be called with the lock held
+func (self *SeriesIndex) sortedNames(database string, regex *regexp.Regexp) []string {
+	names := make([]string, 0, len(self.databases[database]))
+	for name := range self.databases[database] {
+		if regex == nil || regex.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stores the times and point counts that changed since they were last stored
+func (self *SeriesIndex) Flush() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	writes := make([]storage.Write, 0)
+	for database, seriesShards := range self.databases {
+		for series, shards := range seriesShards {
+			for shardId, entry := range shards {
+				if !entry.dirty {
+					continue
+				}
+				write, err := entry.write(shardId, database, series)
+				if err != nil {
+					return err
+				}
+				writes = append(writes, write)
+			}
+		}
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	return self.db.BatchPut(writes)
+}
+
+func (self *SeriesIndex) flushPeriodically() {
+	ticker := time.NewTicker(SERIES_INDEX_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := self.Flush(); err != nil {
+				log.Error("DATASTORE: can't store the series index: %s", err)
+			}
+		case <-self.closed:
+			return
+		}
+	}
+}
+
+func (self *SeriesIndex) Close() {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+		if err := self.Flush(); err != nil {
+			log.Error("DATASTORE: can't store the series index: %s", err)
+		}
+		self.db.Close()
+	})
+}
+
+// Adds the series of the shard to the index. The point counts of the series aren't
+// known, the times come from the first and last point of their columns and the
+// column types from the last value.
+func (self *Shard) indexSeries() error {
+	it := self.db.Iterator()
+	defer it.Close()
+
+	infos := make([]*protocol.SeriesInfo, 0)
+	var info *protocol.SeriesInfo
+	dbNameStart := len(SERIES_COLUMN_INDEX_PREFIX)
+	for it.Seek(SERIES_COLUMN_INDEX_PREFIX); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) < dbNameStart || !bytes.Equal(key[:dbNameStart], SERIES_COLUMN_INDEX_PREFIX) {
+			break
+		}
+		parts := strings.Split(string(key[dbNameStart:]), "~")
+		if len(parts) < 3 {
+			continue
+		}
+		if info == nil || info.GetDatabase() != parts[0] || info.GetName() != parts[1] {
+			info = &protocol.SeriesInfo{
+				Name:       proto.String(parts[1]),
+				ShardId:    proto.Uint32(self.id),
+				Database:   proto.String(parts[0]),
+				PointCount: proto.Uint64(0),
+			}
+			infos = append(infos, info)
+		}
+		first, last, lastValue, err := self.columnRange(it.Value())
+		if err != nil {
+			return err
+		}
+		info.Columns = append(info.Columns, parts[2])
+		info.ColumnTypes = append(info.ColumnTypes, lastValue.GetTypeName())
+		if lastValue == nil {
+			continue
+		}
+		if info.FirstSeen == nil || first < info.GetFirstSeen() {
+			info.FirstSeen = proto.Int64(first)
+		}
+		if info.LastSeen == nil || last > info.GetLastSeen() {
+			info.LastSeen = proto.Int64(last)
+		}
+	}
+	return self.index.IndexShard(self.id, infos)
+}
+
+// returns the timestamps of the first and last point of the column and the value of
+// the last point, the value is nil if the column doesn't have any points
+func (self *Shard) columnRange(id []byte) (first, last int64, lastValue *protocol.FieldValue, err error) {
+	it := newPointIterator(self.db.Iterator(), id)
+	defer it.Close()
+
+	start, end := pointKeyRange(id, byteArrayForTimeInt(math.MinInt64), byteArrayForTimeInt(math.MaxInt64))
+	it.Seek(start)
+	if !it.Valid() || !isColumnKey(id, it.Key()) {
+		return 0, 0, nil, it.Error()
+	}
+	first = timestampFromRaw(it.Key()[8:16])
+
+	it.Seek(end)
+	if it.Valid() {
+		it.Prev()
+	}
+	if !it.Valid() || !isColumnKey(id, it.Key()) {
+		return 0, 0, nil, it.Error()
+	}
+	lastValue, err = it.FieldValue()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return first, timestampFromRaw(it.Key()[8:16]), lastValue, nil
+}
@@ -4,10 +4,10 @@ import (
 	"bytes"
 	"cluster"
 	"common"
+	"datastore/storage"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"math"
 	"parser"
 	"protocol"
 	"regexp"
@@ -17,22 +17,29 @@ import (
 
 	"code.google.com/p/goprotobuf/proto"
 	log "code.google.com/p/log4go"
-	"github.com/jmhodges/levigo"
 )
 
-type LevelDbShard struct {
-	db             *levigo.DB
-	readOptions    *levigo.ReadOptions
-	writeOptions   *levigo.WriteOptions
-	lastIdUsed     uint64
-	columnIdMutex  sync.Mutex
-	closed         bool
+type Shard struct {
+	db            storage.Engine
+	lastIdUsed    uint64
+	columnIdMutex sync.Mutex
+	closed        bool
+	// set when the shard is going to be deleted, it stays open until it's returned
+	dropped        bool
 	pointBatchSize int
+	encoding       string
+	migrating      bool
+	// held while writing, writes with blocks read the entries they replace
+	writeLock sync.Mutex
+	// held while compacting, so the shard doesn't get closed under a compaction
+	compactLock sync.Mutex
+	id          uint32
+	// the series index of the server, nil if the shard isn't part of a datastore
+	index *SeriesIndex
 }
 
-func NewLevelDbShard(db *levigo.DB, pointBatchSize int) (*LevelDbShard, error) {
-	ro := levigo.NewReadOptions()
-	lastIdBytes, err2 := db.Get(ro, NEXT_ID_KEY)
+func NewShard(db storage.Engine, pointBatchSize int, encoding string) (*Shard, error) {
+	lastIdBytes, err2 := db.Get(NEXT_ID_KEY)
 	if err2 != nil {
 		return nil, err2
 	}
@@ -45,38 +52,63 @@ func NewLevelDbShard(db *levigo.DB, pointBatchSize int) (*LevelDbShard, error) {
 		}
 	}
 
-	return &LevelDbShard{
+	encoding, err2 = readShardEncoding(db, lastIdBytes == nil, encoding)
+	if err2 != nil {
+		return nil, err2
+	}
+	migrating, err2 := db.Get(SHARD_MIGRATING_KEY)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	return &Shard{
 		db:             db,
-		writeOptions:   levigo.NewWriteOptions(),
-		readOptions:    ro,
 		lastIdUsed:     lastId,
 		pointBatchSize: pointBatchSize,
+		encoding:       encoding,
+		migrating:      migrating != nil,
 	}, nil
 }
 
-func (self *LevelDbShard) Write(database string, series *protocol.Series) error {
-	wb := levigo.NewWriteBatch()
-	defer wb.Close()
-
+func (self *Shard) Write(database string, series *protocol.Series) error {
 	if series == nil || len(series.Points) == 0 {
 		return errors.New("Unable to write no data. Series was nil or had no points.")
 	}
 
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	// the shard gets closed when it's dropped or restored while the write waits
+	if self.closed || self.dropped {
+		return errors.New("Shard is closed")
+	}
+	// the index has to know about the series before its points are written
+	if self.index != nil {
+		if err := self.index.Update(self.id, database, series); err != nil {
+			return err
+		}
+	}
+
+	wb := make([]storage.Write, 0, len(series.Fields)*len(series.Points))
+
 	for fieldIndex, field := range series.Fields {
 		temp := field
 		id, err := self.createIdForDbSeriesColumn(&database, series.Name, &temp)
 		if err != nil {
 			return err
 		}
+		if self.mayHaveBlocks() {
+			writes, err := self.mergeIntoColumn(id, columnPoints(series, fieldIndex))
+			if err != nil {
+				return err
+			}
+			wb = append(wb, writes...)
+			continue
+		}
 		for _, point := range series.Points {
-			keyBuffer := bytes.NewBuffer(make([]byte, 0, 24))
-			keyBuffer.Write(id)
-			binary.Write(keyBuffer, binary.BigEndian, self.convertTimestampToUint(point.GetTimestampInMicroseconds()))
-			binary.Write(keyBuffer, binary.BigEndian, *point.SequenceNumber)
-			pointKey := keyBuffer.Bytes()
+			key := pointKey(id, *point.GetTimestampInMicroseconds(), *point.SequenceNumber)
 
 			if point.Values[fieldIndex].GetIsNull() {
-				wb.Delete(pointKey)
+				wb = append(wb, storage.Write{Key: key, Value: nil})
 				continue
 			}
 
@@ -84,14 +116,18 @@ func (self *LevelDbShard) Write(database string, series *protocol.Series) error
 			if err != nil {
 				return err
 			}
-			wb.Put(pointKey, data)
+			wb = append(wb, storage.Write{Key: key, Value: data})
 		}
 	}
 
-	return self.db.Write(self.writeOptions, wb)
+	return self.db.BatchPut(wb)
 }
 
-func (self *LevelDbShard) Query(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
+func (self *Shard) Query(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
+	if self.closed {
+		return errors.New("Shard is closed")
+	}
+
 	if querySpec.IsListSeriesQuery() {
 		return self.executeListSeriesQuery(querySpec, processor)
 	} else if querySpec.IsDeleteFromSeriesQuery() {
@@ -128,10 +164,7 @@ func (self *LevelDbShard) Query(querySpec *parser.QuerySpec, processor cluster.Q
 	return nil
 }
 
-func (self *LevelDbShard) DropDatabase(database string) error {
-	wb := levigo.NewWriteBatch()
-	defer wb.Close()
-
+func (self *Shard) DropDatabase(database string) error {
 	seriesNames := self.getSeriesForDatabase(database)
 	for _, name := range seriesNames {
 		if err := self.dropSeries(database, name); err != nil {
@@ -139,17 +172,60 @@ func (self *LevelDbShard) DropDatabase(database string) error {
 		}
 
 	}
+	return nil
+}
+
+// Returns the series of the database if they all match, covered is false otherwise.
+// The shard is marked as dropped if they match and the database is the only one in
+// it, so it doesn't take any more writes and its files can be removed once it's
+// returned. Writes wait for the check, series that get written after it are left
+// alone.
+func (self *Shard) dropIfDatabaseCovered(database string, matches func(series string) bool) (series []string, covered, dropped bool) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+
+	series = self.getSeriesForDatabase(database)
+	for _, name := range series {
+		if !matches(name) {
+			return nil, false, false
+		}
+	}
+	for _, name := range self.getDatabases() {
+		if name != database {
+			return series, true, false
+		}
+	}
+	self.dropped = true
+	return series, true, true
+}
 
-	return self.db.Write(self.writeOptions, wb)
+// Returns the names of the databases that have series in the shard
+func (self *Shard) getDatabases() []string {
+	it := self.db.Iterator()
+	defer it.Close()
+
+	dbNameStart := len(DATABASE_SERIES_INDEX_PREFIX)
+	databases := make([]string, 0)
+	for it.Seek(DATABASE_SERIES_INDEX_PREFIX); it.Valid(); {
+		key := it.Key()
+		if len(key) < dbNameStart || !bytes.Equal(key[:dbNameStart], DATABASE_SERIES_INDEX_PREFIX) {
+			break
+		}
+		database := strings.SplitN(string(key[dbNameStart:]), "~", 2)[0]
+		databases = append(databases, database)
+		// skip the other series of the database, '~' + 1 sorts after all of them
+		it.Seek(append(append([]byte{}, DATABASE_SERIES_INDEX_PREFIX...), []byte(database+"\x7f")...))
+	}
+	return databases
 }
 
-func (self *LevelDbShard) IsClosed() bool {
+func (self *Shard) IsClosed() bool {
 	return self.closed
 }
 
-func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, seriesName string, columns []string, processor cluster.QueryProcessor) error {
-	startTimeBytes := self.byteArrayForTime(querySpec.GetStartTime())
-	endTimeBytes := self.byteArrayForTime(querySpec.GetEndTime())
+func (self *Shard) executeQueryForSeries(querySpec *parser.QuerySpec, seriesName string, columns []string, processor cluster.QueryProcessor) error {
+	startTimeBytes := byteArrayForTime(querySpec.GetStartTime())
+	endTimeBytes := byteArrayForTime(querySpec.GetEndTime())
 
 	fields, err := self.getFieldsForSeries(querySpec.Database(), seriesName, columns)
 	if err != nil {
@@ -207,7 +283,10 @@ func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, ser
 				continue
 			}
 
-			value := it.Value()
+			value, err := it.FieldValue()
+			if err != nil {
+				return err
+			}
 			sequenceNumber := key[16:]
 
 			rawTime := key[8:16]
@@ -251,29 +330,25 @@ func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, ser
 				iterator.Prev()
 			}
 
-			fv := &protocol.FieldValue{}
-			err := proto.Unmarshal(rawColumnValues[i].value, fv)
-			if err != nil {
-				return err
-			}
-			point.Values[i] = fv
+			point.Values[i] = rawColumnValues[i].value
 			rawColumnValues[i] = nil
 		}
 
-		var sequence uint64
-		// set the point sequence number and timestamp
-		binary.Read(bytes.NewBuffer(pointSequenceRaw), binary.BigEndian, &sequence)
-		var t uint64
-		binary.Read(bytes.NewBuffer(pointTimeRaw), binary.BigEndian, &t)
-		time := self.convertUintTimestampToInt64(&t)
-		point.SetTimestampInMicroseconds(time)
-		point.SequenceNumber = &sequence
-
 		// stop the loop if we ran out of points
 		if !isValid {
+			for _, it := range iterators {
+				if err := it.Error(); err != nil {
+					return err
+				}
+			}
 			break
 		}
 
+		// set the point sequence number and timestamp
+		sequence := sequenceNumberFromRaw(pointSequenceRaw)
+		point.SetTimestampInMicroseconds(timestampFromRaw(pointTimeRaw))
+		point.SequenceNumber = &sequence
+
 		shouldContinue := true
 
 		seriesOutgoing.Points = append(seriesOutgoing.Points, point)
@@ -309,11 +384,12 @@ func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, ser
 	return nil
 }
 
-func (self *LevelDbShard) executeListSeriesQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
-	it := self.db.NewIterator(self.readOptions)
+func (self *Shard) executeListSeriesQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
+	it := self.db.Iterator()
 	defer it.Close()
 
 	database := querySpec.Database()
+	regex := querySpec.Query().ListQuery.Regex
 	seekKey := append(DATABASE_SERIES_INDEX_PREFIX, []byte(querySpec.Database()+"~")...)
 	it.Seek(seekKey)
 	dbNameStart := len(DATABASE_SERIES_INDEX_PREFIX)
@@ -329,6 +405,9 @@ func (self *LevelDbShard) executeListSeriesQuery(querySpec *parser.QuerySpec, pr
 				break
 			}
 			name := parts[1]
+			if regex != nil && !regex.MatchString(name) {
+				continue
+			}
 			shouldContinue := processor.YieldPoint(&name, nil, nil)
 			if !shouldContinue {
 				return nil
@@ -338,7 +417,7 @@ func (self *LevelDbShard) executeListSeriesQuery(querySpec *parser.QuerySpec, pr
 	return nil
 }
 
-func (self *LevelDbShard) executeDeleteQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
+func (self *Shard) executeDeleteQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
 	query := querySpec.DeleteQuery()
 	series := query.GetFromClause()
 	database := querySpec.Database()
@@ -361,46 +440,43 @@ func (self *LevelDbShard) executeDeleteQuery(querySpec *parser.QuerySpec, proces
 	return nil
 }
 
-func (self *LevelDbShard) executeDropSeriesQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
+func (self *Shard) executeDropSeriesQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
 	database := querySpec.Database()
 	series := querySpec.Query().DropSeriesQuery.GetTableName()
 	return self.dropSeries(database, series)
 }
 
-func (self *LevelDbShard) dropSeries(database, series string) error {
+func (self *Shard) dropSeries(database, series string) error {
 	startTimeBytes := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 	endTimeBytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
 
-	wb := levigo.NewWriteBatch()
-	defer wb.Close()
-
 	if err := self.deleteRangeOfSeriesCommon(database, series, startTimeBytes, endTimeBytes); err != nil {
 		return err
 	}
 
+	wb := make([]storage.Write, 0)
 	for _, name := range self.getColumnNamesForSeries(database, series) {
-		indexKey := append(SERIES_COLUMN_INDEX_PREFIX, []byte(database+"~"+series+"~"+name)...)
-		wb.Delete(indexKey)
+		wb = append(wb, storage.Write{Key: seriesColumnIndexKey(database, series, name)})
 	}
 
-	wb.Delete(append(DATABASE_SERIES_INDEX_PREFIX, []byte(database+"~"+series)...))
+	wb = append(wb, storage.Write{Key: databaseSeriesIndexKey(database, series)})
 
 	// remove the column indeces for this time series
-	return self.db.Write(self.writeOptions, wb)
-}
-
-func (self *LevelDbShard) byteArrayForTimeInt(time int64) []byte {
-	timeBuffer := bytes.NewBuffer(make([]byte, 0, 8))
-	binary.Write(timeBuffer, binary.BigEndian, self.convertTimestampToUint(&time))
-	bytes := timeBuffer.Bytes()
-	return bytes
-}
-
-func (self *LevelDbShard) byteArraysForStartAndEndTimes(startTime, endTime int64) ([]byte, []byte) {
-	return self.byteArrayForTimeInt(startTime), self.byteArrayForTimeInt(endTime)
+	if err := self.db.BatchPut(wb); err != nil {
+		return err
+	}
+	ranges := make([][2][]byte, 0, len(wb))
+	for _, write := range wb {
+		ranges = append(ranges, [2][]byte{write.Key, write.Key})
+	}
+	self.compactRanges(ranges)
+	if self.index != nil {
+		return self.index.DropSeries(self.id, database, series)
+	}
+	return nil
 }
 
-func (self *LevelDbShard) deleteRangeOfSeriesCommon(database, series string, startTimeBytes, endTimeBytes []byte) error {
+func (self *Shard) deleteRangeOfSeriesCommon(database, series string, startTimeBytes, endTimeBytes []byte) error {
 	columns := self.getColumnNamesForSeries(database, series)
 	fields, err := self.getFieldsForSeries(database, series, columns)
 	if err != nil {
@@ -412,63 +488,62 @@ func (self *LevelDbShard) deleteRangeOfSeriesCommon(database, series string, sta
 			return err
 		}
 	}
-	ro := levigo.NewReadOptions()
-	defer ro.Close()
-	ro.SetFillCache(false)
-	rangesToCompact := make([]*levigo.Range, 0)
+	ranges, err := self.deletePoints(fields, startTimeBytes, endTimeBytes)
+	if err != nil {
+		return err
+	}
+	// writes don't have to wait for the compaction
+	self.compactRanges(ranges)
+	return nil
+}
+
+// Deletes the points of the fields in the time range. Returns the key ranges that
+// got deleted.
+func (self *Shard) deletePoints(fields []*Field, startTimeBytes, endTimeBytes []byte) ([][2][]byte, error) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+
+	ranges := make([][2][]byte, 0, len(fields))
 	for _, field := range fields {
-		it := self.db.NewIterator(ro)
-		defer it.Close()
-		wb := levigo.NewWriteBatch()
-		defer wb.Close()
-
-		startKey := append(field.Id, startTimeBytes...)
-		endKey := startKey
-		it.Seek(startKey)
-		if it.Valid() {
-			if !bytes.Equal(it.Key()[:8], field.Id) {
-				it.Next()
-				if it.Valid() {
-					startKey = it.Key()
-				}
-			}
-		}
-		count := 0
-		for it = it; it.Valid(); it.Next() {
-			k := it.Key()
-			if len(k) < 16 || !bytes.Equal(k[:8], field.Id) || bytes.Compare(k[8:16], endTimeBytes) == 1 {
-				break
+		startKey, endKey := pointKeyRange(field.Id, startTimeBytes, endTimeBytes)
+		if self.mayHaveBlocks() {
+			writes, err := self.splitBoundaryBlocks(field.Id, startKey, endKey)
+			if err != nil {
+				return nil, err
 			}
-			wb.Delete(k)
-			count++
-			if count >= SIXTY_FOUR_KILOBYTES {
-				err = self.db.Write(self.writeOptions, wb)
-				if err != nil {
-					return err
+			if len(writes) > 0 {
+				if err := self.db.BatchPut(writes); err != nil {
+					return nil, err
 				}
-				count = 0
-				wb.Clear()
 			}
-			endKey = k
 		}
-		err = self.db.Write(self.writeOptions, wb)
-		if err != nil {
-			return err
+		if err := self.db.Del(startKey, endKey); err != nil {
+			return nil, err
 		}
-		rangesToCompact = append(rangesToCompact, &levigo.Range{startKey, endKey})
+		ranges = append(ranges, [2][]byte{startKey, endKey})
 	}
-	for _, r := range rangesToCompact {
-		self.db.CompactRange(*r)
+	return ranges, nil
+}
+
+// Compacts the key ranges so the space of the deleted keys gets reclaimed. Does
+// nothing if the shard got closed.
+func (self *Shard) compactRanges(ranges [][2][]byte) {
+	self.compactLock.Lock()
+	defer self.compactLock.Unlock()
+	if self.closed {
+		return
+	}
+	for _, r := range ranges {
+		self.db.CompactRange(r[0], r[1])
 	}
-	return nil
 }
 
-func (self *LevelDbShard) deleteRangeOfSeries(database, series string, startTime, endTime time.Time) error {
-	startTimeBytes, endTimeBytes := self.byteArraysForStartAndEndTimes(common.TimeToMicroseconds(startTime), common.TimeToMicroseconds(endTime))
+func (self *Shard) deleteRangeOfSeries(database, series string, startTime, endTime time.Time) error {
+	startTimeBytes, endTimeBytes := byteArrayForTime(startTime), byteArrayForTime(endTime)
 	return self.deleteRangeOfSeriesCommon(database, series, startTimeBytes, endTimeBytes)
 }
 
-func (self *LevelDbShard) deleteRangeOfRegex(database string, regex *regexp.Regexp, startTime, endTime time.Time) error {
+func (self *Shard) deleteRangeOfRegex(database string, regex *regexp.Regexp, startTime, endTime time.Time) error {
 	series := self.getSeriesForDbAndRegex(database, regex)
 	for _, name := range series {
 		err := self.deleteRangeOfSeries(database, name, startTime, endTime)
@@ -479,7 +554,7 @@ func (self *LevelDbShard) deleteRangeOfRegex(database string, regex *regexp.Rege
 	return nil
 }
 
-func (self *LevelDbShard) getFieldsForSeries(db, series string, columns []string) ([]*Field, error) {
+func (self *Shard) getFieldsForSeries(db, series string, columns []string) ([]*Field, error) {
 	isCountQuery := false
 	if len(columns) > 0 && columns[0] == "*" {
 		columns = self.getColumnNamesForSeries(db, series)
@@ -513,8 +588,8 @@ func (self *LevelDbShard) getFieldsForSeries(db, series string, columns []string
 	return fields, nil
 }
 
-func (self *LevelDbShard) getColumnNamesForSeries(db, series string) []string {
-	it := self.db.NewIterator(self.readOptions)
+func (self *Shard) getColumnNamesForSeries(db, series string) []string {
+	it := self.db.Iterator()
 	defer it.Close()
 
 	seekKey := append(SERIES_COLUMN_INDEX_PREFIX, []byte(db+"~"+series+"~")...)
@@ -538,7 +613,7 @@ func (self *LevelDbShard) getColumnNamesForSeries(db, series string) []string {
 	return names
 }
 
-func (self *LevelDbShard) hasReadAccess(querySpec *parser.QuerySpec) bool {
+func (self *Shard) hasReadAccess(querySpec *parser.QuerySpec) bool {
 	for series, _ := range querySpec.SeriesValuesAndColumns() {
 		if _, isRegex := series.GetCompiledRegex(); !isRegex {
 			if !querySpec.HasReadAccess(series.Name) {
@@ -549,14 +624,10 @@ func (self *LevelDbShard) hasReadAccess(querySpec *parser.QuerySpec) bool {
 	return true
 }
 
-func (self *LevelDbShard) byteArrayForTime(t time.Time) []byte {
-	timeBuffer := bytes.NewBuffer(make([]byte, 0, 8))
-	timeMicro := common.TimeToMicroseconds(t)
-	binary.Write(timeBuffer, binary.BigEndian, self.convertTimestampToUint(&timeMicro))
-	return timeBuffer.Bytes()
-}
-
-func (self *LevelDbShard) getSeriesForDbAndRegex(database string, regex *regexp.Regexp) []string {
+func (self *Shard) getSeriesForDbAndRegex(database string, regex *regexp.Regexp) []string {
+	if self.index != nil && self.index.IsShardIndexed(self.id) {
+		return self.index.GetSeriesForShard(self.id, database, regex)
+	}
 	names := []string{}
 	allSeries := self.getSeriesForDatabase(database)
 	for _, name := range allSeries {
@@ -567,8 +638,8 @@ func (self *LevelDbShard) getSeriesForDbAndRegex(database string, regex *regexp.
 	return names
 }
 
-func (self *LevelDbShard) getSeriesForDatabase(database string) []string {
-	it := self.db.NewIterator(self.readOptions)
+func (self *Shard) getSeriesForDatabase(database string) []string {
+	it := self.db.Iterator()
 	defer it.Close()
 
 	seekKey := append(DATABASE_SERIES_INDEX_PREFIX, []byte(database+"~")...)
@@ -593,7 +664,7 @@ func (self *LevelDbShard) getSeriesForDatabase(database string) []string {
 	return names
 }
 
-func (self *LevelDbShard) createIdForDbSeriesColumn(db, series, column *string) (ret []byte, err error) {
+func (self *Shard) createIdForDbSeriesColumn(db, series, column *string) (ret []byte, err error) {
 	ret, err = self.getIdForDbSeriesColumn(db, series, column)
 	if err != nil {
 		return
@@ -607,58 +678,53 @@ func (self *LevelDbShard) createIdForDbSeriesColumn(db, series, column *string)
 	if err != nil {
 		return
 	}
-	s := fmt.Sprintf("%s~%s~%s", *db, *series, *column)
-	b := []byte(s)
-	key := append(SERIES_COLUMN_INDEX_PREFIX, b...)
-	err = self.db.Put(self.writeOptions, key, ret)
+	err = self.db.BatchPut([]storage.Write{{Key: seriesColumnIndexKey(*db, *series, *column), Value: ret}})
 	return
 }
 
-func (self *LevelDbShard) getIdForDbSeriesColumn(db, series, column *string) (ret []byte, err error) {
-	s := fmt.Sprintf("%s~%s~%s", *db, *series, *column)
-	b := []byte(s)
-	key := append(SERIES_COLUMN_INDEX_PREFIX, b...)
-	if ret, err = self.db.Get(self.readOptions, key); err != nil {
+func (self *Shard) getIdForDbSeriesColumn(db, series, column *string) (ret []byte, err error) {
+	if ret, err = self.db.Get(seriesColumnIndexKey(*db, *series, *column)); err != nil {
 		return nil, err
 	}
 	return ret, nil
 }
 
-func (self *LevelDbShard) getNextIdForColumn(db, series, column *string) (ret []byte, err error) {
+func (self *Shard) getNextIdForColumn(db, series, column *string) (ret []byte, err error) {
 	self.columnIdMutex.Lock()
 	defer self.columnIdMutex.Unlock()
 	id := self.lastIdUsed + 1
 	self.lastIdUsed += 1
 	idBytes := make([]byte, 8, 8)
 	binary.PutUvarint(idBytes, id)
-	wb := levigo.NewWriteBatch()
-	defer wb.Close()
-	wb.Put(NEXT_ID_KEY, idBytes)
-	databaseSeriesIndexKey := append(DATABASE_SERIES_INDEX_PREFIX, []byte(*db+"~"+*series)...)
-	wb.Put(databaseSeriesIndexKey, []byte{})
-	seriesColumnIndexKey := append(SERIES_COLUMN_INDEX_PREFIX, []byte(*db+"~"+*series+"~"+*column)...)
-	wb.Put(seriesColumnIndexKey, idBytes)
-	if err = self.db.Write(self.writeOptions, wb); err != nil {
+	wb := []storage.Write{
+		{Key: NEXT_ID_KEY, Value: idBytes},
+		{Key: databaseSeriesIndexKey(*db, *series), Value: []byte{}},
+		{Key: seriesColumnIndexKey(*db, *series, *column), Value: idBytes},
+	}
+	if err = self.db.BatchPut(wb); err != nil {
 		return nil, err
 	}
 	return idBytes, nil
 }
 
-func (self *LevelDbShard) close() {
-	self.closed = true
-	self.readOptions.Close()
-	self.writeOptions.Close()
-	self.db.Close()
+func (self *Shard) close() {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	self.closeEngine()
 }
 
-func (self *LevelDbShard) convertTimestampToUint(t *int64) uint64 {
-	if *t < 0 {
-		return uint64(math.MaxInt64 + *t + 1)
+// has to be called with the write lock held
+func (self *Shard) closeEngine() {
+	self.compactLock.Lock()
+	defer self.compactLock.Unlock()
+	if self.closed {
+		return
 	}
-	return uint64(*t) + uint64(math.MaxInt64) + uint64(1)
+	self.closed = true
+	self.db.Close()
 }
 
-func (self *LevelDbShard) fetchSinglePoint(querySpec *parser.QuerySpec, series string, fields []*Field) (*protocol.Series, error) {
+func (self *Shard) fetchSinglePoint(querySpec *parser.QuerySpec, series string, fields []*Field) (*protocol.Series, error) {
 	query := querySpec.SelectQuery()
 	fieldCount := len(fields)
 	fieldNames := make([]string, 0, fieldCount)
@@ -669,29 +735,16 @@ func (self *LevelDbShard) fetchSinglePoint(querySpec *parser.QuerySpec, series s
 		return nil, err
 	}
 
-	timeAndSequenceBuffer := bytes.NewBuffer(make([]byte, 0, 16))
-	binary.Write(timeAndSequenceBuffer, binary.BigEndian, self.convertTimestampToUint(&timestamp))
-	binary.Write(timeAndSequenceBuffer, binary.BigEndian, sequenceNumber)
 	sequenceNumber_uint64 := uint64(sequenceNumber)
 	point.SequenceNumber = &sequenceNumber_uint64
 	point.SetTimestampInMicroseconds(timestamp)
 
-	timeAndSequenceBytes := timeAndSequenceBuffer.Bytes()
 	for _, field := range fields {
-		pointKey := append(field.Id, timeAndSequenceBytes...)
-
-		if data, err := self.db.Get(self.readOptions, pointKey); err != nil {
+		if fieldValue, err := self.getPoint(field.Id, timestamp, sequenceNumber_uint64); err != nil {
 			return nil, err
-		} else {
-			fieldValue := &protocol.FieldValue{}
-			err := proto.Unmarshal(data, fieldValue)
-			if err != nil {
-				return nil, err
-			}
-			if data != nil {
-				fieldNames = append(fieldNames, field.Name)
-				point.Values = append(point.Values, fieldValue)
-			}
+		} else if fieldValue != nil {
+			fieldNames = append(fieldNames, field.Name)
+			point.Values = append(point.Values, fieldValue)
 		}
 	}
 
@@ -700,14 +753,27 @@ func (self *LevelDbShard) fetchSinglePoint(querySpec *parser.QuerySpec, series s
 	return result, nil
 }
 
-func (self *LevelDbShard) getIterators(fields []*Field, start, end []byte, isAscendingQuery bool) (fieldNames []string, iterators []*levigo.Iterator) {
-	iterators = make([]*levigo.Iterator, len(fields))
+// returns nil if the column doesn't have a point with the timestamp and sequence number
+func (self *Shard) getPoint(columnId []byte, timestamp int64, sequenceNumber uint64) (*protocol.FieldValue, error) {
+	it := newPointIterator(self.db.Iterator(), columnId)
+	defer it.Close()
+
+	key := pointKey(columnId, timestamp, sequenceNumber)
+	it.Seek(key)
+	if !it.Valid() || !bytes.Equal(it.Key(), key) {
+		return nil, it.Error()
+	}
+	return it.FieldValue()
+}
+
+func (self *Shard) getIterators(fields []*Field, start, end []byte, isAscendingQuery bool) (fieldNames []string, iterators []*pointIterator) {
+	iterators = make([]*pointIterator, len(fields))
 	fieldNames = make([]string, len(fields))
 
 	// start the iterators to go through the series data
 	for i, field := range fields {
 		fieldNames[i] = field.Name
-		iterators[i] = self.db.NewIterator(self.readOptions)
+		iterators[i] = newPointIterator(self.db.Iterator(), field.Id)
 		if isAscendingQuery {
 			iterators[i].Seek(append(field.Id, start...))
 		} else {
@@ -719,10 +785,3 @@ func (self *LevelDbShard) getIterators(fields []*Field, start, end []byte, isAsc
 	}
 	return
 }
-
-func (self *LevelDbShard) convertUintTimestampToInt64(t *uint64) int64 {
-	if *t > uint64(math.MaxInt64) {
-		return int64(*t-math.MaxInt64) - int64(1)
-	}
-	return int64(*t) - math.MaxInt64 - int64(1)
-}
@@ -0,0 +1,330 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"cluster"
+	"compress/gzip"
+	"datastore/storage"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	log "code.google.com/p/log4go"
+)
+
+// A shard backup is a gzipped stream of
+//
+//	BACKUP_MAGIC, BACKUP_VERSION
+//	the length of the json encoded cluster.ShardBackupInfo as an uvarint, the info
+//	an entry for every key of the shard: the key length, the key, the value length
+//	and the value, the lengths are uvarints
+//	a zero key length, the number of entries as an uvarint
+//	the big endian crc32 of everything that came before it
+//
+// The entries are the raw keys and values of the storage engine, so the backup
+// has the indexes and the point encoding of the shard and can be restored into a
+// shard that uses any engine.
+const (
+	BACKUP_VERSION = 1
+	// the number of entries that get written to the restored shard at once
+	RESTORE_BATCH_SIZE = 1000
+	// guards against allocating huge buffers for corrupted backups
+	MAX_BACKUP_ENTRY_SIZE = 64 * ONE_MEGABYTE
+)
+
+var BACKUP_MAGIC = []byte("influxdb shard backup")
+
+func (self *Shard) backup(info *cluster.ShardBackupInfo, w io.Writer) error {
+	self.writeLock.Lock()
+	if self.closed {
+		self.writeLock.Unlock()
+		return fmt.Errorf("Shard is closed")
+	}
+	it := self.db.Snapshot()
+	self.writeLock.Unlock()
+	defer it.Close()
+
+	writer, err := newBackupWriter(w, info)
+	if err != nil {
+		return err
+	}
+	for it.Seek([]byte{}); it.Valid(); it.Next() {
+		if err := writer.write(it.Key(), it.Value()); err != nil {
+			return err
+		}
+	}
+	return writer.close()
+}
+
+type backupWriter struct {
+	gzipWriter *gzip.Writer
+	writer     *bufio.Writer
+	crc        hash.Hash32
+	entries    uint64
+	buffer     []byte
+}
+
+func newBackupWriter(w io.Writer, info *cluster.ShardBackupInfo) (*backupWriter, error) {
+	infoJson, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	gzipWriter := gzip.NewWriter(w)
+	crc := crc32.NewIEEE()
+	self := &backupWriter{
+		gzipWriter: gzipWriter,
+		writer:     bufio.NewWriter(io.MultiWriter(gzipWriter, crc)),
+		crc:        crc,
+		buffer:     make([]byte, binary.MaxVarintLen64),
+	}
+	self.writer.Write(BACKUP_MAGIC)
+	self.writer.WriteByte(BACKUP_VERSION)
+	self.writeBytes(infoJson)
+	return self, nil
+}
+
+func (self *backupWriter) writeUvarint(value uint64) {
+	n := binary.PutUvarint(self.buffer, value)
+	self.writer.Write(self.buffer[:n])
+}
+
+func (self *backupWriter) writeBytes(data []byte) {
+	self.writeUvarint(uint64(len(data)))
+	self.writer.Write(data)
+}
+
+// bufio keeps the first error it runs into, so it's enough to check the last write
+func (self *backupWriter) write(key, value []byte) error {
+	self.writeBytes(key)
+	self.writeBytes(value)
+	self.entries++
+	_, err := self.writer.Write(nil)
+	return err
+}
+
+func (self *backupWriter) close() error {
+	self.writeUvarint(0)
+	self.writeUvarint(self.entries)
+	if err := self.writer.Flush(); err != nil {
+		return err
+	}
+	if err := binary.Write(self.gzipWriter, binary.BigEndian, self.crc.Sum32()); err != nil {
+		return err
+	}
+	return self.gzipWriter.Close()
+}
+
+// checksums the bytes as they're read, the bufio reader reads ahead
+type backupReader struct {
+	reader *bufio.Reader
+	crc    hash.Hash32
+	buffer []byte
+}
+
+func newBackupReader(r io.Reader) (*backupReader, *cluster.ShardBackupInfo, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Not a shard backup: %s", err)
+	}
+	self := &backupReader{reader: bufio.NewReader(gzipReader), crc: crc32.NewIEEE(), buffer: make([]byte, 1)}
+
+	magic := make([]byte, len(BACKUP_MAGIC)+1)
+	if _, err := io.ReadFull(self, magic); err != nil || !bytes.Equal(magic[:len(BACKUP_MAGIC)], BACKUP_MAGIC) {
+		return nil, nil, errors.New("Not a shard backup")
+	}
+	if version := magic[len(BACKUP_MAGIC)]; version != BACKUP_VERSION {
+		return nil, nil, fmt.Errorf("Unsupported shard backup version %d", version)
+	}
+	infoJson, err := self.readBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	info := &cluster.ShardBackupInfo{}
+	if err := json.Unmarshal(infoJson, info); err != nil {
+		return nil, nil, err
+	}
+	return self, info, nil
+}
+
+func (self *backupReader) Read(p []byte) (int, error) {
+	n, err := self.reader.Read(p)
+	self.crc.Write(p[:n])
+	return n, err
+}
+
+func (self *backupReader) ReadByte() (byte, error) {
+	b, err := self.reader.ReadByte()
+	if err == nil {
+		self.buffer[0] = b
+		self.crc.Write(self.buffer)
+	}
+	return b, err
+}
+
+func (self *backupReader) readBytes() ([]byte, error) {
+	length, err := binary.ReadUvarint(self)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return self.readData(length)
+}
+
+func (self *backupReader) readData(length uint64) ([]byte, error) {
+	if length > MAX_BACKUP_ENTRY_SIZE {
+		return nil, fmt.Errorf("Corrupted shard backup, entry of %d bytes", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(self, data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return data, nil
+}
+
+// returns a nil key after the last entry, verify checks the end of the backup
+func (self *backupReader) read() (key, value []byte, err error) {
+	keyLength, err := binary.ReadUvarint(self)
+	if err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	if keyLength == 0 {
+		return nil, nil, nil
+	}
+	if key, err = self.readData(keyLength); err != nil {
+		return nil, nil, err
+	}
+	if value, err = self.readBytes(); err != nil {
+		return nil, nil, err
+	}
+	return key, value, nil
+}
+
+func (self *backupReader) verify(entries uint64) error {
+	count, err := binary.ReadUvarint(self)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	expected := self.crc.Sum32()
+	var crc uint32
+	if err := binary.Read(self.reader, binary.BigEndian, &crc); err != nil {
+		return unexpectedEOF(err)
+	}
+	if count != entries || crc != expected {
+		return errors.New("Corrupted shard backup, the checksum doesn't match")
+	}
+	// reading up to the end makes gzip check its own checksum
+	if _, err := self.reader.ReadByte(); err != io.EOF {
+		if err == nil {
+			return errors.New("Corrupted shard backup, there's data after the end")
+		}
+		return err
+	}
+	return nil
+}
+
+// a backup that ends early is corrupted, not just over
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Writes a consistent snapshot of the shard to w
+func (self *ShardDatastore) BackupShard(id uint32, info *cluster.ShardBackupInfo, w io.Writer) error {
+	if _, err := os.Stat(self.shardDir(id)); os.IsNotExist(err) {
+		return fmt.Errorf("Shard %d doesn't exist", id)
+	}
+	db, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(id)
+	return db.(*Shard).backup(info, w)
+}
+
+// Replaces the shard with the backup read from r. validate gets called with the info
+// of the backup before any of the data is loaded. The backup is loaded next to the
+// shard and swapped in once it's complete, so a failed restore leaves the shard as
+// it was.
+func (self *ShardDatastore) RestoreShard(id uint32, r io.Reader, validate func(info *cluster.ShardBackupInfo) error) error {
+	reader, info, err := newBackupReader(r)
+	if err != nil {
+		return err
+	}
+	if err := validate(info); err != nil {
+		return err
+	}
+
+	restoreDir := self.shardDir(id) + ".restore"
+	if err := os.RemoveAll(restoreDir); err != nil {
+		return err
+	}
+	self.shardsLock.Lock()
+	engine, err := self.openEngine(self.engineName, restoreDir, self.longTermShards[id])
+	self.shardsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = loadBackup(engine, reader)
+	engine.Close()
+	if err != nil {
+		os.RemoveAll(restoreDir)
+		return err
+	}
+	return self.swapShardDir(id, restoreDir)
+}
+
+func loadBackup(engine storage.Engine, reader *backupReader) error {
+	writes := make([]storage.Write, 0, RESTORE_BATCH_SIZE)
+	entries := uint64(0)
+	for {
+		key, value, err := reader.read()
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			break
+		}
+		writes = append(writes, storage.Write{Key: key, Value: value})
+		entries++
+		if len(writes) == RESTORE_BATCH_SIZE {
+			if err := engine.BatchPut(writes); err != nil {
+				return err
+			}
+			writes = writes[:0]
+		}
+	}
+	if err := reader.verify(entries); err != nil {
+		return err
+	}
+	return engine.BatchPut(writes)
+}
+
+// Closes the shard if it's open, the next GetOrCreateShard opens the restored one
+func (self *ShardDatastore) swapShardDir(id uint32, restoreDir string) error {
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	if shard := self.shards[id]; shard != nil {
+		shard.close()
+		delete(self.shards, id)
+		delete(self.lastAccess, id)
+	}
+
+	// the series of the restored shard get indexed when it's opened
+	if err := self.seriesIndex.DropShard(id); err != nil {
+		return err
+	}
+	dir := self.shardDir(id)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	log.Info("DATASTORE: restoring shard %s", dir)
+	return os.Rename(restoreDir, dir)
+}
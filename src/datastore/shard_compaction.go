@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+)
+
+// Compacts the whole shard, or only the points of the database if it isn't empty.
+// progress gets called after every series with the number of series compacted so
+// far and the number of series to compact, a whole shard counts as one series.
+func (self *Shard) compact(database string, progress func(compacted, total int)) error {
+	if self.IsClosed() {
+		return fmt.Errorf("Shard is closed")
+	}
+	if database == "" {
+		self.compactRanges([][2][]byte{{nil, nil}})
+		progress(1, 1)
+		return nil
+	}
+
+	startTimeBytes := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	endTimeBytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	series := self.getSeriesForDatabase(database)
+	for i, name := range series {
+		fields, err := self.getFieldsForSeries(database, name, self.getColumnNamesForSeries(database, name))
+		if err != nil {
+			// the series got dropped since it was listed
+			if _, ok := err.(FieldLookupError); ok {
+				progress(i+1, len(series))
+				continue
+			}
+			return err
+		}
+		ranges := make([][2][]byte, 0, len(fields))
+		for _, field := range fields {
+			startKey, endKey := pointKeyRange(field.Id, startTimeBytes, endTimeBytes)
+			ranges = append(ranges, [2][]byte{startKey, endKey})
+		}
+		self.compactRanges(ranges)
+		progress(i+1, len(series))
+	}
+	return nil
+}
+
+// Compacts the local shard so the space of deleted points gets reclaimed. Only
+// the points of the database get compacted if it isn't empty.
+func (self *ShardDatastore) CompactShard(id uint32, database string, progress func(compacted, total int)) error {
+	if _, err := os.Stat(self.shardDir(id)); os.IsNotExist(err) {
+		return fmt.Errorf("Shard %d doesn't exist", id)
+	}
+	db, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(id)
+	return db.(*Shard).compact(database, progress)
+}
@@ -0,0 +1,502 @@
+package datastore
+
+import (
+	"bytes"
+	"cluster"
+	log "code.google.com/p/log4go"
+	"configuration"
+	"datastore/storage"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"protocol"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ShardDatastore struct {
+	baseDbDir      string
+	config         *configuration.Configuration
+	shards         map[uint32]*Shard
+	lastAccess     map[uint32]int64
+	shardRefCounts map[uint32]int
+	shardsToClose  map[uint32]bool
+	// the shards that get deleted once they aren't used anymore
+	shardsToDelete map[uint32]bool
+	// the shards that get opened with the long term options
+	longTermShards map[uint32]bool
+	shardsLock     sync.RWMutex
+	engineName     string
+	openers        map[string]storage.Opener
+	pointEncoding  string
+	writeBuffer    *cluster.WriteBuffer
+	maxOpenShards  int
+	pointBatchSize int
+	seriesIndex    *SeriesIndex
+}
+
+const (
+	ONE_KILOBYTE            = 1024
+	ONE_MEGABYTE            = 1024 * 1024
+	ONE_GIGABYTE            = ONE_MEGABYTE * 1024
+	TWO_FIFTY_SIX_KILOBYTES = 256 * 1024
+	SIXTY_FOUR_KILOBYTES    = 64 * 1024
+	MAX_SERIES_SIZE         = ONE_MEGABYTE
+	DATABASE_DIR            = "db"
+	SHARD_DATABASE_DIR      = "shard_db"
+	SHARD_TYPE_FILE         = "type"
+)
+
+var (
+
+	// This datastore implements the PersistentAtomicInteger interface. All of the persistent
+	// integers start with this prefix, followed by their name
+	ATOMIC_INCREMENT_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFD}
+	// NEXT_ID_KEY holds the next id. ids are used to "intern" timeseries and column names
+	NEXT_ID_KEY = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	// SERIES_COLUMN_INDEX_PREFIX is the prefix of the series to column names index
+	SERIES_COLUMN_INDEX_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE}
+	// DATABASE_SERIES_INDEX_PREFIX is the prefix of the database to series names index
+	DATABASE_SERIES_INDEX_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	MAX_SEQUENCE                 = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	// SHARD_METADATA_PREFIX is the prefix of the settings of the shard
+	SHARD_METADATA_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFC}
+	// SHARD_ENCODING_KEY holds the point encoding the shard writes with
+	SHARD_ENCODING_KEY = append(SHARD_METADATA_PREFIX, []byte("encoding")...)
+	// SHARD_MIGRATING_KEY is set while the points of the shard are rewritten with a new encoding
+	SHARD_MIGRATING_KEY = append(SHARD_METADATA_PREFIX, []byte("migrating")...)
+
+	// replicateWrite = protocol.Request_REPLICATION_WRITE
+
+	TRUE = true
+)
+
+type Field struct {
+	Id   []byte
+	Name string
+}
+
+type rawColumnValue struct {
+	time     []byte
+	sequence []byte
+	value    *protocol.FieldValue
+}
+
+func NewShardDatastore(config *configuration.Configuration) (*ShardDatastore, error) {
+	baseDbDir := filepath.Join(config.DataDir, SHARD_DATABASE_DIR)
+	err := os.MkdirAll(baseDbDir, 0744)
+	if err != nil {
+		return nil, err
+	}
+
+	engineName := config.StorageEngine
+	if engineName == "" {
+		engineName = storage.LEVELDB_NAME
+	}
+	// fail early if the engine doesn't exist
+	opener, err := storage.GetOpener(engineName, config)
+	if err != nil {
+		return nil, err
+	}
+
+	pointEncoding := config.StoragePointEncoding
+	if pointEncoding == "" {
+		pointEncoding = POINT_ENCODING_POINTS
+	}
+	if !IsValidPointEncoding(pointEncoding) {
+		return nil, fmt.Errorf("Unknown point encoding %s", pointEncoding)
+	}
+
+	self := &ShardDatastore{
+		baseDbDir:      baseDbDir,
+		config:         config,
+		shards:         make(map[uint32]*Shard),
+		engineName:     engineName,
+		openers:        map[string]storage.Opener{engineName: opener},
+		pointEncoding:  pointEncoding,
+		maxOpenShards:  config.LevelDbMaxOpenShards,
+		lastAccess:     make(map[uint32]int64),
+		shardRefCounts: make(map[uint32]int),
+		shardsToClose:  make(map[uint32]bool),
+		shardsToDelete: make(map[uint32]bool),
+		longTermShards: make(map[uint32]bool),
+		pointBatchSize: config.LevelDbPointBatchSize,
+	}
+
+	indexDir := filepath.Join(config.DataDir, SERIES_INDEX_DIR)
+	indexEngineName, err := self.shardEngineName(indexDir)
+	if err != nil {
+		return nil, err
+	}
+	indexEngine, err := self.openEngine(indexEngineName, indexDir, false)
+	if err != nil {
+		return nil, err
+	}
+	self.seriesIndex, err = NewSeriesIndex(indexEngine)
+	if err != nil {
+		indexEngine.Close()
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *ShardDatastore) Close() {
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	for _, shard := range self.shards {
+		shard.close()
+	}
+	self.seriesIndex.Close()
+}
+
+func (self *ShardDatastore) GetOrCreateShard(id uint32) (cluster.LocalShardDb, error) {
+	now := time.Now().Unix()
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	if self.shardsToDelete[id] {
+		return nil, fmt.Errorf("Shard %d is being dropped", id)
+	}
+	db := self.shards[id]
+	self.lastAccess[id] = now
+
+	if db != nil {
+		self.incrementShardRefCountAndCloseOldestIfNeeded(id)
+		return db, nil
+	}
+
+	dbDir := self.shardDir(id)
+
+	engineName, err := self.shardEngineName(dbDir)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("DATASTORE: opening or creating %s shard %s", engineName, dbDir)
+	engine, err := self.openEngine(engineName, dbDir, self.longTermShards[id])
+	if err != nil {
+		return nil, err
+	}
+
+	db, err = NewShard(engine, self.pointBatchSize, self.pointEncoding)
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	db.id = id
+	db.index = self.seriesIndex
+	if !self.seriesIndex.IsShardIndexed(id) {
+		log.Info("DATASTORE: adding the series of shard %s to the series index", dbDir)
+		if err := db.indexSeries(); err != nil {
+			engine.Close()
+			return nil, err
+		}
+	}
+	self.shards[id] = db
+	self.incrementShardRefCountAndCloseOldestIfNeeded(id)
+	return db, nil
+}
+
+// Rewrites the shards that don't use the configured point encoding yet, one at a time.
+// The shards can be used while they're migrated.
+func (self *ShardDatastore) MigratePointEncoding() {
+	dirs, err := ioutil.ReadDir(self.baseDbDir)
+	if err != nil {
+		log.Error("DATASTORE: can't list the shards to migrate: %s", err)
+		return
+	}
+	for _, dir := range dirs {
+		id, err := strconv.ParseUint(dir.Name(), 10, 32)
+		if err != nil || !dir.IsDir() {
+			continue
+		}
+		if err := self.migrateShard(uint32(id)); err != nil {
+			log.Error("DATASTORE: can't migrate shard %d to the %s point encoding: %s", id, self.pointEncoding, err)
+		}
+	}
+}
+
+func (self *ShardDatastore) migrateShard(id uint32) error {
+	db, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(id)
+
+	shard := db.(*Shard)
+	if !shard.NeedsMigration(self.pointEncoding) {
+		return nil
+	}
+	log.Info("DATASTORE: migrating shard %d to the %s point encoding", id, self.pointEncoding)
+	start := time.Now()
+	if err := shard.MigrateEncoding(self.pointEncoding); err != nil {
+		return err
+	}
+	log.Info("DATASTORE: migrated shard %d in %s", id, time.Now().Sub(start))
+	return nil
+}
+
+// Adds the shards that were written before the series index existed to it, one at
+// a time. Shards also get indexed the first time they're opened.
+func (self *ShardDatastore) IndexSeries() {
+	dirs, err := ioutil.ReadDir(self.baseDbDir)
+	if err != nil {
+		log.Error("DATASTORE: can't list the shards to index: %s", err)
+		return
+	}
+	for _, dir := range dirs {
+		id, err := strconv.ParseUint(dir.Name(), 10, 32)
+		if err != nil || !dir.IsDir() || self.seriesIndex.IsShardIndexed(uint32(id)) {
+			continue
+		}
+		if _, err := self.GetOrCreateShard(uint32(id)); err != nil {
+			log.Error("DATASTORE: can't add the series of shard %d to the series index: %s", id, err)
+			continue
+		}
+		self.ReturnShard(uint32(id))
+	}
+}
+
+// Returns an entry for every series of the database that matches the regex and every
+// local shard it's in
+func (self *ShardDatastore) ListSeries(database string, regex *regexp.Regexp) []*protocol.SeriesInfo {
+	return self.seriesIndex.ListSeries(database, regex)
+}
+
+// A shard that's already open keeps its options until it gets closed
+func (self *ShardDatastore) SetShardType(id uint32, shardType cluster.ShardType) {
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	self.longTermShards[id] = shardType == cluster.LONG_TERM
+}
+
+func (self *ShardDatastore) incrementShardRefCountAndCloseOldestIfNeeded(id uint32) {
+	self.shardRefCounts[id] += 1
+	delete(self.shardsToClose, id)
+	if self.maxOpenShards > 0 && len(self.shards) > self.maxOpenShards {
+		for i := len(self.shards) - self.maxOpenShards; i > 0; i-- {
+			self.closeOldestShard()
+		}
+	}
+}
+
+func (self *ShardDatastore) ReturnShard(id uint32) {
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	self.shardRefCounts[id] -= 1
+	if self.shardRefCounts[id] > 0 {
+		return
+	}
+	if self.shardsToDelete[id] {
+		if err := self.deleteShard(id); err != nil {
+			log.Error("DATASTORE: cannot drop shard %d: %s", id, err)
+		}
+	} else if self.shardsToClose[id] {
+		self.closeShard(id)
+	}
+}
+
+func (self *ShardDatastore) Write(request *protocol.Request) error {
+	shardDb, err := self.GetOrCreateShard(*request.ShardId)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(*request.ShardId)
+	return shardDb.Write(*request.Database, request.Series)
+}
+
+func (self *ShardDatastore) BufferWrite(request *protocol.Request) {
+	self.writeBuffer.Write(request)
+}
+
+func (self *ShardDatastore) BufferWriteAndNotify(request *protocol.Request, acks chan<- uint32) {
+	self.writeBuffer.WriteAndNotify(request, acks)
+}
+
+func (self *ShardDatastore) StopNotifying(requestNumber uint32, acks chan<- uint32) {
+	self.writeBuffer.StopNotifying(requestNumber, acks)
+}
+
+func (self *ShardDatastore) SetWriteBuffer(writeBuffer *cluster.WriteBuffer) {
+	self.writeBuffer = writeBuffer
+}
+
+// Deletes the shard, or marks it for deletion if it's in use. The last ReturnShard
+// deletes it then, until that it can't be opened anymore.
+func (self *ShardDatastore) DeleteShard(shardId uint32) error {
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	if self.shardRefCounts[shardId] > 0 {
+		log.Info("DATASTORE: shard %d is in use, dropping it once it's returned", shardId)
+		self.shardsToDelete[shardId] = true
+		return nil
+	}
+	return self.deleteShard(shardId)
+}
+
+// should be called with the shards lock held
+func (self *ShardDatastore) deleteShard(shardId uint32) error {
+	self.closeShard(shardId)
+	delete(self.shardsToDelete, shardId)
+
+	dir := self.shardDir(shardId)
+	log.Info("DATASTORE: dropping shard %s", dir)
+	if err := self.seriesIndex.DropShard(shardId); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// Removes all the points of the database from the local shard if every series of
+// the database in it matches, e.g. for a delete that covers the time range of the
+// shard. The shard gets dropped if the database is the only one in it, otherwise
+// the series get dropped. Returns false without removing anything if a series
+// doesn't match.
+func (self *ShardDatastore) DropShardDatabase(id uint32, database string, matches func(series string) bool) (bool, error) {
+	if _, err := os.Stat(self.shardDir(id)); os.IsNotExist(err) {
+		return true, nil
+	}
+	db, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return false, err
+	}
+
+	shard := db.(*Shard)
+	series, covered, dropped := shard.dropIfDatabaseCovered(database, matches)
+	if dropped {
+		// queries that still use the shard keep it around until they return it
+		self.ReturnShard(id)
+		log.Info("DATASTORE: %s is the only database in shard %d, dropping the shard", database, id)
+		return true, self.DeleteShard(id)
+	}
+	defer self.ReturnShard(id)
+	if !covered {
+		return false, nil
+	}
+	for _, name := range series {
+		if err := shard.dropSeries(database, name); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+func (self *ShardDatastore) shardDir(id uint32) string {
+	return filepath.Join(self.baseDbDir, fmt.Sprintf("%.5d", id))
+}
+
+// Returns the engine the shard in dir was created with. New shards use the configured
+// engine, shards created before the engine was configurable are LevelDB shards without
+// a type file.
+func (self *ShardDatastore) shardEngineName(dir string) (string, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return self.engineName, nil
+	}
+	name, err := ioutil.ReadFile(filepath.Join(dir, SHARD_TYPE_FILE))
+	if os.IsNotExist(err) {
+		return storage.LEVELDB_NAME, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(name)), nil
+}
+
+// should be called with the shards lock held
+func (self *ShardDatastore) openEngine(engineName, dir string, longTerm bool) (storage.Engine, error) {
+	opener := self.openers[engineName]
+	if opener == nil {
+		var err error
+		opener, err = storage.GetOpener(engineName, self.config)
+		if err != nil {
+			return nil, err
+		}
+		self.openers[engineName] = opener
+	}
+
+	engine, err := opener(dir, longTerm)
+	if err != nil {
+		return nil, err
+	}
+
+	typeFile := filepath.Join(dir, SHARD_TYPE_FILE)
+	if _, err := os.Stat(typeFile); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(typeFile, []byte(engineName), 0644); err != nil {
+			engine.Close()
+			return nil, err
+		}
+	}
+	return engine, nil
+}
+
+func (self *ShardDatastore) closeOldestShard() {
+	var oldestId uint32
+	oldestAccess := int64(math.MaxInt64)
+	for id, lastAccess := range self.lastAccess {
+		if lastAccess < oldestAccess && self.shardsToClose[id] == false {
+			oldestId = id
+			oldestAccess = lastAccess
+		}
+	}
+	if self.shardRefCounts[oldestId] == 0 {
+		self.closeShard(oldestId)
+	} else {
+		self.shardsToClose[oldestId] = true
+	}
+}
+
+func (self *ShardDatastore) closeShard(id uint32) {
+	shard := self.shards[id]
+	if shard != nil {
+		shard.close()
+	}
+	delete(self.shardRefCounts, id)
+	delete(self.shards, id)
+	delete(self.lastAccess, id)
+	delete(self.shardsToClose, id)
+	log.Debug("DATASTORE: closing shard %s", self.shardDir(id))
+}
+
+type FieldLookupError struct {
+	message string
+}
+
+func (self FieldLookupError) Error() string {
+	return self.message
+}
+
+// depending on the query order (whether it's ascending or not) returns
+// the min (or max in case of descending query) of the current
+// [timestamp,sequence] and the self's [timestamp,sequence]
+//
+// This is used to determine what the next point's timestamp
+// and sequence number should be.
+func (self *rawColumnValue) updatePointTimeAndSequence(currentTimeRaw, currentSequenceRaw []byte, isAscendingQuery bool) ([]byte, []byte) {
+	if currentTimeRaw == nil {
+		return self.time, self.sequence
+	}
+
+	compareValue := 1
+	if isAscendingQuery {
+		compareValue = -1
+	}
+
+	timeCompare := bytes.Compare(self.time, currentTimeRaw)
+	if timeCompare == compareValue {
+		return self.time, self.sequence
+	}
+
+	if timeCompare != 0 {
+		return currentTimeRaw, currentSequenceRaw
+	}
+
+	if bytes.Compare(self.sequence, currentSequenceRaw) == compareValue {
+		return currentTimeRaw, self.sequence
+	}
+
+	return currentTimeRaw, currentSequenceRaw
+}
@@ -0,0 +1,406 @@
+package datastore
+
+import (
+	"bytes"
+	"cluster"
+	"code.google.com/p/goprotobuf/proto"
+	"configuration"
+	. "launchpad.net/gocheck"
+	"os"
+	"parser"
+	"path/filepath"
+	"protocol"
+	"regexp"
+	"time"
+)
+
+const TEST_DATASTORE_SHARD_DIR = "/tmp/influxdb/shard_datastore_test"
+
+// the suite runs once per storage engine
+type ShardDatastoreSuite struct {
+	engine string
+}
+
+var _ = Suite(&ShardDatastoreSuite{engine: "leveldb"})
+var _ = Suite(&ShardDatastoreSuite{engine: "boltdb"})
+
+func (self *ShardDatastoreSuite) SetUpTest(c *C) {
+	err := os.RemoveAll(self.dataDir())
+	c.Assert(err, IsNil)
+}
+
+func (self *ShardDatastoreSuite) dataDir() string {
+	return filepath.Join(TEST_DATASTORE_SHARD_DIR, self.engine)
+}
+
+func (self *ShardDatastoreSuite) newStore(c *C, pointEncoding string) *ShardDatastore {
+	config := &configuration.Configuration{}
+	config.DataDir = self.dataDir()
+	config.StorageEngine = self.engine
+	config.StoragePointEncoding = pointEncoding
+	config.LevelDbPointBatchSize = 100
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	return store
+}
+
+type collectingProcessor struct {
+	points []*protocol.Point
+}
+
+func (self *collectingProcessor) YieldPoint(seriesName *string, columnNames []string, point *protocol.Point) bool {
+	if point != nil {
+		self.points = append(self.points, point)
+	}
+	return true
+}
+
+func (self *collectingProcessor) YieldSeries(series *protocol.Series) bool {
+	self.points = append(self.points, series.Points...)
+	return true
+}
+
+func (self *collectingProcessor) Close()                                    {}
+func (self *collectingProcessor) SetShardInfo(shardId int, shardLocal bool) {}
+
+func (self *ShardDatastoreSuite) query(c *C, store *ShardDatastore, q string) []*protocol.Point {
+	shard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	defer store.ReturnShard(1)
+
+	queries, err := parser.ParseQuery(q)
+	c.Assert(err, IsNil)
+	processor := &collectingProcessor{}
+	err = shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor)
+	c.Assert(err, IsNil)
+	return processor.points
+}
+
+func (self *ShardDatastoreSuite) queryShard(c *C, shard cluster.LocalShardDb, q string) error {
+	queries, err := parser.ParseQuery(q)
+	c.Assert(err, IsNil)
+	return shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), &collectingProcessor{})
+}
+
+func (self *ShardDatastoreSuite) TestWillEnforceMaxOpenShards(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = self.dataDir()
+	config.StorageEngine = self.engine
+	config.LevelDbMaxOpenShards = 2
+
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+
+	shard, err := store.GetOrCreateShard(uint32(2))
+	c.Assert(err, IsNil)
+	c.Assert(shard.IsClosed(), Equals, false)
+	_, err = store.GetOrCreateShard(uint32(1))
+	c.Assert(err, IsNil)
+	c.Assert(shard.IsClosed(), Equals, false)
+	_, err = store.GetOrCreateShard(uint32(3))
+	c.Assert(err, IsNil)
+	c.Assert(shard.IsClosed(), Equals, false)
+	store.ReturnShard(uint32(2))
+	c.Assert(shard.IsClosed(), Equals, true)
+}
+
+func (self *ShardDatastoreSuite) TestWriteQueryAndDelete(c *C) {
+	self.assertWriteQueryAndDelete(c, POINT_ENCODING_POINTS)
+}
+
+func (self *ShardDatastoreSuite) TestWriteQueryAndDeleteWithBlocks(c *C) {
+	self.assertWriteQueryAndDelete(c, POINT_ENCODING_BLOCKS)
+}
+
+func (self *ShardDatastoreSuite) writePoints(c *C, store *ShardDatastore, values ...int64) {
+	series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"value"}}
+	for _, value := range values {
+		series.Points = append(series.Points, &protocol.Point{
+			Values:         []*protocol.FieldValue{{Int64Value: proto.Int64(value)}},
+			Timestamp:      proto.Int64(value * 1000000),
+			SequenceNumber: proto.Uint64(1),
+		})
+	}
+	shard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	c.Assert(shard.Write("db1", series), IsNil)
+	store.ReturnShard(1)
+}
+
+func (self *ShardDatastoreSuite) assertWriteQueryAndDelete(c *C, pointEncoding string) {
+	store := self.newStore(c, pointEncoding)
+	defer store.Close()
+
+	series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"value"}}
+	for i := int64(1); i <= 3; i++ {
+		series.Points = append(series.Points, &protocol.Point{
+			Values:         []*protocol.FieldValue{{Int64Value: proto.Int64(i)}},
+			Timestamp:      proto.Int64(i * 1000000),
+			SequenceNumber: proto.Uint64(1),
+		})
+	}
+	// negative timestamps have to sort before the positive ones
+	series.Points = append(series.Points, &protocol.Point{
+		Values:         []*protocol.FieldValue{{Int64Value: proto.Int64(0)}},
+		Timestamp:      proto.Int64(-1000000),
+		SequenceNumber: proto.Uint64(1),
+	})
+	shard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	c.Assert(shard.Write("db1", series), IsNil)
+	store.ReturnShard(1)
+
+	points := self.query(c, store, "select value from foo where time > -10s order asc")
+	c.Assert(points, HasLen, 4)
+	for i, point := range points {
+		c.Assert(point.Values[0].GetInt64Value(), Equals, int64(i))
+	}
+
+	points = self.query(c, store, "select value from foo where time > -10s")
+	c.Assert(points, HasLen, 4)
+	c.Assert(points[0].Values[0].GetInt64Value(), Equals, int64(3))
+
+	self.query(c, store, "delete from foo where time > -10s and time < 1500000u")
+	points = self.query(c, store, "select value from foo where time > -10s order asc")
+	c.Assert(points, HasLen, 2)
+	c.Assert(points[0].GetTimestamp(), Equals, int64(2000000))
+
+	points = self.query(c, store, "select value from foo where time = 3s and sequence_number = 1")
+	c.Assert(points, HasLen, 1)
+	c.Assert(points[0].Values[0].GetInt64Value(), Equals, int64(3))
+}
+
+func (self *ShardDatastoreSuite) TestMigratePointEncoding(c *C) {
+	store := self.newStore(c, POINT_ENCODING_POINTS)
+	self.writePoints(c, store, 1, 2, 3)
+	store.Close()
+
+	// existing shards keep their encoding until they're migrated
+	store = self.newStore(c, POINT_ENCODING_BLOCKS)
+	defer store.Close()
+	shard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	defer store.ReturnShard(1)
+	c.Assert(shard.(*Shard).Encoding(), Equals, POINT_ENCODING_POINTS)
+
+	store.MigratePointEncoding()
+	c.Assert(shard.(*Shard).Encoding(), Equals, POINT_ENCODING_BLOCKS)
+	c.Assert(shard.(*Shard).NeedsMigration(POINT_ENCODING_BLOCKS), Equals, false)
+
+	self.writePoints(c, store, 4)
+	points := self.query(c, store, "select value from foo where time > -10s order asc")
+	c.Assert(points, HasLen, 4)
+	for i, point := range points {
+		c.Assert(point.Values[0].GetInt64Value(), Equals, int64(i+1))
+	}
+}
+
+func (self *ShardDatastoreSuite) TestShardsKeepTheirEngine(c *C) {
+	store := self.newStore(c, POINT_ENCODING_POINTS)
+	_, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	store.ReturnShard(1)
+	store.Close()
+
+	other := "boltdb"
+	if self.engine == other {
+		other = "leveldb"
+	}
+	config := &configuration.Configuration{}
+	config.DataDir = self.dataDir()
+	config.StorageEngine = other
+	store, err = NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+	shard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	c.Assert(shard.(*Shard).db.Name(), Equals, self.engine)
+	store.ReturnShard(1)
+}
+
+func (self *ShardDatastoreSuite) TestBackupAndRestore(c *C) {
+	store := self.newStore(c, POINT_ENCODING_BLOCKS)
+	defer store.Close()
+	self.writePoints(c, store, 1, 2, 3)
+
+	info := &cluster.ShardBackupInfo{ShardId: 1, StartTime: time.Unix(0, 0).UTC(), EndTime: time.Unix(3600, 0).UTC()}
+	backup := &bytes.Buffer{}
+	c.Assert(store.BackupShard(1, info, backup), IsNil)
+
+	// the restore replaces the points written after the backup
+	self.writePoints(c, store, 4)
+	var restored *cluster.ShardBackupInfo
+	err := store.RestoreShard(1, bytes.NewReader(backup.Bytes()), func(info *cluster.ShardBackupInfo) error {
+		restored = info
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(restored.ShardId, Equals, uint32(1))
+	c.Assert(restored.EndTime.Equal(info.EndTime), Equals, true)
+
+	points := self.query(c, store, "select value from foo where time > -10s order asc")
+	c.Assert(points, HasLen, 3)
+	for i, point := range points {
+		c.Assert(point.Values[0].GetInt64Value(), Equals, int64(i+1))
+	}
+	shard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	c.Assert(shard.(*Shard).Encoding(), Equals, POINT_ENCODING_BLOCKS)
+	store.ReturnShard(1)
+
+	// a cut off backup leaves the shard alone
+	truncated := backup.Bytes()[:backup.Len()-1]
+	err = store.RestoreShard(1, bytes.NewReader(truncated), func(info *cluster.ShardBackupInfo) error { return nil })
+	c.Assert(err, NotNil)
+	c.Assert(self.query(c, store, "select value from foo where time > -10s"), HasLen, 3)
+}
+
+func (self *ShardDatastoreSuite) TestSeriesIndex(c *C) {
+	store := self.newStore(c, POINT_ENCODING_BLOCKS)
+	self.writePoints(c, store, 1, 2, 3)
+	series := store.ListSeries("db1", nil)
+	c.Assert(series, HasLen, 1)
+	c.Assert(series[0].GetName(), Equals, "foo")
+	c.Assert(series[0].Columns, DeepEquals, []string{"value"})
+	c.Assert(series[0].ColumnTypes, DeepEquals, []string{"int64"})
+	c.Assert(series[0].GetFirstSeen(), Equals, int64(1000000))
+	c.Assert(series[0].GetLastSeen(), Equals, int64(3000000))
+	c.Assert(series[0].GetPointCount(), Equals, uint64(3))
+	c.Assert(store.ListSeries("db2", nil), HasLen, 0)
+	c.Assert(store.ListSeries("db1", regexp.MustCompile("^bar")), HasLen, 0)
+
+	// regex queries get the series names from the index
+	c.Assert(self.query(c, store, "select value from /^f.*/ where time > -10s"), HasLen, 3)
+	c.Assert(self.query(c, store, "select value from /^bar/ where time > -10s"), HasLen, 0)
+	store.Close()
+
+	store = self.newStore(c, POINT_ENCODING_BLOCKS)
+	series = store.ListSeries("db1", nil)
+	c.Assert(series, HasLen, 1)
+	c.Assert(series[0].GetPointCount(), Equals, uint64(3))
+
+	// shards that aren't in the index get added when they're opened, without a point count
+	c.Assert(store.seriesIndex.DropShard(1), IsNil)
+	c.Assert(store.ListSeries("db1", nil), HasLen, 0)
+	store.Close()
+	store = self.newStore(c, POINT_ENCODING_BLOCKS)
+	defer store.Close()
+	store.IndexSeries()
+	series = store.ListSeries("db1", nil)
+	c.Assert(series, HasLen, 1)
+	c.Assert(series[0].GetFirstSeen(), Equals, int64(1000000))
+	c.Assert(series[0].GetLastSeen(), Equals, int64(3000000))
+	c.Assert(series[0].ColumnTypes, DeepEquals, []string{"int64"})
+	c.Assert(series[0].GetPointCount(), Equals, uint64(0))
+
+	self.query(c, store, "drop series foo")
+	c.Assert(store.ListSeries("db1", nil), HasLen, 0)
+}
+
+func (self *ShardDatastoreSuite) TestCompactShard(c *C) {
+	store := self.newStore(c, POINT_ENCODING_BLOCKS)
+	defer store.Close()
+	self.writePoints(c, store, 1, 2, 3)
+	self.query(c, store, "delete from foo where time > -10s and time < 1500000u")
+
+	progress := [][2]int{}
+	record := func(compacted, total int) { progress = append(progress, [2]int{compacted, total}) }
+	c.Assert(store.CompactShard(1, "db1", record), IsNil)
+	c.Assert(progress, DeepEquals, [][2]int{{1, 1}})
+	c.Assert(store.CompactShard(1, "db2", record), IsNil)
+	c.Assert(progress, HasLen, 1)
+	c.Assert(store.CompactShard(1, "", record), IsNil)
+	c.Assert(progress, HasLen, 2)
+	c.Assert(self.query(c, store, "select value from foo where time > -10s"), HasLen, 2)
+
+	c.Assert(store.CompactShard(2, "", record), NotNil)
+}
+
+func (self *ShardDatastoreSuite) TestDropShardDatabase(c *C) {
+	store := self.newStore(c, POINT_ENCODING_BLOCKS)
+	defer store.Close()
+	self.writePoints(c, store, 1, 2, 3)
+	shard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	series := &protocol.Series{Name: protocol.String("bar"), Fields: []string{"value"}, Points: []*protocol.Point{
+		{Values: []*protocol.FieldValue{{Int64Value: proto.Int64(1)}}, Timestamp: proto.Int64(1000000), SequenceNumber: proto.Uint64(1)},
+	}}
+	c.Assert(shard.Write("db2", series), IsNil)
+	store.ReturnShard(1)
+
+	// nothing gets removed unless all the series match
+	dropped, err := store.DropShardDatabase(1, "db1", func(series string) bool { return series == "bar" })
+	c.Assert(err, IsNil)
+	c.Assert(dropped, Equals, false)
+	c.Assert(self.query(c, store, "select value from foo where time > -10s"), HasLen, 3)
+
+	// the series get dropped while the shard has other databases
+	matchAll := func(series string) bool { return true }
+	dropped, err = store.DropShardDatabase(1, "db1", matchAll)
+	c.Assert(err, IsNil)
+	c.Assert(dropped, Equals, true)
+	c.Assert(self.query(c, store, "select value from foo where time > -10s"), HasLen, 0)
+	c.Assert(store.ListSeries("db2", nil), HasLen, 1)
+
+	// the last database drops the whole shard
+	dropped, err = store.DropShardDatabase(1, "db2", matchAll)
+	c.Assert(err, IsNil)
+	c.Assert(dropped, Equals, true)
+	_, err = os.Stat(store.shardDir(1))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(store.ListSeries("db2", nil), HasLen, 0)
+
+	self.writePoints(c, store, 1, 2, 3)
+	c.Assert(self.query(c, store, "select value from foo where time > -10s"), HasLen, 3)
+}
+
+func (self *ShardDatastoreSuite) TestDropShardDatabaseWaitsForTheShardToBeReturned(c *C) {
+	store := self.newStore(c, POINT_ENCODING_BLOCKS)
+	defer store.Close()
+	self.writePoints(c, store, 1, 2, 3)
+	shard, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+
+	dropped, err := store.DropShardDatabase(1, "db1", func(series string) bool { return true })
+	c.Assert(err, IsNil)
+	c.Assert(dropped, Equals, true)
+
+	// the shard is still in use, it can be read but not written to or opened again
+	c.Assert(shard.IsClosed(), Equals, false)
+	_, err = os.Stat(store.shardDir(1))
+	c.Assert(err, IsNil)
+	c.Assert(self.queryShard(c, shard, "select value from foo where time > -10s"), IsNil)
+	_, err = store.GetOrCreateShard(1)
+	c.Assert(err, NotNil)
+
+	store.ReturnShard(1)
+	c.Assert(shard.IsClosed(), Equals, true)
+	_, err = os.Stat(store.shardDir(1))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(self.queryShard(c, shard, "select value from foo where time > -10s"), NotNil)
+}
+
+func (self *ShardDatastoreSuite) TestShardStats(c *C) {
+	store := self.newStore(c, POINT_ENCODING_POINTS)
+	defer store.Close()
+	self.writePoints(c, store, 1, 2, 3)
+
+	stats := store.ShardStats()
+	c.Assert(stats, HasLen, 1)
+	c.Assert(stats[0].GetShardId(), Equals, uint32(1))
+	c.Assert(stats[0].GetBytes() > 0, Equals, true)
+	c.Assert(stats[0].GetApproximateKeys(), Equals, int64(3))
+	c.Assert(stats[0].GetSeries(), Equals, int64(1))
+	c.Assert(stats[0].GetOpen(), Equals, true)
+	c.Assert(stats[0].GetRefCount(), Equals, int64(0))
+	if self.engine == "leveldb" {
+		c.Assert(stats[0].LevelFiles, HasLen, 7)
+	} else {
+		c.Assert(stats[0].LevelFiles, HasLen, 0)
+	}
+
+	_, err := store.GetOrCreateShard(1)
+	c.Assert(err, IsNil)
+	c.Assert(store.ShardStats()[0].GetRefCount(), Equals, int64(1))
+	store.ReturnShard(1)
+}
@@ -0,0 +1,434 @@
+package datastore
+
+import (
+	"bytes"
+	"datastore/storage"
+	"fmt"
+	"protocol"
+	"sort"
+
+	"code.google.com/p/goprotobuf/proto"
+	log "code.google.com/p/log4go"
+)
+
+// Shards store their points either with an entry per point and column or in blocks
+// of consecutive points of a column (see block.go). Reads work with both, so a shard
+// can be migrated to the other encoding while it's in use.
+const (
+	POINT_ENCODING_POINTS = "points"
+	POINT_ENCODING_BLOCKS = "blocks"
+
+	// the number of blocks worth of points that get rewritten at once when migrating
+	MIGRATION_BLOCKS_PER_BATCH = 10
+)
+
+func IsValidPointEncoding(encoding string) bool {
+	return encoding == POINT_ENCODING_POINTS || encoding == POINT_ENCODING_BLOCKS
+}
+
+// returns the encoding the shard was written with. New shards get the given encoding,
+// shards written before the encoding was configurable have an entry per point.
+func readShardEncoding(db storage.Engine, isNew bool, encoding string) (string, error) {
+	value, err := db.Get(SHARD_ENCODING_KEY)
+	if err != nil {
+		return "", err
+	}
+	if value != nil {
+		return string(value), nil
+	}
+	if !isNew {
+		encoding = POINT_ENCODING_POINTS
+	}
+	err = db.BatchPut([]storage.Write{{Key: SHARD_ENCODING_KEY, Value: []byte(encoding)}})
+	return encoding, err
+}
+
+func (self *Shard) Encoding() string {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	return self.encoding
+}
+
+// returns true if the shard doesn't use the encoding yet or a previous migration
+// didn't finish
+func (self *Shard) NeedsMigration(encoding string) bool {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	return self.encoding != encoding || self.migrating
+}
+
+// returns true if the column entries can be blocks, writes have to go through
+// mergeIntoColumn then
+func (self *Shard) mayHaveBlocks() bool {
+	return self.encoding == POINT_ENCODING_BLOCKS || self.migrating
+}
+
+// Rewrites the points of all the columns with the given encoding. New writes use the
+// encoding right away, the existing points get rewritten a few blocks at a time so
+// writes aren't held up for long.
+func (self *Shard) MigrateEncoding(encoding string) error {
+	if !IsValidPointEncoding(encoding) {
+		return fmt.Errorf("Unknown point encoding %s", encoding)
+	}
+
+	self.writeLock.Lock()
+	if self.closed {
+		self.writeLock.Unlock()
+		return fmt.Errorf("Shard is closed")
+	}
+	err := self.db.BatchPut([]storage.Write{
+		{Key: SHARD_MIGRATING_KEY, Value: []byte(encoding)},
+		{Key: SHARD_ENCODING_KEY, Value: []byte(encoding)},
+	})
+	if err == nil {
+		self.encoding = encoding
+		self.migrating = true
+	}
+	self.writeLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range self.getColumnIds() {
+		if err := self.rewriteColumn(id); err != nil {
+			return err
+		}
+	}
+
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	if self.closed {
+		return fmt.Errorf("Shard is closed")
+	}
+	if err := self.db.BatchPut([]storage.Write{{Key: SHARD_MIGRATING_KEY}}); err != nil {
+		return err
+	}
+	self.migrating = false
+	return nil
+}
+
+func (self *Shard) getColumnIds() [][]byte {
+	it := self.db.Iterator()
+	defer it.Close()
+
+	ids := make([][]byte, 0)
+	for it.Seek(SERIES_COLUMN_INDEX_PREFIX); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) < len(SERIES_COLUMN_INDEX_PREFIX) || !bytes.Equal(key[:len(SERIES_COLUMN_INDEX_PREFIX)], SERIES_COLUMN_INDEX_PREFIX) {
+			break
+		}
+		ids = append(ids, append([]byte{}, it.Value()...))
+	}
+	return ids
+}
+
+func (self *Shard) rewriteColumn(id []byte) error {
+	start := id
+	for start != nil {
+		var err error
+		start, err = self.rewriteColumnBatch(id, start)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrites the entries of the column starting at the given key and returns the key
+// to continue with, nil if there are no entries left
+func (self *Shard) rewriteColumnBatch(id, start []byte) ([]byte, error) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	if self.closed {
+		return nil, fmt.Errorf("Shard is closed")
+	}
+
+	it := self.db.Iterator()
+	keys := make([][]byte, 0)
+	points := make([]*blockPoint, 0)
+	for it.Seek(start); it.Valid() && isColumnKey(id, it.Key()); it.Next() {
+		entryPoints, err := decodeEntry(it.Key(), it.Value())
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		keys = append(keys, append([]byte{}, it.Key()...))
+		points = append(points, entryPoints...)
+		if len(points) >= MAX_POINTS_PER_BLOCK*MIGRATION_BLOCKS_PER_BATCH {
+			break
+		}
+	}
+	// the iterator has to be closed before writing, some engines block writes while
+	// there are open iterators
+	it.Close()
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	writes := deleteWrites(keys)
+	encoded, err := self.encodePoints(id, points)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.db.BatchPut(append(writes, encoded...)); err != nil {
+		return nil, err
+	}
+	log.Debug("DATASTORE: rewrote %d points of column %v", len(points), id)
+	// the keys are fixed size, so this is the first key after the last one
+	return append(keys[len(keys)-1], 0), nil
+}
+
+func (self *Shard) encodePoints(id []byte, points []*blockPoint) ([]storage.Write, error) {
+	if self.encoding == POINT_ENCODING_BLOCKS {
+		return blockWrites(id, points), nil
+	}
+
+	writes := make([]storage.Write, 0, len(points))
+	for _, point := range points {
+		data, err := proto.Marshal(point.value)
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, storage.Write{Key: pointKey(id, point.timestamp, point.sequence), Value: data})
+	}
+	return writes, nil
+}
+
+// Returns the writes that merge the points into the entries of the column. The points
+// have to be sorted, points with a nil value delete the existing ones. Used for all
+// the writes once a shard can have blocks, so no two entries of a column overlap.
+func (self *Shard) mergeIntoColumn(id []byte, points []*blockPoint) ([]storage.Write, error) {
+	first, last := points[0], points[len(points)-1]
+	firstKey := pointKey(id, first.timestamp, first.sequence)
+	lastKey := pointKey(id, last.timestamp, last.sequence)
+
+	it := self.db.Iterator()
+	defer it.Close()
+
+	keys := make([][]byte, 0)
+	existing := make([]*blockPoint, 0)
+
+	// the block before the new points gets filled up first, this is where
+	// points usually go
+	it.Seek(firstKey)
+	if self.encoding == POINT_ENCODING_BLOCKS && it.Valid() {
+		it.Prev()
+		if it.Valid() && isColumnKey(id, it.Key()) && isBlock(it.Value()) {
+			previous, err := decodeBlock(it.Value())
+			if err != nil {
+				return nil, err
+			}
+			if len(previous) < MAX_POINTS_PER_BLOCK {
+				keys = append(keys, append([]byte{}, it.Key()...))
+				existing = append(existing, previous...)
+			}
+		}
+	}
+
+	// then the entries overlapping the new points
+	for it.Seek(firstKey); it.Valid() && isColumnKey(id, it.Key()); it.Next() {
+		key := it.Key()
+		entryPoints, err := decodeEntry(key, it.Value())
+		if err != nil {
+			return nil, err
+		}
+		if entryPoints[0].compare(last) > 0 {
+			break
+		}
+		keys = append(keys, append([]byte{}, key...))
+		existing = append(existing, entryPoints...)
+		if bytes.Compare(key, lastKey) >= 0 {
+			break
+		}
+	}
+
+	writes := deleteWrites(keys)
+	encoded, err := self.encodePoints(id, mergePoints(existing, points))
+	if err != nil {
+		return nil, err
+	}
+	return append(writes, encoded...), nil
+}
+
+// Blocks can hold points on both sides of the start or the end of a range that's
+// getting deleted. Returns the writes that replace these blocks with blocks of the
+// points outside of the range, the rest of the range can be deleted by key.
+func (self *Shard) splitBoundaryBlocks(id, startKey, endKey []byte) ([]storage.Write, error) {
+	it := self.db.Iterator()
+	defer it.Close()
+
+	keys := make([][]byte, 0)
+	kept := make([]*blockPoint, 0)
+	keep := func(key, block []byte) error {
+		points, err := decodeBlock(block)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, append([]byte{}, key...))
+		for _, point := range points {
+			pointKey := pointKey(id, point.timestamp, point.sequence)
+			if bytes.Compare(pointKey, startKey) < 0 || bytes.Compare(pointKey, endKey) > 0 {
+				kept = append(kept, point)
+			}
+		}
+		return nil
+	}
+
+	// the block holding the first points of the range can start before it
+	it.Seek(startKey)
+	var firstKey []byte
+	if it.Valid() && isColumnKey(id, it.Key()) && isBlock(it.Value()) {
+		firstKey = append([]byte{}, it.Key()...)
+		timestamp, sequence, err := blockFirstPoint(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Compare(pointKey(id, timestamp, sequence), startKey) < 0 || bytes.Compare(firstKey, endKey) > 0 {
+			if err := keep(firstKey, it.Value()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// and the block holding the last points can end after it
+	it.Seek(endKey)
+	if it.Valid() && isColumnKey(id, it.Key()) && isBlock(it.Value()) && !bytes.Equal(it.Key(), firstKey) && bytes.Compare(it.Key(), endKey) > 0 {
+		timestamp, sequence, err := blockFirstPoint(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Compare(pointKey(id, timestamp, sequence), endKey) <= 0 {
+			if err := keep(it.Key(), it.Value()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	writes := deleteWrites(keys)
+	encoded, err := self.encodePoints(id, kept)
+	if err != nil {
+		return nil, err
+	}
+	return append(writes, encoded...), nil
+}
+
+func isColumnKey(id, key []byte) bool {
+	return len(key) == POINT_KEY_SIZE && bytes.Equal(key[:len(id)], id)
+}
+
+// returns the points stored in the entry, which is either a block or a single point
+func decodeEntry(key, value []byte) ([]*blockPoint, error) {
+	if isBlock(value) {
+		return decodeBlock(value)
+	}
+	fieldValue := &protocol.FieldValue{}
+	if err := proto.Unmarshal(value, fieldValue); err != nil {
+		return nil, err
+	}
+	point := &blockPoint{
+		timestamp: timestampFromRaw(key[8:16]),
+		sequence:  sequenceNumberFromRaw(key[16:]),
+		value:     fieldValue,
+	}
+	return []*blockPoint{point}, nil
+}
+
+func deleteWrites(keys [][]byte) []storage.Write {
+	writes := make([]storage.Write, 0, len(keys))
+	for _, key := range keys {
+		writes = append(writes, storage.Write{Key: key})
+	}
+	return writes
+}
+
+// returns the writes that store the sorted points in blocks, each block is stored
+// under the key of its last point
+func blockWrites(id []byte, points []*blockPoint) []storage.Write {
+	writes := make([]storage.Write, 0, len(points)/MAX_POINTS_PER_BLOCK+1)
+	for len(points) > 0 {
+		size := len(points)
+		if size > MAX_POINTS_PER_BLOCK {
+			size = MAX_POINTS_PER_BLOCK
+		}
+		last := points[size-1]
+		writes = append(writes, storage.Write{
+			Key:   pointKey(id, last.timestamp, last.sequence),
+			Value: encodeBlock(points[:size]),
+		})
+		points = points[size:]
+	}
+	return writes
+}
+
+// returns the points of the column in the series sorted by timestamp and sequence
+// number, with null values as points with a nil value. If a point is in the series
+// more than once the last one wins.
+func columnPoints(series *protocol.Series, fieldIndex int) []*blockPoint {
+	points := make([]*blockPoint, 0, len(series.Points))
+	for _, point := range series.Points {
+		columnPoint := &blockPoint{
+			timestamp: *point.GetTimestampInMicroseconds(),
+			sequence:  *point.SequenceNumber,
+		}
+		if !point.Values[fieldIndex].GetIsNull() {
+			columnPoint.value = point.Values[fieldIndex]
+		}
+		points = append(points, columnPoint)
+	}
+	sort.Stable(blockPoints(points))
+
+	deduped := points[:0]
+	for i, point := range points {
+		if i+1 < len(points) && point.compare(points[i+1]) == 0 {
+			continue
+		}
+		deduped = append(deduped, point)
+	}
+	return deduped
+}
+
+// merges the new points into the existing ones, both have to be sorted. New points
+// replace existing ones with the same timestamp and sequence number, new points with
+// a nil value remove them.
+func mergePoints(existing, points []*blockPoint) []*blockPoint {
+	merged := make([]*blockPoint, 0, len(existing)+len(points))
+	i, j := 0, 0
+	for i < len(existing) || j < len(points) {
+		var point *blockPoint
+		switch {
+		case j == len(points):
+			point = existing[i]
+			i++
+		case i == len(existing):
+			point = points[j]
+			j++
+		default:
+			switch existing[i].compare(points[j]) {
+			case -1:
+				point = existing[i]
+				i++
+			case 0:
+				point = points[j]
+				i++
+				j++
+			case 1:
+				point = points[j]
+				j++
+			}
+		}
+		if point.value != nil {
+			merged = append(merged, point)
+		}
+	}
+	return merged
+}
+
+type blockPoints []*blockPoint
+
+func (self blockPoints) Len() int           { return len(self) }
+func (self blockPoints) Less(i, j int) bool { return self[i].compare(self[j]) < 0 }
+func (self blockPoints) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
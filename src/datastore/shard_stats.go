@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"protocol"
+	"strconv"
+
+	"code.google.com/p/goprotobuf/proto"
+	log "code.google.com/p/log4go"
+)
+
+// Returns the stats of all the local shards. Shards that aren't open don't get
+// opened, their level file counts are missing.
+func (self *ShardDatastore) ShardStats() []*protocol.ShardStats {
+	dirs, err := ioutil.ReadDir(self.baseDbDir)
+	if err != nil {
+		log.Error("DATASTORE: can't list the shards: %s", err)
+		return nil
+	}
+	series, points := self.seriesIndex.ShardCounts()
+
+	allStats := make([]*protocol.ShardStats, 0, len(dirs))
+	for _, dir := range dirs {
+		id, err := strconv.ParseUint(dir.Name(), 10, 32)
+		if err != nil || !dir.IsDir() {
+			continue
+		}
+		shardId := uint32(id)
+		size, err := dirSize(self.shardDir(shardId))
+		if err != nil {
+			// the shard got dropped since the directory was listed
+			continue
+		}
+		stats := &protocol.ShardStats{
+			ShardId:         &shardId,
+			Bytes:           &size,
+			ApproximateKeys: proto.Int64(points[shardId]),
+			Series:          proto.Int64(series[shardId]),
+		}
+
+		self.shardsLock.Lock()
+		shard := self.shards[shardId]
+		refCount := int64(self.shardRefCounts[shardId])
+		self.shardsLock.Unlock()
+		stats.RefCount = &refCount
+		if shard != nil {
+			levelFiles, open := shard.levelFiles()
+			stats.Open = &open
+			stats.LevelFiles = levelFiles
+		} else {
+			stats.Open = proto.Bool(false)
+		}
+		allStats = append(allStats, stats)
+	}
+	return allStats
+}
+
+// Returns the number of files on every level of the shard and false if the shard
+// got closed
+func (self *Shard) levelFiles() ([]int64, bool) {
+	self.compactLock.Lock()
+	defer self.compactLock.Unlock()
+	if self.closed {
+		return nil, false
+	}
+	levelFiles := make([]int64, 0)
+	for _, files := range self.db.LevelFiles() {
+		levelFiles = append(levelFiles, int64(files))
+	}
+	return levelFiles, true
+}
+
+func dirSize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"bytes"
+	"configuration"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	BOLTDB_NAME = "boltdb"
+	boltDbFile  = "data.bolt"
+)
+
+var boltDbBucket = []byte("data")
+
+func init() {
+	RegisterEngine(BOLTDB_NAME, NewBoltDbOpener)
+}
+
+// A pure Go engine, everything is kept in a single bucket of a bolt file. It doesn't
+// need cgo, but every batch is a transaction that gets synced to disk, so writes are
+// slower than with LevelDB.
+type BoltDb struct {
+	db *bolt.DB
+}
+
+func NewBoltDbOpener(config *configuration.Configuration) (Opener, error) {
+	return func(path string, longTerm bool) (Engine, error) {
+		if err := os.MkdirAll(path, 0744); err != nil {
+			return nil, err
+		}
+		db, err := bolt.Open(filepath.Join(path, boltDbFile), 0644, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltDbBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return &BoltDb{db}, nil
+	}, nil
+}
+
+func (self *BoltDb) Name() string {
+	return BOLTDB_NAME
+}
+
+func (self *BoltDb) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := self.db.View(func(tx *bolt.Tx) error {
+		// the value is only valid during the transaction
+		if v := tx.Bucket(boltDbBucket).Get(key); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (self *BoltDb) BatchPut(writes []Write) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltDbBucket)
+		for _, w := range writes {
+			var err error
+			if w.Value == nil {
+				err = bucket.Delete(w.Key)
+			} else {
+				err = bucket.Put(w.Key, w.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (self *BoltDb) Del(start, end []byte) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltDbBucket)
+		// collect the keys first, deleting moves the cursor
+		keys := make([][]byte, 0)
+		c := bucket.Cursor()
+		for k, _ := c.Seek(start); k != nil && bytes.Compare(k, end) <= 0; k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The iterator holds a read transaction open until it gets closed. Writes that need
+// to grow the file wait for the open read transactions, so iterators shouldn't be kept
+// around while writing to the same shard.
+func (self *BoltDb) Iterator() Iterator {
+	tx, err := self.db.Begin(false)
+	if err != nil {
+		// an iterator that is never valid
+		return &boltDbIterator{}
+	}
+	return &boltDbIterator{tx: tx, cursor: tx.Bucket(boltDbBucket).Cursor()}
+}
+
+// Iterators already see the transaction they were created in. Writes that grow the
+// file wait until the snapshot is closed.
+func (self *BoltDb) Snapshot() Iterator {
+	return self.Iterator()
+}
+
+// bolt reuses the freed pages on its own
+func (self *BoltDb) CompactRange(start, end []byte) {}
+
+func (self *BoltDb) LevelFiles() []int {
+	return nil
+}
+
+func (self *BoltDb) Close() {
+	self.db.Close()
+}
+
+type boltDbIterator struct {
+	tx      *bolt.Tx
+	cursor  *bolt.Cursor
+	key     []byte
+	value   []byte
+	pastEnd bool
+}
+
+func (self *boltDbIterator) Seek(key []byte) {
+	if self.cursor == nil {
+		return
+	}
+	self.key, self.value = self.cursor.Seek(key)
+	self.pastEnd = self.key == nil
+}
+
+func (self *boltDbIterator) Next() {
+	if self.cursor == nil {
+		return
+	}
+	self.key, self.value = self.cursor.Next()
+	self.pastEnd = self.key == nil
+}
+
+func (self *boltDbIterator) Prev() {
+	if self.cursor == nil {
+		return
+	}
+	if self.key == nil {
+		// like LevelDB, going back from the end of the keys gets to the last key
+		if self.pastEnd {
+			self.key, self.value = self.cursor.Last()
+			self.pastEnd = false
+		}
+		return
+	}
+	self.key, self.value = self.cursor.Prev()
+}
+
+func (self *boltDbIterator) Valid() bool {
+	return self.key != nil
+}
+
+func (self *boltDbIterator) Key() []byte {
+	return self.key
+}
+
+func (self *boltDbIterator) Value() []byte {
+	return self.value
+}
+
+func (self *boltDbIterator) Close() {
+	if self.tx != nil {
+		self.tx.Rollback()
+	}
+}
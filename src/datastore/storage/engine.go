@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"configuration"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A sorted key value store the shards keep their data and indexes in. Keys are
+// compared byte wise.
+type Engine interface {
+	Name() string
+	Get(key []byte) ([]byte, error)
+	// Puts all the writes atomically, writes with a nil value delete the key
+	BatchPut(writes []Write) error
+	// Deletes all the keys in the range [start, end]
+	Del(start, end []byte) error
+	Iterator() Iterator
+	// Returns an iterator over the store as it was when it got created, writes made
+	// after that aren't visible to it. Meant for long scans like backups.
+	Snapshot() Iterator
+	// Lets the engine reclaim the space used by deleted keys in the range [start, end],
+	// a nil start or end extends the range to the first or last key
+	CompactRange(start, end []byte)
+	// Returns the number of files on every level, nil if the engine doesn't have levels
+	LevelFiles() []int
+	Close()
+}
+
+type Write struct {
+	Key   []byte
+	Value []byte
+}
+
+// Iterators have the same semantics as LevelDB's, they start out invalid until Seek
+// is called. The key and value are only valid until the iterator is closed.
+type Iterator interface {
+	// Positions the iterator at the first key that is greater or equal to key
+	Seek(key []byte)
+	Next()
+	Prev()
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Close()
+}
+
+// Opens the engine in the directory, creating it if it doesn't exist. Engines can
+// tune the shards that hold long term data differently.
+type Opener func(path string, longTerm bool) (Engine, error)
+
+// Called once per datastore so engines can share state, like caches, between shards
+type Initializer func(config *configuration.Configuration) (Opener, error)
+
+var (
+	engines     = make(map[string]Initializer)
+	enginesLock sync.RWMutex
+)
+
+func RegisterEngine(name string, initializer Initializer) {
+	enginesLock.Lock()
+	defer enginesLock.Unlock()
+	if _, ok := engines[name]; ok {
+		panic(fmt.Errorf("Storage engine %s is already registered", name))
+	}
+	engines[name] = initializer
+}
+
+func GetOpener(name string, config *configuration.Configuration) (Opener, error) {
+	enginesLock.RLock()
+	initializer, ok := engines[name]
+	enginesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown storage engine %s, the available engines are %v", name, EngineNames())
+	}
+	return initializer(config)
+}
+
+func EngineNames() []string {
+	enginesLock.RLock()
+	defer enginesLock.RUnlock()
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
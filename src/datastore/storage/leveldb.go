@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"bytes"
+	"configuration"
+	"fmt"
+	"strconv"
+
+	"github.com/jmhodges/levigo"
+)
+
+const (
+	LEVELDB_NAME                 = "leveldb"
+	LEVELDB_DELETE_BATCH_ENTRIES = 64 * 1024
+	// the number of levels LevelDB is compiled with
+	LEVELDB_LEVELS = 7
+)
+
+func init() {
+	RegisterEngine(LEVELDB_NAME, NewLevelDbOpener)
+}
+
+type LevelDb struct {
+	db           *levigo.DB
+	readOptions  *levigo.ReadOptions
+	writeOptions *levigo.WriteOptions
+}
+
+// The short term and the long term shards have options of their own, all the shards
+// of a type share the same LRU cache
+func NewLevelDbOpener(config *configuration.Configuration) (Opener, error) {
+	shortTermOptions, err := newLevelDbOptions(config, config.LevelDbShortTerm)
+	if err != nil {
+		return nil, err
+	}
+	longTermOptions, err := newLevelDbOptions(config, config.LevelDbLongTerm)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(path string, longTerm bool) (Engine, error) {
+		opts := shortTermOptions
+		if longTerm {
+			opts = longTermOptions
+		}
+		db, err := levigo.Open(path, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &LevelDb{
+			db:           db,
+			readOptions:  levigo.NewReadOptions(),
+			writeOptions: levigo.NewWriteOptions(),
+		}, nil
+	}, nil
+}
+
+func newLevelDbOptions(config *configuration.Configuration, shardOptions configuration.LevelDbShardOptions) (*levigo.Options, error) {
+	// configurations that weren't loaded from a file don't have the defaults
+	if shardOptions == (configuration.LevelDbShardOptions{}) {
+		var err error
+		shardOptions, err = (&configuration.LevelDbShardConfiguration{}).Options(config.LevelDbLruCacheSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	opts := levigo.NewOptions()
+	opts.SetCache(levigo.NewLRUCache(shardOptions.CacheSize))
+	opts.SetCreateIfMissing(true)
+	opts.SetBlockSize(shardOptions.BlockSize)
+	opts.SetWriteBufferSize(shardOptions.WriteBufferSize)
+	if shardOptions.Compression {
+		opts.SetCompression(levigo.SnappyCompression)
+	} else {
+		opts.SetCompression(levigo.NoCompression)
+	}
+	opts.SetFilterPolicy(levigo.NewBloomFilter(shardOptions.BloomFilterBits))
+	opts.SetMaxOpenFiles(config.LevelDbMaxOpenFiles)
+	return opts, nil
+}
+
+func (self *LevelDb) Name() string {
+	return LEVELDB_NAME
+}
+
+func (self *LevelDb) Get(key []byte) ([]byte, error) {
+	return self.db.Get(self.readOptions, key)
+}
+
+func (self *LevelDb) BatchPut(writes []Write) error {
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	for _, w := range writes {
+		if w.Value == nil {
+			wb.Delete(w.Key)
+		} else {
+			wb.Put(w.Key, w.Value)
+		}
+	}
+	return self.db.Write(self.writeOptions, wb)
+}
+
+func (self *LevelDb) Del(start, end []byte) error {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := self.db.NewIterator(ro)
+	defer it.Close()
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+
+	count := 0
+	for it.Seek(start); it.Valid(); it.Next() {
+		k := it.Key()
+		if bytes.Compare(k, end) > 0 {
+			break
+		}
+		wb.Delete(k)
+		count++
+		if count >= LEVELDB_DELETE_BATCH_ENTRIES {
+			if err := self.db.Write(self.writeOptions, wb); err != nil {
+				return err
+			}
+			count = 0
+			wb.Clear()
+		}
+	}
+	return self.db.Write(self.writeOptions, wb)
+}
+
+func (self *LevelDb) Iterator() Iterator {
+	return self.db.NewIterator(self.readOptions)
+}
+
+// The snapshot doesn't fill the cache, so a full scan doesn't push out what the
+// queries use
+func (self *LevelDb) Snapshot() Iterator {
+	snapshot := self.db.NewSnapshot()
+	ro := levigo.NewReadOptions()
+	ro.SetSnapshot(snapshot)
+	ro.SetFillCache(false)
+	return &levelDbSnapshotIterator{
+		Iterator:    self.db.NewIterator(ro),
+		db:          self.db,
+		snapshot:    snapshot,
+		readOptions: ro,
+	}
+}
+
+func (self *LevelDb) CompactRange(start, end []byte) {
+	self.db.CompactRange(levigo.Range{start, end})
+}
+
+func (self *LevelDb) LevelFiles() []int {
+	files := make([]int, LEVELDB_LEVELS)
+	for level := range files {
+		files[level], _ = strconv.Atoi(self.db.PropertyValue(fmt.Sprintf("leveldb.num-files-at-level%d", level)))
+	}
+	return files
+}
+
+func (self *LevelDb) Close() {
+	self.readOptions.Close()
+	self.writeOptions.Close()
+	self.db.Close()
+}
+
+type levelDbSnapshotIterator struct {
+	*levigo.Iterator
+	db          *levigo.DB
+	snapshot    *levigo.Snapshot
+	readOptions *levigo.ReadOptions
+}
+
+func (self *levelDbSnapshotIterator) Close() {
+	self.Iterator.Close()
+	self.readOptions.Close()
+	self.db.ReleaseSnapshot(self.snapshot)
+}
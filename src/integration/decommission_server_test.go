@@ -0,0 +1,70 @@
+package integration
+
+import (
+	"fmt"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type DecommissionServerSuite struct {
+	serverProcesses []*ServerProcess
+}
+
+var _ = Suite(&DecommissionServerSuite{})
+
+func (self *DecommissionServerSuite) SetUpSuite(c *C) {
+	err := os.RemoveAll("/tmp/influxdb/test")
+	c.Assert(err, IsNil)
+	self.serverProcesses = []*ServerProcess{
+		NewServerProcess("test_config1.toml", 60500, time.Second, c),
+		NewServerProcess("test_config2.toml", 60506, time.Second, c),
+		NewServerProcess("test_config3.toml", 60510, time.Second, c)}
+	self.serverProcesses[0].Post("/db?u=root&p=root", "{\"name\":\"decommission_rep\", \"replicationFactor\":2}", c)
+	time.Sleep(time.Second)
+}
+
+func (self *DecommissionServerSuite) TearDownSuite(c *C) {
+	for _, s := range self.serverProcesses {
+		s.Stop()
+	}
+}
+
+func (self *DecommissionServerSuite) TestDecommissionMovesReplicas(c *C) {
+	leader := self.serverProcesses[0]
+	firstId := serverIdWithProtobufPort(leader, 60502, c)
+	targetId := serverIdWithProtobufPort(leader, 60508, c)
+	decommissionedId := serverIdWithProtobufPort(leader, 60512, c)
+
+	// the second server is the only one without a copy of the shard, so the
+	// replica of the decommissioned server has to move there
+	startTime := time.Now().Unix() / 3600 * 3600
+	data := fmt.Sprintf(`{"startTime":%d, "endTime":%d, "longTerm": false, "shards": [{"serverIds": [%d, %d]}]}`,
+		startTime, startTime+3600, firstId, decommissionedId)
+	resp := leader.Post("/cluster/shards?u=root&p=root", data, c)
+	c.Assert(resp.StatusCode, Equals, http.StatusAccepted)
+	time.Sleep(time.Second)
+
+	data = `[{"points": [[1], [2], [3]], "name": "test_decommission_server", "columns": ["value"]}]`
+	resp = leader.Post("/db/decommission_rep/series?u=root&p=root", data, c)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	time.Sleep(time.Second)
+
+	url := fmt.Sprintf("/cluster/servers/%d/decommission?u=root&p=root", decommissionedId)
+	resp = leader.Post(url, "", c)
+	c.Assert(resp.StatusCode, Equals, http.StatusAccepted)
+	time.Sleep(5 * time.Second)
+
+	serverIds := shardServerIds(leader, startTime, c)
+	c.Assert(serverIds, DeepEquals, []uint32{firstId, targetId})
+
+	// only read the copy on the server the replica was moved to
+	collection := self.serverProcesses[1].QueryAsRoot("decommission_rep", "select * from test_decommission_server", true, c)
+	series := collection.GetSeries("test_decommission_server", c)
+	c.Assert(series.Points, HasLen, 3)
+
+	body := leader.Get("/cluster/servers?u=root&p=root", c)
+	c.Assert(strings.Contains(string(body), ":60512"), Equals, false)
+}
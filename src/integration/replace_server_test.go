@@ -0,0 +1,108 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type ReplaceServerSuite struct {
+	serverProcesses []*ServerProcess
+}
+
+var _ = Suite(&ReplaceServerSuite{})
+
+func (self *ReplaceServerSuite) SetUpSuite(c *C) {
+	err := os.RemoveAll("/tmp/influxdb/test")
+	c.Assert(err, IsNil)
+	self.serverProcesses = []*ServerProcess{
+		NewServerProcess("test_config1.toml", 60500, time.Second, c),
+		NewServerProcess("test_config2.toml", 60506, time.Second, c),
+		NewServerProcess("test_config3.toml", 60510, time.Second, c)}
+	self.serverProcesses[0].Post("/db?u=root&p=root", "{\"name\":\"replace_rep\", \"replicationFactor\":2}", c)
+	time.Sleep(time.Second)
+}
+
+func (self *ReplaceServerSuite) TearDownSuite(c *C) {
+	for _, s := range self.serverProcesses {
+		s.Stop()
+	}
+}
+
+func serverIdWithProtobufPort(server *ServerProcess, port int, c *C) uint32 {
+	body := server.Get("/cluster/servers?u=root&p=root", c)
+	servers := []map[string]interface{}{}
+	err := json.Unmarshal(body, &servers)
+	c.Assert(err, IsNil)
+	for _, s := range servers {
+		if strings.HasSuffix(s["protobufConnectString"].(string), fmt.Sprintf(":%d", port)) {
+			return uint32(s["id"].(float64))
+		}
+	}
+	c.Fatalf("Couldn't find server with protobuf port %d in %s", port, string(body))
+	return 0
+}
+
+func shardServerIds(server *ServerProcess, startTime int64, c *C) []uint32 {
+	body := server.Get("/cluster/shards?u=root&p=root", c)
+	shards := map[string][]map[string]interface{}{}
+	err := json.Unmarshal(body, &shards)
+	c.Assert(err, IsNil)
+	for _, shard := range shards["shortTerm"] {
+		if int64(shard["startTime"].(float64)) != startTime {
+			continue
+		}
+		ids := []uint32{}
+		for _, id := range shard["serverIds"].([]interface{}) {
+			ids = append(ids, uint32(id.(float64)))
+		}
+		return ids
+	}
+	c.Fatalf("Couldn't find shard starting at %d in %s", startTime, string(body))
+	return nil
+}
+
+func (self *ReplaceServerSuite) TestReplaceDeadServer(c *C) {
+	leader := self.serverProcesses[0]
+	firstId := serverIdWithProtobufPort(leader, 60502, c)
+	deadId := serverIdWithProtobufPort(leader, 60512, c)
+
+	// make sure the shard for the points we write lives on the server we're going to kill
+	startTime := time.Now().Unix() / 3600 * 3600
+	data := fmt.Sprintf(`{"startTime":%d, "endTime":%d, "longTerm": false, "shards": [{"serverIds": [%d, %d]}]}`,
+		startTime, startTime+3600, firstId, deadId)
+	resp := leader.Post("/cluster/shards?u=root&p=root", data, c)
+	c.Assert(resp.StatusCode, Equals, http.StatusAccepted)
+	time.Sleep(time.Second)
+
+	data = `[{"points": [[1], [2], [3]], "name": "test_replace_dead_server", "columns": ["value"]}]`
+	resp = leader.Post("/db/replace_rep/series?u=root&p=root", data, c)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	time.Sleep(time.Second)
+
+	self.serverProcesses[2].Stop()
+	replacement := NewServerProcess("test_config4.toml", 60514, time.Second, c)
+	self.serverProcesses = append(self.serverProcesses, replacement)
+	replacementId := serverIdWithProtobufPort(leader, 60516, c)
+
+	url := fmt.Sprintf("/cluster/servers/%d/replace?u=root&p=root", deadId)
+	resp = leader.Post(url, fmt.Sprintf(`{"replacementId": %d}`, replacementId), c)
+	c.Assert(resp.StatusCode, Equals, http.StatusAccepted)
+	time.Sleep(5 * time.Second)
+
+	serverIds := shardServerIds(leader, startTime, c)
+	c.Assert(serverIds, DeepEquals, []uint32{firstId, replacementId})
+
+	// the shard is local on the replacement, so this only reads the backfilled data
+	collection := replacement.QueryAsRoot("replace_rep", "select * from test_replace_dead_server", false, c)
+	series := collection.GetSeries("test_replace_dead_server", c)
+	c.Assert(series.Points, HasLen, 3)
+
+	// the dead server shouldn't be part of the cluster anymore
+	body := leader.Get("/cluster/servers?u=root&p=root", c)
+	c.Assert(strings.Contains(string(body), ":60512"), Equals, false)
+}
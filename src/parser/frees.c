@@ -130,6 +130,14 @@ free_drop_series_query (drop_series_query *q)
   free_value(q->name);
 }
 
+void
+free_list_series_query (list_series_query *q)
+{
+  if (q->regex) {
+    free_value(q->regex);
+  }
+}
+
 void
 close_query (query *q)
 {
@@ -151,6 +159,16 @@ close_query (query *q)
     free(q->drop_query);
   }
 
+  if (q->list_series_query) {
+    free_list_series_query(q->list_series_query);
+    free(q->list_series_query);
+  }
+
+  if (q->list_columns_query) {
+    free_value(q->list_columns_query->name);
+    free(q->list_columns_query);
+  }
+
   if (q->delete_query) {
     free_delete_query(q->delete_query);
     free(q->delete_query);
@@ -159,10 +159,18 @@ type ListType int
 const (
 	Series ListType = iota
 	ContinuousQueries
+	Columns
 )
 
 type ListQuery struct {
 	Type ListType
+	// list series only returns the series that match the regex, if there's one, and
+	// skips the first Offset of them. Limit is 0 or less if there's no limit.
+	Regex  *regexp.Regexp
+	Limit  int
+	Offset int
+	// the series list columns is run for
+	SeriesName string
 }
 
 type DropQuery struct {
@@ -213,6 +221,10 @@ func (self *Query) IsListSeriesQuery() bool {
 	return self.ListQuery != nil && self.ListQuery.Type == Series
 }
 
+func (self *Query) IsListColumnsQuery() bool {
+	return self.ListQuery != nil && self.ListQuery.Type == Columns
+}
+
 func (self *Query) IsListContinuousQueriesQuery() bool {
 	return self.ListQuery != nil && self.ListQuery.Type == ContinuousQueries
 }
@@ -518,8 +530,20 @@ func ParseQuery(query string) ([]*Query, error) {
 		return nil, err
 	}
 
-	if q.list_series_query != 0 {
-		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: Series}}}, nil
+	if q.list_series_query != nil {
+		listQuery, err := parseListSeriesQuery(q.list_series_query)
+		if err != nil {
+			return nil, err
+		}
+		return []*Query{&Query{QueryString: query, ListQuery: listQuery}}, nil
+	}
+
+	if q.list_columns_query != nil {
+		name, err := GetValue(q.list_columns_query.name)
+		if err != nil {
+			return nil, err
+		}
+		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: Columns, SeriesName: name.Name}}}, nil
 	}
 
 	if q.list_continuous_queries_query != 0 {
@@ -551,6 +575,22 @@ func ParseQuery(query string) ([]*Query, error) {
 	return nil, fmt.Errorf("Unknown query type encountered")
 }
 
+func parseListSeriesQuery(listSeriesQuery *C.list_series_query) (*ListQuery, error) {
+	listQuery := &ListQuery{
+		Type:   Series,
+		Limit:  int(listSeriesQuery.limit),
+		Offset: int(listSeriesQuery.offset),
+	}
+	if listSeriesQuery.regex != nil {
+		regex, err := GetValue(listSeriesQuery.regex)
+		if err != nil {
+			return nil, err
+		}
+		listQuery.Regex, _ = regex.GetCompiledRegex()
+	}
+	return listQuery, nil
+}
+
 func parseDropSeriesQuery(queryStirng string, dropSeriesQuery *C.drop_series_query) (*DropSeriesQuery, error) {
 	name, err := GetValue(dropSeriesQuery.name)
 	if err != nil {
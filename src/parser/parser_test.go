@@ -277,6 +277,53 @@ func (self *QueryParserSuite) TestParseListSeries(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(queries, HasLen, 1)
 	c.Assert(queries[0].IsListQuery(), Equals, true)
+	c.Assert(queries[0].ListQuery.Regex, IsNil)
+	c.Assert(queries[0].ListQuery.Limit <= 0, Equals, true)
+	c.Assert(queries[0].ListQuery.Offset, Equals, 0)
+}
+
+func (self *QueryParserSuite) TestParseListSeriesWithRegexLimitAndOffset(c *C) {
+	queries, err := ParseQuery("list series /^cpu\\..*/i limit 10 offset 20")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].IsListSeriesQuery(), Equals, true)
+	listQuery := queries[0].ListQuery
+	c.Assert(listQuery.Regex, NotNil)
+	c.Assert(listQuery.Regex.MatchString("CPU.idle"), Equals, true)
+	c.Assert(listQuery.Regex.MatchString("mem.free"), Equals, false)
+	c.Assert(listQuery.Limit, Equals, 10)
+	c.Assert(listQuery.Offset, Equals, 20)
+
+	queries, err = ParseQuery("list series offset 5; select a / 2 from x")
+	c.Assert(err, IsNil)
+	c.Assert(queries[0].ListQuery.Regex, IsNil)
+	c.Assert(queries[0].ListQuery.Offset, Equals, 5)
+}
+
+func (self *QueryParserSuite) TestParseListColumns(c *C) {
+	queries, err := ParseQuery("list columns for cpu.idle")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].IsListColumnsQuery(), Equals, true)
+	c.Assert(queries[0].ListQuery.SeriesName, Equals, "cpu.idle")
+
+	queries, err = ParseQuery("list   columns  for for")
+	c.Assert(err, IsNil)
+	c.Assert(queries[0].IsListColumnsQuery(), Equals, true)
+	c.Assert(queries[0].ListQuery.SeriesName, Equals, "for")
+}
+
+func (self *QueryParserSuite) TestParseListKeywordsAsNames(c *C) {
+	q, err := ParseSelectQuery("select offset, columns from for where for > 1;")
+	c.Assert(err, IsNil)
+	columns := q.GetColumnNames()
+	c.Assert(columns, HasLen, 2)
+	c.Assert(columns[0].Name, Equals, "offset")
+	c.Assert(columns[1].Name, Equals, "columns")
+	c.Assert(q.GetFromClause().Names[0].Name.Name, Equals, "for")
+	boolExpression, ok := q.GetWhereCondition().GetBoolExpression()
+	c.Assert(ok, Equals, true)
+	c.Assert(boolExpression.Elems[0].Name, Equals, "for")
 }
 
 // issue #150
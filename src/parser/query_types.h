@@ -106,12 +106,23 @@ typedef struct {
   int id;
 } drop_query;
 
+typedef struct {
+  value *regex;
+  int limit;
+  int offset;
+} list_series_query;
+
+typedef struct {
+  value *name;
+} list_columns_query;
+
 typedef struct {
   select_query *select_query;
   delete_query *delete_query;
   drop_series_query *drop_series_query;
   drop_query *drop_query;
-  char list_series_query;
+  list_series_query *list_series_query;
+  list_columns_query *list_columns_query;
   char list_continuous_queries_query;
   error *error;
 } query;
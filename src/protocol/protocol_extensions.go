@@ -49,6 +49,40 @@ func (self *FieldValue) GetValue() interface{} {
 	return nil
 }
 
+// The types of the columns of a series, as list columns returns them
+const (
+	STRING_TYPE = "string"
+	DOUBLE_TYPE = "double"
+	INT64_TYPE  = "int64"
+	BOOL_TYPE   = "bool"
+)
+
+// Returns the type of the value, an empty string if it's null
+func (self *FieldValue) GetTypeName() string {
+	switch {
+	case self == nil || self.GetIsNull():
+		return ""
+	case self.StringValue != nil:
+		return STRING_TYPE
+	case self.DoubleValue != nil:
+		return DOUBLE_TYPE
+	case self.Int64Value != nil:
+		return INT64_TYPE
+	case self.BoolValue != nil:
+		return BOOL_TYPE
+	}
+	return ""
+}
+
+// Returns the type of a column that got values of both types. A column that has
+// integers and doubles is a double column, otherwise the first type sticks.
+func MergeColumnTypes(current, other string) string {
+	if current == "" || (current == INT64_TYPE && other == DOUBLE_TYPE) {
+		return other
+	}
+	return current
+}
+
 func (self *Point) GetFieldValue(idx int) interface{} {
 	v := self.Values[idx]
 	// issue #27
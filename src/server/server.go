@@ -26,12 +26,12 @@ type Server struct {
 	RequestHandler *coordinator.ProtobufRequestHandler
 	stopped        bool
 	writeLog       *wal.WAL
-	shardStore     *datastore.LevelDbShardDatastore
+	shardStore     *datastore.ShardDatastore
 }
 
 func NewServer(config *configuration.Configuration) (*Server, error) {
 	log.Info("Opening database at %s", config.DataDir)
-	shardDb, err := datastore.NewLevelDbShardDatastore(config)
+	shardDb, err := datastore.NewShardDatastore(config)
 	if err != nil {
 		return nil, err
 	}
@@ -95,10 +95,17 @@ func (self *Server) ListenAndServe() error {
 	}
 	log.Info("recovered")
 
+	go self.shardStore.IndexSeries()
+	if self.Config.StorageMigrateEncoding {
+		go self.shardStore.MigratePointEncoding()
+	}
+
 	err = self.Coordinator.(*coordinator.CoordinatorImpl).ConnectToProtobufServers(self.Config.ProtobufConnectionString())
 	if err != nil {
 		return err
 	}
+	self.ClusterConfig.StartAntiEntropy()
+	go self.RaftServer.BackfillShardsPeriodically()
 	log.Info("Starting admin interface on port %d", self.Config.AdminHttpPort)
 	go self.AdminServer.ListenAndServe()
 	if self.Config.GraphiteEnabled {
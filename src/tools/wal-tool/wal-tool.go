@@ -0,0 +1,259 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"wal"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Inspects and repairs the wal of a server that isn't running
+const usage = `usage: wal-tool -dir <wal dir>[,<wal dir>...] <command> [options]
+
+commands:
+  list                 lists the log files with their request numbers
+  verify               verifies the checksums of all the entries, exits with 1 if a log file is corrupt
+  dump                 prints the entries, see dump -h for the filters
+  state                prints the bookmark, with the last request number committed by every server
+  truncate -file log.N truncates the log file at its first corrupt entry
+  rewrite -file log.N  rewrites the readable entries of the log file with checksums and removes its index
+`
+
+func main() {
+	dir := flag.String("dir", "/opt/influxdb/shared/data/wal",
+		"the wal directory, or a comma separated list of the wal dir followed by the other dirs")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	dirs := strings.Split(*dir, ",")
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "list":
+		err = list(dirs)
+	case "verify":
+		err = verify(dirs)
+	case "dump":
+		err = dump(dirs, args)
+	case "state":
+		// the bookmark is in the first directory
+		err = state(dirs[0])
+	case "truncate":
+		err = truncate(dirs, args)
+	case "rewrite":
+		err = rewrite(dirs, args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func printSegments(segments []*wal.Segment) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "file\tsize\tversion\tentries\tcompressed\tfirst request\tlast request\tstatus")
+	for _, segment := range segments {
+		status := "ok"
+		if segment.IsCorrupt() {
+			status = fmt.Sprintf("corrupt at offset %d: %s", segment.CorruptOffset, segment.CorruptReason)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			path.Base(segment.Path), segment.Size, segment.EntryVersion, segment.Entries,
+			segment.CompressedEntries, segment.FirstRequestNumber, segment.LastRequestNumber, status)
+	}
+	w.Flush()
+}
+
+func list(dirs []string) error {
+	segments, err := wal.ListSegments(dirs...)
+	if err != nil {
+		return err
+	}
+	printSegments(segments)
+	return nil
+}
+
+func verify(dirs []string) error {
+	segments, err := wal.ListSegments(dirs...)
+	if err != nil {
+		return err
+	}
+	printSegments(segments)
+	corrupt := 0
+	for _, segment := range segments {
+		if segment.IsCorrupt() {
+			corrupt++
+		}
+	}
+	if corrupt > 0 {
+		return fmt.Errorf("%d of %d log files are corrupt", corrupt, len(segments))
+	}
+	return nil
+}
+
+func dump(dirs []string, args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	file := flags.String("file", "", "only dump this log file, e.g. log.1")
+	requestNumber := flags.Int64("request", -1, "only dump the request with this request number")
+	shardId := flags.Int64("shard", -1, "only dump the requests of this shard")
+	verbose := flags.Bool("v", false, "print the whole requests")
+	flags.Parse(args)
+
+	var files []string
+	if *file != "" {
+		filePath, err := findSegmentFile(dirs, *file)
+		if err != nil {
+			return err
+		}
+		files = []string{filePath}
+	} else {
+		segments, err := wal.ListSegments(dirs...)
+		if err != nil {
+			return err
+		}
+		for _, segment := range segments {
+			files = append(files, segment.Path)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "file\toffset\trequest\tshard\tlength\tcompressed\ttype\tdatabase\tseries\tpoints")
+	for _, file := range files {
+		segment, err := wal.ReadSegment(file, func(entry *wal.SegmentEntry) error {
+			if *requestNumber != -1 && int64(entry.RequestNumber) != *requestNumber {
+				return nil
+			}
+			if *shardId != -1 && int64(entry.ShardId) != *shardId {
+				return nil
+			}
+			request := entry.Request
+			series, points := "", 0
+			if request.Series != nil {
+				series, points = request.Series.GetName(), len(request.Series.Points)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%v\t%s\t%s\t%s\t%d\n",
+				path.Base(file), entry.Offset, entry.RequestNumber, entry.ShardId, entry.Length,
+				entry.Compressed, request.GetType(), request.GetDatabase(), series, points)
+			if *verbose {
+				fmt.Fprintf(w, "%s\n", proto.MarshalTextString(request))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if segment.IsCorrupt() {
+			fmt.Fprintf(w, "%s\t%d\tcorrupt: %s\n", path.Base(file), segment.CorruptOffset, segment.CorruptReason)
+		}
+	}
+	return nil
+}
+
+type serverIds []uint32
+
+func (self serverIds) Len() int           { return len(self) }
+func (self serverIds) Less(i, j int) bool { return self[i] < self[j] }
+func (self serverIds) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func state(dir string) error {
+	state, err := wal.ReadGlobalState(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("largest request number: %d\n", state.LargestRequestNumber)
+	fmt.Printf("first log file: log.%d\n", state.FirstSuffix)
+	fmt.Printf("current log file: log.%d, offset: %d\n", state.CurrentFileSuffix, state.CurrentFileOffset)
+	fmt.Printf("lowest committed request number: %d\n", state.LowestCommitedRequestNumber())
+
+	ids := serverIds{}
+	for id := range state.ServerLastRequestNumber {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "server\tlast committed request")
+	for _, id := range ids {
+		fmt.Fprintf(w, "%d\t%d\n", id, state.ServerLastRequestNumber[id])
+	}
+	return w.Flush()
+}
+
+// returns the path of the log file in whichever directory it is
+func findSegmentFile(dirs []string, file string) (string, error) {
+	for _, dir := range dirs {
+		filePath := path.Join(dir, path.Base(file))
+		if _, err := os.Stat(filePath); err == nil {
+			return filePath, nil
+		}
+	}
+	return "", fmt.Errorf("%s isn't in any of %s", path.Base(file), strings.Join(dirs, ", "))
+}
+
+// returns the path of the log file given with -file
+func segmentFile(dirs []string, command string, args []string, flags *flag.FlagSet) (string, error) {
+	file := flags.String("file", "", "the log file, e.g. log.1")
+	flags.Parse(args)
+	if *file == "" {
+		return "", fmt.Errorf("%s needs a log file, use -file", command)
+	}
+	return findSegmentFile(dirs, *file)
+}
+
+func truncate(dirs []string, args []string) error {
+	flags := flag.NewFlagSet("truncate", flag.ExitOnError)
+	file, err := segmentFile(dirs, "truncate", args, flags)
+	if err != nil {
+		return err
+	}
+	segment, err := wal.TruncateSegment(file)
+	if err != nil {
+		return err
+	}
+	if !segment.IsCorrupt() {
+		fmt.Printf("%s isn't corrupt\n", file)
+		return nil
+	}
+	fmt.Printf("Truncated %s at offset %d (%s), dropped %d bytes, the last request is %d\n",
+		file, segment.CorruptOffset, segment.CorruptReason, segment.Size-segment.CorruptOffset, segment.LastRequestNumber)
+	return nil
+}
+
+func rewrite(dirs []string, args []string) error {
+	flags := flag.NewFlagSet("rewrite", flag.ExitOnError)
+	compress := flags.Bool("compress", false, "compress the requests with snappy")
+	file, err := segmentFile(dirs, "rewrite", args, flags)
+	if err != nil {
+		return err
+	}
+	before, err := wal.ReadSegment(file, nil)
+	if err != nil {
+		return err
+	}
+	after, err := wal.RewriteSegment(file, *compress)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rewrote %d entries of %s, %d bytes before, %d bytes after\n", after.Entries, file, before.Size, after.Size)
+	if before.IsCorrupt() {
+		fmt.Printf("Dropped everything after offset %d (%s)\n", before.CorruptOffset, before.CorruptReason)
+	}
+	return nil
+}
@@ -20,8 +20,30 @@ type commitEntry struct {
 	requestNumber uint32
 }
 
+type replayStatsEntry struct {
+	stats chan *ReplayStats
+}
+
+type forgetServerEntry struct {
+	confirmation chan *confirmation
+	serverId     uint32
+}
+
+type markResyncEntry struct {
+	confirmation chan *confirmation
+	serverId     uint32
+}
+
+type clearResyncEntry struct {
+	confirmation  chan *confirmation
+	serverId      uint32
+	requestNumber uint32
+}
+
 type appendEntry struct {
 	confirmation chan *confirmation
 	request      *protocol.Request
 	shardId      uint32
+	// confirm only after the request is fsynced
+	sync bool
 }
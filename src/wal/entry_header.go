@@ -1,36 +1,125 @@
 package wal
 
 import (
+	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 )
 
+// Log files start with LOG_FILE_MAGIC, every entry in them starts with a version
+// byte. Version 1 entries have the request number, shard id, the length of the
+// request and the crc32 of all that and the request. Log files that were written
+// before the entries were versioned don't have the magic, their entries only have
+// the request number, shard id and length.
+const (
+	ENTRY_VERSION_0       = 0
+	ENTRY_VERSION_1       = 1
+	CURRENT_ENTRY_VERSION = ENTRY_VERSION_1
+
+	// set in the version byte if the request is compressed with snappy, the
+	// length and the checksum are the ones of the compressed request
+	ENTRY_COMPRESSED = 0x80
+
+	ENTRY_HEADER_V0_SIZE = 12
+	ENTRY_HEADER_V1_SIZE = 17
+)
+
+var LOG_FILE_MAGIC = []byte("influxdb wal")
+
 type entryHeader struct {
+	version       uint8
 	requestNumber uint32
 	shardId       uint32
 	length        uint32
+	checksum      uint32
+	compressed    bool
 }
 
-func (self *entryHeader) Write(w io.Writer) (int, error) {
-	size := 0
+func (self *entryHeader) size() int {
+	if self.version == ENTRY_VERSION_0 {
+		return ENTRY_HEADER_V0_SIZE
+	}
+	return ENTRY_HEADER_V1_SIZE
+}
 
-	for _, n := range []uint32{self.requestNumber, self.shardId, self.length} {
-		if err := binary.Write(w, binary.BigEndian, n); err != nil {
-			return size, err
+func (self *entryHeader) encode() []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0, self.size()))
+	if self.version != ENTRY_VERSION_0 {
+		versionByte := self.version
+		if self.compressed {
+			versionByte |= ENTRY_COMPRESSED
 		}
-		size += 4
+		buffer.WriteByte(versionByte)
 	}
-	return size, nil
+	for _, n := range []uint32{self.requestNumber, self.shardId, self.length} {
+		binary.Write(buffer, binary.BigEndian, n)
+	}
+	if self.version != ENTRY_VERSION_0 {
+		binary.Write(buffer, binary.BigEndian, self.checksum)
+	}
+	return buffer.Bytes()
 }
 
-func (self *entryHeader) Read(r io.Reader) (int, error) {
-	size := 0
+// The checksum of the header fields before it and the request
+func (self *entryHeader) computeChecksum(request []byte) uint32 {
+	encoded := self.encode()
+	hash := crc32.NewIEEE()
+	hash.Write(encoded[:len(encoded)-4])
+	hash.Write(request)
+	return hash.Sum32()
+}
+
+func (self *entryHeader) Write(w io.Writer) (int, error) {
+	return w.Write(self.encode())
+}
 
-	for _, n := range []*uint32{&self.requestNumber, &self.shardId, &self.length} {
-		if err := binary.Read(r, binary.BigEndian, n); err != nil {
-			return size, err
+// Reads a header of the given version, version 0 headers are only found in log files
+// without the magic. Returns io.EOF if there's nothing left to read and
+// io.ErrUnexpectedEOF if the header got cut off.
+func (self *entryHeader) Read(r io.Reader, version uint8) (int, error) {
+	size := 0
+	if version != ENTRY_VERSION_0 {
+		versionByte := make([]byte, 1)
+		n, err := io.ReadFull(r, versionByte)
+		if err != nil {
+			return n, err
+		}
+		size += n
+		version = versionByte[0] &^ ENTRY_COMPRESSED
+		self.compressed = versionByte[0]&ENTRY_COMPRESSED != 0
+		if version != ENTRY_VERSION_1 {
+			return size, &corruptEntryError{reason: "unknown entry version"}
 		}
-		size += 4
+	}
+	self.version = version
+
+	buffer := make([]byte, self.size()-size)
+	n, err := io.ReadFull(r, buffer)
+	if err == io.EOF && size > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	size += n
+	if err != nil {
+		return size, err
+	}
+	fields := []*uint32{&self.requestNumber, &self.shardId, &self.length}
+	if version != ENTRY_VERSION_0 {
+		fields = append(fields, &self.checksum)
+	}
+	for i, field := range fields {
+		*field = binary.BigEndian.Uint32(buffer[i*4:])
 	}
 	return size, nil
 }
+
+// An entry that got cut off by a crash or that doesn't match its checksum
+type corruptEntryError struct {
+	reason string
+	// the entry ends prematurely, as opposed to not matching its checksum
+	cutOff bool
+}
+
+func (self *corruptEntryError) Error() string {
+	return self.reason
+}
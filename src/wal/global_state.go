@@ -26,6 +26,10 @@ type GlobalState struct {
 	// committed request number per server
 	ServerLastRequestNumber map[uint32]uint32
 
+	// servers that missed requests that were dropped from the wal by the
+	// retention, they need a resync of their shards
+	ServersNeedingResync map[uint32]bool
+
 	// path to the state file
 	path string
 }
@@ -35,6 +39,7 @@ func newGlobalState(path string) (*GlobalState, error) {
 	state := &GlobalState{
 		ServerLastRequestNumber: map[uint32]uint32{},
 		ShardLastSequenceNumber: map[uint32]uint64{},
+		ServersNeedingResync:    map[uint32]bool{},
 		path: path,
 	}
 	if os.IsNotExist(err) {
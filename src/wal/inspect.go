@@ -0,0 +1,241 @@
+package wal
+
+import (
+	"configuration"
+	"fmt"
+	"os"
+	"path"
+	"protocol"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Offline inspection and repair of the log files. None of these should be used
+// while a server has the wal open.
+
+type Segment struct {
+	Path               string
+	Suffix             int
+	Size               int64
+	EntryVersion       uint8
+	Entries            int
+	CompressedEntries  int
+	FirstRequestNumber uint32
+	LastRequestNumber  uint32
+	// the offset of the first corrupt entry, everything after it is unreadable.
+	// -1 if the log file isn't corrupt
+	CorruptOffset int64
+	CorruptReason string
+}
+
+func (self *Segment) IsCorrupt() bool {
+	return self.CorruptOffset != -1
+}
+
+type SegmentEntry struct {
+	Offset        int64
+	RequestNumber uint32
+	ShardId       uint32
+	Length        uint32
+	Compressed    bool
+	Request       *protocol.Request
+}
+
+type sortableSegments []*Segment
+
+func (self sortableSegments) Len() int           { return len(self) }
+func (self sortableSegments) Less(i, j int) bool { return self[i].Suffix < self[j].Suffix }
+func (self sortableSegments) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Reads and verifies all the log files in the wal directories, sorted by suffix
+func ListSegments(dirs ...string) ([]*Segment, error) {
+	segments := []*Segment{}
+	for _, dir := range dirs {
+		f, err := os.Open(dir)
+		if err != nil {
+			return nil, err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			if !strings.HasPrefix(name, "log.") {
+				continue
+			}
+			segment, err := ReadSegment(path.Join(dir, name), nil)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, segment)
+		}
+	}
+	sort.Sort(sortableSegments(segments))
+	return segments, nil
+}
+
+// Reads the log file and calls yield with every entry up to the first corrupt
+// one, if yield isn't nil. Corrupt entries aren't returned as errors, they're
+// recorded in the returned segment.
+func ReadSegment(filePath string, yield func(entry *SegmentEntry) error) (*Segment, error) {
+	suffix, err := strconv.Atoi(strings.TrimPrefix(path.Base(filePath), "log."))
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a log file", filePath)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	version, magicLength, err := readMagic(file)
+	if err != nil {
+		return nil, err
+	}
+	segment := &Segment{
+		Path:          filePath,
+		Suffix:        suffix,
+		Size:          info.Size(),
+		EntryVersion:  version,
+		CorruptOffset: -1,
+	}
+	if version != ENTRY_VERSION_0 && magicLength < len(LOG_FILE_MAGIC) {
+		if magicLength > 0 {
+			segment.CorruptOffset = 0
+			segment.CorruptReason = "incomplete magic"
+		}
+		return segment, nil
+	}
+
+	l := &log{file: file, entryVersion: version}
+	offset, err := file.Seek(l.firstEntryOffset(), os.SEEK_SET)
+	if err != nil {
+		return nil, err
+	}
+
+	corrupt := func(err error) (*Segment, error) {
+		segment.CorruptOffset = offset
+		segment.CorruptReason = err.Error()
+		return segment, nil
+	}
+
+	for {
+		n, hdr, err := l.getNextHeader(file)
+		if _, ok := err.(*corruptEntryError); ok {
+			return corrupt(err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return segment, nil
+		}
+
+		bytes, err := l.readRequest(file, hdr)
+		if _, ok := err.(*corruptEntryError); ok {
+			return corrupt(err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		request := &protocol.Request{}
+		if err := request.Decode(bytes); err != nil {
+			return corrupt(fmt.Errorf("cannot decode request %d: %s", hdr.requestNumber, err))
+		}
+		request.RequestNumber = proto.Uint32(hdr.requestNumber)
+
+		if segment.Entries == 0 {
+			segment.FirstRequestNumber = hdr.requestNumber
+		}
+		segment.LastRequestNumber = hdr.requestNumber
+		segment.Entries++
+		if hdr.compressed {
+			segment.CompressedEntries++
+		}
+
+		if yield != nil {
+			entry := &SegmentEntry{
+				Offset:        offset,
+				RequestNumber: hdr.requestNumber,
+				ShardId:       hdr.shardId,
+				Length:        hdr.length,
+				Compressed:    hdr.compressed,
+				Request:       request,
+			}
+			if err := yield(entry); err != nil {
+				return nil, err
+			}
+		}
+		offset += int64(n) + int64(hdr.length)
+	}
+}
+
+// Truncates the log file at its first corrupt entry. Returns the segment as it
+// was before the truncation.
+func TruncateSegment(filePath string) (*Segment, error) {
+	segment, err := ReadSegment(filePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !segment.IsCorrupt() {
+		return segment, nil
+	}
+	return segment, os.Truncate(filePath, segment.CorruptOffset)
+}
+
+// Rewrites the readable entries of the log file with the current entry version,
+// compressing the requests if compress is true. The entries after the first
+// corrupt one are dropped. The index of the log file is removed since the
+// offsets change, the wal rebuilds it on startup.
+func RewriteSegment(filePath string, compress bool) (*Segment, error) {
+	newPath := filePath + ".rewrite"
+	file, err := os.OpenFile(newPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(newPath)
+	defer file.Close()
+
+	if _, err := file.Write(LOG_FILE_MAGIC); err != nil {
+		return nil, err
+	}
+	l := &log{
+		file:         file,
+		entryVersion: CURRENT_ENTRY_VERSION,
+		config:       &configuration.Configuration{WalCompression: compress},
+	}
+	_, err = ReadSegment(filePath, func(entry *SegmentEntry) error {
+		return l.appendRequest(entry.Request, entry.ShardId)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(newPath, filePath); err != nil {
+		return nil, err
+	}
+
+	suffix := strings.TrimPrefix(path.Base(filePath), "log.")
+	indexPath := path.Join(path.Dir(filePath), "index."+suffix)
+	if err := os.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return ReadSegment(filePath, nil)
+}
+
+// Reads the bookmark in the wal directory
+func ReadGlobalState(dir string) (*GlobalState, error) {
+	return newGlobalState(path.Join(dir, "bookmark"))
+}
@@ -1,8 +1,10 @@
 package wal
 
 import (
+	"bytes"
 	"code.google.com/p/goprotobuf/proto"
 	logger "code.google.com/p/log4go"
+	"code.google.com/p/snappy-go/snappy"
 	"configuration"
 	"fmt"
 	"io"
@@ -20,6 +22,8 @@ type log struct {
 	requestsSinceLastFlush int
 	config                 *configuration.Configuration
 	cachedSuffix           int
+	// the version of the entries in the file, files without the magic have version 0 entries
+	entryVersion uint8
 }
 
 func newLog(file *os.File, config *configuration.Configuration) (*log, error) {
@@ -41,11 +45,69 @@ func newLog(file *os.File, config *configuration.Configuration) (*log, error) {
 		closed:       false,
 		config:       config,
 		cachedSuffix: suffix,
+		entryVersion: CURRENT_ENTRY_VERSION,
 	}
 
+	if err := l.checkMagic(); err != nil {
+		return nil, err
+	}
 	return l, nil
 }
 
+// Writes the magic to new log files and figures out which version of entries the
+// file has. A magic that got cut off by a crash is written again.
+func (self *log) checkMagic() error {
+	version, magicLength, err := readMagic(self.file)
+	if err != nil {
+		return err
+	}
+
+	if magicLength == len(LOG_FILE_MAGIC) {
+		return nil
+	}
+
+	if version != ENTRY_VERSION_0 {
+		if magicLength > 0 {
+			logger.Warn("%s has an incomplete magic, rewriting it", self.file.Name())
+			if err := self.file.Truncate(0); err != nil {
+				return err
+			}
+		}
+		if _, err := self.file.Write(LOG_FILE_MAGIC); err != nil {
+			return err
+		}
+		self.fileSize = uint64(len(LOG_FILE_MAGIC))
+		return nil
+	}
+
+	logger.Info("%s was written before entries had checksums", self.file.Name())
+	self.entryVersion = ENTRY_VERSION_0
+	return nil
+}
+
+// Returns the version of the entries in the file and how much of the magic it
+// starts with. Empty files and files with an incomplete magic have the current
+// version.
+func readMagic(file *os.File) (uint8, int, error) {
+	magic := make([]byte, len(LOG_FILE_MAGIC))
+	n, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	if bytes.Equal(magic[:n], LOG_FILE_MAGIC[:n]) {
+		return CURRENT_ENTRY_VERSION, n, nil
+	}
+	return ENTRY_VERSION_0, 0, nil
+}
+
+// the offset of the first entry in the file
+func (self *log) firstEntryOffset() int64 {
+	if self.entryVersion == ENTRY_VERSION_0 {
+		return 0
+	}
+	return int64(len(LOG_FILE_MAGIC))
+}
+
 func (self *log) offset() int64 {
 	offset, _ := self.file.Seek(0, os.SEEK_CUR)
 	return offset
@@ -76,28 +138,43 @@ func (self *log) appendRequest(request *protocol.Request, shardId uint32) error
 	if err != nil {
 		return err
 	}
-	// every request is preceded with the length, shard id and the request number
+	// every request is preceded with the length, shard id, the request number
+	// and the checksum. The header and the request are written at once, so a
+	// crash can only leave the last entry incomplete.
 	hdr := &entryHeader{
+		version:       self.entryVersion,
 		shardId:       shardId,
 		requestNumber: request.GetRequestNumber(),
 		length:        uint32(len(bytes)),
 	}
-	writtenHdrBytes, err := hdr.Write(self.file)
-	if err != nil {
-		logger.Error("Error while writing header: %s", err)
-		return err
+	if hdr.version != ENTRY_VERSION_0 {
+		// requests are compressed one by one, so the offsets in the index
+		// and the replay don't change
+		if self.config.WalCompression {
+			compressed, err := snappy.Encode(nil, bytes)
+			if err != nil {
+				return err
+			}
+			if len(compressed) < len(bytes) {
+				bytes = compressed
+				hdr.compressed = true
+				hdr.length = uint32(len(bytes))
+			}
+		}
+		hdr.checksum = hdr.computeChecksum(bytes)
 	}
-	written, err := self.file.Write(bytes)
+	entry := append(hdr.encode(), bytes...)
+	written, err := self.file.Write(entry)
 	if err != nil {
 		logger.Error("Error while writing request: %s", err)
 		return err
 	}
-	if written < len(bytes) {
+	if written < len(entry) {
 		err = fmt.Errorf("Couldn't write entire request")
 		logger.Error("Error while writing request: %s", err)
 		return err
 	}
-	self.fileSize += uint64(writtenHdrBytes + written)
+	self.fileSize += uint64(written)
 	return nil
 }
 
@@ -106,8 +183,11 @@ func (self *log) dupLogFile() (*os.File, error) {
 }
 
 // replay requests starting at the given requestNumber and for the
-// given shard ids. Return all requests if shardIds is empty
-func (self *log) dupAndReplayFromOffset(shardIds []uint32, offset int64, rn uint32) (chan *replayRequest, chan struct{}) {
+// given shard ids. Return all requests if shardIds is empty. If
+// truncateCorrupt is true the log is truncated at the first corrupt
+// entry, otherwise an entry that is cut off ends the replay and a
+// checksum mismatch is returned as an error.
+func (self *log) dupAndReplayFromOffset(shardIds []uint32, offset int64, rn uint32, truncateCorrupt bool) (chan *replayRequest, chan struct{}) {
 	// this channel needs to be buffered in case the last request in the
 	// log file caused an error in the yield function
 	stopChan := make(chan struct{}, 1)
@@ -130,25 +210,69 @@ func (self *log) dupAndReplayFromOffset(shardIds []uint32, offset int64, rn uint
 		for _, shardId := range shardIds {
 			shardIdsSet[shardId] = struct{}{}
 		}
-		self.replayFromFileLocation(file, shardIdsSet, replayChan, stopChan)
+		self.replayFromFileLocation(file, shardIdsSet, replayChan, stopChan, truncateCorrupt)
 	}()
 	return replayChan, stopChan
 }
 
 func (self *log) getNextHeader(file *os.File) (int, *entryHeader, error) {
 	hdr := &entryHeader{}
-	numberOfBytes, err := hdr.Read(file)
+	numberOfBytes, err := hdr.Read(file, self.entryVersion)
 	if err == io.EOF {
 		return 0, nil, nil
 	}
+	if err == io.ErrUnexpectedEOF {
+		err = &corruptEntryError{reason: "entry header is cut off", cutOff: true}
+	}
 	return numberOfBytes, hdr, err
 }
 
+// reads the request following the header and verifies its checksum
+func (self *log) readRequest(file *os.File, hdr *entryHeader) ([]byte, error) {
+	// don't trust the length before the checksum is verified, a corrupt
+	// length shouldn't allocate a huge buffer
+	buffer := bytes.NewBuffer(nil)
+	_, err := io.CopyN(buffer, file, int64(hdr.length))
+	if err == io.EOF {
+		return nil, &corruptEntryError{reason: "request is cut off", cutOff: true}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hdr.version != ENTRY_VERSION_0 && hdr.computeChecksum(buffer.Bytes()) != hdr.checksum {
+		return nil, &corruptEntryError{reason: fmt.Sprintf("checksum mismatch in request %d", hdr.requestNumber)}
+	}
+	if hdr.compressed {
+		return snappy.Decode(nil, buffer.Bytes())
+	}
+	return buffer.Bytes(), nil
+}
+
+// truncates the log at the given offset, dropping the corrupt entry there and
+// everything that follows it
+func (self *log) truncateAt(file *os.File, offset int64, cause error) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	logger.Warn("%s has a corrupt entry at offset %d (%s), truncating it and dropping %d bytes",
+		file.Name(), offset, cause, info.Size()-offset)
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+	self.fileSize = uint64(offset)
+	return nil
+}
+
 func (self *log) skip(file *os.File, offset int64, rn uint32) error {
 	if offset == -1 {
-		_, err := file.Seek(0, os.SEEK_SET)
+		_, err := file.Seek(self.firstEntryOffset(), os.SEEK_SET)
 		return err
 	}
+	// the index starts at 0 in log files with a magic
+	if offset < self.firstEntryOffset() {
+		offset = self.firstEntryOffset()
+	}
 	logger.Debug("Replaying from file offset %d", offset)
 	_, err := file.Seek(int64(offset), os.SEEK_SET)
 	if err != nil {
@@ -169,6 +293,11 @@ func (self *log) skipToRequest(file *os.File, requestNumber uint32) error {
 			// EOF
 			return nil
 		}
+		if _, ok := err.(*corruptEntryError); ok {
+			// leave it to the replay to deal with the corrupt entry
+			_, err = file.Seek(int64(-n), os.SEEK_CUR)
+			return err
+		}
 		if err != nil {
 			return err
 		}
@@ -187,7 +316,8 @@ func (self *log) skipToRequest(file *os.File, requestNumber uint32) error {
 func (self *log) replayFromFileLocation(file *os.File,
 	shardIdsSet map[uint32]struct{},
 	replayChan chan *replayRequest,
-	stopChan chan struct{}) {
+	stopChan chan struct{},
+	truncateCorrupt bool) {
 
 	offset, err := file.Seek(0, os.SEEK_CUR)
 	if err != nil {
@@ -196,8 +326,29 @@ func (self *log) replayFromFileLocation(file *os.File,
 	}
 
 	defer func() { close(replayChan) }()
+
+	handleCorrupt := func(err error) {
+		corrupt := err.(*corruptEntryError)
+		if truncateCorrupt {
+			if err := self.truncateAt(file, offset, corrupt); err != nil {
+				sendOrStop(newErrorReplayRequest(err), replayChan, stopChan)
+			}
+			return
+		}
+		// the entry might still be being written
+		if corrupt.cutOff {
+			return
+		}
+		sendOrStop(newErrorReplayRequest(fmt.Errorf("%s: corrupt entry at offset %d: %s", file.Name(), offset, corrupt)), replayChan, stopChan)
+	}
+
 	for {
 		numberOfBytes, hdr, err := self.getNextHeader(file)
+		if _, ok := err.(*corruptEntryError); ok {
+			handleCorrupt(err)
+			return
+		}
+
 		if numberOfBytes == 0 {
 			break
 		}
@@ -219,24 +370,13 @@ func (self *log) replayFromFileLocation(file *os.File,
 				sendOrStop(newErrorReplayRequest(err), replayChan, stopChan)
 				return
 			}
+			offset += int64(numberOfBytes) + int64(hdr.length)
 			continue
 		}
 
-		bytes := make([]byte, hdr.length)
-		read, err := file.Read(bytes)
-		if err == io.EOF {
-			// file ends prematurely, truncate to the previous request
-			logger.Warn("%s ends prematurely", file.Name())
-			offset, err := file.Seek(int64(-numberOfBytes), os.SEEK_CUR)
-			if err != nil {
-				sendOrStop(newErrorReplayRequest(err), replayChan, stopChan)
-				return
-			}
-			logger.Debug("truncating %s to %d", file.Name(), offset)
-			err = file.Truncate(offset)
-			if err != nil {
-				sendOrStop(newErrorReplayRequest(err), replayChan, stopChan)
-			}
+		bytes, err := self.readRequest(file, hdr)
+		if _, ok := err.(*corruptEntryError); ok {
+			handleCorrupt(err)
 			return
 		}
 		if err != nil {
@@ -244,10 +384,6 @@ func (self *log) replayFromFileLocation(file *os.File,
 			return
 		}
 
-		if uint32(read) != hdr.length {
-			sendOrStop(newErrorReplayRequest(fmt.Errorf("expected to read %d but got %d instead", hdr.length, read)), replayChan, stopChan)
-			return
-		}
 		req := &protocol.Request{}
 		err = req.Decode(bytes)
 		if err != nil {
@@ -0,0 +1,143 @@
+package wal
+
+import (
+	"sort"
+	"time"
+)
+
+// How far behind a server is, based on the last request it committed, and the
+// progress of its running or last replay.
+type ServerReplayStats struct {
+	ServerId                   uint32 `json:"serverId"`
+	LastCommittedRequestNumber uint32 `json:"lastCommittedRequestNumber"`
+	RequestsBehind             int64  `json:"requestsBehind"`
+	// based on the average size of the requests in the wal
+	EstimatedBytesBehind int64 `json:"estimatedBytesBehind"`
+	NeedsResync          bool  `json:"needsResync"`
+
+	Replaying                 bool      `json:"replaying"`
+	ReplayStartedAt           time.Time `json:"replayStartedAt"`
+	ReplayFinishedAt          time.Time `json:"replayFinishedAt"`
+	ReplayedRequests          int64     `json:"replayedRequests"`
+	LastReplayedRequestNumber uint32    `json:"lastReplayedRequestNumber"`
+	// requests per second
+	ReplayRate float64 `json:"replayRate"`
+}
+
+type ReplayStats struct {
+	LargestRequestNumber uint32               `json:"largestRequestNumber"`
+	LogFiles             int                  `json:"logFiles"`
+	Bytes                int64                `json:"bytes"`
+	Servers              []*ServerReplayStats `json:"servers"`
+	Retention            RetentionStats       `json:"retention"`
+}
+
+type replayProgress struct {
+	replaying         bool
+	startedAt         time.Time
+	finishedAt        time.Time
+	replayed          int64
+	lastRequestNumber uint32
+}
+
+type serverReplayStatsById []*ServerReplayStats
+
+func (self serverReplayStatsById) Len() int           { return len(self) }
+func (self serverReplayStatsById) Less(i, j int) bool { return self[i].ServerId < self[j].ServerId }
+func (self serverReplayStatsById) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func (self *WAL) startReplay(serverId uint32) {
+	self.replayLock.Lock()
+	defer self.replayLock.Unlock()
+	self.replays[serverId] = &replayProgress{replaying: true, startedAt: time.Now()}
+}
+
+func (self *WAL) requestReplayed(serverId, requestNumber uint32) {
+	self.replayLock.Lock()
+	defer self.replayLock.Unlock()
+	progress := self.replays[serverId]
+	progress.replayed++
+	progress.lastRequestNumber = requestNumber
+}
+
+func (self *WAL) finishReplay(serverId uint32) {
+	self.replayLock.Lock()
+	defer self.replayLock.Unlock()
+	progress := self.replays[serverId]
+	progress.replaying = false
+	progress.finishedAt = time.Now()
+}
+
+// Returns how far behind every server is that committed requests or had requests
+// replayed, sorted by server id.
+func (self *WAL) ReplayStats() *ReplayStats {
+	statsChan := make(chan *ReplayStats)
+	self.entries <- &replayStatsEntry{statsChan}
+	return <-statsChan
+}
+
+func (self *WAL) processReplayStatsEntry(e *replayStatsEntry) {
+	stats := &ReplayStats{
+		LargestRequestNumber: self.state.LargestRequestNumber,
+		LogFiles:             len(self.logFiles),
+		Retention:            self.RetentionStats(),
+	}
+	for _, logFile := range self.logFiles {
+		stats.Bytes += int64(logFile.fileSize)
+	}
+	requestsInWal := int64(0)
+	if len(self.logFiles) > 0 {
+		requestsInWal = int64(self.state.LargestRequestNumber-uint32(self.state.FirstSuffix)) + 1
+	}
+
+	servers := map[uint32]*ServerReplayStats{}
+	server := func(serverId uint32) *ServerReplayStats {
+		if s, ok := servers[serverId]; ok {
+			return s
+		}
+		s := &ServerReplayStats{ServerId: serverId}
+		servers[serverId] = s
+		return s
+	}
+
+	for serverId, requestNumber := range self.state.ServerLastRequestNumber {
+		s := server(serverId)
+		s.LastCommittedRequestNumber = requestNumber
+		s.RequestsBehind = int64(self.state.LargestRequestNumber - requestNumber)
+		behind := s.RequestsBehind
+		if behind > requestsInWal {
+			behind = requestsInWal
+		}
+		if requestsInWal > 0 {
+			s.EstimatedBytesBehind = behind * stats.Bytes / requestsInWal
+		}
+	}
+	for _, serverId := range stats.Retention.ServersNeedingResync {
+		server(serverId).NeedsResync = true
+	}
+
+	self.replayLock.Lock()
+	for serverId, progress := range self.replays {
+		s := server(serverId)
+		s.Replaying = progress.replaying
+		s.ReplayStartedAt = progress.startedAt
+		s.ReplayFinishedAt = progress.finishedAt
+		s.ReplayedRequests = progress.replayed
+		s.LastReplayedRequestNumber = progress.lastRequestNumber
+		end := progress.finishedAt
+		if progress.replaying {
+			end = time.Now()
+		}
+		if elapsed := end.Sub(progress.startedAt).Seconds(); elapsed > 0 {
+			s.ReplayRate = float64(progress.replayed) / elapsed
+		}
+	}
+	self.replayLock.Unlock()
+
+	stats.Servers = make([]*ServerReplayStats, 0, len(servers))
+	for _, s := range servers {
+		stats.Servers = append(stats.Servers, s)
+	}
+	sort.Sort(serverReplayStatsById(stats.Servers))
+	e.stats <- stats
+}
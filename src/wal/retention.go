@@ -0,0 +1,182 @@
+package wal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	logger "code.google.com/p/log4go"
+)
+
+// Returned when replaying the wal for a server that missed requests which were
+// dropped by the retention, the replay can't bring it up to date anymore.
+type ResyncNeededError struct {
+	ServerId uint32
+}
+
+func (self *ResyncNeededError) Error() string {
+	return fmt.Sprintf("Server %d missed requests that were dropped from the wal, it needs a resync", self.ServerId)
+}
+
+type RetentionStats struct {
+	DroppedLogFiles      int       `json:"droppedLogFiles"`
+	DroppedBytes         int64     `json:"droppedBytes"`
+	LastDroppedAt        time.Time `json:"lastDroppedAt"`
+	ServersNeedingResync []uint32  `json:"serversNeedingResync"`
+}
+
+type serverIds []uint32
+
+func (self serverIds) Len() int           { return len(self) }
+func (self serverIds) Less(i, j int) bool { return self[i] < self[j] }
+func (self serverIds) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Returns why the oldest log file should be dropped, or an empty string if the
+// wal is within max-size and max-age. The current log file never gets dropped.
+func (self *WAL) retentionExceeded() (string, error) {
+	if len(self.logFiles) < 2 {
+		return "", nil
+	}
+
+	if maxSize := self.config.WalMaxSize; maxSize > 0 {
+		total := uint64(0)
+		for _, logFile := range self.logFiles {
+			total += logFile.fileSize
+		}
+		if total > uint64(maxSize) {
+			return fmt.Sprintf("the wal is %d bytes, more than max-size %d", total, maxSize), nil
+		}
+	}
+
+	if maxAge := self.config.WalMaxAge; maxAge > 0 {
+		info, err := self.logFiles[0].file.Stat()
+		if err != nil {
+			return "", err
+		}
+		if age := time.Now().Sub(info.ModTime()); age > maxAge {
+			return fmt.Sprintf("it was last written %s ago, more than max-age %s", age, maxAge), nil
+		}
+	}
+	return "", nil
+}
+
+// Drops the oldest log files while the wal is over max-size or max-age. The
+// servers that didn't commit all the requests of a dropped log file are marked
+// as needing a resync and their requests are considered committed, so they
+// don't keep the log files around.
+func (self *WAL) enforceRetention() {
+	dropped := false
+	for {
+		reason, err := self.retentionExceeded()
+		if err != nil {
+			logger.Error("WAL retention: %s", err)
+			break
+		}
+		if reason == "" {
+			break
+		}
+
+		logFile := self.logFiles[0]
+		// log files are named after their first request number
+		firstRequestNumber := uint32(logFile.suffix())
+		lastRequestNumber := uint32(self.logFiles[1].suffix() - 1)
+		logger.Error("WAL retention: dropping %s with requests %d to %d and %d bytes because %s",
+			logFile.file.Name(), firstRequestNumber, lastRequestNumber, logFile.fileSize, reason)
+
+		self.resyncLock.Lock()
+		for serverId, requestNumber := range self.state.ServerLastRequestNumber {
+			if requestNumber >= lastRequestNumber {
+				continue
+			}
+			logger.Error("WAL retention: server %d only committed up to request %d, it needs a resync of its shards",
+				serverId, requestNumber)
+			self.state.ServersNeedingResync[serverId] = true
+			self.state.commitRequestNumber(serverId, lastRequestNumber)
+		}
+		self.retentionStats.DroppedLogFiles++
+		self.retentionStats.DroppedBytes += int64(logFile.fileSize)
+		self.retentionStats.LastDroppedAt = time.Now()
+		self.resyncLock.Unlock()
+
+		self.removeLogFiles(1)
+		dropped = true
+	}
+
+	if dropped {
+		self.bookmark()
+	}
+}
+
+// Returns the servers that missed requests which were dropped by the retention
+func (self *WAL) ServersNeedingResync() []uint32 {
+	self.resyncLock.Lock()
+	defer self.resyncLock.Unlock()
+	ids := serverIds{}
+	for serverId := range self.state.ServersNeedingResync {
+		ids = append(ids, serverId)
+	}
+	sort.Sort(ids)
+	return ids
+}
+
+// Called when requests for the server got lost outside of the wal, e.g. when they
+// were dropped from its hinted handoff queue.
+func (self *WAL) MarkResync(serverId uint32) error {
+	confirmationChan := make(chan *confirmation)
+	self.entries <- &markResyncEntry{confirmationChan, serverId}
+	confirmation := <-confirmationChan
+	return confirmation.err
+}
+
+func (self *WAL) processMarkResyncEntry(e *markResyncEntry) {
+	self.resyncLock.Lock()
+	alreadyMarked := self.state.ServersNeedingResync[e.serverId]
+	self.state.ServersNeedingResync[e.serverId] = true
+	self.resyncLock.Unlock()
+	if alreadyMarked {
+		e.confirmation <- &confirmation{0, nil}
+		return
+	}
+	logger.Error("WAL retention: server %d lost requests, it needs a resync of its shards", e.serverId)
+	e.confirmation <- &confirmation{0, self.bookmark()}
+}
+
+// Returns the number of the last request that got logged. The resync takes it
+// before the repair starts and passes it to ClearResync.
+func (self *WAL) LargestRequestNumber() uint32 {
+	return self.state.LargestRequestNumber
+}
+
+// Called once the shards of the server got resynced. The requests up to
+// requestNumber, the last one logged before the repair started, are considered
+// committed for it. The ones that came in since get replayed to it like to any
+// other server. If some of them got dropped by the retention in the meantime the
+// server keeps needing a resync.
+func (self *WAL) ClearResync(serverId, requestNumber uint32) error {
+	confirmationChan := make(chan *confirmation)
+	self.entries <- &clearResyncEntry{confirmationChan, serverId, requestNumber}
+	confirmation := <-confirmationChan
+	return confirmation.err
+}
+
+func (self *WAL) processClearResyncEntry(e *clearResyncEntry) {
+	if e.requestNumber != self.state.LargestRequestNumber && !self.isInRange(e.requestNumber+1) {
+		e.confirmation <- &confirmation{0, fmt.Errorf("requests logged after %d got dropped during the resync of server %d", e.requestNumber, e.serverId)}
+		return
+	}
+	self.resyncLock.Lock()
+	delete(self.state.ServersNeedingResync, e.serverId)
+	self.state.commitRequestNumber(e.serverId, e.requestNumber)
+	self.resyncLock.Unlock()
+	logger.Info("WAL retention: server %d got resynced up to request %d", e.serverId, e.requestNumber)
+	e.confirmation <- &confirmation{0, self.bookmark()}
+}
+
+func (self *WAL) RetentionStats() RetentionStats {
+	ids := self.ServersNeedingResync()
+	self.resyncLock.Lock()
+	defer self.resyncLock.Unlock()
+	stats := self.retentionStats
+	stats.ServersNeedingResync = ids
+	return stats
+}
@@ -9,6 +9,8 @@ import (
 	"protocol"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"code.google.com/p/goprotobuf/proto"
 	logger "code.google.com/p/log4go"
@@ -28,6 +30,17 @@ type WAL struct {
 	requestsSinceLastBookmark int
 	requestsSinceLastIndex    int
 	requestsSinceRotation     int
+
+	// appends that wait for the next fsync of the log file
+	pendingSyncs []*appendEntry
+
+	// protects the servers that need a resync and the retention stats
+	resyncLock     sync.Mutex
+	retentionStats RetentionStats
+
+	// the progress of the replays, by server id
+	replayLock sync.Mutex
+	replays    map[uint32]*replayProgress
 }
 
 const HOST_ID_OFFSET = uint64(10000)
@@ -37,24 +50,40 @@ func NewWAL(config *configuration.Configuration) (*WAL, error) {
 		return nil, fmt.Errorf("wal directory cannot be empty")
 	}
 
-	logger.Info("Opening wal in %s", config.WalDir)
-	_, err := os.Stat(config.WalDir)
+	// the log files can be in any of the directories, the bookmark is in the first one
+	logFileNames := []string{}
+	names := map[string]string{}
+	for _, walDir := range walDirs(config) {
+		logger.Info("Opening wal in %s", walDir)
+		_, err := os.Stat(walDir)
 
-	if os.IsNotExist(err) {
-		err = os.MkdirAll(config.WalDir, 0755)
-	}
+		if os.IsNotExist(err) {
+			err = os.MkdirAll(walDir, 0755)
+		}
 
-	if err != nil {
-		return nil, err
-	}
+		if err != nil {
+			return nil, err
+		}
 
-	dir, err := os.Open(config.WalDir)
-	if err != nil {
-		return nil, err
-	}
-	names, err := dir.Readdirnames(-1)
-	if err != nil {
-		return nil, err
+		dir, err := os.Open(walDir)
+		if err != nil {
+			return nil, err
+		}
+		dirNames, err := dir.Readdirnames(-1)
+		dir.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range dirNames {
+			if !strings.HasPrefix(name, "log.") {
+				continue
+			}
+			if otherDir, ok := names[name]; ok {
+				return nil, fmt.Errorf("%s is in both %s and %s", name, otherDir, walDir)
+			}
+			names[name] = walDir
+			logFileNames = append(logFileNames, path.Join(walDir, name))
+		}
 	}
 
 	state, err := newGlobalState(path.Join(config.WalDir, "bookmark"))
@@ -70,13 +99,11 @@ func NewWAL(config *configuration.Configuration) (*WAL, error) {
 		logIndex: []*index{},
 		state:    state,
 		entries:  make(chan interface{}, 10),
+		replays:  map[uint32]*replayProgress{},
 	}
 
-	for _, name := range names {
-		if !strings.HasPrefix(name, "log.") {
-			continue
-		}
-		log, _, err := wal.openLog(path.Join(config.WalDir, name))
+	for _, name := range logFileNames {
+		log, _, err := wal.openLog(name)
 		if err != nil {
 			return nil, err
 		}
@@ -105,6 +132,31 @@ func NewWAL(config *configuration.Configuration) (*WAL, error) {
 	return wal, err
 }
 
+// Returns the directories the log files are spread over, WalDir is always the
+// first one
+func walDirs(config *configuration.Configuration) []string {
+	if len(config.WalDirs) == 0 {
+		return []string{config.WalDir}
+	}
+	return config.WalDirs
+}
+
+// Returns the directory that comes after the one of the current log file, so the
+// log files go round robin over the directories
+func (self *WAL) nextLogDir() string {
+	dirs := walDirs(self.config)
+	if len(self.logFiles) == 0 {
+		return dirs[0]
+	}
+	current := path.Dir(self.logFiles[len(self.logFiles)-1].file.Name())
+	for idx, dir := range dirs {
+		if path.Clean(dir) == current {
+			return dirs[(idx+1)%len(dirs)]
+		}
+	}
+	return dirs[0]
+}
+
 func (self *WAL) SetServerId(id uint32) {
 	logger.Info("Setting server id to %d and recovering", id)
 	self.serverId = id
@@ -122,14 +174,32 @@ func (self *WAL) Commit(requestNumber uint32, serverId uint32) error {
 	return confirmation.err
 }
 
+// Called when the server leaves the cluster. The wal stops keeping log files
+// around for it, the ones only it still needed get deleted.
+func (self *WAL) ForgetServer(serverId uint32) error {
+	confirmationChan := make(chan *confirmation)
+	self.entries <- &forgetServerEntry{confirmationChan, serverId}
+	confirmation := <-confirmationChan
+	return confirmation.err
+}
+
+// Returns a *ResyncNeededError without replaying anything if the server missed
+// requests that were dropped by the retention.
 func (self *WAL) RecoverServerFromLastCommit(serverId uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error {
+	self.resyncLock.Lock()
+	needsResync := self.state.ServersNeedingResync[serverId]
+	self.resyncLock.Unlock()
+	if needsResync {
+		return &ResyncNeededError{serverId}
+	}
+
 	requestNumber, ok := self.state.ServerLastRequestNumber[serverId]
 	requestNumber += 1
 	if !ok {
 		requestNumber = uint32(self.state.FirstSuffix)
 	}
 	logger.Info("Recovering server %d from request %d", serverId, requestNumber)
-	return self.RecoverServerFromRequestNumber(requestNumber, shardIds, yield)
+	return self.RecoverServer(serverId, requestNumber, shardIds, yield)
 }
 
 func (self *WAL) isInRange(requestNumber uint32) bool {
@@ -145,6 +215,24 @@ func (self *WAL) isInRange(requestNumber uint32) bool {
 // requests to disk. When the downed server comes back up, it's this server's responsibility to send out any writes that were queued up. If
 // the yield function returns nil then the request is committed.
 func (self *WAL) RecoverServerFromRequestNumber(requestNumber uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error {
+	return self.replay(requestNumber, shardIds, yield)
+}
+
+// Like RecoverServerFromRequestNumber, but the progress of the replay shows up in
+// the replay stats of the server.
+func (self *WAL) RecoverServer(serverId, requestNumber uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error {
+	self.startReplay(serverId)
+	defer self.finishReplay(serverId)
+	return self.replay(requestNumber, shardIds, func(request *protocol.Request, shardId uint32) error {
+		if err := yield(request, shardId); err != nil {
+			return err
+		}
+		self.requestReplayed(serverId, request.GetRequestNumber())
+		return nil
+	})
+}
+
+func (self *WAL) replay(requestNumber uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error {
 	// don't replay if we don't have any log files yet
 	if len(self.logFiles) == 0 {
 		return nil
@@ -180,7 +268,7 @@ outer:
 		}
 		logger.Info("Replaying from %s:%d", logFile.file.Name(), firstOffset)
 		count := 0
-		ch, stopChan := logFile.dupAndReplayFromOffset(shardIds, firstOffset, requestNumber)
+		ch, stopChan := logFile.dupAndReplayFromOffset(shardIds, firstOffset, requestNumber, false)
 		for {
 			x := <-ch
 			if x == nil {
@@ -228,6 +316,7 @@ func (self *WAL) processClose(shouldBookmark bool) error {
 		self.logIndex[idx].syncFile()
 		self.logIndex[idx].close()
 	}
+	self.confirmSyncs(nil)
 	if shouldBookmark {
 		self.bookmark()
 	}
@@ -238,11 +327,36 @@ func (self *WAL) processClose(shouldBookmark bool) error {
 // PRIVATE functions
 
 func (self *WAL) processEntries() {
+	// with the batch sync mode the appends since the last tick are fsynced together
+	var syncTicks <-chan time.Time
+	if self.config.WalSyncMode == configuration.WAL_SYNC_BATCH {
+		ticker := time.NewTicker(self.config.WalSyncInterval)
+		defer ticker.Stop()
+		syncTicks = ticker.C
+	}
+
 	for {
-		e := <-self.entries
+		var e interface{}
+		select {
+		case e = <-self.entries:
+		case <-syncTicks:
+			if self.requestsSinceLastFlush > 0 {
+				self.flush()
+			}
+			continue
+		}
+
 		switch x := e.(type) {
 		case *commitEntry:
 			self.processCommitEntry(x)
+		case *forgetServerEntry:
+			self.processForgetServerEntry(x)
+		case *markResyncEntry:
+			self.processMarkResyncEntry(x)
+		case *clearResyncEntry:
+			self.processClearResyncEntry(x)
+		case *replayStatsEntry:
+			self.processReplayStatsEntry(x)
 		case *appendEntry:
 			self.processAppendEntry(x)
 		case *bookmarkEntry:
@@ -310,7 +424,38 @@ func (self *WAL) processAppendEntry(e *appendEntry) {
 	}
 
 	self.conditionalBookmarkAndIndex()
-	e.confirmation <- &confirmation{e.request.GetRequestNumber(), nil}
+	self.confirmAppend(e)
+}
+
+// Confirms the append right away unless it has to be fsynced first. With the
+// batch sync mode appends that need to be fsynced wait for the next tick,
+// otherwise the log file is fsynced right away.
+func (self *WAL) confirmAppend(e *appendEntry) {
+	requestNumber := e.request.GetRequestNumber()
+	if self.requestsSinceLastFlush == 0 {
+		// already fsynced by the rotation or flush-after
+		e.confirmation <- &confirmation{requestNumber, nil}
+		return
+	}
+
+	switch {
+	case self.config.WalSyncMode == configuration.WAL_SYNC_ALWAYS:
+		e.confirmation <- &confirmation{requestNumber, self.flush()}
+	case !e.sync:
+		e.confirmation <- &confirmation{requestNumber, nil}
+	case self.config.WalSyncMode == configuration.WAL_SYNC_BATCH:
+		self.pendingSyncs = append(self.pendingSyncs, e)
+	default:
+		e.confirmation <- &confirmation{requestNumber, self.flush()}
+	}
+}
+
+// Confirms the appends that were waiting for the log file to be fsynced
+func (self *WAL) confirmSyncs(err error) {
+	for _, e := range self.pendingSyncs {
+		e.confirmation <- &confirmation{e.request.GetRequestNumber(), err}
+	}
+	self.pendingSyncs = nil
 }
 
 func (self *WAL) processCommitEntry(e *commitEntry) {
@@ -322,12 +467,30 @@ func (self *WAL) processCommitEntry(e *commitEntry) {
 		return
 	}
 
+	logger.Debug("Removing some unneeded log files: %d", idx)
+	self.removeLogFiles(idx)
+	e.confirmation <- &confirmation{0, nil}
+}
+
+func (self *WAL) processForgetServerEntry(e *forgetServerEntry) {
+	logger.Info("Forgetting server %d", e.serverId)
+	self.resyncLock.Lock()
+	delete(self.state.ServerLastRequestNumber, e.serverId)
+	delete(self.state.ServersNeedingResync, e.serverId)
+	self.resyncLock.Unlock()
+	if idx := self.firstLogFile(); idx > 0 {
+		self.removeLogFiles(idx)
+	}
+	e.confirmation <- &confirmation{0, self.bookmark()}
+}
+
+// deletes the first n log files and their indexes
+func (self *WAL) removeLogFiles(n int) {
 	var unusedLogFiles []*log
 	var unusedLogIndex []*index
 
-	logger.Debug("Removing some unneeded log files: %d", idx)
-	unusedLogFiles, self.logFiles = self.logFiles[:idx], self.logFiles[idx:]
-	unusedLogIndex, self.logIndex = self.logIndex[:idx], self.logIndex[idx:]
+	unusedLogFiles, self.logFiles = self.logFiles[:n], self.logFiles[n:]
+	unusedLogIndex, self.logIndex = self.logIndex[:n], self.logIndex[n:]
 	for logIdx, logFile := range unusedLogFiles {
 		logger.Info("Deleting %s", logFile.file.Name())
 		logFile.close()
@@ -337,20 +500,19 @@ func (self *WAL) processCommitEntry(e *commitEntry) {
 		logIndex.delete()
 	}
 	self.state.FirstSuffix = self.logFiles[0].suffix()
-	e.confirmation <- &confirmation{0, nil}
 }
 
 // creates a new log file using the next suffix and initializes its
 // state with the state of the last log file
 func (self *WAL) createNewLog(firstRequestNumber uint32) (*log, error) {
 	self.nextLogFileSuffix++
-	logFileName := path.Join(self.config.WalDir, fmt.Sprintf("log.%d", firstRequestNumber))
+	logFileName := path.Join(self.nextLogDir(), fmt.Sprintf("log.%d", firstRequestNumber))
 	log, _, err := self.openLog(logFileName)
 	if err != nil {
 		return nil, err
 	}
 	self.state.CurrentFileSuffix = log.suffix()
-	self.state.CurrentFileOffset = 0
+	self.state.CurrentFileOffset = log.offset()
 	return log, nil
 }
 
@@ -368,7 +530,7 @@ func (self *WAL) openLog(logFileName string) (*log, *index, error) {
 
 	self.logFiles = append(self.logFiles, log)
 	suffix := strings.TrimPrefix(path.Base(logFileName), "log.")
-	indexFileName := path.Join(self.config.WalDir, "index."+suffix)
+	indexFileName := path.Join(path.Dir(logFileName), "index."+suffix)
 	logger.Info("Opening index file %s", indexFileName)
 	index, err := newIndex(indexFileName)
 	if err != nil {
@@ -383,8 +545,19 @@ func (self *WAL) openLog(logFileName string) (*log, *index, error) {
 // Will assign sequence numbers if null. Returns a unique id that
 // should be marked as committed for each server as it gets confirmed.
 func (self *WAL) AssignSequenceNumbersAndLog(request *protocol.Request, shard Shard) (uint32, error) {
+	return self.appendRequest(request, shard, false)
+}
+
+// Like AssignSequenceNumbersAndLog but only returns after the request was
+// fsynced, together with the other requests of its batch if the sync mode is
+// batch.
+func (self *WAL) AssignSequenceNumbersAndLogAndSync(request *protocol.Request, shard Shard) (uint32, error) {
+	return self.appendRequest(request, shard, true)
+}
+
+func (self *WAL) appendRequest(request *protocol.Request, shard Shard, sync bool) (uint32, error) {
 	confirmationChan := make(chan *confirmation)
-	self.entries <- &appendEntry{confirmationChan, request, shard.Id()}
+	self.entries <- &appendEntry{confirmationChan, request, shard.Id(), sync}
 	confirmation := <-confirmationChan
 
 	// we should panic if the wal cannot append the request
@@ -394,6 +567,12 @@ func (self *WAL) AssignSequenceNumbersAndLog(request *protocol.Request, shard Sh
 	return confirmation.requestNumber, confirmation.err
 }
 
+// Returns how many entries (appends, commits, ...) are waiting to be processed
+// and how many fit in the queue before callers block.
+func (self *WAL) QueueLength() (int, int) {
+	return len(self.entries), cap(self.entries)
+}
+
 // returns the first log file that contains the given request number
 func (self *WAL) firstLogFile() int {
 	for idx, logIndex := range self.logIndex {
@@ -427,7 +606,8 @@ func (self *WAL) recover() error {
 			return err
 		}
 		logger.Info("Checking %s, last: %d, size: %d", logFile.file.Name(), lastOffset, stat.Size())
-		replay, _ := logFile.dupAndReplayFromOffset(nil, lastOffset, 0)
+		// entries that got cut off or corrupted by a crash are truncated
+		replay, _ := logFile.dupAndReplayFromOffset(nil, lastOffset, 0, true)
 		firstOffset := int64(-1)
 		for {
 			replayRequest := <-replay
@@ -446,6 +626,11 @@ func (self *WAL) recover() error {
 				points = s.Points
 			}
 			for _, point := range points {
+				// only the sequence numbers this server assigned end in its id, the
+				// ones sent by clients or derived from request ids don't count
+				if point.GetSequenceNumber()%HOST_ID_OFFSET != uint64(self.serverId) {
+					continue
+				}
 				sequenceNumber := (point.GetSequenceNumber() - uint64(self.serverId)) / HOST_ID_OFFSET
 				self.state.recover(replayRequest.shardId, sequenceNumber)
 			}
@@ -473,6 +658,7 @@ func (self *WAL) recover() error {
 	}
 
 	logger.Debug("Finished wal recovery")
+	self.enforceRetention()
 	return nil
 }
 
@@ -485,13 +671,7 @@ func (self *WAL) rotateTheLogFile(nextRequestNumber uint32) (bool, error) {
 	if self.requestsSinceLastIndex > 0 {
 		self.index()
 	}
-	lastEntryIndex := len(self.logFiles) - 1
-	lastLogFile := self.logFiles[lastEntryIndex]
-	lastIndex := self.logIndex[lastEntryIndex]
-	if err := lastLogFile.syncFile(); err != nil {
-		return false, err
-	}
-	if err := lastIndex.syncFile(); err != nil {
+	if err := self.flush(); err != nil {
 		return false, err
 	}
 	lastLogFile, err := self.createNewLog(nextRequestNumber + 1)
@@ -499,6 +679,7 @@ func (self *WAL) rotateTheLogFile(nextRequestNumber uint32) (bool, error) {
 		return false, err
 	}
 	logger.Info("Rotating log. New log file %s", lastLogFile.file.Name())
+	self.enforceRetention()
 	return true, nil
 }
 
@@ -518,7 +699,15 @@ func (self *WAL) conditionalBookmarkAndIndex() {
 	}
 }
 
+// Fsyncs the last log file and its index and confirms the appends that were
+// waiting for it
 func (self *WAL) flush() error {
+	err := self.syncLastLogFile()
+	self.confirmSyncs(err)
+	return err
+}
+
+func (self *WAL) syncLastLogFile() error {
 	logger.Debug("Fsyncing the log file to disk")
 	self.requestsSinceLastFlush = 0
 	lastEntryIndex := len(self.logFiles) - 1
@@ -1,9 +1,11 @@
 package wal
 
 import (
+	"bytes"
 	. "checkers"
 	"configuration"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"net/http"
 	_ "net/http/pprof"
@@ -136,6 +138,33 @@ func (_ *WalSuite) TestLogFilesCompaction(c *C) {
 	c.Assert(os.IsNotExist(err), Equals, true)
 }
 
+func (_ *WalSuite) TestForgetServer(c *C) {
+	wal := newWal(c)
+	wal.config.WalRequestsPerLogFile = 2000
+	wal.Commit(1, 1)
+	wal.Commit(1, 2)
+	for i := 0; i < 2500; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Commit(2001, 1), IsNil)
+	c.Assert(wal.logFiles, HasLen, 2)
+
+	// server 2 left the cluster, it doesn't keep the first log file around anymore
+	c.Assert(wal.ForgetServer(2), IsNil)
+	c.Assert(wal.logFiles, HasLen, 1)
+	_, ok := wal.state.ServerLastRequestNumber[2]
+	c.Assert(ok, Equals, false)
+
+	// and it's still forgotten after a restart
+	c.Assert(wal.Close(), IsNil)
+	wal, err := NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	_, ok = wal.state.ServerLastRequestNumber[2]
+	c.Assert(ok, Equals, false)
+}
+
 func (_ *WalSuite) TestMultipleLogFiles(c *C) {
 	wal := newWal(c)
 	wal.config.WalRequestsPerLogFile = 2000
@@ -366,7 +395,7 @@ func (_ *WalSuite) TestRecoveryFromCrash(c *C) {
 	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	c.Assert(err, IsNil)
 	defer file.Close()
-	hdr := &entryHeader{1, 1, 10}
+	hdr := &entryHeader{version: CURRENT_ENTRY_VERSION, requestNumber: 1, shardId: 1, length: 10}
 	_, err = hdr.Write(file)
 	c.Assert(err, IsNil)
 	wal, err = NewWAL(wal.config)
@@ -380,6 +409,127 @@ func (_ *WalSuite) TestRecoveryFromCrash(c *C) {
 	c.Assert(requests, HasLen, 1)
 }
 
+// returns the offsets at which the entries of the log file start
+func entryOffsets(c *C, data []byte) []int64 {
+	c.Assert(bytes.HasPrefix(data, LOG_FILE_MAGIC), Equals, true)
+	offsets := []int64{}
+	offset := int64(len(LOG_FILE_MAGIC))
+	for offset < int64(len(data)) {
+		offsets = append(offsets, offset)
+		hdr := &entryHeader{}
+		n, err := hdr.Read(bytes.NewReader(data[offset:]), CURRENT_ENTRY_VERSION)
+		c.Assert(err, IsNil)
+		offset += int64(n) + int64(hdr.length)
+	}
+	return offsets
+}
+
+// reopens the wal and returns the requests that get replayed after recovery
+func recoverRequests(c *C, config *configuration.Configuration) []*protocol.Request {
+	wal, err := NewWAL(config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	requests := []*protocol.Request{}
+	err = wal.RecoverServerFromRequestNumber(1, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		requests = append(requests, req)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(wal.closeWithoutBookmarking(), IsNil)
+	return requests
+}
+
+func (_ *WalSuite) TestRecoveryFromTornWrites(c *C) {
+	wal := newWal(c)
+	for i := 0; i < 3; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.closeWithoutBookmarking(), IsNil)
+
+	filePath := path.Join(wal.config.WalDir, "log.1")
+	data, err := ioutil.ReadFile(filePath)
+	c.Assert(err, IsNil)
+	offsets := entryOffsets(c, data)
+	c.Assert(offsets, HasLen, 3)
+	lastEntry := offsets[2]
+
+	// simulate a crash at every byte of the last entry
+	for size := lastEntry; size < int64(len(data)); size++ {
+		c.Assert(ioutil.WriteFile(filePath, data[:size], 0644), IsNil)
+		requests := recoverRequests(c, wal.config)
+		c.Assert(requests, HasLen, 2)
+		c.Assert(requests[1].GetRequestNumber(), Equals, uint32(2))
+		info, err := os.Stat(filePath)
+		c.Assert(err, IsNil)
+		c.Assert(info.Size(), Equals, lastEntry)
+	}
+
+	// the log keeps working after the truncation
+	c.Assert(ioutil.WriteFile(filePath, data[:len(data)-1], 0644), IsNil)
+	wal, err = NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	id, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, uint32(3))
+	c.Assert(wal.closeWithoutBookmarking(), IsNil)
+	c.Assert(recoverRequests(c, wal.config), HasLen, 3)
+}
+
+func (_ *WalSuite) TestRecoveryFromCorruptEntry(c *C) {
+	wal := newWal(c)
+	for i := 0; i < 3; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.closeWithoutBookmarking(), IsNil)
+
+	filePath := path.Join(wal.config.WalDir, "log.1")
+	data, err := ioutil.ReadFile(filePath)
+	c.Assert(err, IsNil)
+	offsets := entryOffsets(c, data)
+
+	// flip a bit in the request of the second entry, the entries after it are dropped
+	data[offsets[1]+ENTRY_HEADER_V1_SIZE] ^= 0x01
+	c.Assert(ioutil.WriteFile(filePath, data, 0644), IsNil)
+	requests := recoverRequests(c, wal.config)
+	c.Assert(requests, HasLen, 1)
+	c.Assert(requests[0].GetRequestNumber(), Equals, uint32(1))
+	info, err := os.Stat(filePath)
+	c.Assert(err, IsNil)
+	c.Assert(info.Size(), Equals, offsets[1])
+}
+
+func (_ *WalSuite) TestRecoveryOfLogsWithoutChecksums(c *C) {
+	wal := newWal(c)
+	c.Assert(wal.closeWithoutBookmarking(), IsNil)
+
+	// write a log file the way it was written before entries had checksums
+	buffer := bytes.NewBuffer(nil)
+	for i := 1; i <= 2; i++ {
+		request, err := generateRequest(2).Encode()
+		c.Assert(err, IsNil)
+		hdr := &entryHeader{version: ENTRY_VERSION_0, requestNumber: uint32(i), shardId: 1, length: uint32(len(request))}
+		_, err = hdr.Write(buffer)
+		c.Assert(err, IsNil)
+		buffer.Write(request)
+	}
+	filePath := path.Join(wal.config.WalDir, "log.1")
+	c.Assert(ioutil.WriteFile(filePath, buffer.Bytes(), 0644), IsNil)
+	c.Assert(recoverRequests(c, wal.config), HasLen, 2)
+
+	// new entries in the file don't get checksums either
+	wal, err := NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	id, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, uint32(3))
+	c.Assert(wal.closeWithoutBookmarking(), IsNil)
+	c.Assert(recoverRequests(c, wal.config), HasLen, 3)
+}
+
 func (_ *WalSuite) TestRecoverWithNonWriteRequests(c *C) {
 	wal := newWal(c)
 	requestType := protocol.Request_QUERY
@@ -514,6 +664,24 @@ func (_ *WalSuite) TestSequenceNumberAssignment(c *C) {
 	c.Assert(request.Series.Points[1].GetSequenceNumber(), Equals, uint64(4*HOST_ID_OFFSET+1))
 }
 
+func (_ *WalSuite) TestSequenceNumberRecoveryIgnoresClientSequenceNumbers(c *C) {
+	wal := newWal(c)
+	request := generateRequest(2)
+	request.Series.Points[0].SequenceNumber = proto.Uint64(123456789 * HOST_ID_OFFSET)
+	_, err := wal.AssignSequenceNumbersAndLog(request, &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(request.Series.Points[1].GetSequenceNumber(), Equals, 1*HOST_ID_OFFSET+1)
+	wal.closeWithoutBookmarking()
+
+	wal, err = NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	request = generateRequest(1)
+	_, err = wal.AssignSequenceNumbersAndLog(request, &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(request.Series.Points[0].GetSequenceNumber(), Equals, 2*HOST_ID_OFFSET+1)
+}
+
 func (_ *WalSuite) TestSequenceNumberAssignmentPerServer(c *C) {
 	wal := newWal(c)
 	wal.SetServerId(1)
@@ -528,3 +696,386 @@ func (_ *WalSuite) TestSequenceNumberAssignmentPerServer(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(request.Series.Points[0].GetSequenceNumber(), Not(Equals), anotherRequest.Series.Points[0].GetSequenceNumber())
 }
+
+func (_ *WalSuite) TestSyncModeNoneAndAlways(c *C) {
+	wal := newWal(c)
+	_, err := wal.AssignSequenceNumbersAndLog(generateRequest(1), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(wal.requestsSinceLastFlush, Equals, 1)
+	// appends that need to be durable are fsynced right away
+	_, err = wal.AssignSequenceNumbersAndLogAndSync(generateRequest(1), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(wal.requestsSinceLastFlush, Equals, 0)
+	c.Assert(wal.Close(), IsNil)
+
+	wal = newWal(c)
+	wal.config.WalSyncMode = configuration.WAL_SYNC_ALWAYS
+	_, err = wal.AssignSequenceNumbersAndLog(generateRequest(1), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(wal.requestsSinceLastFlush, Equals, 0)
+	c.Assert(wal.Close(), IsNil)
+}
+
+func (_ *WalSuite) TestSyncModeBatch(c *C) {
+	dir := c.MkDir()
+	config := &configuration.Configuration{
+		WalDir:                   dir,
+		WalBookmarkAfterRequests: 1000,
+		WalIndexAfterRequests:    1000,
+		WalFlushAfterRequests:    2,
+		WalRequestsPerLogFile:    10000,
+		WalSyncMode:              configuration.WAL_SYNC_BATCH,
+		WalSyncInterval:          time.Hour,
+	}
+	wal, err := NewWAL(config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+
+	synced := make(chan uint32)
+	go func() {
+		// errors make the wal panic
+		id, _ := wal.AssignSequenceNumbersAndLogAndSync(generateRequest(1), &MockShard{id: 1})
+		synced <- id
+	}()
+
+	select {
+	case <-synced:
+		c.Fatal("The append was confirmed before the log file was fsynced")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the second append fsyncs the log file, because of flush-after
+	_, err = wal.AssignSequenceNumbersAndLog(generateRequest(1), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	<-synced
+	c.Assert(wal.Close(), IsNil)
+
+	// appends wait for the next tick
+	config.WalFlushAfterRequests = 1000
+	config.WalSyncInterval = 10 * time.Millisecond
+	wal, err = NewWAL(config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	for i := 0; i < 10; i++ {
+		go func() {
+			id, _ := wal.AssignSequenceNumbersAndLogAndSync(generateRequest(1), &MockShard{id: 1})
+			synced <- id
+		}()
+	}
+	ids := map[uint32]bool{}
+	for i := 0; i < 10; i++ {
+		ids[<-synced] = true
+	}
+	c.Assert(ids, HasLen, 10)
+	c.Assert(wal.Close(), IsNil)
+}
+
+func (_ *WalSuite) TestCompression(c *C) {
+	logSize := func(wal *WAL) int64 {
+		info, err := os.Stat(path.Join(wal.config.WalDir, "log.1"))
+		c.Assert(err, IsNil)
+		return info.Size()
+	}
+
+	uncompressed := newWal(c)
+	compressed := newWal(c)
+	compressed.config.WalCompression = true
+	for i := 0; i < 10; i++ {
+		for _, wal := range []*WAL{uncompressed, compressed} {
+			_, err := wal.AssignSequenceNumbersAndLog(generateRequest(100), &MockShard{id: 1})
+			c.Assert(err, IsNil)
+		}
+	}
+	c.Assert(uncompressed.closeWithoutBookmarking(), IsNil)
+	c.Assert(compressed.closeWithoutBookmarking(), IsNil)
+	c.Assert(logSize(compressed) < logSize(uncompressed), Equals, true)
+
+	// compressed and uncompressed requests can be in the same log file
+	compressed.config.WalCompression = false
+	wal, err := NewWAL(compressed.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	_, err = wal.AssignSequenceNumbersAndLog(generateRequest(100), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(wal.closeWithoutBookmarking(), IsNil)
+
+	requests := recoverRequests(c, compressed.config)
+	c.Assert(requests, HasLen, 11)
+	for i, request := range requests {
+		c.Assert(request.GetRequestNumber(), Equals, uint32(i+1))
+		c.Assert(request.Series.Points, HasLen, 100)
+	}
+}
+
+func (_ *WalSuite) TestInspectAndRepair(c *C) {
+	wal := newWal(c)
+	for i := 0; i < 4; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: uint32(i%2 + 1)})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Commit(3, 2), IsNil)
+	c.Assert(wal.Close(), IsNil)
+
+	dir := wal.config.WalDir
+	state, err := ReadGlobalState(dir)
+	c.Assert(err, IsNil)
+	c.Assert(state.LargestRequestNumber, Equals, uint32(4))
+	c.Assert(state.ServerLastRequestNumber[2], Equals, uint32(3))
+
+	segments, err := ListSegments(dir)
+	c.Assert(err, IsNil)
+	c.Assert(segments, HasLen, 1)
+	c.Assert(segments[0].IsCorrupt(), Equals, false)
+	c.Assert(segments[0].Entries, Equals, 4)
+	c.Assert(segments[0].FirstRequestNumber, Equals, uint32(1))
+	c.Assert(segments[0].LastRequestNumber, Equals, uint32(4))
+
+	filePath := path.Join(dir, "log.1")
+	requestNumbers := []uint32{}
+	_, err = ReadSegment(filePath, func(entry *SegmentEntry) error {
+		if entry.ShardId == 2 {
+			requestNumbers = append(requestNumbers, entry.Request.GetRequestNumber())
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(requestNumbers, DeepEquals, []uint32{2, 4})
+
+	// corrupt the third entry and truncate the log file
+	data, err := ioutil.ReadFile(filePath)
+	c.Assert(err, IsNil)
+	offsets := entryOffsets(c, data)
+	data[offsets[2]+ENTRY_HEADER_V1_SIZE] ^= 0x01
+	c.Assert(ioutil.WriteFile(filePath, data, 0644), IsNil)
+	segment, err := TruncateSegment(filePath)
+	c.Assert(err, IsNil)
+	c.Assert(segment.IsCorrupt(), Equals, true)
+	c.Assert(segment.CorruptOffset, Equals, offsets[2])
+	c.Assert(segment.Entries, Equals, 2)
+	segment, err = ReadSegment(filePath, nil)
+	c.Assert(err, IsNil)
+	c.Assert(segment.IsCorrupt(), Equals, false)
+	c.Assert(segment.Size, Equals, offsets[2])
+}
+
+func (_ *WalSuite) TestRewriteSegment(c *C) {
+	wal := newWal(c)
+	c.Assert(wal.closeWithoutBookmarking(), IsNil)
+
+	// a log file without checksums and a cut off entry at the end
+	buffer := bytes.NewBuffer(nil)
+	for i := 1; i <= 2; i++ {
+		request, err := generateRequest(100).Encode()
+		c.Assert(err, IsNil)
+		hdr := &entryHeader{version: ENTRY_VERSION_0, requestNumber: uint32(i), shardId: 1, length: uint32(len(request))}
+		_, err = hdr.Write(buffer)
+		c.Assert(err, IsNil)
+		buffer.Write(request)
+	}
+	buffer.Write([]byte{0, 0, 0, 3, 0})
+	filePath := path.Join(wal.config.WalDir, "log.1")
+	c.Assert(ioutil.WriteFile(filePath, buffer.Bytes(), 0644), IsNil)
+	indexPath := path.Join(wal.config.WalDir, "index.1")
+	c.Assert(ioutil.WriteFile(indexPath, []byte("1\n"), 0644), IsNil)
+
+	segment, err := RewriteSegment(filePath, true)
+	c.Assert(err, IsNil)
+	c.Assert(segment.IsCorrupt(), Equals, false)
+	c.Assert(segment.EntryVersion, Equals, uint8(CURRENT_ENTRY_VERSION))
+	c.Assert(segment.Entries, Equals, 2)
+	c.Assert(segment.CompressedEntries, Equals, 2)
+	_, err = os.Stat(indexPath)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	requests := recoverRequests(c, wal.config)
+	c.Assert(requests, HasLen, 2)
+	c.Assert(requests[1].Series.Points, HasLen, 100)
+}
+
+func (_ *WalSuite) TestRetentionBySize(c *C) {
+	wal := newWal(c)
+	wal.config.WalRequestsPerLogFile = 10
+	wal.config.WalMaxSize = 1
+	c.Assert(wal.Commit(5, 2), IsNil)
+	for i := 0; i < 25; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	// only the current log file is left
+	c.Assert(wal.logFiles, HasLen, 1)
+	c.Assert(wal.logFiles[0].suffix(), Equals, 21)
+	stats := wal.RetentionStats()
+	c.Assert(stats.DroppedLogFiles, Equals, 2)
+	c.Assert(stats.DroppedBytes > 0, Equals, true)
+	c.Assert(stats.ServersNeedingResync, DeepEquals, []uint32{2})
+
+	err := wal.RecoverServerFromLastCommit(2, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		c.Fatal("The wal shouldn't replay requests for a server that needs a resync")
+		return nil
+	})
+	c.Assert(err, FitsTypeOf, &ResyncNeededError{})
+
+	// the mark survives restarts
+	c.Assert(wal.Close(), IsNil)
+	wal, err = NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	c.Assert(wal.ServersNeedingResync(), DeepEquals, []uint32{2})
+
+	c.Assert(wal.ClearResync(2, wal.LargestRequestNumber()), IsNil)
+	c.Assert(wal.ServersNeedingResync(), HasLen, 0)
+	requests := 0
+	err = wal.RecoverServerFromLastCommit(2, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		requests++
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(requests, Equals, 0)
+}
+
+func (_ *WalSuite) TestRequestsLoggedDuringTheResyncAreReplayed(c *C) {
+	wal := newWal(c)
+	c.Assert(wal.MarkResync(2), IsNil)
+	for i := 0; i < 2; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+
+	// the repair starts, the requests that come in while it runs may miss it
+	requestNumber := wal.LargestRequestNumber()
+	for i := 0; i < 3; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.ClearResync(2, requestNumber), IsNil)
+	c.Assert(wal.ServersNeedingResync(), HasLen, 0)
+
+	requests := 0
+	err := wal.RecoverServerFromLastCommit(2, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		requests++
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(requests, Equals, 3)
+}
+
+func (_ *WalSuite) TestMarkResync(c *C) {
+	wal := newWal(c)
+	c.Assert(wal.MarkResync(2), IsNil)
+	c.Assert(wal.ServersNeedingResync(), DeepEquals, []uint32{2})
+
+	c.Assert(wal.Close(), IsNil)
+	wal, err := NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	c.Assert(wal.ServersNeedingResync(), DeepEquals, []uint32{2})
+}
+
+func (_ *WalSuite) TestRetentionByAge(c *C) {
+	wal := newWal(c)
+	wal.config.WalRequestsPerLogFile = 10
+	wal.config.WalMaxAge = time.Hour
+	c.Assert(wal.Commit(5, 2), IsNil)
+	for i := 0; i < 10; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.logFiles, HasLen, 2)
+	c.Assert(wal.ServersNeedingResync(), HasLen, 0)
+
+	lastWrite := time.Now().Add(-2 * time.Hour)
+	c.Assert(os.Chtimes(path.Join(wal.config.WalDir, "log.1"), lastWrite, lastWrite), IsNil)
+	for i := 0; i < 10; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.logFiles, HasLen, 2)
+	c.Assert(wal.logFiles[0].suffix(), Equals, 11)
+	c.Assert(wal.ServersNeedingResync(), DeepEquals, []uint32{2})
+	c.Assert(wal.state.ServerLastRequestNumber[2], Equals, uint32(10))
+}
+
+func (_ *WalSuite) TestReplayStats(c *C) {
+	wal := newWal(c)
+	for i := 0; i < 10; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Commit(4, 2), IsNil)
+	err := wal.RecoverServer(3, 1, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		return nil
+	})
+	c.Assert(err, IsNil)
+
+	stats := wal.ReplayStats()
+	c.Assert(stats.LargestRequestNumber, Equals, uint32(10))
+	c.Assert(stats.LogFiles, Equals, 1)
+	c.Assert(stats.Servers, HasLen, 2)
+
+	behind := stats.Servers[0]
+	c.Assert(behind.ServerId, Equals, uint32(2))
+	c.Assert(behind.LastCommittedRequestNumber, Equals, uint32(4))
+	c.Assert(behind.RequestsBehind, Equals, int64(6))
+	c.Assert(behind.EstimatedBytesBehind > 0, Equals, true)
+	c.Assert(behind.EstimatedBytesBehind < stats.Bytes, Equals, true)
+
+	replayed := stats.Servers[1]
+	c.Assert(replayed.ServerId, Equals, uint32(3))
+	c.Assert(replayed.Replaying, Equals, false)
+	c.Assert(replayed.ReplayedRequests, Equals, int64(10))
+	c.Assert(replayed.LastReplayedRequestNumber, Equals, uint32(10))
+	c.Assert(replayed.ReplayFinishedAt.IsZero(), Equals, false)
+}
+
+func (_ *WalSuite) TestMultipleDirectories(c *C) {
+	dirs := []string{c.MkDir(), c.MkDir()}
+	config := &configuration.Configuration{
+		WalDir:                   dirs[0],
+		WalDirs:                  dirs,
+		WalBookmarkAfterRequests: 1000,
+		WalIndexAfterRequests:    1000,
+		WalFlushAfterRequests:    1000,
+		WalRequestsPerLogFile:    10,
+	}
+	wal, err := NewWAL(config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	for i := 0; i < 35; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	// the log files alternate between the directories
+	c.Assert(wal.logFiles, HasLen, 4)
+	for idx, logFile := range wal.logFiles {
+		c.Assert(path.Dir(logFile.file.Name()), Equals, path.Clean(dirs[idx%2]))
+	}
+	c.Assert(wal.Close(), IsNil)
+
+	segments, err := ListSegments(dirs...)
+	c.Assert(err, IsNil)
+	c.Assert(segments, HasLen, 4)
+	c.Assert(segments[3].LastRequestNumber, Equals, uint32(35))
+
+	// recovery finds the log files in all the directories
+	wal, err = NewWAL(config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	c.Assert(wal.logFiles, HasLen, 4)
+	requests := 0
+	err = wal.RecoverServerFromRequestNumber(1, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		requests++
+		c.Assert(req.GetRequestNumber(), Equals, uint32(requests))
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(requests, Equals, 35)
+
+	// the next log file goes to the directory after the one of the last log file
+	for i := 0; i < 10; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.logFiles, HasLen, 5)
+	c.Assert(path.Dir(wal.logFiles[4].file.Name()), Equals, path.Clean(dirs[0]))
+	c.Assert(wal.Close(), IsNil)
+}